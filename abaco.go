@@ -17,9 +17,12 @@ import (
 	"github.com/usnistgov/dastard/ringbuffer"
 )
 
-const abacoFractionBits = 16 // changed from 13 to 16 in Jan 2021.
+const abacoFractionBits = rawTypeBits // changed from 13 to 16 in Jan 2021; 32 in raw32 builds.
 const abacoBitsToDrop = 4
 
+// abacoInt32Divisor squeezes 32-bit packet values into the RawType's bits, keeping the highest.
+const abacoInt32Divisor = 1 << (32 - rawTypeBits)
+
 // That is, Abaco data is of the form bbbb bbbb bbbb bbbb with 0 integer bits
 // and 16 fractional bits. In the unwrapping process, we drop 4, making it 4/12, or
 // iiii.bbbb bbbb bbbb. This gives room for up to ±8ϕ0 (actually, -8ϕ0 and +8ϕ0 both map to 0x8000).
@@ -43,6 +46,7 @@ type AbacoGroup struct {
 	lasttime   time.Time
 	seqnumsync uint32 // Global sequence number is referenced to this group's seq number at seqnumsync
 	lastSN     uint32
+	rawWords   bool // 16-bit packet values are raw TDM words, not high bits of a phase
 }
 
 // NewAbacoGroup creates an AbacoGroup given the specified GroupIndex.
@@ -217,11 +221,16 @@ func (group *AbacoGroup) demuxData(datacopies [][]RawType, frames int) int {
 
 		switch d := p.Data.(type) {
 		case []int16:
+			// Phases fill the highest bits of the RawType, but raw TDM words keep their value.
+			v16 := func(v int16) RawType { return RawType(v) << (rawTypeBits - 16) }
+			if group.rawWords {
+				v16 = func(v int16) RawType { return RawType(uint16(v)) }
+			}
 			// Reading vector d in channel order was faster than in packet-data order.
 			nsamp := len(d) / nchan
 			for idx, dc := range datacopies {
 				for i, j := 0, idx; i < nsamp; i++ {
-					dc[i+samplesConsumed] = RawType(d[j])
+					dc[i+samplesConsumed] = v16(d[j])
 					j += nchan
 				}
 			}
@@ -233,11 +242,12 @@ func (group *AbacoGroup) demuxData(datacopies [][]RawType, frames int) int {
 			// This was changed Jan 2021 (issue 227). It was previously the 16 lowest above the 12 lowest.
 			// If we need a permanent solution to 32-bit raw data, then it might need to be flexible
 			// about _which_ 16 bits are kept and which discarded. (JF 3/7/2020).
+			// Builds with the raw32 tag keep all 32 bits.
 
 			nsamp := len(d) / nchan
 			for idx, dc := range datacopies {
 				for i, j := 0, idx; i < nsamp; i++ {
-					dc[i+samplesConsumed] = RawType(d[j] / 0x10000)
+					dc[i+samplesConsumed] = RawType(d[j] / abacoInt32Divisor)
 					j += nchan
 				}
 			}
@@ -480,7 +490,7 @@ func (device *AbacoUDPReceiver) start() (err error) {
 		defer close(singlepackets)
 		for {
 			message := bufferPool.Get().([]byte)
-			if _, _, err := device.conn.ReadFrom(message); err != nil {
+			if _, _, err := conn.ReadFrom(message); err != nil {
 				// Getting an error here is the normal way to detect closed connection.
 				bufferPool.Put(message)
 				return
@@ -692,28 +702,27 @@ func (as *AbacoSource) Configure(config *AbacoSourceConfig) (err error) {
 	return nil
 }
 
-// distributePackets sorts a slice of Abaco packets into the data queues according to the GroupIndex.
-func (as *AbacoSource) distributePackets(allpackets []*packets.Packet, now time.Time) {
+// distributePackets sorts a slice of packets into the data queues of groups according to the GroupIndex.
+func distributePackets(groups map[GroupIndex]*AbacoGroup, allpackets []*packets.Packet, now time.Time) {
 	for _, p := range allpackets {
 		cidx := gIndex(p)
-		as.groups[cidx].enqueuePacket(p, now)
+		groups[cidx].enqueuePacket(p, now)
 	}
 }
 
-// Sample determines key data facts by sampling some initial data.
-func (as *AbacoSource) Sample() error {
-	if len(as.producers) <= 0 {
-		return fmt.Errorf("No Abaco ring buffers or UDP receivers are active")
-	}
-
+// sampleGroups starts each PacketProducer and samples its packets, in parallel, to save time.
+// It returns one group (made by newGroup) per GroupIndex seen, and the group indices in sorted
+// order. Each group will have learned its sample rate from the sampled packets.
+func sampleGroups(producers []PacketProducer, newGroup func(GroupIndex) *AbacoGroup) (
+	map[GroupIndex]*AbacoGroup, []GroupIndex, error) {
 	// Launch device.samplePackets as goroutines on each device, in parallel, to save time.
 	type SampleResult struct {
 		allpackets []*packets.Packet
 		err        error
 	}
-	sampleResults := make(chan SampleResult)
+	sampleResults := make(chan SampleResult, len(producers))
 	timeout := 2000 * time.Millisecond
-	for _, pp := range as.producers {
+	for _, pp := range producers {
 		go func(pp PacketProducer) {
 			pp.start()
 			p, err := pp.samplePackets(timeout)
@@ -722,50 +731,69 @@ func (as *AbacoSource) Sample() error {
 	}
 
 	// Now sort the packets received into the right AbacoGroups
-	as.nchan = 0
-	as.groups = make(map[GroupIndex]*AbacoGroup)
-	for _ = range as.producers {
+	groups := make(map[GroupIndex]*AbacoGroup)
+	for range producers {
 		results := <-sampleResults
 		now := time.Now()
 		if results.err != nil {
-			return results.err
+			return nil, nil, results.err
 		}
 		// Create new AbacoGroup for each GroupIndex seen
 		for _, p := range results.allpackets {
 			cidx := gIndex(p)
-			if _, ok := as.groups[cidx]; !ok {
-				as.groups[cidx] = NewAbacoGroup(cidx, as.unwrapEnable, as.unwrapResetSamp)
-				as.nchan += cidx.Nchan
+			if _, ok := groups[cidx]; !ok {
+				groups[cidx] = newGroup(cidx)
 			}
 		}
-		as.distributePackets(results.allpackets, now)
+		distributePackets(groups, results.allpackets, now)
 	}
 
 	// Verify that no channel # appears in 2 groups.
 	known := make(map[int]bool)
-	for _, g := range as.groups {
+	for _, g := range groups {
 		cinit := g.index.Firstchan
 		cend := cinit + g.index.Nchan
 		for cnum := cinit; cnum < cend; cnum++ {
 			if known[cnum] {
-				return fmt.Errorf("Channel group %v sees channel %d, which was in another group", g.index, cnum)
+				return nil, nil, fmt.Errorf("Channel group %v sees channel %d, which was in another group", g.index, cnum)
 			}
 			known[cnum] = true
 		}
 	}
 
-	// Compute a fixed ordering for iteration over the map as.groups
+	// Compute a fixed ordering for iteration over the map groups
 	var keys []GroupIndex
-	for k := range as.groups {
+	for k := range groups {
 		keys = append(keys, k)
 	}
 	sort.Sort(ByGroup(keys))
-	as.groupKeysSorted = keys
 
 	// Each AbacoGroup should process its sampled packets.
-	for _, group := range as.groups {
+	for _, group := range groups {
 		group.samplePackets()
 	}
+	return groups, keys, nil
+}
+
+// Sample determines key data facts by sampling some initial data.
+func (as *AbacoSource) Sample() error {
+	if len(as.producers) <= 0 {
+		return fmt.Errorf("No Abaco ring buffers or UDP receivers are active")
+	}
+
+	newGroup := func(cidx GroupIndex) *AbacoGroup {
+		return NewAbacoGroup(cidx, as.unwrapEnable, as.unwrapResetSamp)
+	}
+	groups, keys, err := sampleGroups(as.producers, newGroup)
+	if err != nil {
+		return err
+	}
+	as.groups = groups
+	as.groupKeysSorted = keys
+	as.nchan = 0
+	for _, group := range as.groups {
+		as.nchan += group.nchan
+	}
 
 	as.sampleRate = 0
 	for _, group := range as.groups {
@@ -830,6 +858,83 @@ type AbacoBuffersType struct {
 	droppedFrames  int
 }
 
+// readGroups reads all packets from the producers into the groups, then aligns the groups and
+// demultiplexes as many frames as every group has ready, in the order given by keys, into a
+// total of nchan slices. It fills in for any missing packets. The result's datacopies is nil
+// if no frames are ready. Its timeDiff is left for the caller to fill in.
+func readGroups(producers []PacketProducer, groups map[GroupIndex]*AbacoGroup, keys []GroupIndex,
+	nchan int) AbacoBuffersType {
+	var lastSampleTime time.Time
+	var droppedFrames int
+	var droppedBytes int
+	for _, pp := range producers {
+		allPackets, err := pp.ReadAllPackets()
+		lastSampleTime = time.Now()
+		if err != nil {
+			fmt.Printf("PacketProducer.ReadAllPackets failed with error: %v\n", err)
+			panic("PacketProducer.ReadAllPackets failed")
+		}
+		distributePackets(groups, allPackets, lastSampleTime)
+	}
+
+	// Align the first sample in each group. Do this by checking the first global sequenceNumber
+	// in each group and trimming leading packets if any precede the others.
+	// Fill in for any missing packets first, so a missing first packet isn't a problem.
+	firstSn := uint32(0)
+	for idx, group := range groups {
+		bytesAdded, packetsAdded, framesAdded := group.fillMissingPackets()
+		droppedFrames += framesAdded
+		droppedBytes += bytesAdded
+		if packetsAdded > 0 && ProblemLogger != nil {
+			cfirst := idx.Firstchan
+			clast := cfirst + idx.Nchan - 1
+			ProblemLogger.Printf("AbacoGroup %v=channels [%d,%d] filled in %d missing packets (%d frames)", idx,
+				cfirst, clast, packetsAdded, framesAdded)
+		}
+		sn0, err := group.firstSeqNum()
+		if err != nil { // That is, no data available from this group
+			return AbacoBuffersType{}
+		}
+		if sn0 > firstSn {
+			firstSn = sn0
+		}
+	}
+
+	// For any queue that starts before maxsn0, trim the leading packets. Learn the # of samples.
+	framesToDeMUX := math.MaxInt64
+	for _, group := range groups {
+		group.trimPacketsBefore(firstSn)
+		nsamp := group.countSamplesInQueue()
+		if nsamp < framesToDeMUX {
+			framesToDeMUX = nsamp
+		}
+	}
+	if framesToDeMUX <= 0 {
+		return AbacoBuffersType{}
+	}
+
+	// Demux data into this slice of slices of RawType
+	datacopies := make([][]RawType, nchan)
+	for i := 0; i < nchan; i++ {
+		datacopies[i] = make([]RawType, framesToDeMUX)
+	}
+	chanProcessed := 0
+	bytesProcessed := 0
+	for _, k := range keys {
+		group := groups[k]
+		dc := datacopies[chanProcessed : chanProcessed+group.nchan]
+		bytesProcessed += group.demuxData(dc, framesToDeMUX)
+		chanProcessed += group.nchan
+	}
+	return AbacoBuffersType{
+		datacopies:     datacopies,
+		lastSampleTime: lastSampleTime,
+		totalBytes:     bytesProcessed,
+		droppedBytes:   droppedBytes,
+		droppedFrames:  droppedFrames,
+	}
+}
+
 func (as *AbacoSource) readerMainLoop() {
 	defer close(as.buffersChan)
 	const timeoutPeriod = 5 * time.Second
@@ -839,7 +944,6 @@ func (as *AbacoSource) readerMainLoop() {
 	defer timeout.Stop()
 	as.lastread = time.Now()
 
-awaitmoredata:
 	for {
 		select {
 		case <-as.abortSelf:
@@ -852,100 +956,23 @@ awaitmoredata:
 			return
 
 		case <-ticker.C:
-			// read from the ring buffer
-			var lastSampleTime time.Time
-			var droppedFrames int
-			var droppedBytes int
-			for _, pp := range as.producers {
-				allPackets, err := pp.ReadAllPackets()
-				lastSampleTime = time.Now()
-				if err != nil {
-					fmt.Printf("PacketProducer.ReadAllPackets failed with error: %v\n", err)
-					panic("PacketProducer.ReadAllPackets failed")
-				}
-				as.distributePackets(allPackets, lastSampleTime)
-			}
-
-			// var t1, t2 time.Time
-			// t1, t2 = t2, time.Now()
-			// fmt.Printf("Time required to distributePackets: %v\n", t2.Sub(t1))
-
-			// Align the first sample in each group. Do this by checking the first global sequenceNumber
-			// in each group and trimming leading packets if any precede the others.
-			// Fill in for any missing packets first, so a missing first packet isn't a problem.
-			firstSn := uint32(0)
-			for idx, group := range as.groups {
-				bytesAdded, packetsAdded, framesAdded := group.fillMissingPackets()
-				droppedFrames += framesAdded
-				droppedBytes += bytesAdded
-				if packetsAdded > 0 && ProblemLogger != nil {
-					cfirst := idx.Firstchan
-					clast := cfirst + idx.Nchan - 1
-					ProblemLogger.Printf("AbacoGroup %v=channels [%d,%d] filled in %d missing packets (%d frames)", idx,
-						cfirst, clast, packetsAdded, framesAdded)
-				}
-				sn0, err := group.firstSeqNum()
-				if err != nil { // That is, no data available from this group
-					continue awaitmoredata
-				}
-				if sn0 > firstSn {
-					firstSn = sn0
-				}
+			buffers := readGroups(as.producers, as.groups, as.groupKeysSorted, as.nchan)
+			if buffers.datacopies == nil {
+				continue
 			}
-			// t1, t2 = t2, time.Now()
-			// fmt.Printf("Time required to fillMissingPackets: %v\n", t2.Sub(t1))
-
-			// For any queue that starts before maxsn0, trim the leading packets. Learn the # of samples.
-			framesToDeMUX := math.MaxInt64
-			for _, group := range as.groups {
-				group.trimPacketsBefore(firstSn)
-				nsamp := group.countSamplesInQueue()
-				if nsamp < framesToDeMUX {
-					framesToDeMUX = nsamp
-				}
+			buffers.timeDiff = buffers.lastSampleTime.Sub(as.lastread)
+			if buffers.timeDiff > 2*as.readPeriod {
+				fmt.Println("timeDiff in abaco reader", buffers.timeDiff)
 			}
-			if framesToDeMUX <= 0 {
-				continue awaitmoredata
-			}
-			// t1, t2 = t2, time.Now()
-			// fmt.Printf("Time required to trimPacketsBefore: %v\n", t2.Sub(t1))
-
-			// Demux data into this slice of slices of RawType
-			datacopies := make([][]RawType, as.nchan)
-			for i := 0; i < as.nchan; i++ {
-				datacopies[i] = make([]RawType, framesToDeMUX)
-			}
-			chanProcessed := 0
-			bytesProcessed := 0
-			for _, k := range as.groupKeysSorted {
-				group := as.groups[k]
-				dc := datacopies[chanProcessed : chanProcessed+group.nchan]
-				bytesProcessed += group.demuxData(dc, framesToDeMUX)
-				chanProcessed += group.nchan
-			}
-			// t1, t2 = t2, time.Now()
-			// fmt.Printf("Time required to demuxData: %v\n", t2.Sub(t1))
-
-			timeDiff := lastSampleTime.Sub(as.lastread)
-			if timeDiff > 2*as.readPeriod {
-				fmt.Println("timeDiff in abaco reader", timeDiff)
-			}
-			as.lastread = lastSampleTime
+			as.lastread = buffers.lastSampleTime
 
 			if len(as.buffersChan) == cap(as.buffersChan) {
 				msg := fmt.Sprintf("internal buffersChan full, len %v, capacity %v", len(as.buffersChan), cap(as.buffersChan))
 				fmt.Printf("Panic! %s\n", msg)
 				panic(msg)
 			}
-			as.buffersChan <- AbacoBuffersType{
-				datacopies:     datacopies,
-				lastSampleTime: lastSampleTime,
-				timeDiff:       timeDiff,
-				totalBytes:     bytesProcessed,
-				droppedBytes:   droppedBytes,
-				droppedFrames:  droppedFrames,
-			}
-			if bytesProcessed > 0 {
+			as.buffersChan <- buffers
+			if buffers.totalBytes > 0 {
 				timeout.Reset(timeoutPeriod)
 			}
 		}
@@ -1026,10 +1053,10 @@ func (as *AbacoSource) distributeData(buffersMsg AbacoBuffersType) *dataBlock {
 				droppedFrames:   buffersMsg.droppedFrames,
 			}
 			block.segments[channelIndex] = seg
-			block.nSamp = len(data)
 		}(channelIndex)
 	}
 	wg.Wait()
+	block.nSamp = framesUsed
 	as.nextFrameNum += FrameIndex(framesUsed)
 	if as.heartbeats != nil {
 		pmb := float64(buffersMsg.totalBytes) / 1e6
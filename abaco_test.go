@@ -343,6 +343,7 @@ func prepareDemux(nframes int) (*AbacoGroup, []*packets.Packet, [][]RawType) {
 }
 
 func TestDemux(t *testing.T) {
+	skipUnlessRaw16(t)
 	const nframes = 32768
 	group, allpackets, copies := prepareDemux(nframes)
 	want := (nframes * len(copies)) / 4096
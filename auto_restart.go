@@ -0,0 +1,349 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// AutoRestartPolicy limits how often and how quickly SourceControl restarts a data source
+// that stopped because of an error (for sources whose ShouldAutoRestart() is true).
+type AutoRestartPolicy struct {
+	MaxRestarts     int     // give up after this many restarts without a quiet period
+	InitialDelaySec float64 // wait this many seconds before the first restart
+	MaxDelaySec     float64 // the delay doubles after each restart, up to this limit
+	ResetAfterSec   float64 // a source that runs this many seconds after a restart resets the count
+}
+
+// defaultAutoRestartPolicy is used until a client calls ConfigureAutoRestart.
+var defaultAutoRestartPolicy = AutoRestartPolicy{
+	MaxRestarts:     5,
+	InitialDelaySec: 5,
+	MaxDelaySec:     300,
+	ResetAfterSec:   3600,
+}
+
+// RestartRecord describes one automatic restart of a data source. It is sent to clients as
+// an AUTORESTART status message when a restart is scheduled and again when it is done.
+type RestartRecord struct {
+	Time        time.Time
+	SourceName  string
+	Reason      string // the error that stopped the source
+	Attempt     int    // counts restarts since the last quiet period, starting at 1
+	MaxRestarts int
+	DelaySec    float64
+	Status      string // "Scheduled", "Restarted", "Failed", "GaveUp", or "Cancelled"
+	Error       string // why the restart failed, if Status is "Failed"
+}
+
+// channelAnalysis holds the per-channel analysis settings that don't survive a source restart.
+type channelAnalysis struct {
+	projectors        *mat.Dense
+	basis             *mat.Dense
+	modelDescription  string
+	filter            *mat.VecDense
+	arrivalFilter     *mat.VecDense
+	filterDescription string
+}
+
+// restartSettings is everything about a stopped source that a restart should restore.
+type restartSettings struct {
+	sourceName  string
+	triggers    []FullTriggerState
+	analysis    []channelAnalysis
+	mix         []float64
+	writeConfig *WriteControlConfig // nil if the source was not writing
+	writePaused bool
+	stateLabel  string
+	reason      error
+	writingDir  string // where the stopped source was writing, or "" if it wasn't
+}
+
+// autoRestarter is the bookkeeping for SourceControl's restart supervisor.
+type autoRestarter struct {
+	sync.Mutex
+	policy    AutoRestartPolicy
+	attempts  int
+	lastStart time.Time        // when the source was last (re)started by the supervisor
+	pending   bool             // a restart is scheduled and has not been cancelled
+	settings  *restartSettings // settings to restore, kept until a restart restores them
+}
+
+// analysisSettings returns copies of the per-channel projectors and filters.
+func (ds *AnySource) analysisSettings() []channelAnalysis {
+	result := make([]channelAnalysis, len(ds.processors))
+	for i, dsp := range ds.processors {
+		if dsp.HasProjectors() {
+			result[i].projectors = mat.DenseCopyOf(dsp.projectors)
+			result[i].basis = mat.DenseCopyOf(dsp.basis)
+			result[i].modelDescription = dsp.modelDescription
+		}
+		if dsp.HasFilter() {
+			result[i].filter = mat.VecDenseCopyOf(dsp.filter)
+			if dsp.arrivalFilter != nil {
+				result[i].arrivalFilter = mat.VecDenseCopyOf(dsp.arrivalFilter)
+			}
+			result[i].filterDescription = dsp.filterDescription
+		}
+	}
+	return result
+}
+
+// restoreAnalysisSettings loads projectors and filters saved by analysisSettings.
+// Channels that no longer exist are skipped; the first error is returned.
+func (ds *AnySource) restoreAnalysisSettings(settings []channelAnalysis) error {
+	var firstErr error
+	for i, ca := range settings {
+		if i >= len(ds.processors) {
+			break
+		}
+		var err error
+		if ca.projectors != nil {
+			err = ds.ConfigureProjectorsBases(i, ca.projectors, ca.basis, ca.modelDescription)
+		}
+		if err == nil && ca.filter != nil {
+			err = ds.ConfigureFilters(i, ca.filter, ca.arrivalFilter, ca.filterDescription)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ConfigureAutoRestart sets the limits on automatically restarting a source after an error.
+func (s *SourceControl) ConfigureAutoRestart(policy *AutoRestartPolicy, reply *bool) error {
+	*reply = false
+	if policy.MaxRestarts < 0 || policy.InitialDelaySec < 0 || policy.MaxDelaySec < policy.InitialDelaySec ||
+		policy.ResetAfterSec < 0 {
+		return fmt.Errorf("invalid AutoRestartPolicy %+v", *policy)
+	}
+	s.restart.Lock()
+	s.restart.policy = *policy
+	s.restart.Unlock()
+	*reply = true
+	return nil
+}
+
+// superviseStoppedSource is called when the active source has stopped. If it stopped because
+// of an error and should be restarted, schedule a restart (unless the limit is reached).
+func (s *SourceControl) superviseStoppedSource() {
+	reason := s.ActiveSource.RunError()
+	if reason == nil || !s.ActiveSource.ShouldAutoRestart() || s.lastSourceName == "" {
+		return
+	}
+	settings := s.captureRestartSettings(reason)
+	s.restart.Lock()
+	if s.restart.settings != nil {
+		// The source stopped before a restart could restore the original settings: keep them.
+		settings = s.restart.settings
+		settings.reason = reason
+	}
+	s.restart.Unlock()
+	s.scheduleRestart(settings)
+}
+
+// scheduleRestart starts a goroutine to restart the source after a delay that grows with
+// each attempt, or gives up if there have been too many attempts.
+func (s *SourceControl) scheduleRestart(settings *restartSettings) {
+	s.restart.Lock()
+	defer s.restart.Unlock()
+	if s.restart.pending {
+		return
+	}
+	s.restart.settings = settings
+	if time.Since(s.restart.lastStart).Seconds() > s.restart.policy.ResetAfterSec {
+		s.restart.attempts = 0
+	}
+	s.restart.attempts++
+	rec := RestartRecord{Time: time.Now(), SourceName: s.status.SourceName, Reason: settings.reason.Error(),
+		Attempt: s.restart.attempts, MaxRestarts: s.restart.policy.MaxRestarts}
+	if s.restart.attempts > s.restart.policy.MaxRestarts {
+		rec.Status = "GaveUp"
+		s.recordRestart(&rec, settings.writingDir)
+		s.restart.settings = nil
+		return
+	}
+	rec.DelaySec = math.Min(s.restart.policy.InitialDelaySec*math.Pow(2, float64(s.restart.attempts-1)),
+		s.restart.policy.MaxDelaySec)
+	rec.Status = "Scheduled"
+	s.recordRestart(&rec, settings.writingDir)
+	s.restart.pending = true
+	go s.restartAfterDelay(settings, rec)
+}
+
+// cancelRestart cancels any scheduled restart (because a client has started a source).
+func (s *SourceControl) cancelRestart() {
+	s.restart.Lock()
+	s.restart.pending = false
+	s.restart.settings = nil
+	s.restart.Unlock()
+}
+
+// captureRestartSettings saves the settings of the stopped source, and stops any writing
+// that was in progress so the files are closed properly.
+func (s *SourceControl) captureRestartSettings(reason error) *restartSettings {
+	ds := s.ActiveSource
+	settings := &restartSettings{sourceName: s.lastSourceName, reason: reason,
+		triggers: ds.ComputeFullTriggerState(), analysis: ds.analysisSettings()}
+	if s.lastMix != nil {
+		settings.mix = make([]float64, len(s.lastMix))
+		copy(settings.mix, s.lastMix)
+	}
+	ws := ds.ComputeWritingState()
+	if ws.Active && s.lastWriteConfig != nil {
+		wc := *s.lastWriteConfig
+		settings.writeConfig = &wc
+		settings.writePaused = ws.Paused
+		settings.stateLabel = ws.ExperimentStateLabel
+		settings.writingDir = filepath.Dir(ws.FilenamePattern)
+		if err := ds.WriteControl(&WriteControlConfig{Request: "Stop"}); err != nil {
+			log.Printf("Could not stop writing after the source stopped: %v\n", err)
+		}
+	}
+	return settings
+}
+
+// restartAfterDelay waits, then restarts the source and restores its settings. If the
+// restart fails, it lets the supervisor decide whether to try again.
+func (s *SourceControl) restartAfterDelay(settings *restartSettings, rec RestartRecord) {
+	time.Sleep(time.Duration(float64(time.Second) * rec.DelaySec))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.restart.Lock()
+	if !s.restart.pending || s.isSourceActive {
+		s.restart.pending = false
+		s.restart.Unlock()
+		rec.Time = time.Now()
+		rec.Status = "Cancelled"
+		s.recordRestart(&rec, settings.writingDir)
+		return
+	}
+	s.restart.pending = false
+	s.restart.lastStart = time.Now()
+	s.restart.Unlock()
+
+	rec.Time = time.Now()
+	name := settings.sourceName
+	if err := s.start(&name); err != nil {
+		rec.Status = "Failed"
+		rec.Error = err.Error()
+		s.recordRestart(&rec, settings.writingDir)
+		settings.reason = err // try again, subject to the restart limit
+		s.scheduleRestart(settings)
+		return
+	}
+	if err := s.restoreRestartSettings(settings); err != nil {
+		rec.Status = "Failed"
+		rec.Error = err.Error()
+		s.recordRestart(&rec, settings.writingDir)
+		if !s.ActiveSource.Running() {
+			s.handlePossibleStoppedSource() // try again, subject to the restart limit
+		}
+		return
+	}
+	s.restart.Lock()
+	s.restart.settings = nil
+	s.restart.Unlock()
+	rec.Status = "Restarted"
+	s.recordRestart(&rec, settings.writingDir)
+	if settings.writeConfig != nil {
+		// Also note the restart at the start of the new writing directory.
+		var pattern string
+		f := func() {
+			pattern = s.ActiveSource.ComputeWritingState().FilenamePattern
+			s.queuedResults <- nil
+		}
+		if err := s.runLaterIfActive(f); err == nil {
+			s.recordRestart(&rec, filepath.Dir(pattern))
+		}
+	}
+}
+
+// restoreRestartSettings applies the saved settings to the newly restarted source.
+func (s *SourceControl) restoreRestartSettings(settings *restartSettings) error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	f := func() {
+		for i := range settings.triggers {
+			keep(s.ActiveSource.ChangeTriggerState(&settings.triggers[i]))
+		}
+		keep(s.ActiveSource.restoreAnalysisSettings(settings.analysis))
+		s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+		s.status.ChannelsWithFilters = s.ActiveSource.ChannelsWithFilters()
+		if settings.writeConfig != nil {
+			wc := *settings.writeConfig
+			wc.MapInternalOnly = s.mapServer.Map
+			keep(s.ActiveSource.WriteControl(&wc))
+			if settings.stateLabel != "" {
+				keep(s.ActiveSource.SetExperimentStateLabel(time.Now(), settings.stateLabel))
+			}
+			if settings.writePaused {
+				keep(s.ActiveSource.WriteControl(&WriteControlConfig{Request: "Pause"}))
+			}
+		}
+		s.broadcastWritingState()
+		s.queuedResults <- nil
+	}
+	// Don't wait forever if the source stops again before it can take the request.
+	for sent := false; !sent; {
+		select {
+		case s.queuedRequests <- f:
+			<-s.queuedResults
+			sent = true
+		case <-time.After(50 * time.Millisecond):
+			if !s.ActiveSource.Running() {
+				return fmt.Errorf("source stopped again before its settings were restored")
+			}
+		}
+	}
+	s.broadcastTriggerState()
+	if len(settings.mix) > 0 {
+		mfo := MixFractionObject{}
+		for i := 1; i < len(settings.mix); i += 2 { // only feedback (odd) channels have a mix
+			mfo.ChannelIndices = append(mfo.ChannelIndices, i)
+			mfo.MixFractions = append(mfo.MixFractions, settings.mix[i])
+		}
+		var okay bool
+		keep(s.ConfigureMixFraction(&mfo, &okay))
+	}
+	return firstErr
+}
+
+// recordRestart logs a restart, sends it to clients, and (if the source had been writing)
+// appends it to a log file in the writing directory.
+func (s *SourceControl) recordRestart(rec *RestartRecord, writingDir string) {
+	line := fmt.Sprintf("%s %s restart %d of %d of source %s after error: %s",
+		rec.Time.Format(time.RFC3339), rec.Status, rec.Attempt, rec.MaxRestarts, rec.SourceName, rec.Reason)
+	if rec.Status == "Scheduled" {
+		line += fmt.Sprintf(" (in %v s)", rec.DelaySec)
+	}
+	if rec.Error != "" {
+		line += fmt.Sprintf(" (restart error: %s)", rec.Error)
+	}
+	log.Println(line)
+	if s.clientUpdates != nil {
+		s.clientUpdates <- ClientUpdate{"AUTORESTART", *rec}
+	}
+	if writingDir == "" {
+		return
+	}
+	fp, err := os.OpenFile(filepath.Join(writingDir, "dastard_restarts.log"),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Could not record restart in %s: %v\n", writingDir, err)
+		return
+	}
+	defer fp.Close()
+	fmt.Fprintln(fp, line)
+}
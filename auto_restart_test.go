@@ -0,0 +1,92 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoRestart(t *testing.T) {
+	s := NewSourceControl()
+	updates := make(chan ClientUpdate)
+	s.clientUpdates = updates
+	records := make(chan RestartRecord, 100)
+	go func() {
+		for u := range updates {
+			if u.tag == "AUTORESTART" {
+				records <- u.state.(RestartRecord)
+			}
+		}
+	}()
+	go func() {
+		for range s.heartbeats {
+		}
+	}()
+	s.status.Npresamp = 256
+	s.status.Nsamples = 1024
+	var okay bool
+	badPolicy := AutoRestartPolicy{MaxRestarts: 2, InitialDelaySec: 1, MaxDelaySec: 0.001}
+	if err := s.ConfigureAutoRestart(&badPolicy, &okay); err == nil {
+		t.Error("ConfigureAutoRestart accepted MaxDelaySec < InitialDelaySec")
+	}
+	policy := AutoRestartPolicy{MaxRestarts: 2, InitialDelaySec: 0.001, MaxDelaySec: 0.002, ResetAfterSec: 3600}
+	if err := s.ConfigureAutoRestart(&policy, &okay); err != nil {
+		t.Fatal(err)
+	}
+
+	// An ErroringSource stops with an error right after every start. With the restart limit
+	// of 2, it should be started 3 times before the supervisor gives up.
+	s.erroring.shouldAutoRestart = true
+	defer func() { s.erroring.shouldAutoRestart = false }()
+	nStarts := s.erroring.nStarts
+	name := "ERRORINGSOURCE"
+	if err := s.Start(&name, &okay); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case rec := <-records:
+			statuses = append(statuses, rec.Status)
+			if rec.Reason == "" || rec.SourceName != "Erroring" {
+				t.Errorf("RestartRecord %+v lacks a reason or has the wrong source", rec)
+			}
+			done = rec.Status == "GaveUp"
+		case <-time.After(2 * time.Millisecond):
+			s.serially(s.handlePossibleStoppedSource)
+		case <-timeout:
+			t.Fatalf("supervisor did not give up on ErroringSource; restart statuses %v", statuses)
+		}
+	}
+	// Outcomes of the restarts can be reported after the next one is scheduled; collect them all.
+	for waiting := true; waiting; {
+		select {
+		case rec := <-records:
+			statuses = append(statuses, rec.Status)
+		case <-time.After(200 * time.Millisecond):
+			waiting = false
+		}
+	}
+	var n int
+	s.serially(func() { n = s.erroring.nStarts - nStarts })
+	if n != 3 {
+		t.Errorf("ErroringSource started %d times, want 3 (restart statuses %v)", n, statuses)
+	}
+	count := make(map[string]int)
+	for _, status := range statuses {
+		count[status]++
+	}
+	if count["Scheduled"] != 2 || count["GaveUp"] != 1 || count["Restarted"]+count["Failed"] != 2 {
+		t.Errorf("restart statuses %v, want 2 each of Scheduled and Restarted/Failed, then GaveUp", statuses)
+	}
+
+	// A source stopped by request is not restarted.
+	s.restart.attempts = 0
+	s.erroring.setRunError(nil)
+	s.superviseStoppedSource()
+	select {
+	case rec := <-records:
+		t.Errorf("supervisor restarts a source that stopped without error: %+v", rec)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
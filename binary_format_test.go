@@ -10,6 +10,7 @@ import (
 
 // TestPublishRecord checks packet(DataRecord) makes a reasonable header and message.
 func TestPublishRecord(t *testing.T) {
+	skipUnlessRaw16(t)
 	data := []RawType{1, 2, 3, 4, 5, 4, 3, 2, 1}
 	rec := &DataRecord{data: data, trigTime: time.Now()}
 
@@ -35,3 +36,36 @@ func TestPublishRecord(t *testing.T) {
 	}
 
 }
+
+// TestPublishSummary checks messageSummaries(DataRecord) makes a reasonable header and message.
+func TestPublishSummary(t *testing.T) {
+	data := []RawType{1, 2, 3, 4, 5, 4, 3, 2, 1}
+	rec := &DataRecord{data: data, trigTime: time.Now(), channelIndex: 3, presamples: 2,
+		filtValue: 1234.5, filtPhase: -0.25, modelCoefs: []float64{1, 2, 3}}
+
+	fullMessage := messageSummaries(rec)
+	header := fullMessage[0]
+	if len(header) != 56 {
+		t.Errorf("summary header is %d bytes, want 56", len(header))
+	}
+	var h struct {
+		ChannelIndex, Version                     uint16
+		Presamples, Samples                       uint32
+		PTMean, Peak, RMS, Average, ResidualStdDv float32
+		TrigTime, TrigFrame                       int64
+		FiltValue, FiltPhase                      float32
+	}
+	if err := binary.Read(bytes.NewReader(header), binary.LittleEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.ChannelIndex != 3 || h.Version != 1 || h.Presamples != 2 || h.Samples != uint32(len(data)) {
+		t.Errorf("summary header has chan %d, version %d, presamples %d, samples %d, want 3, 1, 2, %d",
+			h.ChannelIndex, h.Version, h.Presamples, h.Samples, len(data))
+	}
+	if h.FiltValue != 1234.5 || h.FiltPhase != -0.25 {
+		t.Errorf("summary header has filtValue %v, filtPhase %v, want 1234.5, -0.25", h.FiltValue, h.FiltPhase)
+	}
+	if len(fullMessage[1]) != 8*len(rec.modelCoefs) {
+		t.Errorf("summary message has %d bytes of model coefficients, want %d", len(fullMessage[1]), 8*len(rec.modelCoefs))
+	}
+}
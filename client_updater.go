@@ -11,6 +11,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
@@ -86,7 +87,7 @@ func init() {
 // RunClientUpdater forwards any message from its input channel to the ZMQ publisher socket
 // to publish any information that clients need to know.
 func RunClientUpdater(statusport int, abort <-chan struct{}) {
-	hostname := fmt.Sprintf("tcp://*:%d", statusport)
+	hostname := zmqPubEndpoint(statusport)
 	pubSocket, err := czmq.NewPub(hostname)
 	if err != nil {
 		return
@@ -172,10 +173,21 @@ var nosaveMessages = map[string]struct{}{
 	"newdastard":      {},
 	"tesmap":          {},
 	"externaltrigger": {},
+	"sequence":        {},
+	"diskspace":       {},
+	"faultinjection":  {},
+	"autorestart":     {},
+	"noisepsd":        {},
 }
 
+// configLock serializes use of the global viper configuration, which saveState changes
+// from the client updater goroutine while sources read it.
+var configLock sync.Mutex
+
 // saveState stores server configuration to the standard config file.
 func saveState(lastMessages map[string]interface{}) {
+	configLock.Lock()
+	defer configLock.Unlock()
 
 	now := time.Now().Format(time.UnixDate)
 	lastMessages["CURRENTTIME"] = now
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -54,28 +55,58 @@ func makeFileExist(dir, filename string) (string, error) {
 }
 
 // setupViper sets up the viper configuration manager: says where to find config
-// files and the filename and suffix. Sets some defaults.
-func setupViper() error {
+// files and the filename and suffix. Sets some defaults. A configDir other than the
+// default is the only place searched, so each Dastard instance can have its own.
+func setupViper(configDir string) error {
 	viper.SetDefault("Verbose", false)
 
 	const path string = "$HOME/.dastard"
 	const filename string = "config"
 	const suffix string = ".yaml"
-	if _, err := makeFileExist(path, filename+suffix); err != nil {
+	fullname, err := makeFileExist(configDir, filename+suffix)
+	if err != nil {
 		return err
 	}
+	dastard.ConfigDirectory = filepath.Dir(fullname) // profiles go here, too
 
 	viper.SetConfigName(filename)
-	viper.AddConfigPath("/etc/dastard")
-	viper.AddConfigPath(path)
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
+	if configDir == path {
+		viper.AddConfigPath("/etc/dastard")
+		viper.AddConfigPath(path)
+		viper.AddConfigPath(".")
+	} else {
+		viper.AddConfigPath(configDir)
+	}
+	err = viper.ReadInConfig() // Find and read the config file
+	if err != nil {            // Handle errors reading the config file
 		return fmt.Errorf("error reading config file: %s", err)
 	}
 	return nil
 }
 
+// configureNetwork sets Dastard's TCP port numbers and bind addresses from any
+// command-line flags that were set, or else from the viper configuration. Flag values
+// are not stored in viper, so they are not saved in the config file.
+func configureNetwork(basePort *int, rpcBind, pubBind *string) error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["port"] && viper.IsSet("BasePort") {
+		*basePort = viper.GetInt("BasePort")
+	}
+	if !set["rpc-bind"] {
+		*rpcBind = viper.GetString("RPCBindAddress")
+	}
+	if !set["pub-bind"] {
+		*pubBind = viper.GetString("PublishBindAddress")
+	}
+	if err := dastard.SetPortnumbers(*basePort); err != nil {
+		return err
+	}
+	dastard.Bind.RPC = *rpcBind
+	dastard.Bind.Publish = *pubBind
+	return nil
+}
+
 func startProblemLogger(pfname string) *log.Logger {
 	probFile, err := os.OpenFile(pfname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
@@ -99,6 +130,13 @@ func main() {
 	dastard.Build.Githash = githash
 
 	printVersion := flag.Bool("version", false, "print version and quit")
+	basePort := flag.Int("port", 5500, "base TCP port number (overrides config key BasePort)")
+	rpcBind := flag.String("rpc-bind", "",
+		"interface for the JSON-RPC control port, e.g. localhost; empty for all (overrides config key RPCBindAddress)")
+	pubBind := flag.String("pub-bind", "",
+		"interface for the ZMQ publisher ports; empty for all (overrides config key PublishBindAddress)")
+	configDir := flag.String("config-dir", "$HOME/.dastard",
+		"directory of the config file, e.g. a separate one for each instance run on one computer")
 	flag.Parse()
 	if *printVersion {
 		fmt.Printf("This is DASTARD version %s\n", dastard.Build.Version)
@@ -117,9 +155,14 @@ func main() {
 	fmt.Printf("Logging problems to %v\n", dastard.ProblemLogger)
 
 	// Find config file, creating it if needed, and read it.
-	if err := setupViper(); err != nil {
+	if err := setupViper(*configDir); err != nil {
+		panic(err)
+	}
+	if err := configureNetwork(basePort, rpcBind, pubBind); err != nil {
 		panic(err)
 	}
+	fmt.Printf("Control (JSON-RPC) port %d; ZMQ publisher ports %d-%d\n", dastard.Ports.RPC,
+		dastard.Ports.Status, dastard.Ports.RPC+dastard.NumberOfPorts-1)
 
 	abort := make(chan struct{})
 	go dastard.RunClientUpdater(dastard.Ports.Status, abort)
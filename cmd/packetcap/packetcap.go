@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/usnistgov/dastard/packets"
+	"github.com/usnistgov/dastard/ringbuffer"
+)
+
+const packetAlign = 8192     // Packets go into the ring buffer at this stride (bytes)
+const maxPacketSize = 65536  // No UDP message can be larger than this
+const captureHeaderSize = 14 // Bytes before each packet in a capture file
+const captureMagic = "Dastard packet capture v1\n"
+
+// A capture file starts with captureMagic. Then each packet is stored as these little-endian
+// values, followed by the packet exactly as it was received:
+// int64: arrival time (nanoseconds since 1 Jan 1970)
+// uint16: source index (which UDP port or ring buffer, in the order given when recording)
+// uint32: N = packet length in bytes
+
+// capturedPacket is one packet and the time and place it was received.
+type capturedPacket struct {
+	source  int       // index of the UDP port or ring buffer the packet came from
+	arrival time.Time // when the packet was received
+	data    []byte
+}
+
+// captureWriter writes packets to a capture file.
+type captureWriter struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+// createCapture creates a capture file and writes its magic string.
+func createCapture(filename string) (*captureWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	cw := &captureWriter{file: file, w: bufio.NewWriterSize(file, 1<<20)}
+	if _, err := cw.w.WriteString(captureMagic); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *captureWriter) write(cp *capturedPacket) error {
+	var hdr [captureHeaderSize]byte
+	binary.LittleEndian.PutUint64(hdr[0:], uint64(cp.arrival.UnixNano()))
+	binary.LittleEndian.PutUint16(hdr[8:], uint16(cp.source))
+	binary.LittleEndian.PutUint32(hdr[10:], uint32(len(cp.data)))
+	if _, err := cw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(cp.data)
+	return err
+}
+
+// Close flushes and closes the capture file.
+func (cw *captureWriter) Close() error {
+	if err := cw.w.Flush(); err != nil {
+		cw.file.Close()
+		return err
+	}
+	return cw.file.Close()
+}
+
+// captureReader reads packets from a capture file.
+type captureReader struct {
+	file *os.File
+	r    *bufio.Reader
+}
+
+// openCapture opens a capture file and checks its magic string.
+func openCapture(filename string) (*captureReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	cr := &captureReader{file: file, r: bufio.NewReaderSize(file, 1<<20)}
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != captureMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a packet capture file", filename)
+	}
+	return cr, nil
+}
+
+// next returns the next packet in the file, or io.EOF after the last one.
+func (cr *captureReader) next() (*capturedPacket, error) {
+	var hdr [captureHeaderSize]byte
+	if _, err := io.ReadFull(cr.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(hdr[10:])
+	if n > maxPacketSize {
+		return nil, fmt.Errorf("captured packet of %d bytes exceeds the maximum %d", n, maxPacketSize)
+	}
+	cp := &capturedPacket{
+		source:  int(binary.LittleEndian.Uint16(hdr[8:])),
+		arrival: time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[0:]))),
+		data:    make([]byte, n),
+	}
+	if _, err := io.ReadFull(cr.r, cp.data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Close closes the capture file.
+func (cr *captureReader) Close() error {
+	return cr.file.Close()
+}
+
+// sourceStats counts the packets from one source.
+type sourceStats struct {
+	npackets int
+	nbytes   int
+	nbad     int            // packets that packets.ReadPacket could not parse
+	nmissing int            // packets missing from the sequence numbers
+	lastSeq  map[int]uint32 // the last sequence number seen for each channel offset
+}
+
+// captureStats tallies the packets recorded or replayed from each source.
+type captureStats struct {
+	sources     []sourceStats
+	first, last time.Time
+}
+
+func (cs *captureStats) total() int {
+	n := 0
+	for _, s := range cs.sources {
+		n += s.npackets
+	}
+	return n
+}
+
+// add counts a packet. Each channel group numbers its packets separately, so look for
+// gaps in the sequence numbers separately for each channel offset.
+func (cs *captureStats) add(cp *capturedPacket) {
+	for len(cs.sources) <= cp.source {
+		cs.sources = append(cs.sources, sourceStats{lastSeq: make(map[int]uint32)})
+	}
+	if cs.first.IsZero() {
+		cs.first = cp.arrival
+	}
+	cs.last = cp.arrival
+	s := &cs.sources[cp.source]
+	s.npackets++
+	s.nbytes += len(cp.data)
+	p, err := packets.ReadPacket(bytes.NewReader(cp.data))
+	if err != nil {
+		s.nbad++
+		return
+	}
+	_, offset := p.ChannelInfo()
+	sn := p.SequenceNumber()
+	if last, ok := s.lastSeq[offset]; ok && sn > last+1 {
+		s.nmissing += int(sn - last - 1)
+	}
+	s.lastSeq[offset] = sn
+}
+
+// report prints the statistics to the terminal.
+func (cs *captureStats) report(verb string) {
+	duration := cs.last.Sub(cs.first)
+	fmt.Printf("%s %d packets spanning %v.\n", verb, cs.total(), duration)
+	for i, s := range cs.sources {
+		fmt.Printf("Source %d: %7d packets, %10d bytes, %d unparseable, %d missing from the sequence numbers\n",
+			i, s.npackets, s.nbytes, s.nbad, s.nmissing)
+	}
+}
+
+// packetSource is a UDP port or ring buffer that packets can be recorded from.
+type packetSource interface {
+	readPackets(source int, packetchan chan<- *capturedPacket, done <-chan struct{})
+	Close() error
+}
+
+// udpSource receives packets on a UDP port.
+type udpSource struct {
+	conn *net.UDPConn
+}
+
+func listenUDP(hostport string) (*udpSource, error) {
+	addr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSource{conn: conn}, nil
+}
+
+// readPackets puts each UDP message on packetchan until the connection is closed.
+func (us *udpSource) readPackets(source int, packetchan chan<- *capturedPacket, done <-chan struct{}) {
+	message := make([]byte, maxPacketSize)
+	for {
+		n, _, err := us.conn.ReadFrom(message)
+		if err != nil {
+			// Getting an error here is the normal way to detect closed connection.
+			return
+		}
+		cp := &capturedPacket{source: source, arrival: time.Now(), data: append([]byte{}, message[:n]...)}
+		select {
+		case packetchan <- cp:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (us *udpSource) Close() error {
+	return us.conn.Close()
+}
+
+// ringSource reads packets from a shared-memory ring buffer.
+type ringSource struct {
+	ring       *ringbuffer.RingBuffer
+	packetSize int
+}
+
+// openRing opens an existing ring buffer and discards whatever is in it.
+func openRing(cardnum int) (*ringSource, error) {
+	ringname := fmt.Sprintf("xdma%d_c2h_0_buffer", cardnum)
+	ringdesc := fmt.Sprintf("xdma%d_c2h_0_description", cardnum)
+	ring, err := ringbuffer.NewRingBuffer(ringname, ringdesc)
+	if err != nil {
+		return nil, err
+	}
+	if err := ring.Open(); err != nil {
+		return nil, fmt.Errorf("Could not open ringbuffer %d: %s", cardnum, err)
+	}
+	psize, err := ring.PacketSize()
+	if err != nil {
+		ring.Close()
+		return nil, err
+	}
+	rs := &ringSource{ring: ring, packetSize: int(psize)}
+	if err := ring.DiscardStride(uint64(psize)); err != nil {
+		ring.Close()
+		return nil, err
+	}
+	return rs, nil
+}
+
+// readPackets polls the ring and puts each packet on packetchan until done is closed.
+// All packets found in one poll share an arrival time.
+func (rs *ringSource) readPackets(source int, packetchan chan<- *capturedPacket, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		data, err := rs.ring.ReadMultipleOf(rs.packetSize)
+		if err != nil {
+			fmt.Printf("Could not read ring buffer for source %d: %v\n", source, err)
+			return
+		}
+		if len(data) == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		now := time.Now()
+		for ; len(data) >= rs.packetSize; data = data[rs.packetSize:] {
+			// Keep the packet but not its padding. Keep the whole slot if it isn't a packet.
+			slot := data[:rs.packetSize]
+			n := rs.packetSize
+			if p, err := packets.ReadPacket(bytes.NewReader(slot)); err == nil && p.Length() <= n {
+				n = p.Length()
+			}
+			cp := &capturedPacket{source: source, arrival: now, data: append([]byte{}, slot[:n]...)}
+			select {
+			case packetchan <- cp:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func (rs *ringSource) Close() error {
+	return rs.ring.Close()
+}
+
+// recordPackets writes packets from all the sources to cw, until stop is closed or
+// maxPackets (if positive) have been written.
+func recordPackets(cw *captureWriter, sources []packetSource, maxPackets int, stop <-chan struct{}) (*captureStats, error) {
+	packetchan := make(chan *capturedPacket, 1024)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func(source int, src packetSource) {
+			defer wg.Done()
+			src.readPackets(source, packetchan, done)
+		}(i, src)
+	}
+	defer func() {
+		close(done)
+		for _, src := range sources {
+			src.Close()
+		}
+		wg.Wait()
+	}()
+
+	stats := new(captureStats)
+	for maxPackets <= 0 || stats.total() < maxPackets {
+		select {
+		case <-stop:
+			return stats, nil
+		case cp := <-packetchan:
+			if err := cw.write(cp); err != nil {
+				return stats, err
+			}
+			stats.add(cp)
+		}
+	}
+	return stats, nil
+}
+
+// packetSender is a UDP port or ring buffer that packets can be replayed to.
+type packetSender interface {
+	send(data []byte) error
+	Close() error
+}
+
+// udpSender sends packets to a UDP port.
+type udpSender struct {
+	conn net.Conn
+}
+
+func dialUDP(hostport string) (*udpSender, error) {
+	conn, err := net.Dial("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSender{conn: conn}, nil
+}
+
+func (us *udpSender) send(data []byte) error {
+	_, err := us.conn.Write(data)
+	return err
+}
+
+func (us *udpSender) Close() error {
+	return us.conn.Close()
+}
+
+// ringSender puts packets into a shared-memory ring buffer that it creates.
+type ringSender struct {
+	ring     *ringbuffer.RingBuffer
+	slot     []byte
+	ndropped int // packets dropped because the ring was full
+}
+
+// createRing creates a ring buffer of ringsize bytes, replacing any that exists.
+func createRing(cardnum, ringsize int) (*ringSender, error) {
+	ringname := fmt.Sprintf("xdma%d_c2h_0_buffer", cardnum)
+	ringdesc := fmt.Sprintf("xdma%d_c2h_0_description", cardnum)
+	ring, err := ringbuffer.NewRingBuffer(ringname, ringdesc)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open ringbuffer %d: %s", cardnum, err)
+	}
+	ring.Unlink() // in case it exists from before
+	if err = ring.Create(ringsize); err != nil {
+		return nil, fmt.Errorf("Failed RingBuffer.Create(%d): %s", ringsize, err)
+	}
+	return &ringSender{ring: ring, slot: make([]byte, packetAlign)}, nil
+}
+
+// send pads the packet to packetAlign bytes and writes it to the ring. Like the hardware,
+// it drops the packet if the ring is full.
+func (rs *ringSender) send(data []byte) error {
+	if len(data) > packetAlign {
+		return fmt.Errorf("packet of %d bytes does not fit the ring's %d-byte stride", len(data), packetAlign)
+	}
+	if rs.ring.BytesWriteable() < packetAlign {
+		rs.ndropped++
+		return nil
+	}
+	n := copy(rs.slot, data)
+	for i := n; i < packetAlign; i++ {
+		rs.slot[i] = 0
+	}
+	_, err := rs.ring.Write(rs.slot)
+	return err
+}
+
+// Close removes the ring buffer.
+func (rs *ringSender) Close() error {
+	if rs.ndropped > 0 {
+		fmt.Printf("Dropped %d packets because the ring buffer was full.\n", rs.ndropped)
+	}
+	return rs.ring.Unlink()
+}
+
+// replayPackets sends packets from cr, each to the sender given by its source index, at
+// speed times the original rate (or as fast as possible, if speed is not positive). It
+// stops at the end of the file, when stop is closed, or after maxPackets (if positive).
+func replayPackets(cr *captureReader, senders []packetSender, speed float64, maxPackets int, stop <-chan struct{}) (*captureStats, error) {
+	stats := new(captureStats)
+	var t0, start time.Time
+	for maxPackets <= 0 || stats.total() < maxPackets {
+		cp, err := cr.next()
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+		if cp.source >= len(senders) {
+			return stats, fmt.Errorf("packet came from source %d, but there are only %d destinations", cp.source, len(senders))
+		}
+
+		// Wait until it's time to send the packet. Don't bother sleeping <1 ms.
+		if start.IsZero() {
+			t0 = cp.arrival
+			start = time.Now()
+		} else if speed > 0 {
+			due := start.Add(time.Duration(float64(cp.arrival.Sub(t0)) / speed))
+			if wait := time.Until(due); wait > time.Millisecond {
+				select {
+				case <-stop:
+					return stats, nil
+				case <-time.After(wait):
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return stats, nil
+		default:
+		}
+
+		if err := senders[cp.source].send(cp.data); err != nil {
+			return stats, err
+		}
+		stats.add(cp)
+	}
+	return stats, nil
+}
+
+// parseList splits a comma-separated list, ignoring empty items.
+func parseList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseRings converts a comma-separated list of ring buffer numbers.
+func parseRings(s string) ([]int, error) {
+	var cardnums []int
+	for _, item := range parseList(s) {
+		cardnum, err := strconv.Atoi(item)
+		if err != nil || cardnum < 0 || cardnum > 999 {
+			return nil, fmt.Errorf("ring number %q must be in the range [0, 999]", item)
+		}
+		cardnums = append(cardnums, cardnum)
+	}
+	return cardnums, nil
+}
+
+func record(filename string, udpAddrs []string, cardnums []int, maxPackets int, stop <-chan struct{}) error {
+	var sources []packetSource
+	defer func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}()
+	for _, hostport := range udpAddrs {
+		src, err := listenUDP(hostport)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+		fmt.Printf("Recording source %d from UDP %s\n", len(sources)-1, hostport)
+	}
+	for _, cardnum := range cardnums {
+		src, err := openRing(cardnum)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+		fmt.Printf("Recording source %d from ring buffer %d\n", len(sources)-1, cardnum)
+	}
+
+	cw, err := createCapture(filename)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Type Ctrl-C to stop recording.")
+	stats, err := recordPackets(cw, sources, maxPackets, stop)
+	sources = nil // recordPackets closed them
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	stats.report("Recorded")
+	return err
+}
+
+func replay(filename string, udpAddrs []string, cardnums []int, ringsize int, speed float64,
+	maxPackets int, stop <-chan struct{}) error {
+	var senders []packetSender
+	defer func() {
+		for _, s := range senders {
+			s.Close()
+		}
+	}()
+	for _, hostport := range udpAddrs {
+		s, err := dialUDP(hostport)
+		if err != nil {
+			return err
+		}
+		senders = append(senders, s)
+		fmt.Printf("Replaying source %d to UDP %s\n", len(senders)-1, hostport)
+	}
+	for _, cardnum := range cardnums {
+		s, err := createRing(cardnum, ringsize)
+		if err != nil {
+			return err
+		}
+		senders = append(senders, s)
+		fmt.Printf("Replaying source %d into shm:xdma%d_c2h_0_buffer\n", len(senders)-1, cardnum)
+	}
+
+	cr, err := openCapture(filename)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	stats, err := replayPackets(cr, senders, speed, maxPackets, stop)
+	stats.report("Replayed")
+	return err
+}
+
+func main() {
+	recordFile := flag.String("record", "", "Record packets to this capture file")
+	replayFile := flag.String("replay", "", "Replay packets from this capture file")
+	udp := flag.String("udp", "", "Comma-separated host:port list of UDP ports to record from or replay to")
+	rings := flag.String("rings", "", "Comma-separated list of ring buffer numbers (0-999) to record from or replay into")
+	speed := flag.Float64("speed", 1.0, "Replay at this multiple of the original rate (<=0 means as fast as possible)")
+	duration := flag.Duration("duration", 0, "Stop after this long (0 means run until Ctrl-C)")
+	npackets := flag.Int("npackets", 0, "Stop after this many packets (0 means no limit)")
+	ringsize := flag.Int("ringsize", 500*packetAlign, "Size of each ring buffer created for replay (bytes)")
+	flag.Usage = func() {
+		fmt.Println("packetcap, a program to record Abaco/µMUX packet streams and replay them")
+		fmt.Println("Usage:")
+		flag.PrintDefaults()
+		fmt.Println("Give exactly one of -record or -replay. Packets from the Nth port or ring given when")
+		fmt.Println("recording are replayed to the Nth port or ring given when replaying, UDP ports first.")
+	}
+	flag.Parse()
+
+	udpAddrs := parseList(*udp)
+	cardnums, err := parseRings(*rings)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if (*recordFile == "") == (*replayFile == "") {
+		fmt.Println("Give exactly one of -record or -replay.")
+		os.Exit(1)
+	}
+	if len(udpAddrs)+len(cardnums) == 0 {
+		fmt.Println("Give at least one UDP port (-udp) or ring buffer (-rings).")
+		os.Exit(1)
+	}
+	if *ringsize < 2*packetAlign {
+		*ringsize = 2 * packetAlign
+	}
+	*ringsize -= *ringsize % packetAlign
+
+	cancel := make(chan os.Signal, 1)
+	signal.Notify(cancel, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		var timeout <-chan time.Time
+		if *duration > 0 {
+			timeout = time.After(*duration)
+		}
+		select {
+		case <-cancel:
+		case <-timeout:
+		}
+		close(stop)
+	}()
+
+	if *recordFile != "" {
+		err = record(*recordFile, udpAddrs, cardnums, *npackets, stop)
+	} else {
+		err = replay(*replayFile, udpAddrs, cardnums, *ringsize, *speed, *npackets, stop)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/usnistgov/dastard/packets"
+)
+
+// makeCapture writes a capture file of npackets packets, alternating between 2 sources,
+// with arrival times dt apart. Source 1 skips sequence number 3. It returns the packets.
+func makeCapture(t *testing.T, filename string, npackets int, dt time.Duration) []*capturedPacket {
+	cw, err := createCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := []*packets.Packet{packets.NewPacket(10, 20, 0, 0), packets.NewPacket(10, 20, 0, 4)}
+	dims := []int16{4}
+	t0 := time.Now()
+	var written []*capturedPacket
+	for i := 0; i < npackets; i++ {
+		source := i % 2
+		if source == 1 && i/2 == 3 {
+			p[source].NewData([]int16{}, dims) // increments the sequence number
+		}
+		d := make([]int16, 40)
+		for j := range d {
+			d[j] = int16(i*100 + j)
+		}
+		p[source].NewData(d, dims)
+		cp := &capturedPacket{source: source, arrival: t0.Add(time.Duration(i) * dt), data: p[source].Bytes()}
+		if err := cw.write(cp); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, cp)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return written
+}
+
+func TestCaptureFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "packetcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	filename := path.Join(tmp, "test.cap")
+	const npackets = 10
+	written := makeCapture(t, filename, npackets, time.Millisecond)
+
+	cr, err := openCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	stats := new(captureStats)
+	for i, want := range written {
+		cp, err := cr.next()
+		if err != nil {
+			t.Fatalf("captureReader.next() packet %d error: %v", i, err)
+		}
+		if cp.source != want.source || !cp.arrival.Equal(want.arrival) || !bytes.Equal(cp.data, want.data) {
+			t.Errorf("captureReader.next() packet %d is source %d at %v, want source %d at %v", i,
+				cp.source, cp.arrival, want.source, want.arrival)
+		}
+		if p, err := packets.ReadPacket(bytes.NewReader(cp.data)); err != nil || p.Frames() != 10 {
+			t.Errorf("captured packet %d could not be read as a 10-frame packet: %v", i, err)
+		}
+		stats.add(cp)
+	}
+	if _, err := cr.next(); err != io.EOF {
+		t.Errorf("captureReader.next() after the last packet returns %v, want EOF", err)
+	}
+	if stats.total() != npackets || len(stats.sources) != 2 {
+		t.Errorf("captureStats has %d packets from %d sources, want %d from 2", stats.total(), len(stats.sources), npackets)
+	}
+	if stats.sources[0].nmissing != 0 || stats.sources[1].nmissing != 1 {
+		t.Errorf("captureStats has %d and %d missing packets, want 0 and 1", stats.sources[0].nmissing,
+			stats.sources[1].nmissing)
+	}
+	stats.add(&capturedPacket{source: 0, data: []byte("not a packet")})
+	if stats.sources[0].nbad != 1 {
+		t.Errorf("captureStats counts %d unparseable packets, want 1", stats.sources[0].nbad)
+	}
+
+	if _, err := openCapture(path.Join(tmp, "nonexistent.cap")); err == nil {
+		t.Error("openCapture on a nonexistent file succeeded, want error")
+	}
+	notcapture := path.Join(tmp, "notcapture.cap")
+	ioutil.WriteFile(notcapture, []byte("something else entirely"), 0644)
+	if _, err := openCapture(notcapture); err == nil {
+		t.Error("openCapture on a file that isn't a capture succeeded, want error")
+	}
+}
+
+func TestUDPRecordReplay(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "packetcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	original := path.Join(tmp, "original.cap")
+	const npackets = 20
+	const dt = 5 * time.Millisecond
+	written := makeCapture(t, original, npackets, dt)
+
+	hostports := []string{"localhost:4950", "localhost:4951"}
+	var sources []packetSource
+	for _, hp := range hostports {
+		src, err := listenUDP(hp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, src)
+	}
+	copied := path.Join(tmp, "copy.cap")
+	cw, err := createCapture(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		stats *captureStats
+		err   error
+	}
+	recorded := make(chan result)
+	stopRecording := make(chan struct{})
+	go func() {
+		stats, err := recordPackets(cw, sources, npackets, stopRecording)
+		recorded <- result{stats, err}
+	}()
+
+	// Replay at double speed.
+	var senders []packetSender
+	for _, hp := range hostports {
+		s, err := dialUDP(hp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		senders = append(senders, s)
+	}
+	cr, err := openCapture(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	start := time.Now()
+	stats, err := replayPackets(cr, senders, 2.0, 0, make(chan struct{}))
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.total() != npackets {
+		t.Errorf("replayPackets sent %d packets, want %d", stats.total(), npackets)
+	}
+	if want := (npackets - 1) * dt / 2; elapsed < want-time.Millisecond || elapsed > 4*want {
+		t.Errorf("replayPackets at speed 2 took %v, want about %v", elapsed, want)
+	}
+
+	var r result
+	select {
+	case r = <-recorded:
+	case <-time.After(2 * time.Second):
+		close(stopRecording)
+		r = <-recorded
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r.stats.total() != npackets {
+		t.Fatalf("recordPackets got %d packets, want %d", r.stats.total(), npackets)
+	}
+
+	// Packets from each port arrive in order, but the two ports might interleave differently.
+	cr2, err := openCapture(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr2.Close()
+	var got [2][]*capturedPacket
+	for {
+		cp, err := cr2.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got[cp.source] = append(got[cp.source], cp)
+	}
+	for i, want := range written {
+		idx := i / 2
+		if len(got[want.source]) <= idx {
+			t.Fatalf("recorded %d packets from source %d, want more", len(got[want.source]), want.source)
+		}
+		if !bytes.Equal(got[want.source][idx].data, want.data) {
+			t.Errorf("recorded packet %d from source %d differs from the replayed one", idx, want.source)
+		}
+	}
+}
+
+func TestRingReplay(t *testing.T) {
+	const cardnum = 17
+	sender, err := createRing(cardnum, 4*packetAlign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	src, err := openRing(cardnum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.send(make([]byte, packetAlign+1)); err == nil {
+		t.Error("ringSender.send of an oversized packet succeeded, want error")
+	}
+
+	// The ring holds only 3 packets, so the 4th and 5th are dropped.
+	p := packets.NewPacket(10, 20, 0, 0)
+	var sent [][]byte
+	for i := 0; i < 5; i++ {
+		p.NewData([]int16{int16(i), 2, 3, 4}, []int16{4})
+		b := p.Bytes()
+		sent = append(sent, b)
+		if err := sender.send(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sender.ndropped != 2 {
+		t.Errorf("ringSender dropped %d packets, want 2", sender.ndropped)
+	}
+
+	packetchan := make(chan *capturedPacket)
+	done := make(chan struct{})
+	go src.readPackets(3, packetchan, done)
+	for i := 0; i < 3; i++ {
+		select {
+		case cp := <-packetchan:
+			if cp.source != 3 || !bytes.Equal(cp.data, sent[i]) {
+				t.Errorf("ringSource packet %d is %v from source %d, want %v from source 3", i, cp.data, cp.source, sent[i])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("ringSource produced %d packets, want 3", i)
+		}
+	}
+	close(done)
+	src.Close()
+}
+
+func TestParseRings(t *testing.T) {
+	if cardnums, err := parseRings(" 0,3,, 999"); err != nil || len(cardnums) != 3 || cardnums[2] != 999 {
+		t.Errorf("parseRings returns %v, %v, want [0 3 999]", cardnums, err)
+	}
+	for _, bad := range []string{"1000", "-1", "x"} {
+		if _, err := parseRings(bad); err == nil {
+			t.Errorf("parseRings(%q) succeeded, want error", bad)
+		}
+	}
+}
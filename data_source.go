@@ -15,8 +15,19 @@ import (
 	"gonum.org/v1/gonum/mat"
 )
 
-// RawType holds raw signal data.
-type RawType uint16
+// rawSignOffset is added to signed RawType values to make them sort like unsigned ones.
+const rawSignOffset = RawType(1) << (rawTypeBits - 1)
+
+// signExtend16 extends signed 16-bit words, stored in data, to fill the RawType. It
+// does nothing when RawType is itself 16 bits.
+func signExtend16(data []RawType) {
+	if rawTypeBits == 16 {
+		return
+	}
+	for i, v := range data {
+		data[i] = RawType(int16(v))
+	}
+}
 
 // FrameIndex is used for counting raw data frames.
 type FrameIndex int64
@@ -69,16 +80,37 @@ type DataSource interface {
 	ChannelNames() []string
 	ConfigurePulseLengths(int, int) error
 	ConfigureProjectorsBases(int, *mat.Dense, *mat.Dense, string) error
+	ConfigureFilters(int, *mat.VecDense, *mat.VecDense, string) error
+	ConfigureHistograms(*HistogramConfigObject) error
+	ResetHistograms([]int) error
+	HistogramSnapshots([]int) ([]*HistogramSnapshot, error)
+	StartNoisePSD(*NoisePSDConfig) error
+	StopNoisePSD([]int) error
+	NoisePSDs([]int) ([]*NoisePSDResult, error)
+	TrainProjectors(*ProjectorTrainingConfig) error
+	CancelProjectorTraining([]int) error
+	ProjectorTrainingStatuses([]int) ([]*ProjectorTrainingStatus, error)
 	ChangeTriggerState(*FullTriggerState) error
 	ConfigureMixFraction(*MixFractionObject) ([]float64, error)
 	WriteControl(*WriteControlConfig) error
 	SetCoupling(CouplingStatus) error
+	ChangeGroupTrigger(bool, *GroupTriggerState) error
+	ComputeGroupTriggerState() GroupTriggerState
+	GroupTriggerRuleConnections(*GroupTriggerRule, *Map) (*GroupTriggerState, error)
 	SetExperimentStateLabel(time.Time, string) error
 	ChannelsWithProjectors() []int
+	ChannelsWithFilters() []int
 	ProcessSegments(*dataBlock) error
 	RunDoneActivate()
 	RunDoneDeactivate()
 	ShouldAutoRestart() bool
+	RunError() error
+	setRunError(error)
+	analysisSettings() []channelAnalysis
+	restoreAnalysisSettings([]channelAnalysis) error
+	setWritingBasePath(string)
+	totalNumberWritten() int
+	stopWriting(string) error
 	getPulseLengths() (int, int, error)
 }
 
@@ -109,7 +141,21 @@ func (ds *AnySource) ShouldAutoRestart() bool {
 	return ds.shouldAutoRestart
 }
 
-// ConfigureMixFraction provides a default implementation for all non-lancero sources that
+// RunError returns the error that stopped the last run, or nil if it stopped normally (or is running)
+func (ds *AnySource) RunError() error {
+	ds.sourceStateLock.Lock()
+	defer ds.sourceStateLock.Unlock()
+	return ds.runError
+}
+
+// setRunError records the error that stopped the run
+func (ds *AnySource) setRunError(err error) {
+	ds.sourceStateLock.Lock()
+	defer ds.sourceStateLock.Unlock()
+	ds.runError = err
+}
+
+// ConfigureMixFraction provides a default implementation for all non-TDM sources that
 // don't need the mix
 func (ds *AnySource) ConfigureMixFraction(mfo *MixFractionObject) ([]float64, error) {
 	return nil, fmt.Errorf("source type %s does not support Mix", ds.name)
@@ -118,6 +164,9 @@ func (ds *AnySource) ConfigureMixFraction(mfo *MixFractionObject) ([]float64, er
 // getNextBlock returns the channel on which data sources send data and any errors.
 // Waiting on this channel = waiting on the source to produce a data block.
 func (ds *AnySource) getNextBlock() chan *dataBlock {
+	if ds.faultedBlock != nil {
+		return ds.faultedBlock
+	}
 	return ds.nextBlock
 }
 
@@ -135,6 +184,7 @@ func Start(ds DataSource, queuedRequests chan func(), Npresamp int, Nsamples int
 	if err := ds.SetStateStarting(); err != nil {
 		return err
 	}
+	ds.setRunError(nil)
 	if err := ds.Sample(); err != nil {
 		ds.SetStateInactive()
 		return err
@@ -186,6 +236,7 @@ func CoreLoop(ds DataSource, queuedRequests chan func()) {
 			} else if block.err != nil {
 				// errors in block indicate a problem with source: need to close down
 				log.Printf("nextBlock received Error; stopping source: %s\n", block.err.Error())
+				ds.setRunError(block.err)
 				return
 			}
 			if err := ds.ProcessSegments(block); err != nil {
@@ -295,16 +346,24 @@ type AnySource struct {
 	broker                 *TriggerBroker
 	configError            error // Any error that arose when configuring the source (before Start)
 
-	shouldAutoRestart   bool // used to tell SourceControl to try to restart this source after an error
-	noProcess           bool // Set true only for testing.
+	shouldAutoRestart   bool  // used to tell SourceControl to try to restart this source after an error
+	runError            error // the error that stopped the last run, if any; guarded by sourceStateLock
+	noProcess           bool  // Set true only for testing.
 	heartbeats          chan Heartbeat
 	writingState        WritingState
 	numberWrittenTicker *time.Ticker
+	histogramTicker     *time.Ticker
+	writingConfig       WriteControlConfig // the request that started writing, kept for rotating files
+	manifest            *RunManifest       // summary of the current writing run
+	nextRotationCheck   time.Time
 	sourceState         SourceState
 	sourceStateLock     sync.Mutex // guards sourceState
 	runDone             sync.WaitGroup
 	readCounter         int
 	channelsPerPixel    int
+
+	faults       *FaultInjectionConfig // faults to inject into each run (nil for none)
+	faultedBlock chan *dataBlock       // nextBlock after fault injection (nil if none)
 }
 
 // SamplePeriod returns the sample period of the underlying source.
@@ -339,15 +398,22 @@ func (ds *AnySource) ProcessSegments(block *dataBlock) error {
 	}
 
 	// Each processor (channel) handles its segment in parallel.
+	writeErrors := make([]error, len(ds.processors))
 	for i, dsp := range ds.processors {
 		segment := block.segments[i]
 		wg.Add(1)
-		go func(dsp *DataStreamProcessor) {
+		go func(i int, dsp *DataStreamProcessor) {
 			defer wg.Done()
-			dsp.processSegment(&segment)
-		}(dsp)
+			writeErrors[i] = dsp.processSegment(&segment)
+		}(i, dsp)
 	}
 	wg.Wait()
+	for i, err := range writeErrors {
+		if err != nil {
+			ds.stopWritingAfterError(fmt.Errorf("channel %s: %v", ds.processors[i].Name, err))
+			return nil
+		}
+	}
 
 	tStart := time.Now()
 	for i, dsp := range ds.processors {
@@ -366,12 +432,21 @@ func (ds *AnySource) ProcessSegments(block *dataBlock) error {
 		numberWritten[i] = dsp.numberWritten
 	}
 	if err := ds.HandleExternalTriggers(block.externalTriggerRowcounts); err != nil {
-		return err
+		ds.stopWritingAfterError(err)
+		return nil
 	}
 
 	// all segments will have the same value for droppedFrames and firstFramenum, so we just look at the first segment here
 	if err := ds.HandleDataDrop(block.segments[0].droppedFrames, int(block.segments[0].firstFramenum)); err != nil {
-		return err
+		ds.stopWritingAfterError(err)
+		return nil
+	}
+	if ds.histogramTicker != nil {
+		select {
+		case <-ds.histogramTicker.C:
+			ds.publishHistograms()
+		default:
+		}
 	}
 	if ds.writingState.Active && !ds.writingState.Paused {
 		select {
@@ -381,6 +456,12 @@ func (ds *AnySource) ProcessSegments(block *dataBlock) error {
 		default:
 		}
 	}
+	ds.rotateFilesIfDue(time.Now())
+	if err := ds.stopWritingIfLimitReached(numberWritten); err != nil {
+		// Writing has stopped anyway; don't stop the data source, too.
+		log.Printf("Error stopping writing at a limit: %v\n", err)
+		ProblemLogger.Printf("Error stopping writing at a limit: %v", err)
+	}
 	return nil
 }
 
@@ -398,6 +479,10 @@ func (ds *AnySource) HandleDataDrop(droppedFrames, firstFramenum int) error {
 		ds.writingState.dataDropsObserved++
 		fmt.Printf("DATA DROP. firstFramenum %v, droppedFrames %v\n", firstFramenum, droppedFrames)
 		if ds.writingState.IsActive() {
+			if ds.manifest != nil {
+				ds.manifest.DataDrops++
+				ds.manifest.DroppedFrames += droppedFrames
+			}
 			// Set up the log file if not already done
 			if ds.writingState.dataDropFileBufferedWriter == nil {
 				// create file
@@ -465,6 +550,9 @@ func (ds *AnySource) HandleExternalTriggers(externalTriggerRowcounts []int64) er
 		}
 	}
 	ds.writingState.externalTriggerNumberObserved += len(externalTriggerRowcounts)
+	if ds.manifest != nil {
+		ds.manifest.ExternalTriggers += len(externalTriggerRowcounts)
+	}
 	if ds.writingState.externalTriggerFileBufferedWriter != nil {
 		_, err := ds.writingState.externalTriggerFileBufferedWriter.Write(getbytes.FromSliceInt64(externalTriggerRowcounts))
 		if err != nil {
@@ -545,12 +633,7 @@ func (ds *AnySource) WriteControl(config *WriteControlConfig) error {
 		ds.writingState.Paused = false
 
 	case strings.HasPrefix(requestStr, "STOP"):
-		for _, dsp := range ds.processors {
-			dsp.DataPublisher.RemoveLJH22()
-			dsp.DataPublisher.RemoveOFF()
-			dsp.DataPublisher.RemoveLJH3()
-		}
-		return ds.writingState.Stop()
+		return ds.writeControlStop("")
 
 	case strings.HasPrefix(requestStr, "START"):
 		return ds.writeControlStart(config)
@@ -564,15 +647,25 @@ func (ds *AnySource) WriteControl(config *WriteControlConfig) error {
 
 // writeControlStart handles the most complex case of WriteControl: starting to write.
 func (ds *AnySource) writeControlStart(config *WriteControlConfig) error {
-	if !(config.WriteLJH22 || config.WriteOFF || config.WriteLJH3) {
-		return fmt.Errorf("WriteLJH22 and WriteOFF and WriteLJH3 all false")
+	if !(config.WriteLJH22 || config.WriteOFF || config.WriteLJH3 || config.WriteRaw) {
+		return fmt.Errorf("WriteLJH22 and WriteOFF and WriteLJH3 and WriteRaw all false")
+	}
+	if rawTypeBits > 16 && (config.WriteLJH22 || config.WriteLJH3) {
+		return fmt.Errorf("LJH files cannot store %d-bit raw data; write OFF or raw files instead", rawTypeBits)
+	}
+	if config.MaxDurationSec < 0 || config.MaxRecords < 0 || config.RecordsPerChannel < 0 {
+		return fmt.Errorf("writing limits must not be negative: %+v", config.WritingLimits)
+	}
+	if err := config.RotationPolicy.validate(); err != nil {
+		return err
 	}
 
 	for _, dsp := range ds.processors {
-		if dsp.DataPublisher.HasLJH22() || dsp.DataPublisher.HasOFF() || dsp.DataPublisher.HasLJH3() {
+		dp := &dsp.DataPublisher
+		if dp.HasLJH22() || dp.HasOFF() || dp.HasLJH3() || dp.HasRawStream() {
 			return fmt.Errorf(
-				"Writing already in progress, stop writing before starting again. Currently: LJH22 %v, OFF %v, LJH3 %v",
-				dsp.DataPublisher.HasLJH22(), dsp.DataPublisher.HasOFF(), dsp.DataPublisher.HasLJH3())
+				"Writing already in progress, stop writing before starting again. Currently: LJH22 %v, OFF %v, LJH3 %v, Raw %v",
+				dp.HasLJH22(), dp.HasOFF(), dp.HasLJH3(), dp.HasRawStream())
 		}
 	}
 	if config.WriteOFF {
@@ -605,7 +698,55 @@ func (ds *AnySource) writeControlStart(config *WriteControlConfig) error {
 		return fmt.Errorf("could not make directory: %s", err.Error())
 	}
 
-	channelsWithOff := 0
+	ds.writingConfig = *config
+	runPattern := filenamePattern
+	if config.RotationPolicy.enabled() {
+		filenamePattern = segmentFilenamePattern(runPattern, 0)
+	}
+	ds.openWriters(config, filenamePattern)
+	if err := ds.writingState.Start(runPattern, path); err != nil {
+		return err
+	}
+	ds.writingState.setLimits(config.WritingLimits)
+	ds.writingState.setRotation(config.RotationPolicy)
+	if err := ds.startManifest(config); err != nil {
+		// Undo the start, so that writing is not left active after an error.
+		ds.manifest = nil
+		ds.writeControlStop("")
+		return err
+	}
+	return nil
+}
+
+// writeControlStop stops writing, closing all files, and completes the run manifest.
+// stopReason says why writing stopped on its own ("" if stopped on request).
+func (ds *AnySource) writeControlStop(stopReason string) error {
+	ws := ds.writingState.ComputeState()
+	if ws.Active {
+		pattern := ws.FilenamePattern
+		if ws.Rotation.enabled() {
+			pattern = segmentFilenamePattern(pattern, ws.Segment)
+		}
+		ds.addManifestFiles(pattern, ws.Segment)
+	}
+	for _, dsp := range ds.processors {
+		dsp.DataPublisher.RemoveLJH22()
+		dsp.DataPublisher.RemoveOFF()
+		dsp.DataPublisher.RemoveLJH3()
+		dsp.DataPublisher.RemoveRawStream()
+	}
+	// Complete the manifest even if closing the run's other files fails (e.g., on a full disk).
+	err := ds.writingState.Stop()
+	ds.writingState.setStopReason(stopReason)
+	if err2 := ds.finishManifest(&ws, stopReason); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// openWriters sets up the writers of each file type requested in config, in every channel,
+// with file names following filenamePattern.
+func (ds *AnySource) openWriters(config *WriteControlConfig, filenamePattern string) {
 	for i, dsp := range ds.processors {
 		timebase := 1.0 / dsp.SampleRate
 		rccode := ds.rowColCodes[i]
@@ -635,14 +776,56 @@ func (ds *AnySource) writeControlStart(config *WriteControlConfig) error {
 				timebase, DastardStartTime, nrows, ncols, ds.nchan, rowNum, colNum, filename,
 				ds.name, ds.chanNames[i], ds.chanNumbers[i], dsp.projectors, dsp.basis,
 				dsp.modelDescription, pixel)
-			channelsWithOff++
 		}
 		if config.WriteLJH3 {
 			filename := fmt.Sprintf(filenamePattern, dsp.Name, "ljh3")
 			dsp.DataPublisher.SetLJH3(i, timebase, nrows, ncols, filename)
 		}
+		if config.WriteRaw {
+			filename := fmt.Sprintf(filenamePattern, dsp.Name, "raw")
+			dsp.DataPublisher.SetRawStream(i, timebase, nrows, ncols, ds.nchan, rowNum, colNum, filename,
+				ds.name, ds.chanNames[i], ds.chanNumbers[i])
+		}
 	}
-	return ds.writingState.Start(filenamePattern, path)
+}
+
+// stopWritingIfLimitReached stops writing when one of its limits has been reached, and
+// tells clients why in a WRITING message.
+func (ds *AnySource) stopWritingIfLimitReached(numberWritten []int) error {
+	writesRecords := make([]bool, len(ds.processors))
+	for i, dsp := range ds.processors {
+		dp := &dsp.DataPublisher
+		writesRecords[i] = dp.HasLJH22() || dp.HasLJH3() || dp.HasOFF()
+	}
+	reason := ds.writingState.limitReached(numberWritten, writesRecords, time.Now())
+	if reason == "" {
+		return nil
+	}
+	return ds.stopWriting(reason)
+}
+
+// stopWritingAfterError stops writing after an error writing the output files, so that a
+// full disk or a lost file system stops the writing but not the data source. The error is
+// logged and reported to clients as the StopReason in a WRITING message. Any further error
+// from stopping (closing files on the same bad disk will often fail) is only logged.
+func (ds *AnySource) stopWritingAfterError(err error) {
+	log.Printf("Error writing files: %v\n", err)
+	ProblemLogger.Printf("Error writing files: %v", err)
+	if err := ds.stopWriting(fmt.Sprintf("write error: %v", err)); err != nil {
+		log.Printf("Error stopping writing after a write error: %v\n", err)
+		ProblemLogger.Printf("Error stopping writing after a write error: %v", err)
+	}
+}
+
+// stopWriting stops writing without a client asking for it, and tells clients why in a
+// WRITING message.
+func (ds *AnySource) stopWriting(reason string) error {
+	log.Printf("Stopping writing: %s\n", reason)
+	if err := ds.writeControlStop(reason); err != nil {
+		return err
+	}
+	clientMessageChan <- ClientUpdate{"WRITING", ds.ComputeWritingState()}
+	return nil
 }
 
 // ComputeWritingState returns a partial copy of the writingState
@@ -650,6 +833,23 @@ func (ds *AnySource) ComputeWritingState() WritingState {
 	return ds.writingState.ComputeState()
 }
 
+// setWritingBasePath sets the directory for writing when WriteControl is given no Path.
+func (ds *AnySource) setWritingBasePath(path string) {
+	ds.writingState.Lock()
+	defer ds.writingState.Unlock()
+	ds.writingState.BasePath = path
+}
+
+// totalNumberWritten returns the number of records written (in all channels together)
+// since writing last started.
+func (ds *AnySource) totalNumberWritten() int {
+	total := 0
+	for _, dsp := range ds.processors {
+		total += dsp.numberWritten
+	}
+	return total
+}
+
 // WritingIsActive returns whether the current writers are active
 func (ds *AnySource) WritingIsActive() bool {
 	return ds.writingState.IsActive()
@@ -664,6 +864,26 @@ func (ds *AnySource) ConfigureProjectorsBases(channelIndex int, projectors *mat.
 	return dsp.SetProjectorsBasis(projectors, basis, modelDescription)
 }
 
+// ConfigureFilters calls SetFilters on ds.processors[channelIndex]
+func (ds *AnySource) ConfigureFilters(channelIndex int, filter *mat.VecDense, arrival *mat.VecDense, description string) error {
+	if channelIndex >= len(ds.processors) || channelIndex < 0 {
+		return fmt.Errorf("channelIndex out of range, channelIndex=%v, len(ds.processors)=%v", channelIndex, len(ds.processors))
+	}
+	dsp := ds.processors[channelIndex]
+	return dsp.SetFilters(filter, arrival, description)
+}
+
+// ChannelsWithFilters returns a list of the ChannelIndices of channels that have optimal filters loaded
+func (ds *AnySource) ChannelsWithFilters() []int {
+	result := make([]int, 0)
+	for channelIndex, dsp := range ds.processors {
+		if dsp.HasFilter() {
+			result = append(result, channelIndex)
+		}
+	}
+	return result
+}
+
 // ChannelsWithProjectors returns a list of the ChannelIndices of channels that have projectors loaded
 func (ds *AnySource) ChannelsWithProjectors() []int {
 	result := make([]int, 0)
@@ -676,6 +896,34 @@ func (ds *AnySource) ChannelsWithProjectors() []int {
 	return result
 }
 
+// processorsForIndices returns the processors for the given channels, checking that each one
+// passes the test has, or all processors that pass it if channelIndices is empty. The
+// error for a channel that fails names it, followed by lacks (e.g., "has no histogram").
+func (ds *AnySource) processorsForIndices(channelIndices []int, has func(*DataStreamProcessor) bool,
+	lacks string) ([]*DataStreamProcessor, error) {
+	dsps := make([]*DataStreamProcessor, 0)
+	if len(channelIndices) == 0 {
+		for _, dsp := range ds.processors {
+			if has(dsp) {
+				dsps = append(dsps, dsp)
+			}
+		}
+		return dsps, nil
+	}
+	for _, channelIndex := range channelIndices {
+		if channelIndex < 0 || channelIndex >= len(ds.processors) {
+			return nil, fmt.Errorf("channelIndex out of range, channelIndex=%v, len(ds.processors)=%v",
+				channelIndex, len(ds.processors))
+		}
+		dsp := ds.processors[channelIndex]
+		if !has(dsp) {
+			return nil, fmt.Errorf("channelIndex %d %s", channelIndex, lacks)
+		}
+		dsps = append(dsps, dsp)
+	}
+	return dsps, nil
+}
+
 // Nchan returns the current number of valid channels in the data source.
 func (ds *AnySource) Nchan() int {
 	return ds.nchan
@@ -760,12 +1008,19 @@ func (ds *AnySource) PrepareRun(Npresamples int, Nsamples int) error {
 
 	ds.abortSelf = make(chan struct{})
 	ds.nextBlock = make(chan *dataBlock)
+	ds.startFaultInjection()
 
 	// Start a TriggerBroker to handle secondary triggering
 	ds.broker = NewTriggerBroker(ds.nchan)
 	go ds.broker.Run()
 
 	ds.numberWrittenTicker = time.NewTicker(1 * time.Second)
+	ds.histogramTicker = time.NewTicker(1 * time.Second)
+	if PubHistogramsChan == nil {
+		if err := configurePubHistogramsSocket(); err != nil {
+			ProblemLogger.Println("could not publish histograms:", err)
+		}
+	}
 	ds.writingState.externalTriggerTicker = time.NewTicker(time.Second * 1)
 	ds.writingState.dataDropTicker = time.NewTicker(time.Second * 10)
 
@@ -775,7 +1030,10 @@ func (ds *AnySource) PrepareRun(Npresamples int, Nsamples int) error {
 
 	// Load last trigger state from config file
 	var fts []FullTriggerState
-	if err := viper.UnmarshalKey("trigger", &fts); err != nil {
+	configLock.Lock()
+	err := viper.UnmarshalKey("trigger", &fts)
+	configLock.Unlock()
+	if err != nil {
 		// could not read trigger state from config file.
 		fts = []FullTriggerState{}
 	}
@@ -860,6 +1118,9 @@ func (ds *AnySource) ChangeTriggerState(state *FullTriggerState) error {
 			return fmt.Errorf("channelIndex %v is >= ds.nchan %v", channelIndex, ds.nchan)
 		}
 	}
+	if err := state.TriggerState.validate(); err != nil {
+		return err
+	}
 	for _, channelIndex := range state.ChannelIndices {
 		dsp := ds.processors[channelIndex]
 		dsp.ConfigureTrigger(state.TriggerState)
@@ -977,7 +1238,7 @@ type DataRecord struct {
 	voltsPerArb  float32 // "volts" or other physical unit per raw unit
 	sampPeriod   float32
 
-	// trigger type?
+	noise bool // record came from the noise trigger
 
 	// Analyzed quantities
 	pretrigMean  float64
@@ -989,4 +1250,6 @@ type DataRecord struct {
 	// Real time Analysis quantities
 	modelCoefs     []float64
 	residualStdDev float64
+	filtValue      float64 // optimally filtered pulse height (NaN if no filter)
+	filtPhase      float64 // arrival-time phase estimate in samples (NaN if no arrival filter)
 }
@@ -74,7 +74,7 @@ func TestWritingFiles(t *testing.T) {
 	ds.PrepareChannels()
 	ds.PrepareRun(256, 1024)
 	defer ds.Stop()
-	config := &WriteControlConfig{Request: "Pause", Path: tmp, WriteLJH22: true}
+	config := &WriteControlConfig{Request: "Pause", Path: tmp, WriteLJH22: testWritesLJH}
 
 	// set projectors so that we can use WriterOFF = true
 	config.WriteOFF = true
@@ -90,13 +90,13 @@ func TestWritingFiles(t *testing.T) {
 		t.Error(err1)
 	}
 	config.Request = "Start"
-	config.WriteLJH22 = true
+	config.WriteLJH22 = testWritesLJH
 	config.WriteOFF = true
-	config.WriteLJH3 = true
+	config.WriteLJH3 = testWritesLJH
 	if err := ds.WriteControl(config); err != nil {
 		t.Errorf("%v\n%v", err, config.Request)
 	}
-	if !ds.processors[0].DataPublisher.HasLJH22() {
+	if ds.processors[0].DataPublisher.HasLJH22() != testWritesLJH {
 		t.Error("WriteLJH22 did not result in HasLJH22")
 	}
 	if !ds.processors[0].DataPublisher.HasOFF() {
@@ -105,7 +105,7 @@ func TestWritingFiles(t *testing.T) {
 	if ds.processors[1].DataPublisher.HasOFF() {
 		t.Error("WriteOFF resulting in HasOFF for a channel without projectors")
 	}
-	if !ds.processors[0].DataPublisher.HasLJH3() {
+	if ds.processors[0].DataPublisher.HasLJH3() != testWritesLJH {
 		t.Error("WriteLJH3 did not result in HasLJH3")
 	}
 	config.Request = "PAUSE"
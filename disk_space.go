@@ -0,0 +1,187 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DiskSpaceGuard sets the free-space thresholds for the disk that data are written to.
+// A threshold of zero is never crossed.
+type DiskSpaceGuard struct {
+	WarningBytes   uint64 // warn clients when free space falls below this
+	CriticalBytes  uint64 // pause or stop writing when free space falls below this
+	CriticalAction string // "Pause" or "Stop": what to do at the critical threshold
+}
+
+// defaultDiskSpaceGuard is used until a client calls ConfigureDiskSpaceGuard.
+var defaultDiskSpaceGuard = DiskSpaceGuard{
+	WarningBytes:   10 << 30,
+	CriticalBytes:  1 << 30,
+	CriticalAction: "Stop",
+}
+
+// diskSpaceCheckPeriod is how often the free space is checked while writing.
+const diskSpaceCheckPeriod = 5 * time.Second
+
+// DiskSpaceStatus is sent to clients as a DISKSPACE status message when the free space on
+// the writing disk crosses a threshold, and whenever the guard pauses or stops writing.
+type DiskSpaceStatus struct {
+	Path       string // the directory being written to
+	FreeBytes  uint64 // space available to dastard
+	TotalBytes uint64
+	Level      string // "OK", "Warning", or "Critical"
+	Action     string // "Paused" or "Stopped" if the guard just acted, else ""
+}
+
+// diskSpaceMonitor is the bookkeeping for SourceControl's disk space guard.
+type diskSpaceMonitor struct {
+	sync.Mutex
+	guard DiskSpaceGuard
+	level string // level at the last check, or "" if not writing then
+}
+
+// validate checks that the guard makes sense.
+func (g *DiskSpaceGuard) validate() error {
+	switch strings.ToUpper(g.CriticalAction) {
+	case "PAUSE", "STOP":
+	default:
+		return fmt.Errorf("DiskSpaceGuard CriticalAction=%q, must be Pause or Stop", g.CriticalAction)
+	}
+	if g.WarningBytes > 0 && g.WarningBytes < g.CriticalBytes {
+		return fmt.Errorf("DiskSpaceGuard WarningBytes %d must not be less than CriticalBytes %d",
+			g.WarningBytes, g.CriticalBytes)
+	}
+	return nil
+}
+
+// level returns "OK", "Warning", or "Critical" for the given free space.
+func (g *DiskSpaceGuard) level(free uint64) string {
+	switch {
+	case free < g.CriticalBytes:
+		return "Critical"
+	case free < g.WarningBytes:
+		return "Warning"
+	}
+	return "OK"
+}
+
+// diskSpace returns the free (to unprivileged users) and total bytes on the file system
+// holding path. If path doesn't exist yet, its nearest existing ancestor is used.
+func diskSpace(path string) (free, total uint64, err error) {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("cannot find free space on %q: %v", path, err)
+	}
+	bsize := uint64(stat.Bsize)
+	return uint64(stat.Bavail) * bsize, uint64(stat.Blocks) * bsize, nil
+}
+
+// ConfigureDiskSpaceGuard sets the free-space thresholds for writing.
+func (s *SourceControl) ConfigureDiskSpaceGuard(guard *DiskSpaceGuard, reply *bool) error {
+	*reply = false
+	if err := guard.validate(); err != nil {
+		return err
+	}
+	s.diskSpace.Lock()
+	s.diskSpace.guard = *guard
+	s.diskSpace.level = "" // so the next check reports the level under the new thresholds
+	s.diskSpace.Unlock()
+	*reply = true
+	return nil
+}
+
+// checkDiskSpaceBeforeWriting returns an error if the free space at path is already below
+// the critical threshold, so that writing is not started (or unpaused) only to be stopped.
+func (s *SourceControl) checkDiskSpaceBeforeWriting(path string) error {
+	free, _, err := diskSpace(path)
+	if err != nil {
+		return err
+	}
+	s.diskSpace.Lock()
+	guard := s.diskSpace.guard
+	s.diskSpace.Unlock()
+	if guard.level(free) == "Critical" {
+		return fmt.Errorf("only %d bytes free on %q, below the critical threshold %d",
+			free, path, guard.CriticalBytes)
+	}
+	return nil
+}
+
+// checkDiskSpace checks the free space on the disk being written to. A DISKSPACE message
+// goes to clients when the level changes. At the critical level, writing is paused or
+// stopped (either way, all files are flushed). Call it through s.serially, as it uses
+// the active source.
+func (s *SourceControl) checkDiskSpace() {
+	if !s.isSourceActive || !s.ActiveSource.WritingIsActive() {
+		s.diskSpace.Lock()
+		s.diskSpace.level = ""
+		s.diskSpace.Unlock()
+		return
+	}
+	ws := s.ActiveSource.ComputeWritingState()
+	status := DiskSpaceStatus{Path: filepath.Dir(ws.FilenamePattern)}
+	var err error
+	status.FreeBytes, status.TotalBytes, err = diskSpace(status.Path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.diskSpace.Lock()
+	guard := s.diskSpace.guard
+	previous := s.diskSpace.level
+	status.Level = guard.level(status.FreeBytes)
+	s.diskSpace.level = status.Level
+	s.diskSpace.Unlock()
+
+	if status.Level == "Critical" {
+		reason := fmt.Sprintf("free disk space %d bytes is below the critical threshold %d",
+			status.FreeBytes, guard.CriticalBytes)
+		if strings.ToUpper(guard.CriticalAction) == "STOP" {
+			f := func() {
+				err := s.ActiveSource.stopWriting(reason)
+				if err == nil {
+					s.lastWriteConfig = nil
+				}
+				s.queuedResults <- err
+			}
+			err = s.runLaterIfActive(f)
+			status.Action = "Stopped"
+		} else if !ws.Paused {
+			var okay bool
+			err = s.WriteControl(&WriteControlConfig{Request: "Pause"}, &okay)
+			status.Action = "Paused"
+		}
+		if err != nil {
+			log.Printf("Disk space guard could not %s writing: %v\n", guard.CriticalAction, err)
+			status.Action = ""
+		} else if status.Action != "" {
+			log.Printf("Disk space guard: %s writing because %s\n", status.Action, reason)
+			ProblemLogger.Printf("Disk space guard: %s writing because %s", status.Action, reason)
+		}
+	}
+	if status.Level != previous || status.Action != "" {
+		if status.Level == "Warning" {
+			log.Printf("Warning: only %d bytes free on %q\n", status.FreeBytes, status.Path)
+		}
+		if s.clientUpdates != nil {
+			s.clientUpdates <- ClientUpdate{"DISKSPACE", status}
+		}
+	}
+}
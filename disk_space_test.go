@@ -0,0 +1,197 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskSpaceGuard(t *testing.T) {
+	free, total, err := diskSpace(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("diskSpace returns free=%d, total=%d", free, total)
+	}
+	// A path that doesn't exist yet is on the disk of its nearest existing ancestor.
+	if _, _, err := diskSpace(filepath.Join(os.TempDir(), "no", "such", "dir")); err != nil {
+		t.Error(err)
+	}
+
+	bad := []DiskSpaceGuard{
+		{CriticalAction: "Panic"},
+		{WarningBytes: 10, CriticalBytes: 100, CriticalAction: "Stop"},
+	}
+	for _, g := range bad {
+		if err := g.validate(); err == nil {
+			t.Errorf("DiskSpaceGuard %+v should fail validation", g)
+		}
+	}
+	g := DiskSpaceGuard{WarningBytes: 1000, CriticalBytes: 100, CriticalAction: "pause"}
+	if err := g.validate(); err != nil {
+		t.Error(err)
+	}
+	levels := map[uint64]string{0: "Critical", 99: "Critical", 100: "Warning", 999: "Warning", 1000: "OK"}
+	for free, want := range levels {
+		if got := g.level(free); got != want {
+			t.Errorf("DiskSpaceGuard.level(%d)=%q, want %q", free, got, want)
+		}
+	}
+}
+
+func TestDiskSpaceChecks(t *testing.T) {
+	s := NewSourceControl()
+	s.mapServer = newMapServer()
+	updates := make(chan ClientUpdate)
+	s.clientUpdates = updates
+	s.mapServer.clientUpdates = updates
+	statuses := make(chan DiskSpaceStatus, 100)
+	go func() {
+		for u := range updates {
+			if u.tag == "DISKSPACE" {
+				statuses <- u.state.(DiskSpaceStatus)
+			}
+		}
+	}()
+	go func() {
+		for range s.heartbeats {
+		}
+	}()
+	s.status.Npresamp = 50
+	s.status.Nsamples = 100
+	var okay bool
+	if err := s.ConfigureTriangleSource(&TriangleSourceConfig{Nchan: 2, SampleRate: 10000, Min: 100, Max: 200},
+		&okay); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "dastard_disk_space_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := "TriangleSource"
+	if err := s.Start(&name, &okay); err != nil {
+		t.Fatal(err)
+	}
+	dummy := ""
+	defer s.Stop(&dummy, &okay)
+	nextStatus := func() DiskSpaceStatus {
+		select {
+		case status := <-statuses:
+			return status
+		case <-time.After(5 * time.Second):
+			t.Fatal("no DISKSPACE message was sent")
+		}
+		return DiskSpaceStatus{}
+	}
+
+	// Not writing: no checks.
+	s.checkDiskSpace()
+	select {
+	case status := <-statuses:
+		t.Errorf("DISKSPACE message %+v sent when not writing", status)
+	default:
+	}
+
+	start := testWriteConfig("Start", dir)
+	if err := s.WriteControl(start, &okay); err != nil {
+		t.Fatal(err)
+	}
+	guards := []DiskSpaceGuard{
+		{WarningBytes: 0, CriticalBytes: 0, CriticalAction: "Stop"},
+		{WarningBytes: math.MaxUint64, CriticalBytes: 0, CriticalAction: "Stop"},
+	}
+	for _, g := range guards {
+		if err := s.ConfigureDiskSpaceGuard(&g, &okay); err != nil {
+			t.Fatal(err)
+		}
+		s.checkDiskSpace()
+		status := nextStatus()
+		if want := g.level(status.FreeBytes); status.Level != want || status.Action != "" {
+			t.Errorf("DISKSPACE message %+v, want Level %s and no Action", status, want)
+		}
+		// Repeated checks at the same level send no message.
+		s.checkDiskSpace()
+		select {
+		case status := <-statuses:
+			t.Errorf("DISKSPACE message %+v sent without a change of level", status)
+		default:
+		}
+	}
+
+	// Critical with Pause: writing is paused, and can't be unpaused.
+	g := DiskSpaceGuard{WarningBytes: math.MaxUint64, CriticalBytes: math.MaxUint64, CriticalAction: "Pause"}
+	if err := s.ConfigureDiskSpaceGuard(&g, &okay); err != nil {
+		t.Fatal(err)
+	}
+	s.checkDiskSpace()
+	if status := nextStatus(); status.Level != "Critical" || status.Action != "Paused" {
+		t.Errorf("DISKSPACE message %+v, want Critical and Paused", status)
+	}
+	ws := s.ActiveSource.ComputeWritingState()
+	if !ws.Active || !ws.Paused {
+		t.Errorf("writing state Active=%v, Paused=%v, want active and paused", ws.Active, ws.Paused)
+	}
+	if err := s.WriteControl(&WriteControlConfig{Request: "Unpause"}, &okay); err == nil {
+		t.Error("WriteControl Unpause should fail when the disk space is critical")
+	}
+
+	// Critical with Stop: writing is stopped, and can't be started.
+	g.CriticalAction = "Stop"
+	if err := s.ConfigureDiskSpaceGuard(&g, &okay); err != nil {
+		t.Fatal(err)
+	}
+	s.checkDiskSpace()
+	if status := nextStatus(); status.Level != "Critical" || status.Action != "Stopped" {
+		t.Errorf("DISKSPACE message %+v, want Critical and Stopped", status)
+	}
+	ws = s.ActiveSource.ComputeWritingState()
+	if ws.Active || !strings.Contains(ws.StopReason, "disk space") {
+		t.Errorf("writing state Active=%v, StopReason=%q, want inactive with a StopReason about disk space", ws.Active, ws.StopReason)
+	}
+	if err := s.WriteControl(start, &okay); err == nil {
+		t.Error("WriteControl Start should fail when the disk space is critical")
+	}
+	g = defaultDiskSpaceGuard
+	if err := s.ConfigureDiskSpaceGuard(&g, &okay); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteErrorStopsWriting(t *testing.T) {
+	ds := AnySource{nchan: 1}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	if err := ds.PrepareRun(256, 1024); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Stop()
+	dir, err := ioutil.TempDir("", "dastard_write_error_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ds.WriteControl(testWriteConfig("Start", dir)); err != nil {
+		t.Fatal(err)
+	}
+	ds.stopWritingAfterError(os.ErrPermission)
+	ws := ds.ComputeWritingState()
+	if ws.Active || !strings.HasPrefix(ws.StopReason, "write error") {
+		t.Errorf("writing state Active=%v, StopReason=%q, want inactive with a write error StopReason", ws.Active, ws.StopReason)
+	}
+
+	// Writing must stop even if the directory is gone, so the run manifest can't be written.
+	if err := ds.WriteControl(testWriteConfig("Start", dir)); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	ds.stopWritingAfterError(os.ErrNotExist)
+	if ws := ds.ComputeWritingState(); ws.Active {
+		t.Error("writing is still active after stopWritingAfterError on a removed directory")
+	}
+}
@@ -0,0 +1,186 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// FaultInjectionConfig describes faults to inject into the data from the software sources
+// (simulated and replay), to test how Dastard handles the ways that hardware misbehaves.
+// Each fault with an xxxEvery field happens in every Nth block of data (0 means never).
+type FaultInjectionConfig struct {
+	DropEvery     int     // drop frames, announcing it in DataSegment.droppedFrames
+	DropFrames    int     // how many frames each drop loses
+	JumpEvery     int     // jump the frame number without announcing a drop
+	JumpFrames    int     // size of each jump (may be negative)
+	StallEvery    int     // stop delivering data for a while before the block
+	StallTimeSec  float64 // length of each stall, in seconds
+	LateEvery     int     // stamp the block as read later than its frame numbers imply
+	LateTimeSec   float64 // how late each late block is, in seconds
+	BurstEvery    int     // add a burst of external triggers to the block
+	BurstTriggers int     // number of external triggers in each burst
+	ErrorAfter    int     // replace the block after this many with an error (0 means never)
+}
+
+// validate checks that the configuration makes sense.
+func (fc *FaultInjectionConfig) validate() error {
+	if fc.DropEvery < 0 || fc.JumpEvery < 0 || fc.StallEvery < 0 || fc.LateEvery < 0 ||
+		fc.BurstEvery < 0 || fc.ErrorAfter < 0 {
+		return fmt.Errorf("FaultInjectionConfig cannot have negative block counts: %+v", *fc)
+	}
+	if (fc.DropEvery > 0 && fc.DropFrames <= 0) || (fc.JumpEvery > 0 && fc.JumpFrames == 0) ||
+		(fc.StallEvery > 0 && fc.StallTimeSec <= 0) || (fc.LateEvery > 0 && fc.LateTimeSec <= 0) ||
+		(fc.BurstEvery > 0 && fc.BurstTriggers <= 0) {
+		return fmt.Errorf("FaultInjectionConfig has a fault with no size: %+v", *fc)
+	}
+	return nil
+}
+
+// active returns whether any fault is configured.
+func (fc *FaultInjectionConfig) active() bool {
+	return fc.DropEvery > 0 || fc.JumpEvery > 0 || fc.StallEvery > 0 || fc.LateEvery > 0 ||
+		fc.BurstEvery > 0 || fc.ErrorAfter > 0
+}
+
+// faultInjector applies a FaultInjectionConfig to the blocks of one run of a source.
+type faultInjector struct {
+	config      FaultInjectionConfig
+	nblocks     int           // blocks seen so far
+	frameOffset FrameIndex    // total frames dropped or jumped so far
+	timeOffset  time.Duration // time of the frames dropped so far
+}
+
+// every returns whether the current block is one of every n blocks.
+func (fi *faultInjector) every(n int) bool {
+	return n > 0 && fi.nblocks%n == 0
+}
+
+// inject applies the configured faults to block, and returns how long to stall before
+// delivering it. The block is replaced by an error block if the error is due.
+func (fi *faultInjector) inject(block *dataBlock) time.Duration {
+	fi.nblocks++
+	cfg := &fi.config
+	if cfg.ErrorAfter > 0 && fi.nblocks > cfg.ErrorAfter {
+		*block = dataBlock{err: fmt.Errorf("fault injection: error after %d blocks", cfg.ErrorAfter)}
+		return 0
+	}
+	if len(block.segments) == 0 {
+		return 0
+	}
+	droppedFrames := 0
+	if fi.every(cfg.DropEvery) {
+		droppedFrames = cfg.DropFrames
+		fi.frameOffset += FrameIndex(cfg.DropFrames)
+		fi.timeOffset += time.Duration(cfg.DropFrames) * block.segments[0].framePeriod
+	}
+	if fi.every(cfg.JumpEvery) {
+		fi.frameOffset += FrameIndex(cfg.JumpFrames)
+	}
+	lateness := time.Duration(0)
+	if fi.every(cfg.LateEvery) {
+		lateness = time.Duration(float64(time.Second) * cfg.LateTimeSec)
+	}
+	for i := range block.segments {
+		seg := &block.segments[i]
+		seg.firstFramenum += fi.frameOffset
+		seg.firstTime = seg.firstTime.Add(fi.timeOffset + lateness)
+		if droppedFrames > 0 {
+			seg.droppedFrames = droppedFrames
+		}
+	}
+	if fi.every(cfg.BurstEvery) {
+		// Spread the burst evenly over the block. Software sources have 1 row per frame.
+		seg := &block.segments[0]
+		nframes := int64(len(seg.rawData) * seg.framesPerSample)
+		for i := 0; i < cfg.BurstTriggers; i++ {
+			rowcount := int64(seg.firstFramenum) + int64(i)*nframes/int64(cfg.BurstTriggers)
+			block.externalTriggerRowcounts = append(block.externalTriggerRowcounts, rowcount)
+		}
+	}
+	if fi.every(cfg.StallEvery) {
+		return time.Duration(float64(time.Second) * cfg.StallTimeSec)
+	}
+	return 0
+}
+
+// configureFaults sets the faults to inject into future runs of the source (nil for none).
+func (ds *AnySource) configureFaults(config *FaultInjectionConfig) error {
+	ds.sourceStateLock.Lock()
+	defer ds.sourceStateLock.Unlock()
+	if ds.sourceState != Inactive {
+		return fmt.Errorf("cannot configure fault injection for source %s if it's not Inactive", ds.name)
+	}
+	ds.faults = config
+	return nil
+}
+
+// startFaultInjection puts a fault injector between the source's data production loop and
+// the core loop, if faults are configured. Call it after ds.nextBlock is made.
+func (ds *AnySource) startFaultInjection() {
+	ds.faultedBlock = nil
+	if ds.faults == nil || !ds.faults.active() {
+		return
+	}
+	fi := &faultInjector{config: *ds.faults}
+	in := ds.nextBlock
+	out := make(chan *dataBlock)
+	abort := ds.abortSelf
+	ds.faultedBlock = out
+	log.Printf("Injecting faults into source %s: %+v\n", ds.name, fi.config)
+	go func() {
+		defer close(out)
+		for block := range in {
+			if block.err == nil {
+				if stall := fi.inject(block); stall > 0 {
+					select {
+					case <-time.After(stall):
+					case <-abort:
+					}
+				}
+			}
+			if block.err != nil {
+				// The core loop stops on an error, so stop the source as a real one would,
+				// and wait until its production loop ends, so that it can be restarted.
+				ds.sourceStateLock.Lock()
+				closeIfOpen(abort)
+				ds.sourceStateLock.Unlock()
+				for range in {
+				}
+				out <- block
+				return
+			}
+			out <- block
+		}
+	}()
+}
+
+// ConfigureFaultInjection sets the faults to inject into the data of the software sources
+// (simulated and replay) when they next start. A configuration with no faults turns
+// fault injection off.
+func (s *SourceControl) ConfigureFaultInjection(config *FaultInjectionConfig, reply *bool) error {
+	*reply = false
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if s.isSourceActive {
+		return fmt.Errorf("cannot configure fault injection while a source is active")
+	}
+	var faults *FaultInjectionConfig
+	if config.active() {
+		c := *config
+		faults = &c
+	}
+	sources := []*AnySource{&s.triangle.AnySource, &s.simPulses.AnySource, &s.tesSim.AnySource,
+		&s.ljhReplay.AnySource, &s.rawReplay.AnySource}
+	for _, ds := range sources {
+		if err := ds.configureFaults(faults); err != nil {
+			return err
+		}
+	}
+	if s.clientUpdates != nil {
+		s.clientUpdates <- ClientUpdate{"FAULTINJECTION", config}
+	}
+	*reply = true
+	return nil
+}
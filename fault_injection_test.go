@@ -0,0 +1,172 @@
+package dastard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	bad := []FaultInjectionConfig{
+		{DropEvery: -1},
+		{DropEvery: 2},
+		{JumpEvery: 2},
+		{StallEvery: 2},
+		{LateEvery: 2, LateTimeSec: -1},
+		{BurstEvery: 2},
+	}
+	for _, fc := range bad {
+		if err := fc.validate(); err == nil {
+			t.Errorf("FaultInjectionConfig %+v passes validation, want error", fc)
+		}
+	}
+	if (&FaultInjectionConfig{}).active() {
+		t.Error("empty FaultInjectionConfig is active, want inactive")
+	}
+
+	fc := FaultInjectionConfig{DropEvery: 2, DropFrames: 10, JumpEvery: 3, JumpFrames: 1000,
+		StallEvery: 2, StallTimeSec: 0.005, LateEvery: 4, LateTimeSec: 1,
+		BurstEvery: 5, BurstTriggers: 4, ErrorAfter: 6}
+	if err := fc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	fi := &faultInjector{config: fc}
+	const nframes = 100
+	t0 := time.Now()
+	wantOffset := []FrameIndex{0, 10, 1010, 1020, 1020, 2030}
+	for i := 0; i < 6; i++ {
+		block := &dataBlock{segments: make([]DataSegment, 2)}
+		firstTime := t0.Add(time.Duration(i*nframes) * time.Millisecond)
+		for j := range block.segments {
+			block.segments[j] = DataSegment{rawData: make([]RawType, nframes), framesPerSample: 1,
+				framePeriod: time.Millisecond, firstFramenum: FrameIndex(i * nframes), firstTime: firstTime}
+		}
+		stall := fi.inject(block)
+		n := i + 1
+		if block.err != nil {
+			t.Fatalf("block %d has error %v", n, block.err)
+		}
+		if (n%2 == 0) != (stall == 5*time.Millisecond) {
+			t.Errorf("block %d stalls %v", n, stall)
+		}
+		for j, seg := range block.segments {
+			if want := FrameIndex(i*nframes) + wantOffset[i]; seg.firstFramenum != want {
+				t.Errorf("block %d segment %d firstFramenum=%d, want %d", n, j, seg.firstFramenum, want)
+			}
+			if (n%2 == 0) != (seg.droppedFrames == fc.DropFrames) {
+				t.Errorf("block %d segment %d droppedFrames=%d", n, j, seg.droppedFrames)
+			}
+			wantTime := firstTime.Add(time.Duration(n/2*fc.DropFrames) * time.Millisecond)
+			if n%4 == 0 {
+				wantTime = wantTime.Add(time.Second)
+			}
+			if !seg.firstTime.Equal(wantTime) {
+				t.Errorf("block %d segment %d firstTime is %v after the expected time", n, j,
+					seg.firstTime.Sub(wantTime))
+			}
+		}
+		if n%5 == 0 {
+			first := int64(block.segments[0].firstFramenum)
+			want := []int64{first, first + 25, first + 50, first + 75}
+			if len(block.externalTriggerRowcounts) != len(want) {
+				t.Errorf("block %d has external triggers %v, want %v", n, block.externalTriggerRowcounts, want)
+			} else {
+				for k := range want {
+					if block.externalTriggerRowcounts[k] != want[k] {
+						t.Errorf("block %d has external triggers %v, want %v", n, block.externalTriggerRowcounts, want)
+						break
+					}
+				}
+			}
+		} else if len(block.externalTriggerRowcounts) > 0 {
+			t.Errorf("block %d has external triggers %v, want none", n, block.externalTriggerRowcounts)
+		}
+	}
+	block := &dataBlock{segments: make([]DataSegment, 2)}
+	fi.inject(block)
+	if block.err == nil || len(block.segments) > 0 {
+		t.Errorf("block 7 has err=%v and %d segments, want an error and no data", block.err, len(block.segments))
+	}
+}
+
+func TestFaultInjectionSource(t *testing.T) {
+	ts := NewTriangleSource()
+	if err := ts.Configure(&TriangleSourceConfig{Nchan: 2, SampleRate: 10000, Min: 100, Max: 200}); err != nil {
+		t.Fatal(err)
+	}
+	fc := FaultInjectionConfig{DropEvery: 2, DropFrames: 10, BurstEvery: 1, BurstTriggers: 3, ErrorAfter: 5}
+	if err := ts.configureFaults(&fc); err != nil {
+		t.Fatal(err)
+	}
+	ds := DataSource(ts)
+	for run := 0; run < 2; run++ {
+		if err := Start(ds, nil, 50, 100); err != nil {
+			t.Fatalf("run %d could not start: %v", run, err)
+		}
+		if run == 0 {
+			if err := ts.configureFaults(nil); err == nil {
+				t.Error("configureFaults succeeds on an active source, want error")
+			}
+		}
+		done := make(chan struct{})
+		go func() {
+			ts.RunDoneWait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d did not stop after the injected error", run)
+		}
+		if ds.RunError() == nil {
+			t.Errorf("run %d RunError() is nil, want the injected error", run)
+		}
+	}
+	// Two runs of 5 good blocks: 2 drops and 15 external triggers each.
+	if ts.writingState.dataDropsObserved != 4 || ts.writingState.externalTriggerNumberObserved != 30 {
+		t.Errorf("saw %d data drops and %d external triggers, want 4 and 30",
+			ts.writingState.dataDropsObserved, ts.writingState.externalTriggerNumberObserved)
+	}
+
+	// With fault injection off, the source runs until stopped.
+	if err := ts.configureFaults(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(ds, nil, 50, 100); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !ds.Running() {
+		t.Error("source without faults stopped on its own")
+	}
+	ds.Stop()
+	if ds.RunError() != nil {
+		t.Errorf("source without faults has RunError %v", ds.RunError())
+	}
+}
+
+func TestConfigureFaultInjection(t *testing.T) {
+	s := NewSourceControl()
+	var okay bool
+	if err := s.ConfigureFaultInjection(&FaultInjectionConfig{DropEvery: 3}, &okay); err == nil || okay {
+		t.Error("ConfigureFaultInjection accepts a drop of no frames, want error")
+	}
+	fc := FaultInjectionConfig{JumpEvery: 3, JumpFrames: -50}
+	if err := s.ConfigureFaultInjection(&fc, &okay); err != nil || !okay {
+		t.Fatalf("ConfigureFaultInjection returns okay=%v, err=%v", okay, err)
+	}
+	for _, ds := range []*AnySource{&s.triangle.AnySource, &s.simPulses.AnySource, &s.tesSim.AnySource,
+		&s.ljhReplay.AnySource, &s.rawReplay.AnySource} {
+		if ds.faults == nil || *ds.faults != fc {
+			t.Errorf("source %s has faults %v, want %v", ds.name, ds.faults, fc)
+		}
+	}
+	if s.lancero.faults != nil {
+		t.Error("hardware source has faults configured")
+	}
+	if err := s.ConfigureFaultInjection(&FaultInjectionConfig{}, &okay); err != nil || !okay {
+		t.Fatalf("ConfigureFaultInjection returns okay=%v, err=%v", okay, err)
+	}
+	if s.triangle.faults != nil {
+		t.Errorf("source has faults %v after they were turned off", s.triangle.faults)
+	}
+}
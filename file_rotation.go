@@ -0,0 +1,154 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// RotationPolicy says when to close all output files and continue writing in a new set
+// (a new "segment"). Zero means no limit; if all are zero, files are never rotated.
+type RotationPolicy struct {
+	RotateBytes       int64   // rotate when any file reaches this size
+	RotateRecords     int     // rotate when any channel has written this many records to its files
+	RotateIntervalSec float64 // rotate after writing to the same files this many seconds
+}
+
+// rotationCheckPeriod is how often the rotation policy is checked.
+const rotationCheckPeriod = time.Second
+
+// enabled tells whether the policy ever rotates files.
+func (rp *RotationPolicy) enabled() bool {
+	return rp.RotateBytes > 0 || rp.RotateRecords > 0 || rp.RotateIntervalSec > 0
+}
+
+// validate checks that the policy makes sense.
+func (rp *RotationPolicy) validate() error {
+	if rp.RotateBytes < 0 || rp.RotateRecords < 0 || rp.RotateIntervalSec < 0 {
+		return fmt.Errorf("file rotation policy must not be negative: %+v", *rp)
+	}
+	return nil
+}
+
+// segmentFilenamePattern inserts a segment index into a filename pattern from makeDirectory,
+// e.g. basepath/20060102/0000/20060102_run0000_%s.%s -> basepath/20060102/0000/20060102_run0000_seg0002_%s.%s
+func segmentFilenamePattern(pattern string, segment int) string {
+	return fmt.Sprintf("%s_seg%4.4d_%%s.%%s", strings.TrimSuffix(pattern, "_%s.%s"), segment)
+}
+
+// setRotation sets the file rotation policy.
+func (ws *WritingState) setRotation(policy RotationPolicy) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.Rotation = policy
+}
+
+// nextSegment starts a new segment, returning its index and filename pattern.
+func (ws *WritingState) nextSegment(now time.Time) (int, string) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.Segment++
+	ws.SegmentStarted = now
+	return ws.Segment, segmentFilenamePattern(ws.FilenamePattern, ws.Segment)
+}
+
+// rotationDue returns why the output files should be rotated now, or "" if they should not.
+func (ds *AnySource) rotationDue(now time.Time) string {
+	ws := ds.writingState.ComputeState()
+	policy := ws.Rotation
+	if !ws.Active || !policy.enabled() {
+		return ""
+	}
+	if policy.RotateIntervalSec > 0 && now.Sub(ws.SegmentStarted).Seconds() >= policy.RotateIntervalSec {
+		return fmt.Sprintf("RotateIntervalSec %v reached", policy.RotateIntervalSec)
+	}
+	if policy.RotateRecords > 0 {
+		for _, dsp := range ds.processors {
+			dp := &dsp.DataPublisher
+			n := 0
+			if dp.HasLJH22() && dp.LJH22.RecordsWritten > n {
+				n = dp.LJH22.RecordsWritten
+			}
+			if dp.HasLJH3() && dp.LJH3.RecordsWritten > n {
+				n = dp.LJH3.RecordsWritten
+			}
+			if dp.HasOFF() && dp.OFF.RecordsWritten() > n {
+				n = dp.OFF.RecordsWritten()
+			}
+			if n >= policy.RotateRecords {
+				return fmt.Sprintf("RotateRecords %d reached in channel %s", policy.RotateRecords, dsp.Name)
+			}
+		}
+	}
+	if policy.RotateBytes > 0 {
+		pattern := segmentFilenamePattern(ws.FilenamePattern, ws.Segment)
+		for _, dsp := range ds.processors {
+			dp := &dsp.DataPublisher
+			for _, ext := range dp.fileExtensions() {
+				info, err := os.Stat(fmt.Sprintf(pattern, dsp.Name, ext))
+				if err == nil && info.Size() >= policy.RotateBytes {
+					return fmt.Sprintf("RotateBytes %d reached by %s", policy.RotateBytes, info.Name())
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// fileExtensions returns the extensions of the files that dp writes.
+func (dp *DataPublisher) fileExtensions() []string {
+	var exts []string
+	if dp.HasLJH22() {
+		exts = append(exts, "ljh")
+	}
+	if dp.HasLJH3() {
+		exts = append(exts, "ljh3")
+	}
+	if dp.HasOFF() {
+		exts = append(exts, "off")
+	}
+	if dp.HasRawStream() {
+		exts = append(exts, "raw")
+	}
+	return exts
+}
+
+// rotateFilesIfDue checks (at most once per rotationCheckPeriod) whether the rotation policy
+// calls for new output files, and if so, rotates them.
+func (ds *AnySource) rotateFilesIfDue(now time.Time) {
+	if now.Before(ds.nextRotationCheck) {
+		return
+	}
+	ds.nextRotationCheck = now.Add(rotationCheckPeriod)
+	if reason := ds.rotationDue(now); reason != "" {
+		ds.rotateFiles(now, reason)
+	}
+}
+
+// rotateFiles closes all output files and opens a new set for the next segment. The count
+// of records written and the paused state carry over, and the run's experiment-state,
+// external-trigger, and data-drop files continue unchanged, so they cover all segments.
+func (ds *AnySource) rotateFiles(now time.Time, reason string) {
+	ws := ds.writingState.ComputeState()
+	ds.addManifestFiles(segmentFilenamePattern(ws.FilenamePattern, ws.Segment), ws.Segment)
+	segment, pattern := ds.writingState.nextSegment(now)
+	log.Printf("Rotating output files to segment %d: %s\n", segment, reason)
+	numberWritten := make([]int, len(ds.processors))
+	paused := make([]bool, len(ds.processors))
+	for i, dsp := range ds.processors {
+		dp := &dsp.DataPublisher
+		numberWritten[i], paused[i] = dp.numberWritten, dp.WritingPaused
+		dp.RemoveLJH22()
+		dp.RemoveOFF()
+		dp.RemoveLJH3()
+		dp.RemoveRawStream()
+	}
+	ds.openWriters(&ds.writingConfig, pattern)
+	for i, dsp := range ds.processors {
+		dsp.DataPublisher.numberWritten = numberWritten[i]
+		dsp.DataPublisher.WritingPaused = paused[i]
+	}
+	clientMessageChan <- ClientUpdate{"WRITING", ds.ComputeWritingState()}
+}
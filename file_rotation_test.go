@@ -0,0 +1,115 @@
+package dastard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSegmentFilenamePattern(t *testing.T) {
+	pattern := "/data/20200102/0003/20200102_run0003_%s.%s"
+	expect := "/data/20200102/0003/20200102_run0003_seg0012_%s.%s"
+	if got := segmentFilenamePattern(pattern, 12); got != expect {
+		t.Errorf("segmentFilenamePattern(%q, 12) = %q, want %q", pattern, got, expect)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastardTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 2, sampleRate: 1000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config, ext := testRecordWriteConfig(t, &ds, tmp)
+	config.RotateRecords = -1
+	if err := ds.WriteControl(config); err == nil {
+		t.Errorf("WriteControl Start with negative RotateRecords should fail")
+	}
+	config.RotationPolicy = RotationPolicy{RotateRecords: 5, RotateBytes: 1000, RotateIntervalSec: 3600}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl Start failed: %v", err)
+	}
+	ws := ds.ComputeWritingState()
+	dp0 := &ds.processors[0].DataPublisher
+	filename0 := fmt.Sprintf(segmentFilenamePattern(ws.FilenamePattern, ws.Segment), ds.processors[0].Name, ext)
+	if !strings.Contains(filename0, "_seg0000_") {
+		t.Errorf("with rotation, first file name %q lacks segment index 0", filename0)
+	}
+	if dp0.HasLJH22() && dp0.LJH22.FileName != filename0 {
+		t.Errorf("first LJH file name %q, want %q", dp0.LJH22.FileName, filename0)
+	}
+	if strings.Contains(ws.ExperimentStateFilename, "_seg") {
+		t.Errorf("experiment state file name %q should not have a segment index", ws.ExperimentStateFilename)
+	}
+
+	now := time.Now()
+	if reason := ds.rotationDue(now); reason != "" {
+		t.Errorf("rotationDue = %q before any limit was reached", reason)
+	}
+	if reason := ds.rotationDue(now.Add(time.Hour)); !strings.Contains(reason, "RotateIntervalSec") {
+		t.Errorf("rotationDue = %q after RotateIntervalSec, want it to name RotateIntervalSec", reason)
+	}
+	rec := &DataRecord{data: make([]RawType, 1024), presamples: 256, modelCoefs: make([]float64, 1)}
+	for i := 0; i < 5; i++ {
+		if err := dp0.PublishData([]*DataRecord{rec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reason := ds.rotationDue(now); !strings.Contains(reason, "RotateRecords") {
+		t.Errorf("rotationDue = %q after RotateRecords, want it to name RotateRecords", reason)
+	}
+
+	dp0.numberWritten = 17
+	config.Request = "Pause"
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatal(err)
+	}
+	ds.rotateFiles(now, "test")
+	ws = ds.ComputeWritingState()
+	if ws.Segment != 1 || !ws.Active {
+		t.Errorf("after rotation, WritingState Segment=%d Active=%t, want 1 and true", ws.Segment, ws.Active)
+	}
+	for i, dsp := range ds.processors {
+		dp := &dsp.DataPublisher
+		if exts := dp.fileExtensions(); len(exts) != 1 || exts[0] != ext || testRecordsWritten(dp) != 0 {
+			t.Errorf("channel %d writes %v files with %d records after rotation, want new %s files", i,
+				exts, testRecordsWritten(dp), ext)
+		}
+		expect := fmt.Sprintf(segmentFilenamePattern(ws.FilenamePattern, 1), dsp.Name, "ljh")
+		if dp.HasLJH22() && dp.LJH22.FileName != expect {
+			t.Errorf("channel %d writes %s after rotation, want %s", i, dp.LJH22.FileName, expect)
+		}
+		if !dsp.DataPublisher.WritingPaused {
+			t.Errorf("channel %d is not paused after rotation while paused", i)
+		}
+	}
+	if dp0.numberWritten != 17 {
+		t.Errorf("numberWritten = %d after rotation, want 17", dp0.numberWritten)
+	}
+	if reason := ds.rotationDue(now); reason != "" {
+		t.Errorf("rotationDue = %q right after rotation", reason)
+	}
+	bigfile := fmt.Sprintf(segmentFilenamePattern(ws.FilenamePattern, 1), ds.processors[0].Name, ext)
+	if err := ioutil.WriteFile(bigfile, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if reason := ds.rotationDue(now); !strings.Contains(reason, "RotateBytes") {
+		t.Errorf("rotationDue = %q after RotateBytes, want it to name RotateBytes", reason)
+	}
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Errorf("WriteControl Stop failed: %v", err)
+	}
+	if ws = ds.ComputeWritingState(); ws.Rotation.enabled() {
+		t.Errorf("rotation policy %+v still set after writing stopped", ws.Rotation)
+	}
+}
@@ -1,8 +1,11 @@
 package dastard
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -13,17 +16,56 @@ type Portnumbers struct {
 	Trigs          int
 	SecondaryTrigs int
 	Summaries      int
+	Histograms     int
 }
 
 // Ports globally holds all TCP port numbers used by Dastard.
 var Ports Portnumbers
 
-func setPortnumbers(base int) {
+// NumberOfPorts is how many sequential TCP ports (starting at the base port) Dastard uses.
+const NumberOfPorts = 6
+
+// SetPortnumbers assigns all TCP port numbers sequentially, starting from base.
+func SetPortnumbers(base int) error {
+	if base < 1 || base+NumberOfPorts-1 > 65535 {
+		return fmt.Errorf("base port %d out of range: ports base through base+%d must be in [1,65535]",
+			base, NumberOfPorts-1)
+	}
 	Ports.RPC = base
 	Ports.Status = base + 1
 	Ports.Trigs = base + 2
 	Ports.SecondaryTrigs = base + 3
 	Ports.Summaries = base + 4
+	Ports.Histograms = base + 5
+	return nil
+}
+
+// BindAddresses structs contain the network interfaces that Dastard's sockets listen on.
+// An empty address means all interfaces.
+type BindAddresses struct {
+	RPC     string // the JSON-RPC control socket
+	Publish string // the ZMQ PUB sockets (status, pulses, secondary records, summaries, histograms)
+}
+
+// Bind globally holds the network interfaces that Dastard's sockets listen on.
+var Bind BindAddresses
+
+// ConfigDirectory is the directory of this Dastard instance's config file, where its
+// profiles are also stored. Empty means ~/.dastard.
+var ConfigDirectory string
+
+// rpcListenAddress returns the address for the JSON-RPC server to listen on.
+func rpcListenAddress(port int) string {
+	return net.JoinHostPort(Bind.RPC, strconv.Itoa(port))
+}
+
+// zmqPubEndpoint returns the ZMQ endpoint for a PUB socket to bind to.
+func zmqPubEndpoint(port int) string {
+	host := Bind.Publish
+	if host == "" {
+		host = "*"
+	}
+	return "tcp://" + net.JoinHostPort(host, strconv.Itoa(port))
 }
 
 // BuildInfo can contain compile-time information about the build
@@ -47,7 +89,7 @@ var DastardStartTime time.Time
 var ProblemLogger *log.Logger
 
 func init() {
-	setPortnumbers(5500)
+	SetPortnumbers(5500)
 	DastardStartTime = time.Now()
 
 	// Dastard main program will override this, but at least initialize with a sensible value
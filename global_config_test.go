@@ -0,0 +1,48 @@
+package dastard
+
+import "testing"
+
+func TestPortnumbers(t *testing.T) {
+	saved := Ports
+	defer func() { Ports = saved }()
+	if err := SetPortnumbers(6000); err != nil {
+		t.Errorf("SetPortnumbers(6000) error: %v", err)
+	}
+	expect := Portnumbers{RPC: 6000, Status: 6001, Trigs: 6002, SecondaryTrigs: 6003,
+		Summaries: 6004, Histograms: 6005}
+	if Ports != expect {
+		t.Errorf("SetPortnumbers(6000) gives %v, want %v", Ports, expect)
+	}
+	for _, base := range []int{0, -1, 65531} {
+		if err := SetPortnumbers(base); err == nil {
+			t.Errorf("SetPortnumbers(%d) should error", base)
+		}
+	}
+	if Ports != expect {
+		t.Errorf("failed SetPortnumbers changed Ports to %v", Ports)
+	}
+}
+
+func TestBindAddresses(t *testing.T) {
+	saved := Bind
+	defer func() { Bind = saved }()
+	tests := []struct {
+		bind    BindAddresses
+		rpc     string
+		publish string
+	}{
+		{BindAddresses{}, ":5500", "tcp://*:5501"},
+		{BindAddresses{RPC: "localhost"}, "localhost:5500", "tcp://*:5501"},
+		{BindAddresses{RPC: "127.0.0.1", Publish: "192.168.1.5"}, "127.0.0.1:5500", "tcp://192.168.1.5:5501"},
+		{BindAddresses{RPC: "::1", Publish: "eth0"}, "[::1]:5500", "tcp://eth0:5501"},
+	}
+	for _, test := range tests {
+		Bind = test.bind
+		if a := rpcListenAddress(5500); a != test.rpc {
+			t.Errorf("rpcListenAddress with %v = %q, want %q", test.bind, a, test.rpc)
+		}
+		if e := zmqPubEndpoint(5501); e != test.publish {
+			t.Errorf("zmqPubEndpoint with %v = %q, want %q", test.bind, e, test.publish)
+		}
+	}
+}
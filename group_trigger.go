@@ -3,6 +3,7 @@ package dastard
 import (
 	"fmt"
 	"log"
+	"math"
 	"sort"
 	"sync"
 	"time"
@@ -187,6 +188,32 @@ func (broker *TriggerBroker) Connections(receiver int) map[int]bool {
 	return sources
 }
 
+// FullConnections returns a map from each source to the sorted slice of all its receivers.
+// Sources with no receivers are omitted.
+func (broker *TriggerBroker) FullConnections() map[int][]int {
+	connections := make(map[int][]int)
+	broker.RLock()
+	defer broker.RUnlock()
+	for receiver, sources := range broker.sources {
+		for source := range sources {
+			connections[source] = append(connections[source], receiver)
+		}
+	}
+	for _, receivers := range connections {
+		sort.Ints(receivers)
+	}
+	return connections
+}
+
+// DeleteAllConnections disconnects all source -> receiver group triggers.
+func (broker *TriggerBroker) DeleteAllConnections() {
+	broker.Lock()
+	for i := 0; i < broker.nchannels; i++ {
+		broker.sources[i] = make(map[int]bool)
+	}
+	broker.Unlock()
+}
+
 // FrameIdxSlice attaches the methods of sort.Interface to []FrameIndex, sorting in increasing order.
 type FrameIdxSlice []FrameIndex
 
@@ -267,3 +294,145 @@ func (broker *TriggerBroker) Run() {
 func (broker *TriggerBroker) Stop() {
 	closeIfOpen(broker.abort)
 }
+
+// GroupTriggerState contains all the group trigger connections, or a set of connections
+// to add or delete. Connections[source] is the list of receivers that get a secondary
+// trigger whenever the source channel has a primary trigger (all are channel indices).
+type GroupTriggerState struct {
+	Connections map[int][]int
+}
+
+// GroupTriggerRule describes a pattern of group trigger connections, so that clients need
+// not list all source -> receiver pairs. Receivers are only ever channels of the same kind
+// as the source (e.g., for Lancero sources, error channels connect only to error channels).
+type GroupTriggerRule struct {
+	Sources          []int // channel indices that will be sources (all channels if empty)
+	SameGroup        bool  // connect each source to all other channels in its GroupIndex
+	NearestNeighbors int   // connect each source to this many of its nearest neighbors
+}
+
+// groupOf returns the index into ds.groupKeysSorted of the group that contains
+// the given channel, or -1 if it's in no group.
+func (ds *AnySource) groupOf(channelIndex int) int {
+	cnum := ds.chanNumbers[channelIndex]
+	for i, g := range ds.groupKeysSorted {
+		if cnum >= g.Firstchan && cnum < g.Firstchan+g.Nchan {
+			return i
+		}
+	}
+	return -1
+}
+
+// GroupTriggerRuleConnections computes the source -> receiver connections implied by a rule.
+// Nearest neighbors are found by pixel location if the TES map m is valid for this source,
+// otherwise by channel number within the same group.
+func (ds *AnySource) GroupTriggerRuleConnections(rule *GroupTriggerRule, m *Map) (*GroupTriggerState, error) {
+	if !rule.SameGroup && rule.NearestNeighbors <= 0 {
+		return nil, fmt.Errorf("group trigger rule needs SameGroup or NearestNeighbors>0")
+	}
+	sources := rule.Sources
+	if len(sources) == 0 {
+		sources = make([]int, ds.nchan)
+		for i := range sources {
+			sources[i] = i
+		}
+	}
+	cpp := ds.channelsPerPixel
+	if cpp < 1 {
+		cpp = 1
+	}
+	useMap := m != nil && len(m.Pixels) == ds.nchan/cpp
+	pixelOf := func(channelIndex int) (Pixel, bool) {
+		idx := ds.chanNumbers[channelIndex] - 1
+		if idx < 0 || idx >= len(m.Pixels) {
+			return Pixel{}, false
+		}
+		return m.Pixels[idx], true
+	}
+
+	gts := GroupTriggerState{Connections: make(map[int][]int)}
+	for _, source := range sources {
+		if source < 0 || source >= ds.nchan {
+			return nil, fmt.Errorf("group trigger source %d out of range [0,%d)", source, ds.nchan)
+		}
+		receivers := make(map[int]bool)
+		group := ds.groupOf(source)
+		if rule.SameGroup {
+			for rx := 0; rx < ds.nchan; rx++ {
+				if rx != source && rx%cpp == source%cpp && ds.groupOf(rx) == group {
+					receivers[rx] = true
+				}
+			}
+		}
+		if rule.NearestNeighbors > 0 {
+			type candidate struct {
+				channelIndex int
+				distance     float64
+			}
+			var candidates []candidate
+			sourcePixel, sourceOK := Pixel{}, false
+			if useMap {
+				sourcePixel, sourceOK = pixelOf(source)
+			}
+			for rx := 0; rx < ds.nchan; rx++ {
+				if rx == source || rx%cpp != source%cpp {
+					continue
+				}
+				if sourceOK {
+					if p, ok := pixelOf(rx); ok {
+						dx := float64(p.X - sourcePixel.X)
+						dy := float64(p.Y - sourcePixel.Y)
+						candidates = append(candidates, candidate{rx, math.Sqrt(dx*dx + dy*dy)})
+					}
+				} else if ds.groupOf(rx) == group {
+					d := ds.chanNumbers[rx] - ds.chanNumbers[source]
+					if d < 0 {
+						d = -d
+					}
+					candidates = append(candidates, candidate{rx, float64(d)})
+				}
+			}
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return candidates[i].distance < candidates[j].distance
+			})
+			for i := 0; i < rule.NearestNeighbors && i < len(candidates); i++ {
+				receivers[candidates[i].channelIndex] = true
+			}
+		}
+		for rx := range receivers {
+			gts.Connections[source] = append(gts.Connections[source], rx)
+		}
+		sort.Ints(gts.Connections[source])
+	}
+	return &gts, nil
+}
+
+// ChangeGroupTrigger adds (turnOn) or deletes (!turnOn) all the group trigger connections in gts.
+// All channel indices are checked before any connections are changed.
+func (ds *AnySource) ChangeGroupTrigger(turnOn bool, gts *GroupTriggerState) error {
+	for source, receivers := range gts.Connections {
+		if source < 0 || source >= ds.nchan {
+			return fmt.Errorf("group trigger source %d out of range [0,%d)", source, ds.nchan)
+		}
+		for _, rx := range receivers {
+			if rx < 0 || rx >= ds.nchan {
+				return fmt.Errorf("group trigger receiver %d out of range [0,%d)", rx, ds.nchan)
+			}
+		}
+	}
+	for source, receivers := range gts.Connections {
+		for _, rx := range receivers {
+			if turnOn {
+				ds.broker.AddConnection(source, rx)
+			} else {
+				ds.broker.DeleteConnection(source, rx)
+			}
+		}
+	}
+	return nil
+}
+
+// ComputeGroupTriggerState returns the complete set of group trigger connections.
+func (ds *AnySource) ComputeGroupTriggerState() GroupTriggerState {
+	return GroupTriggerState{Connections: ds.broker.FullConnections()}
+}
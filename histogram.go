@@ -0,0 +1,279 @@
+package dastard
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/usnistgov/dastard/getbytes"
+	czmq "github.com/zeromq/goczmq"
+)
+
+// Codes for the record quantity that a Histogram accumulates.
+const (
+	histPeakValue uint16 = iota
+	histPulseAverage
+	histModelCoef
+	histFiltValue
+)
+
+// histogramQuantities maps each allowed (upper case) HistogramConfig.Quantity to its code.
+var histogramQuantities = map[string]uint16{
+	"PEAKVALUE":    histPeakValue,
+	"PULSEAVERAGE": histPulseAverage,
+	"MODELCOEF":    histModelCoef,
+	"FILTVALUE":    histFiltValue,
+}
+
+// HistogramConfig describes what to histogram and how to bin it.
+type HistogramConfig struct {
+	Quantity  string // "PeakValue", "PulseAverage", "ModelCoef", or "FiltValue" (not case sensitive)
+	CoefIndex int    // which model coefficient, used only when Quantity is "ModelCoef"
+	Nbins     int    // number of bins; 0 disables histogramming
+	Min       float64
+	Max       float64
+}
+
+// HistogramConfigObject is the RPC-usable structure for ConfigureHistograms
+type HistogramConfigObject struct {
+	ChannelIndices []int
+	HistogramConfig
+}
+
+// Histogram accumulates the counts of one record quantity in one channel.
+type Histogram struct {
+	HistogramConfig
+	code      uint16
+	counts    []uint32
+	underflow int
+	overflow  int
+	binWidth  float64
+}
+
+// NewHistogram returns a new, empty Histogram, or an error if the config is not valid.
+func NewHistogram(config HistogramConfig) (*Histogram, error) {
+	code, ok := histogramQuantities[strings.ToUpper(config.Quantity)]
+	if !ok {
+		return nil, fmt.Errorf("histogram quantity %q is not one of PeakValue, PulseAverage, ModelCoef, FiltValue",
+			config.Quantity)
+	}
+	if config.Nbins <= 0 {
+		return nil, fmt.Errorf("histogram Nbins=%d, must be positive", config.Nbins)
+	}
+	if !(config.Max > config.Min) {
+		return nil, fmt.Errorf("histogram Max=%v must exceed Min=%v", config.Max, config.Min)
+	}
+	if code == histModelCoef && config.CoefIndex < 0 {
+		return nil, fmt.Errorf("histogram CoefIndex=%d, must be non-negative", config.CoefIndex)
+	}
+	h := &Histogram{HistogramConfig: config, code: code}
+	h.counts = make([]uint32, config.Nbins)
+	h.binWidth = (config.Max - config.Min) / float64(config.Nbins)
+	return h, nil
+}
+
+// value returns the quantity to be histogrammed from rec, or NaN if it was not computed.
+func (h *Histogram) value(rec *DataRecord) float64 {
+	switch h.code {
+	case histPeakValue:
+		return rec.peakValue
+	case histPulseAverage:
+		return rec.pulseAverage
+	case histModelCoef:
+		if h.CoefIndex < len(rec.modelCoefs) {
+			return rec.modelCoefs[h.CoefIndex]
+		}
+	case histFiltValue:
+		return rec.filtValue
+	}
+	return math.NaN()
+}
+
+// AddRecords adds the chosen quantity of each record to the histogram.
+// Records where the quantity was not computed (e.g., no filter loaded) are ignored.
+func (h *Histogram) AddRecords(records []*DataRecord) {
+	for _, rec := range records {
+		v := h.value(rec)
+		switch {
+		case math.IsNaN(v):
+		case v < h.Min:
+			h.underflow++
+		case v >= h.Max:
+			h.overflow++
+		default:
+			bin := int((v - h.Min) / h.binWidth)
+			if bin >= h.Nbins { // guard against roundoff
+				bin = h.Nbins - 1
+			}
+			h.counts[bin]++
+		}
+	}
+}
+
+// Reset sets all counts to zero.
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.underflow = 0
+	h.overflow = 0
+}
+
+// HistogramSnapshot is a copy of one channel's histogram at a moment in time.
+type HistogramSnapshot struct {
+	ChannelIndex int
+	HistogramConfig
+	Counts    []uint32
+	Underflow int
+	Overflow  int
+	Time      time.Time
+}
+
+// snapshot returns a copy of the histogram's current state.
+func (h *Histogram) snapshot(channelIndex int) *HistogramSnapshot {
+	counts := make([]uint32, len(h.counts))
+	copy(counts, h.counts)
+	return &HistogramSnapshot{ChannelIndex: channelIndex, HistogramConfig: h.HistogramConfig,
+		Counts: counts, Underflow: h.underflow, Overflow: h.overflow, Time: time.Now()}
+}
+
+// ConfigureHistograms sets (and resets) the histogram of each channel in hco.ChannelIndices.
+// A config with Nbins==0 turns histogramming off for those channels.
+func (ds *AnySource) ConfigureHistograms(hco *HistogramConfigObject) error {
+	for _, channelIndex := range hco.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= len(ds.processors) {
+			return fmt.Errorf("channelIndex out of range, channelIndex=%v, len(ds.processors)=%v",
+				channelIndex, len(ds.processors))
+		}
+	}
+	if hco.Nbins != 0 {
+		if _, err := NewHistogram(hco.HistogramConfig); err != nil {
+			return err
+		}
+	}
+	for _, channelIndex := range hco.ChannelIndices {
+		dsp := ds.processors[channelIndex]
+		dsp.histogram = nil
+		if hco.Nbins != 0 {
+			dsp.histogram, _ = NewHistogram(hco.HistogramConfig)
+		}
+	}
+	return nil
+}
+
+// ResetHistograms zeros the histograms of the given channels (of all channels, if
+// channelIndices is empty).
+func (ds *AnySource) ResetHistograms(channelIndices []int) error {
+	dsps, err := ds.histogramProcessors(channelIndices)
+	if err != nil {
+		return err
+	}
+	for _, dsp := range dsps {
+		dsp.histogram.Reset()
+	}
+	return nil
+}
+
+// HistogramSnapshots returns copies of the histograms of the given channels (of all
+// channels with histograms, if channelIndices is empty).
+func (ds *AnySource) HistogramSnapshots(channelIndices []int) ([]*HistogramSnapshot, error) {
+	dsps, err := ds.histogramProcessors(channelIndices)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*HistogramSnapshot, 0, len(dsps))
+	for _, dsp := range dsps {
+		snapshots = append(snapshots, dsp.histogram.snapshot(dsp.channelIndex))
+	}
+	return snapshots, nil
+}
+
+// histogramProcessors returns the processors for the given channels, checking that each one
+// has a histogram. If channelIndices is empty, return all processors that have a histogram.
+func (ds *AnySource) histogramProcessors(channelIndices []int) ([]*DataStreamProcessor, error) {
+	hasHistogram := func(dsp *DataStreamProcessor) bool { return dsp.histogram != nil }
+	return ds.processorsForIndices(channelIndices, hasHistogram, "has no histogram configured")
+}
+
+// publishHistograms sends snapshots of all histograms to the histogram ZMQ socket.
+func (ds *AnySource) publishHistograms() {
+	if PubHistogramsChan == nil {
+		return
+	}
+	snapshots, _ := ds.HistogramSnapshots(nil)
+	if len(snapshots) > 0 {
+		select {
+		case PubHistogramsChan <- snapshots:
+		default: // never block data processing to publish histograms
+		}
+	}
+}
+
+// messageHistogram makes a message with the following format for publishing on portHistograms
+// Structure of the message header is defined in BINARY_FORMATS.md
+// uint16: channel number
+// uint16: header version number
+// uint16: code for histogrammed quantity (0=peakValue, 1=pulseAverage, 2=model coefficient, 3=filtValue)
+// uint16: model coefficient index
+// uint32: number of bins
+// float64: lower edge of first bin
+// float64: upper edge of last bin
+// uint64: underflow count
+// uint64: overflow count
+// uint64: snapshot time, in ns since epoch 1970
+// end of first message packet
+// counts, each is uint32, length is number of bins
+func messageHistogram(snap *HistogramSnapshot) [][]byte {
+	const headerVersion = uint16(0)
+
+	code := histogramQuantities[strings.ToUpper(snap.Quantity)]
+	header := new(bytes.Buffer)
+	header.Write(getbytes.FromUint16(uint16(snap.ChannelIndex)))
+	header.Write(getbytes.FromUint16(headerVersion))
+	header.Write(getbytes.FromUint16(code))
+	header.Write(getbytes.FromUint16(uint16(snap.CoefIndex)))
+	header.Write(getbytes.FromUint32(uint32(len(snap.Counts))))
+	header.Write(getbytes.FromFloat64(snap.Min))
+	header.Write(getbytes.FromFloat64(snap.Max))
+	header.Write(getbytes.FromUint64(uint64(snap.Underflow)))
+	header.Write(getbytes.FromUint64(uint64(snap.Overflow)))
+	header.Write(getbytes.FromInt64(snap.Time.UnixNano()))
+
+	return [][]byte{header.Bytes(), getbytes.FromSliceUint32(snap.Counts)}
+}
+
+// PubHistogramsChan is used to enable multiple different DataSources to publish on the same zmq pub socket
+var PubHistogramsChan chan []*HistogramSnapshot
+
+// configurePubHistogramsSocket should be run exactly one time; analogue of configurePubRecordsSocket
+func configurePubHistogramsSocket() error {
+	if PubHistogramsChan != nil {
+		return fmt.Errorf("run configurePubHistogramsSocket only one time")
+	}
+	const publishChannelDepth = 10
+	pubchan := make(chan []*HistogramSnapshot, publishChannelDepth)
+	hostname := zmqPubEndpoint(Ports.Histograms)
+	pubSocket, err := czmq.NewPub(hostname)
+	if err != nil {
+		return err
+	}
+	pubSocket.SetSndhwm(10)
+	go func() {
+		for {
+			snapshots, ok := <-pubchan
+			if !ok { // Destroy socket when pubchan is closed and drained
+				pubSocket.Destroy()
+				return
+			}
+			for _, snap := range snapshots {
+				if err := pubSocket.SendMessage(messageHistogram(snap)); err != nil {
+					ProblemLogger.Println("zmq send error publishing a histogram:", err)
+				}
+			}
+		}
+	}()
+	PubHistogramsChan = pubchan
+	return nil
+}
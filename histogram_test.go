@@ -0,0 +1,96 @@
+package dastard
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	badConfigs := []HistogramConfig{
+		{Quantity: "height", Nbins: 10, Min: 0, Max: 10},
+		{Quantity: "PeakValue", Nbins: 0, Min: 0, Max: 10},
+		{Quantity: "PeakValue", Nbins: 10, Min: 10, Max: 10},
+		{Quantity: "ModelCoef", CoefIndex: -1, Nbins: 10, Min: 0, Max: 10},
+	}
+	for _, c := range badConfigs {
+		if _, err := NewHistogram(c); err == nil {
+			t.Errorf("NewHistogram(%v) succeeded, want error", c)
+		}
+	}
+
+	h, err := NewHistogram(HistogramConfig{Quantity: "peakvalue", Nbins: 10, Min: 0, Max: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []float64{-1, 0, 0.5, 3.2, 9.999, 10, 20, math.NaN()}
+	records := make([]*DataRecord, len(values))
+	for i, v := range values {
+		records[i] = &DataRecord{peakValue: v}
+	}
+	h.AddRecords(records)
+	expect := []uint32{2, 0, 0, 1, 0, 0, 0, 0, 0, 1}
+	for i, c := range h.counts {
+		if c != expect[i] {
+			t.Errorf("Histogram bin %d has %d counts, want %d", i, c, expect[i])
+		}
+	}
+	if h.underflow != 1 || h.overflow != 2 {
+		t.Errorf("Histogram underflow, overflow = %d, %d, want 1, 2", h.underflow, h.overflow)
+	}
+	snap := h.snapshot(4)
+	h.Reset()
+	if h.underflow != 0 || h.overflow != 0 || h.counts[0] != 0 {
+		t.Errorf("Histogram.Reset() left counts %v, underflow %d, overflow %d", h.counts, h.underflow, h.overflow)
+	}
+	if snap.Counts[0] != 2 || snap.Underflow != 1 || snap.ChannelIndex != 4 {
+		t.Errorf("Histogram snapshot changed by Reset: %v", snap)
+	}
+
+	msg := messageHistogram(snap)
+	if len(msg) != 2 || len(msg[0]) != 52 || len(msg[1]) != 4*10 {
+		t.Errorf("messageHistogram returned frames of wrong length")
+	} else if binary.LittleEndian.Uint16(msg[0][0:]) != 4 || binary.LittleEndian.Uint32(msg[1][0:]) != 2 {
+		t.Errorf("messageHistogram has wrong channel number or counts")
+	}
+
+	// Model coefficients that do not exist are ignored.
+	hc, _ := NewHistogram(HistogramConfig{Quantity: "ModelCoef", CoefIndex: 2, Nbins: 5, Min: 0, Max: 5})
+	hc.AddRecords([]*DataRecord{{modelCoefs: []float64{1, 2, 3}}, {modelCoefs: []float64{1}}})
+	if hc.counts[3] != 1 || hc.underflow+hc.overflow != 0 {
+		t.Errorf("ModelCoef histogram has counts %v, want [0 0 0 1 0]", hc.counts)
+	}
+
+	// Configure through a data source.
+	ds := AnySource{nchan: 4}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	hco := &HistogramConfigObject{ChannelIndices: []int{1, 5},
+		HistogramConfig: HistogramConfig{Quantity: "FiltValue", Nbins: 10, Min: 0, Max: 1}}
+	if err := ds.ConfigureHistograms(hco); err == nil {
+		t.Error("ConfigureHistograms succeeded with channel index out of range")
+	}
+	hco.ChannelIndices = []int{1, 2}
+	if err := ds.ConfigureHistograms(hco); err != nil {
+		t.Error(err)
+	}
+	if _, err := ds.HistogramSnapshots([]int{0}); err == nil {
+		t.Error("HistogramSnapshots succeeded on a channel without a histogram")
+	}
+	if snaps, err := ds.HistogramSnapshots(nil); err != nil || len(snaps) != 2 {
+		t.Errorf("HistogramSnapshots(nil) returned %d snapshots, err=%v, want 2, nil", len(snaps), err)
+	}
+	if err := ds.ResetHistograms(nil); err != nil {
+		t.Error(err)
+	}
+	hco.ChannelIndices = []int{2}
+	hco.Nbins = 0
+	if err := ds.ConfigureHistograms(hco); err != nil {
+		t.Error(err)
+	}
+	if snaps, _ := ds.HistogramSnapshots(nil); len(snaps) != 1 || snaps[0].ChannelIndex != 1 {
+		t.Errorf("after turning off channel 2 histogram, HistogramSnapshots(nil) returned %v", snaps)
+	}
+}
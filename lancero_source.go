@@ -686,7 +686,7 @@ func (ls *LanceroSource) launchLanceroReader() {
 					log.Printf("DATA DROP, first word = %v\n", firstWord)
 
 				}
-				buffers = append(buffers, bytesToRawType(b))
+				buffers = append(buffers, wordsToRawType(b))
 				bframes := len(b) / dev.frameSize
 				if bframes < framesUsed { // for multiple cards, take data amount equal to minimum across all cards
 					framesUsed = bframes
@@ -858,6 +858,8 @@ func (ls *LanceroSource) distributeData(buffersMsg BuffersChanType) *dataBlock {
 			errData := datacopies[ls.chan2readoutOrder[channelIndex-1]]
 			//	MixRetardFb alters data in place to mix some of errData in based on mix.errorScale
 			mix.MixRetardFb(&data, &errData)
+		} else {
+			signExtend16(data)
 		}
 		seg := DataSegment{
 			rawData:         data,
@@ -8,6 +8,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"time"
@@ -20,6 +22,11 @@ type PulseRecord struct {
 	TimeCode int64
 	RowCount int64
 	Pulse    []uint16
+
+	// FirstRisingSample is the index in Pulse of the first sample after the pretrigger.
+	// LJH3 files store it in each record. For LJH2 files, it is Presamples+1, the value
+	// Dastard would store for the same record in an LJH3 file.
+	FirstRisingSample int
 }
 
 // VersionCode enumerates the LJH file version numbers.
@@ -30,20 +37,49 @@ const (
 	VersionInvalid VersionCode = iota
 	Version2_1
 	Version2_2
+	Version3_0
 )
 
+// HeaderInfo holds the metadata parsed from an LJH file header. Items missing from a
+// file's header are left zero. LJH3 headers hold only VersionNumber, Timebase, the TDM
+// rows and columns, and Fields; their records vary in length, so Presamples and Samples are 0.
+type HeaderInfo struct {
+	ChannelIndex        int // the "Channel" number (matching the channel name)
+	DastardChannelIndex int // the channel's index within Dastard
+	Presamples          int
+	Samples             int
+	VersionNumber       VersionCode
+	WordSize            int
+	Timebase            float64
+	TimestampOffset     float64
+	FramesPerSample     int
+	NumberOfRows        int
+	NumberOfColumns     int
+	NumberOfChans       int
+	RowNum              int
+	ColumnNum           int
+	ChanName            string
+	SoftwareVersion     string
+	GitHash             string
+	SourceName          string
+	ServerStartTime     string
+	FirstRecordTime     string
+	PixelXPosition      int
+	PixelYPosition      int
+	PixelName           string
+
+	// Fields holds every "key: value" line of an LJH2 header, or every top-level value
+	// (as JSON text) of an LJH3 header, including items not parsed into the fields above.
+	Fields map[string]string
+}
+
 // Reader is the interface for reading an LJH file
 type Reader struct {
-	ChannelIndex    int
-	Presamples      int
-	Samples         int
-	VersionNumber   VersionCode
-	WordSize        int
-	Timebase        float64
-	TimestampOffset float64
+	HeaderInfo
 
 	recordLength int
 	headerLength int
+	fileSize     int64 // size of the file when last checked (LJH3 only)
 	file         *os.File
 	buffer       []byte
 }
@@ -85,9 +121,19 @@ func OpenReader(fileName string) (r *Reader, err error) {
 	}
 
 	r = &Reader{file: f}
-	err = r.parseHeader()
+	first := make([]byte, 1)
+	if _, err = f.ReadAt(first, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("LJH file '%s': could not read header: %v", fileName, err)
+	}
+	if first[0] == '{' {
+		err = r.parseHeader3()
+	} else {
+		err = r.parseHeader()
+	}
 	if err != nil {
-		return
+		f.Close()
+		return nil, err
 	}
 	return r, nil
 }
@@ -132,6 +178,19 @@ func extractFloat(line, pattern string, f *float64) bool {
 	return n >= 1 && err != nil
 }
 
+func extractString(line, pattern string, s *string) bool {
+	n, err := fmt.Sscanf(line, pattern, s)
+	return n >= 1 && err != nil
+}
+
+// extractSecond is like extract, but for patterns with 2 integers, where only the
+// second one is wanted (e.g., "Row number (from 0-%d inclusive): %d").
+func extractSecond(line, pattern string, i *int) bool {
+	var ignore int
+	n, err := fmt.Sscanf(line, pattern, &ignore, i)
+	return n >= 2 && err != nil
+}
+
 // CreateFile creates a file with filename .FileName and assigns it to .file
 // you can't write records without doing this
 func (w *Writer) CreateFile() error {
@@ -339,6 +398,7 @@ func (w *Writer3) CreateFile() error {
 }
 
 func (r *Reader) parseHeader() error {
+	r.Fields = make(map[string]string)
 	scanner := bufio.NewScanner(r.file)
 	lnum := 0
 	textLength := 0
@@ -362,18 +422,42 @@ header:
 			break header
 
 		case extract(line, "Digitized Word Size in Bytes: %d", &r.WordSize):
+		case extract(line, "Digitized Word Size In Bytes: %d", &r.WordSize):
 		case extract(line, "Presamples: %d", &r.Presamples):
 		case extract(line, "Total Samples: %d", &r.Samples):
 		case extract(line, "Channel: %d", &r.ChannelIndex):
-		case extract(line, "Channel: %d", &r.ChannelIndex):
+		case extract(line, "ChannelIndex (in dastard): %d", &r.DastardChannelIndex):
+		case extractString(line, "Channel name: %s", &r.ChanName):
+		case extract(line, "Number of samples per point: %d", &r.FramesPerSample):
+		case extract(line, "Number of rows: %d", &r.NumberOfRows):
+		case extract(line, "Number of columns: %d", &r.NumberOfColumns):
+		case extract(line, "Number of channels: %d", &r.NumberOfChans):
+		case extractSecond(line, "Row number (from 0-%d inclusive): %d", &r.RowNum):
+		case extractSecond(line, "Column number (from 0-%d inclusive): %d", &r.ColumnNum):
 		case extractFloat(line, "Timestamp offset (s): %f", &r.TimestampOffset):
 		case extractFloat(line, "Timebase: %f", &r.Timebase):
+		case extract(line, "Pixel X Position: %d", &r.PixelXPosition):
+		case extract(line, "Pixel Y Position: %d", &r.PixelYPosition):
 
+		}
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 && !strings.HasPrefix(line, "#") {
+			r.Fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 		}
 		lnum++
 	}
 	r.recordLength += r.WordSize * r.Samples
 
+	// Items whose values can contain spaces are taken from the whole line.
+	r.SoftwareVersion = r.Fields["Software Version"]
+	r.GitHash = r.Fields["Software Git Hash"]
+	r.SourceName = r.Fields["Data source"]
+	r.ServerStartTime = r.Fields["Server Start Time"]
+	r.FirstRecordTime = r.Fields["First Record Time"]
+	if r.FirstRecordTime == "" {
+		r.FirstRecordTime = r.Fields["File First Record Time"]
+	}
+	r.PixelName = r.Fields["Pixel Name"]
+
 	// To find the header length is a big pain, because the bufio Reader and Scanner
 	// outsmart us by not reporting the \r and/or \n line delimeters to us. We must
 	// re-find the end-header line, then consume any \r and \n that follow it.
@@ -404,9 +488,59 @@ header:
 	return nil
 }
 
+// parseHeader3 parses the JSON header of an LJH3 file.
+func (r *Reader) parseHeader3() error {
+	dec := json.NewDecoder(r.file)
+	var msg json.RawMessage
+	if err := dec.Decode(&msg); err != nil {
+		return fmt.Errorf("LJH3 file '%s': could not parse header: %v", r.file.Name(), err)
+	}
+	var h Header
+	if err := json.Unmarshal(msg, &h); err != nil {
+		return fmt.Errorf("LJH3 file '%s': could not parse header: %v", r.file.Name(), err)
+	}
+	if h.Format != "LJH3" || !strings.HasPrefix(h.FormatVersion, "3.") {
+		return fmt.Errorf("LJH file '%s' has format '%s' version '%s', want 'LJH3' version 3",
+			r.file.Name(), h.Format, h.FormatVersion)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return fmt.Errorf("LJH3 file '%s': could not parse header: %v", r.file.Name(), err)
+	}
+	r.Fields = make(map[string]string)
+	for k, v := range fields {
+		r.Fields[k] = string(v)
+	}
+	r.VersionNumber = Version3_0
+	r.WordSize = 2
+	r.Timebase = h.Frameperiod
+	r.FramesPerSample = 1
+	r.NumberOfRows = h.TDM.NumberOfRows
+	r.NumberOfColumns = h.TDM.NumberOfColumns
+	r.RowNum = h.TDM.Row
+	r.ColumnNum = h.TDM.Column
+
+	// The header ends where the decoder stopped reading, and is followed by one newline.
+	read, err := r.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	unread, err := io.Copy(ioutil.Discard, dec.Buffered())
+	if err != nil {
+		return err
+	}
+	r.headerLength = int(read-unread) + 1
+	_, err = r.file.Seek(int64(r.headerLength), io.SeekStart)
+	return err
+}
+
 // NextPulse returns the next pulse from the open LJH file
 func (r *Reader) NextPulse() (*PulseRecord, error) {
+	if r.VersionNumber == Version3_0 {
+		return r.nextPulse3()
+	}
 	pr := new(PulseRecord)
+	pr.FirstRisingSample = r.Presamples + 1
 	pr.Pulse = make([]uint16, r.Samples)
 	if err := binary.Read(r.file, binary.LittleEndian, &pr.RowCount); err != nil {
 		return nil, err
@@ -419,3 +553,57 @@ func (r *Reader) NextPulse() (*PulseRecord, error) {
 	}
 	return pr, nil
 }
+
+// checkRemaining returns io.ErrUnexpectedEOF if the file has fewer than n bytes after the
+// current position, so a corrupt record length can't make us allocate a huge record.
+func (r *Reader) checkRemaining(n int64) error {
+	pos, err := r.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if pos+n <= r.fileSize {
+		return nil
+	}
+	info, err := r.file.Stat() // the file might have grown since we last checked
+	if err != nil {
+		return err
+	}
+	r.fileSize = info.Size()
+	if pos+n > r.fileSize {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// nextPulse3 returns the next (variable-length) pulse from an LJH3 file. LJH3 records store a
+// frame count; it is converted to a RowCount as in LJH2 files.
+func (r *Reader) nextPulse3() (*PulseRecord, error) {
+	var hdr struct {
+		Nsamples          int32
+		FirstRisingSample int32
+		FrameCount        int64
+		TimeCode          int64
+	}
+	if err := binary.Read(r.file, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Nsamples < 0 {
+		return nil, fmt.Errorf("LJH3 file '%s' has record of invalid length %d", r.file.Name(), hdr.Nsamples)
+	}
+	if err := r.checkRemaining(2 * int64(hdr.Nsamples)); err != nil {
+		return nil, err
+	}
+	nrows := int64(r.NumberOfRows)
+	if nrows < 1 {
+		nrows = 1
+	}
+	pr := &PulseRecord{TimeCode: hdr.TimeCode, RowCount: hdr.FrameCount*nrows + int64(r.RowNum),
+		FirstRisingSample: int(hdr.FirstRisingSample), Pulse: make([]uint16, hdr.Nsamples)}
+	if err := binary.Read(r.file, binary.LittleEndian, pr.Pulse); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return pr, nil
+}
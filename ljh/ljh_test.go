@@ -3,6 +3,7 @@ package ljh
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -31,6 +32,11 @@ func TestRead(t *testing.T) {
 		{"r.Samples", r.Samples, 1024},
 		{"r.VersionNumber", int(r.VersionNumber), int(Version2_2)},
 		{"r.WordSize", r.WordSize, 2},
+		{"r.FramesPerSample", r.FramesPerSample, 1},
+		{"r.NumberOfRows", r.NumberOfRows, 30},
+		{"r.NumberOfColumns", r.NumberOfColumns, 8},
+		{"r.RowNum", r.RowNum, 5},
+		{"r.ColumnNum", r.ColumnNum, 0},
 		{"r.headerLength", r.headerLength, 1216},
 		{"r.recordLength", r.recordLength, 2064},
 	}
@@ -40,6 +46,10 @@ func TestRead(t *testing.T) {
 		}
 	}
 
+	if r.FirstRecordTime != "06 May 2016, 20:33:04 GMT" || r.Fields["Sample"] != "Fe55" {
+		t.Errorf("r.FirstRecordTime = %q, r.Fields[\"Sample\"] = %q", r.FirstRecordTime, r.Fields["Sample"])
+	}
+
 	expectedTC := []int64{1462566784410601, 1462566784420431}
 	expectedRC := []int64{25221272465, 25221303185}
 	for i, tc := range expectedTC {
@@ -53,6 +63,9 @@ func TestRead(t *testing.T) {
 		if pr.RowCount != expectedRC[i] {
 			t.Errorf("r.NextPulse().RowCount = %d, want %d", pr.RowCount, expectedRC[i])
 		}
+		if pr.FirstRisingSample != 257 {
+			t.Errorf("r.NextPulse().FirstRisingSample = %d, want 257", pr.FirstRisingSample)
+		}
 	}
 	_, err = r.NextPulse()
 	if err == nil {
@@ -108,10 +121,19 @@ func TestBadVersionNumbers(t *testing.T) {
 
 func TestWriter(t *testing.T) {
 	w := Writer{FileName: "writertest.ljh",
-		Samples:      100,
-		Presamples:   50,
-		NumberOfRows: 2,
-		RowNum:       1}
+		Samples:                   100,
+		Presamples:                50,
+		NumberOfRows:              2,
+		NumberOfChans:             4,
+		RowNum:                    1,
+		ChanName:                  "chan3",
+		ChannelIndex:              2,
+		ChannelNumberMatchingName: 3,
+		DastardVersion:            "0.2.10",
+		SourceName:                "SimPulses",
+		PixelXPosition:            -5,
+		PixelYPosition:            7,
+		PixelName:                 "pixel 3"}
 	err := w.CreateFile()
 	if err != nil {
 		t.Errorf("file creation error: %v", err)
@@ -158,6 +180,32 @@ func TestWriter(t *testing.T) {
 	if err != nil {
 		t.Errorf("WriterTest, OpenReader Error: %v", err)
 	}
+	if r.NumberOfRows != 2 || r.RowNum != 1 {
+		t.Errorf("WriterTest, reader found rows=%d, row #%d, want 2, #1", r.NumberOfRows, r.RowNum)
+	}
+	if r.ChanName != "chan3" {
+		t.Errorf("WriterTest, reader found ChanName=%q, want %q", r.ChanName, "chan3")
+	}
+	var headertests = []struct {
+		name  string
+		found interface{}
+		want  interface{}
+	}{
+		{"ChannelIndex", r.ChannelIndex, 3},
+		{"DastardChannelIndex", r.DastardChannelIndex, 2},
+		{"NumberOfChans", r.NumberOfChans, 4},
+		{"WordSize", r.WordSize, 2},
+		{"SoftwareVersion", r.SoftwareVersion, "DASTARD version 0.2.10"},
+		{"SourceName", r.SourceName, "SimPulses"},
+		{"PixelXPosition", r.PixelXPosition, -5},
+		{"PixelYPosition", r.PixelYPosition, 7},
+		{"PixelName", r.PixelName, "pixel 3"},
+	}
+	for _, ht := range headertests {
+		if ht.found != ht.want {
+			t.Errorf("WriterTest, reader found %s=%v, want %v", ht.name, ht.found, ht.want)
+		}
+	}
 	record, err := r.NextPulse()
 	if err != nil {
 		t.Errorf("WriterTest, NextPulse Error: %v", err)
@@ -238,6 +286,83 @@ func TestWriter3(t *testing.T) {
 	w.Close()
 }
 
+func TestReader3(t *testing.T) {
+	fileName := "readertest.ljh3"
+	defer os.Remove(fileName)
+	w := Writer3{FileName: fileName, Timebase: 9.6e-6, NumberOfRows: 4, NumberOfColumns: 2, Row: 3, Column: 1}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	lengths := []int{100, 37, 250}
+	for i, n := range lengths {
+		data := make([]uint16, n)
+		for j := range data {
+			data[j] = uint16(i + j)
+		}
+		if err := w.WriteRecord(int32(n/4), int64(1000*i), int64(2000*i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	r, err := OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.VersionNumber != Version3_0 || r.Timebase != 9.6e-6 || r.NumberOfRows != 4 ||
+		r.NumberOfColumns != 2 || r.RowNum != 3 || r.ColumnNum != 1 {
+		t.Errorf("LJH3 reader found header %+v", r.HeaderInfo)
+	}
+	if r.Fields["File Format"] != `"LJH3"` {
+		t.Errorf("LJH3 reader Fields[\"File Format\"] = %s, want \"LJH3\"", r.Fields["File Format"])
+	}
+	for i, n := range lengths {
+		pr, err := r.NextPulse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pr.Pulse) != n || pr.FirstRisingSample != n/4 || pr.TimeCode != int64(2000*i) ||
+			pr.RowCount != int64(1000*i*4+3) || pr.Pulse[n-1] != uint16(i+n-1) {
+			t.Errorf("LJH3 record %d has %d samples, FirstRisingSample=%d, TimeCode=%d, RowCount=%d",
+				i, len(pr.Pulse), pr.FirstRisingSample, pr.TimeCode, pr.RowCount)
+		}
+	}
+	if _, err := r.NextPulse(); err != io.EOF {
+		t.Errorf("LJH3 reader NextPulse() after the last record returns %v, want io.EOF", err)
+	}
+
+	// A corrupt record length longer than the rest of the file is an error, not a huge record.
+	f, err := os.OpenFile(fileName, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0x7f}, int64(r.headerLength))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if _, err := r2.NextPulse(); err != io.ErrUnexpectedEOF {
+		t.Errorf("LJH3 reader NextPulse() on a record too long for the file returns %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	// A JSON header of another format is not an LJH3 file.
+	if err := ioutil.WriteFile(fileName, []byte(`{"File Format": "OFF"}`+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenReader(fileName); err == nil {
+		t.Error("OpenReader on a non-LJH3 JSON file should fail")
+	}
+}
+
 func BenchmarkLJH22(b *testing.B) {
 	w := Writer{FileName: "writertest.ljh",
 		Samples:    1000,
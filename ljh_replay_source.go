@@ -0,0 +1,353 @@
+package dastard
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/usnistgov/dastard/ljh"
+)
+
+// LJHReplaySource replays the records stored in a directory of LJH 2.2 files, as if
+// they were arriving from hardware. Because LJH files contain only triggered records,
+// the gaps between records are filled by linear interpolation between the last sample of
+// one record and the first sample of the next. Frame numbers and times come from the
+// RowCount and TimeCode of each record, so re-triggered records keep consistent times.
+type LJHReplaySource struct {
+	directory      string
+	fastAsPossible bool
+	signed         bool
+	fileNames      []string
+	channels       []*ljhReplayChannel
+	blockLen       int           // samples per data block
+	timeperbuf     time.Duration // data duration of one block
+	AnySource
+}
+
+// NewLJHReplaySource creates a new LJHReplaySource. It must be configured with a
+// directory to replay before it is started.
+func NewLJHReplaySource() *LJHReplaySource {
+	rs := new(LJHReplaySource)
+	rs.name = "LJHReplay"
+	return rs
+}
+
+// LJHReplaySourceConfig holds the arguments needed to call LJHReplaySource.Configure by RPC
+type LJHReplaySourceConfig struct {
+	Directory      string // replay all *.ljh files in this directory, one channel per file
+	FastAsPossible bool   // if false, pace the replay at the original sample rate
+	Signed         bool   // whether to treat the raw data as signed
+}
+
+// Configure sets the directory of LJH files to replay and the pacing.
+func (rs *LJHReplaySource) Configure(config *LJHReplaySourceConfig) error {
+	rs.sourceStateLock.Lock()
+	defer rs.sourceStateLock.Unlock()
+	if rs.sourceState != Inactive {
+		return fmt.Errorf("cannot Configure an LJHReplaySource if it's not Inactive")
+	}
+	fileNames, err := filepath.Glob(filepath.Join(config.Directory, "*.ljh"))
+	if err != nil {
+		return err
+	}
+	if len(fileNames) == 0 {
+		return fmt.Errorf("LJHReplaySource found no *.ljh files in directory '%s'", config.Directory)
+	}
+	rs.directory = config.Directory
+	rs.fastAsPossible = config.FastAsPossible
+	rs.signed = config.Signed
+	rs.fileNames = fileNames
+	return nil
+}
+
+// ljhReplayChannel holds the state of one channel (one LJH file) being replayed
+// as a continuous data stream.
+type ljhReplayChannel struct {
+	reader     *ljh.Reader
+	record     *ljh.PulseRecord // the record now being replayed, or nil after EOF
+	recFirst   FrameIndex       // frame number of record.Pulse[0]
+	lastFrame  FrameIndex       // frame number of the last sample of the previous record
+	lastValue  RawType          // value of the last sample of the previous record
+	hasLast    bool             // whether lastFrame and lastValue are valid
+	keyFrame   FrameIndex       // frame number of the most recent record's trigger
+	keyTime    time.Time        // time of the most recent record's trigger
+	nrecords   int
+	firstError error
+}
+
+// nextRecord reads the next record from the file. At EOF, ch.record becomes nil.
+func (ch *ljhReplayChannel) nextRecord() {
+	if ch.record != nil {
+		n := len(ch.record.Pulse)
+		ch.lastFrame = ch.recFirst + FrameIndex(n-1)
+		ch.lastValue = RawType(ch.record.Pulse[n-1])
+		ch.hasLast = true
+	}
+	for {
+		pr, err := ch.reader.NextPulse()
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				ch.firstError = err
+			}
+			ch.record = nil
+			return
+		}
+		if len(pr.Pulse) == 0 {
+			continue
+		}
+		trigFrame := FrameIndex(pr.RowCount)
+		if ch.reader.NumberOfRows > 0 {
+			trigFrame /= FrameIndex(ch.reader.NumberOfRows)
+		}
+		ch.record = pr
+		ch.recFirst = trigFrame - FrameIndex(ch.reader.Presamples)
+		ch.keyFrame = trigFrame
+		ch.keyTime = time.Unix(0, pr.TimeCode*1000)
+		ch.nrecords++
+		return
+	}
+}
+
+// fill puts into data the values of the frames starting at firstFrame. Where no
+// record covers a frame, the value is interpolated between the neighboring records
+// (or held constant before the first and after the last record).
+func (ch *ljhReplayChannel) fill(data []RawType, firstFrame FrameIndex) {
+	for i := range data {
+		f := firstFrame + FrameIndex(i)
+		for ch.record != nil && f >= ch.recFirst+FrameIndex(len(ch.record.Pulse)) {
+			ch.nextRecord()
+		}
+		switch {
+		case ch.record == nil:
+			data[i] = ch.lastValue
+		case f >= ch.recFirst:
+			data[i] = RawType(ch.record.Pulse[f-ch.recFirst])
+		case !ch.hasLast:
+			data[i] = RawType(ch.record.Pulse[0])
+		default:
+			next := float64(ch.record.Pulse[0])
+			prev := float64(ch.lastValue)
+			frac := float64(f-ch.lastFrame) / float64(ch.recFirst-ch.lastFrame)
+			data[i] = RawType(prev + frac*(next-prev) + 0.5)
+		}
+	}
+}
+
+// Sample opens all the LJH files and determines the number of channels and the
+// sample rate. It is an error for the files to disagree on the sample rate.
+func (rs *LJHReplaySource) Sample() error {
+	if len(rs.fileNames) == 0 {
+		return fmt.Errorf("LJHReplaySource has no files to replay; configure it first")
+	}
+	rs.closeFiles()
+	for _, fname := range rs.fileNames {
+		r, err := ljh.OpenReader(fname)
+		if err != nil {
+			rs.closeFiles()
+			return err
+		}
+		rs.channels = append(rs.channels, &ljhReplayChannel{reader: r})
+		if r.VersionNumber != ljh.Version2_2 {
+			rs.closeFiles()
+			return fmt.Errorf("LJHReplaySource can replay only LJH 2.2 files, not '%s'", fname)
+		}
+		if r.FramesPerSample > 1 {
+			rs.closeFiles()
+			return fmt.Errorf("LJHReplaySource cannot replay decimated data (%d frames per sample) in '%s'",
+				r.FramesPerSample, fname)
+		}
+		if r.Timebase <= 0 {
+			rs.closeFiles()
+			return fmt.Errorf("LJHReplaySource file '%s' has invalid Timebase %v", fname, r.Timebase)
+		}
+	}
+	sort.SliceStable(rs.channels, func(i, j int) bool {
+		return rs.channels[i].reader.ChannelIndex < rs.channels[j].reader.ChannelIndex
+	})
+
+	timebase := rs.channels[0].reader.Timebase
+	for _, ch := range rs.channels {
+		if math.Abs(ch.reader.Timebase/timebase-1) > 1e-6 {
+			rs.closeFiles()
+			return fmt.Errorf("LJHReplaySource files have different Timebase values %v and %v",
+				timebase, ch.reader.Timebase)
+		}
+	}
+	rs.nchan = len(rs.channels)
+	rs.sampleRate = 1.0 / timebase
+	rs.samplePeriod = time.Duration(roundint(1e9 * timebase))
+	rs.readPeriod()
+	return nil
+}
+
+// readPeriod computes the size and duration of each data block: about 50 ms of data.
+func (rs *LJHReplaySource) readPeriod() {
+	rs.blockLen = roundint(0.05 * rs.sampleRate)
+	if rs.blockLen < 1 {
+		rs.blockLen = 1
+	}
+	rs.timeperbuf = time.Duration(float64(time.Second) * float64(rs.blockLen) / rs.sampleRate)
+}
+
+// closeFiles closes all open LJH files.
+func (rs *LJHReplaySource) closeFiles() {
+	for _, ch := range rs.channels {
+		ch.reader.Close()
+	}
+	rs.channels = nil
+}
+
+// PrepareChannels sets up the channel names, numbers, and row/column codes from the
+// information in the LJH file headers.
+func (rs *LJHReplaySource) PrepareChannels() error {
+	rs.channelsPerPixel = 1
+	rs.chanNames = make([]string, rs.nchan)
+	rs.chanNumbers = make([]int, rs.nchan)
+	rs.rowColCodes = make([]RowColCode, rs.nchan)
+	known := make(map[string]bool)
+	for i, ch := range rs.channels {
+		r := ch.reader
+		name := r.ChanName
+		if name == "" {
+			name = fmt.Sprintf("chan%d", r.ChannelIndex)
+		}
+		if known[name] {
+			return fmt.Errorf("LJHReplaySource found channel name '%s' in more than one file", name)
+		}
+		known[name] = true
+		rs.chanNames[i] = name
+		rs.chanNumbers[i] = r.ChannelIndex
+		if r.NumberOfRows > 0 && r.NumberOfColumns > 0 {
+			rs.rowColCodes[i] = rcCode(r.RowNum, r.ColumnNum, r.NumberOfRows, r.NumberOfColumns)
+		} else {
+			rs.rowColCodes[i] = rcCode(0, i, 1, rs.nchan)
+		}
+	}
+	firstchan := rs.chanNumbers[0]
+	lastchan := rs.chanNumbers[rs.nchan-1]
+	rs.groupKeysSorted = []GroupIndex{{Firstchan: firstchan, Nchan: lastchan + 1 - firstchan}}
+	return nil
+}
+
+// StartRun reads the first record of each file and launches the goroutine that
+// generates the continuous data stream.
+func (rs *LJHReplaySource) StartRun() error {
+	var nextFrame FrameIndex = math.MaxInt64
+	for _, ch := range rs.channels {
+		ch.nextRecord()
+		if ch.firstError != nil {
+			rs.closeFiles()
+			return ch.firstError
+		}
+		if ch.record != nil && ch.recFirst < nextFrame {
+			nextFrame = ch.recFirst
+		}
+	}
+	if nextFrame == math.MaxInt64 {
+		rs.closeFiles()
+		return fmt.Errorf("LJHReplaySource found no records in directory '%s'", rs.directory)
+	}
+	rs.nextFrameNum = nextFrame
+
+	go func() {
+		log.Printf("starting LJHReplaySource with %d channels from %s, fast=%t\n",
+			rs.nchan, rs.directory, rs.fastAsPossible)
+		defer close(rs.nextBlock)
+		defer rs.closeFiles()
+
+		// A receive from a closed channel never blocks, so it paces the "as fast as possible" mode.
+		var pacer <-chan time.Time
+		if rs.fastAsPossible {
+			ready := make(chan time.Time)
+			close(ready)
+			pacer = ready
+		} else {
+			ticker := time.NewTicker(rs.timeperbuf)
+			defer ticker.Stop()
+			pacer = ticker.C
+		}
+		heartbeatTicker := time.NewTicker(1 * time.Second)
+		defer heartbeatTicker.Stop()
+		blocksSentSinceLastHeartbeat := 0
+		for {
+			select {
+			case <-rs.abortSelf:
+				return
+			case <-heartbeatTicker.C:
+				rs.sendHeartbeat(blocksSentSinceLastHeartbeat)
+				blocksSentSinceLastHeartbeat = 0
+			case <-pacer:
+				block, done := rs.makeBlock()
+				select {
+				case <-rs.abortSelf:
+					return
+				case rs.nextBlock <- block:
+				}
+				rs.lastread = time.Now()
+				blocksSentSinceLastHeartbeat++
+				if done {
+					rs.sendHeartbeat(blocksSentSinceLastHeartbeat)
+					log.Printf("LJHReplaySource reached the end of all files in %s\n", rs.directory)
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// makeBlock generates the next data block. It returns done=true if every file
+// has been replayed to the end.
+func (rs *LJHReplaySource) makeBlock() (block *dataBlock, done bool) {
+	block = new(dataBlock)
+	block.segments = make([]DataSegment, rs.nchan)
+	firstFrame := rs.nextFrameNum
+	done = true
+	var key *ljhReplayChannel
+	for channelIndex, ch := range rs.channels {
+		data := make([]RawType, rs.blockLen)
+		ch.fill(data, firstFrame)
+		if rs.signed {
+			signExtend16(data)
+		}
+		if ch.firstError != nil {
+			block.err = ch.firstError
+			return block, true
+		}
+		if ch.record != nil {
+			done = false
+		}
+		if ch.nrecords > 0 && (key == nil || ch.keyFrame > key.keyFrame) {
+			key = ch
+		}
+		block.segments[channelIndex] = DataSegment{
+			rawData:         data,
+			signed:          rs.signed,
+			framesPerSample: 1,
+			framePeriod:     rs.samplePeriod,
+			firstFramenum:   firstFrame,
+		}
+	}
+	// Find the time of the first frame from the most recently read record of any channel.
+	firstTime := key.keyTime.Add(time.Duration(firstFrame-key.keyFrame) * rs.samplePeriod)
+	for i := range block.segments {
+		block.segments[i].firstTime = firstTime
+	}
+	rs.nextFrameNum += FrameIndex(rs.blockLen)
+	return block, done
+}
+
+// sendHeartbeat reports the amount of data replayed in nblocks blocks.
+func (rs *LJHReplaySource) sendHeartbeat(nblocks int) {
+	if rs.heartbeats == nil {
+		return
+	}
+	mb := float64(nblocks*rs.blockLen*2*rs.nchan) / 1e6
+	rs.heartbeats <- Heartbeat{Running: true,
+		Time:       rs.timeperbuf.Seconds() * float64(nblocks),
+		HWactualMB: mb, DataMB: mb}
+}
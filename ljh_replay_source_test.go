@@ -0,0 +1,129 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/usnistgov/dastard/ljh"
+)
+
+// writeReplayTestFile writes an LJH file with one record triggered at each of trigFrames.
+// Record times are 10 µs per frame after an arbitrary offset.
+func writeReplayTestFile(t *testing.T, fname string, name string, cnum, row int, trigFrames []int) {
+	w := ljh.Writer{FileName: fname, Samples: 50, Presamples: 10, FramesPerSample: 1,
+		Timebase: 1e-5, NumberOfRows: 2, NumberOfColumns: 1, RowNum: row, ChanName: name,
+		ChannelNumberMatchingName: cnum}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]uint16, w.Samples)
+	for _, tf := range trigFrames {
+		for i := range data {
+			data[i] = uint16(1000 + tf + i)
+		}
+		if err := w.WriteRecord(int64(tf), int64(1e15)+int64(tf*10), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+}
+
+func TestLJHReplay(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ljh_replay_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rs := NewLJHReplaySource()
+	config := LJHReplaySourceConfig{Directory: tempDir, FastAsPossible: true}
+	if err := rs.Configure(&config); err == nil {
+		t.Errorf("LJHReplaySource.Configure() succeeded on a directory with no LJH files")
+	}
+	writeReplayTestFile(t, filepath.Join(tempDir, "test_chan2.ljh"), "chan2", 2, 1, []int{2000})
+	writeReplayTestFile(t, filepath.Join(tempDir, "test_chan1.ljh"), "chan1", 1, 0, []int{1000, 3000})
+	if err := rs.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if rs.nchan != 2 {
+		t.Errorf("LJHReplaySource.nchan=%d, want 2", rs.nchan)
+	}
+	if rs.samplePeriod != 10*time.Microsecond {
+		t.Errorf("LJHReplaySource.samplePeriod=%v, want 10 µs", rs.samplePeriod)
+	}
+	if err := rs.PrepareChannels(); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"chan1", "chan2"} {
+		if rs.chanNames[i] != name || rs.chanNumbers[i] != i+1 {
+			t.Errorf("LJHReplaySource channel %d is %s (number %d), want %s (%d)",
+				i, rs.chanNames[i], rs.chanNumbers[i], name, i+1)
+		}
+	}
+
+	// Check the replayed data directly, without running the source.
+	for _, ch := range rs.channels {
+		ch.nextRecord()
+	}
+	rs.nextFrameNum = 990
+	block, done := rs.makeBlock()
+	if !done {
+		t.Errorf("LJHReplaySource.makeBlock() not done after all records were replayed")
+	}
+	if block.err != nil {
+		t.Error(block.err)
+	}
+	seg := block.segments[0]
+	if seg.firstFramenum != 990 {
+		t.Errorf("segment firstFramenum=%d, want 990", seg.firstFramenum)
+	}
+	wantTime := time.Unix(0, (int64(1e15)+9900)*1000)
+	if !seg.firstTime.Equal(wantTime) {
+		t.Errorf("segment firstTime=%v, want %v", seg.firstTime, wantTime)
+	}
+	tests := []struct {
+		channel int
+		frame   int
+		want    RawType
+	}{
+		{0, 990, 2000},  // first sample of first record
+		{0, 1039, 2049}, // last sample of first record
+		{0, 2015, 3025}, // halfway between records: interpolated
+		{0, 2990, 4000}, // first sample of second record
+		{0, 3039, 4049}, // last sample of second record
+		{0, 5000, 4049}, // after last record: held constant
+		{1, 990, 3000},  // before first record: held constant
+		{1, 1990, 3000},
+		{1, 2039, 3049},
+		{1, 2500, 3049},
+	}
+	for _, test := range tests {
+		v := block.segments[test.channel].rawData[test.frame-990]
+		if v != test.want {
+			t.Errorf("channel %d frame %d has value %d, want %d", test.channel, test.frame, v, test.want)
+		}
+	}
+	rs.closeFiles()
+
+	// Now run the source to the end of the files.
+	rs.noProcess = true
+	ds := DataSource(rs)
+	if err := Start(ds, nil, 10, 50); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ds.Running(); i++ {
+		if i > 1000 {
+			t.Fatal("LJHReplaySource did not stop at the end of its files")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,173 @@
+package dastard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunManifest is a machine-readable summary of one writing run. It is written as JSON to
+// the run directory (e.g., 20200102_run0003_manifest.json) when writing starts, and again,
+// with Complete set and the final file list and record counts, when writing stops.
+type RunManifest struct {
+	Complete         bool // false while writing is still under way
+	Build            BuildInfo
+	SourceName       string
+	Source           *SourceConfigs `json:",omitempty"` // configuration of the source
+	Started          time.Time
+	Stopped          time.Time
+	StopReason       string // why writing stopped on its own ("" if stopped on request)
+	Directory        string
+	Limits           WritingLimits
+	Rotation         RotationPolicy
+	MapFile          string
+	Channels         []ManifestChannel
+	Triggers         []FullTriggerState // as when writing started
+	GroupTrigger     GroupTriggerState
+	Files            []ManifestFile
+	DataDrops        int    // number of data drops seen while writing
+	DroppedFrames    int    // total frames lost in those drops
+	ExternalTriggers int    // number of external triggers seen while writing
+	Comment          string // contents of comment.txt, if any
+}
+
+// ManifestChannel describes how one channel's records were made.
+type ManifestChannel struct {
+	Index       int
+	Name        string
+	Number      int
+	NSamples    int
+	NPresamples int
+	Decimation  int
+	Projectors  string // the projectors' model description ("" if none)
+}
+
+// ManifestFile describes one file written in a run. Per-channel files that were never
+// created (because the channel saw no triggers) are not listed.
+type ManifestFile struct {
+	Filename string
+	Format   string // "ljh", "ljh3", "off", "raw", "experiment_state", "external_trigger", "data_drop", or "comment"
+	Channel  string `json:",omitempty"`
+	Segment  int
+	Records  int   // records (or, for raw files, chunks) written
+	Bytes    int64 // file size when writing stopped
+}
+
+// manifestFilename returns the manifest's name, given the run's filename pattern.
+func manifestFilename(filenamePattern string) string {
+	return fmt.Sprintf(filenamePattern, "manifest", "json")
+}
+
+// startManifest begins the manifest of a run that has just started writing, and writes it.
+func (ds *AnySource) startManifest(config *WriteControlConfig) error {
+	ws := ds.writingState.ComputeState()
+	m := &RunManifest{
+		Build:        Build,
+		SourceName:   ds.name,
+		Source:       config.SourceConfigsInternalOnly,
+		Started:      ws.Started,
+		Directory:    filepath.Dir(ws.FilenamePattern),
+		Limits:       ws.Limits,
+		Rotation:     ws.Rotation,
+		Triggers:     ds.ComputeFullTriggerState(),
+		GroupTrigger: ds.ComputeGroupTriggerState(),
+	}
+	if config.MapInternalOnly != nil {
+		m.MapFile = config.MapInternalOnly.Filename
+	}
+	for i, dsp := range ds.processors {
+		mc := ManifestChannel{Index: i, Name: dsp.Name, Number: ds.chanNumbers[i],
+			NSamples: dsp.NSamples, NPresamples: dsp.NPresamples, Decimation: 1}
+		if dsp.Decimate {
+			mc.Decimation = dsp.DecimateLevel
+		}
+		if dsp.HasProjectors() {
+			mc.Projectors = dsp.modelDescription
+		}
+		m.Channels = append(m.Channels, mc)
+	}
+	ds.manifest = m
+	return writeManifest(m, manifestFilename(ws.FilenamePattern))
+}
+
+// addManifestFiles adds to the manifest the per-channel files written in one segment,
+// with filenames following pattern. Call it before the writers are removed.
+func (ds *AnySource) addManifestFiles(pattern string, segment int) {
+	if ds.manifest == nil {
+		return
+	}
+	for _, dsp := range ds.processors {
+		dp := &dsp.DataPublisher
+		for _, ext := range dp.fileExtensions() {
+			mf := ManifestFile{Filename: fmt.Sprintf(pattern, dsp.Name, ext), Format: ext,
+				Channel: dsp.Name, Segment: segment}
+			switch ext {
+			case "ljh":
+				mf.Records = dp.LJH22.RecordsWritten
+			case "ljh3":
+				mf.Records = dp.LJH3.RecordsWritten
+			case "off":
+				mf.Records = dp.OFF.RecordsWritten()
+			case "raw":
+				mf.Records = dp.RawStream.ChunksWritten()
+			}
+			ds.manifest.Files = append(ds.manifest.Files, mf)
+		}
+	}
+}
+
+// finishManifest completes the manifest of a run that has just stopped writing, and
+// writes it. ws is the writing state from before writing stopped.
+func (ds *AnySource) finishManifest(ws *WritingState, stopReason string) error {
+	m := ds.manifest
+	if m == nil {
+		return nil
+	}
+	ds.manifest = nil
+	m.Complete = true
+	m.Stopped = time.Now()
+	m.StopReason = stopReason
+	commentFilename := filepath.Join(m.Directory, "comment.txt")
+	if comment, err := ioutil.ReadFile(commentFilename); err == nil {
+		m.Comment = string(comment)
+	}
+	runFiles := []ManifestFile{
+		{Filename: ws.ExperimentStateFilename, Format: "experiment_state"},
+		{Filename: ws.ExternalTriggerFilename, Format: "external_trigger"},
+		{Filename: ws.DataDropFilename, Format: "data_drop"},
+		{Filename: commentFilename, Format: "comment"},
+	}
+	var files []ManifestFile
+	for _, mf := range append(runFiles, m.Files...) {
+		info, err := os.Stat(mf.Filename)
+		if err != nil {
+			continue
+		}
+		mf.Bytes = info.Size()
+		files = append(files, mf)
+	}
+	m.Files = files
+	return writeManifest(m, manifestFilename(ws.FilenamePattern))
+}
+
+// writeManifest writes m as JSON. It writes a temporary file first, then renames it, so
+// readers never see a partial manifest.
+func writeManifest(m *RunManifest, filename string) error {
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpname := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpname, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write run manifest: %v", err)
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		return fmt.Errorf("could not write run manifest: %v", err)
+	}
+	log.Printf("Wrote run manifest %s\n", filename)
+	return nil
+}
@@ -0,0 +1,162 @@
+package dastard
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readManifest(t *testing.T, filename string) RunManifest {
+	var m RunManifest
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("could not read run manifest: %v", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("could not decode run manifest: %v", err)
+	}
+	return m
+}
+
+func TestRunManifest(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastardTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 2, name: "TestSource", sampleRate: 1000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.chanNumbers = []int{1, 2} // so the map has a pixel for each channel
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config, ext := testRecordWriteConfig(t, &ds, tmp)
+	config.SourceConfigsInternalOnly = &SourceConfigs{Triangle: &TriangleSourceConfig{Nchan: 2}}
+	config.MapInternalOnly = &Map{Filename: "/maps/test.cfg", Pixels: make([]Pixel, 2)}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl Start failed: %v", err)
+	}
+	filename := manifestFilename(ds.ComputeWritingState().FilenamePattern)
+
+	m := readManifest(t, filename)
+	if m.Complete {
+		t.Error("run manifest is Complete before writing stopped")
+	}
+	if m.SourceName != "TestSource" || m.Build != Build || m.MapFile != "/maps/test.cfg" {
+		t.Errorf("run manifest SourceName=%q, Build=%v, MapFile=%q", m.SourceName, m.Build, m.MapFile)
+	}
+	if m.Source == nil || m.Source.Triangle == nil || m.Source.Triangle.Nchan != 2 {
+		t.Errorf("run manifest Source=%v, want the triangle source configuration", m.Source)
+	}
+	if len(m.Channels) != 2 || m.Channels[1].NSamples != 1024 || m.Channels[1].NPresamples != 256 {
+		t.Errorf("run manifest Channels=%v, want 2 channels with 1024 samples, 256 presamples", m.Channels)
+	}
+	if len(m.Triggers) == 0 {
+		t.Error("run manifest has no trigger states")
+	}
+
+	// Write 3 records in channel 0 only; note a data drop and an external trigger.
+	dp0 := &ds.processors[0].DataPublisher
+	for i := 0; i < 3; i++ {
+		rec := &DataRecord{data: make([]RawType, 1024), presamples: 256, trigTime: time.Now(),
+			modelCoefs: make([]float64, 1)}
+		if err := dp0.PublishData([]*DataRecord{rec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.HandleDataDrop(5, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.HandleExternalTriggers([]int64{1000, 2000}); err != nil {
+		t.Fatal(err)
+	}
+	comment := "testing the manifest\n"
+	if err := ioutil.WriteFile(filepath.Join(m.Directory, "comment.txt"), []byte(comment), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.stopWriting("testing"); err != nil {
+		t.Fatal(err)
+	}
+
+	m = readManifest(t, filename)
+	if !m.Complete || m.StopReason != "testing" || m.Stopped.Before(m.Started) {
+		t.Errorf("run manifest Complete=%v, StopReason=%q, Started=%v, Stopped=%v", m.Complete,
+			m.StopReason, m.Started, m.Stopped)
+	}
+	if m.DataDrops != 1 || m.DroppedFrames != 5 || m.ExternalTriggers != 2 || m.Comment != comment {
+		t.Errorf("run manifest DataDrops=%d, DroppedFrames=%d, ExternalTriggers=%d, Comment=%q",
+			m.DataDrops, m.DroppedFrames, m.ExternalTriggers, m.Comment)
+	}
+	formats := make(map[string]ManifestFile)
+	for _, mf := range m.Files {
+		formats[mf.Format] = mf
+		if mf.Bytes <= 0 {
+			t.Errorf("run manifest file %s has size %d", mf.Filename, mf.Bytes)
+		}
+	}
+	for _, format := range []string{"experiment_state", "external_trigger", "data_drop", "comment", ext} {
+		if _, ok := formats[format]; !ok {
+			t.Errorf("run manifest lacks a %s file", format)
+		}
+	}
+	if len(m.Files) != 5 {
+		t.Errorf("run manifest lists %d files, want 5 (the %s file of the channel with no records is omitted)",
+			len(m.Files), ext)
+	}
+	if mf := formats[ext]; mf.Records != 3 || mf.Channel != ds.processors[0].Name {
+		t.Errorf("run manifest %s file %+v, want 3 records in channel %s", ext, mf, ds.processors[0].Name)
+	}
+}
+
+// TestManifestErrors tests that a manifest error doesn't leave writing half started, and that
+// an error closing the run's files doesn't leave the manifest incomplete.
+func TestManifestErrors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastardTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := AnySource{nchan: 2, name: "TestSource", sampleRate: 1000}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config, _ := testRecordWriteConfig(t, &ds, tmp)
+
+	// A source configuration that can't be encoded as JSON makes the manifest fail.
+	config.SourceConfigsInternalOnly = &SourceConfigs{Triangle: &TriangleSourceConfig{SampleRate: math.NaN()}}
+	if err := ds.WriteControl(config); err == nil {
+		t.Error("WriteControl Start should fail when the run manifest can't be written")
+	}
+	dp0 := &ds.processors[0].DataPublisher
+	if ds.WritingIsActive() || dp0.HasLJH22() || dp0.HasOFF() {
+		t.Error("writing is active after WriteControl Start failed")
+	}
+	config.SourceConfigsInternalOnly = nil
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl Start failed after an earlier failure: %v", err)
+	}
+	filename := manifestFilename(ds.ComputeWritingState().FilenamePattern)
+
+	// Make the final write to the experiment state file fail.
+	if err := ds.SetExperimentStateLabel(time.Now(), "START"); err != nil {
+		t.Fatal(err)
+	}
+	ds.writingState.experimentStateFile.Close()
+	if err := ds.WriteControl(&WriteControlConfig{Request: "Stop"}); err == nil {
+		t.Error("WriteControl Stop should fail when the experiment state file can't be written")
+	}
+	if m := readManifest(t, filename); !m.Complete || len(m.Files) == 0 {
+		t.Errorf("run manifest Complete=%v with %d files after a failed Stop, want complete with files",
+			m.Complete, len(m.Files))
+	}
+	if ds.WritingIsActive() {
+		t.Error("writing is active after WriteControl Stop")
+	}
+}
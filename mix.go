@@ -37,7 +37,7 @@ type Mix struct {
 // MixRetardFb mixes err into fbs, alters fbs in place to contain the mixed values
 // consecutive calls must be on consecutive data.
 // The following ASSUMES that error signals are signed. That holds for Lancero
-// TDM systems, at least, and that is the only source that uses Mix.
+// TDM systems, at least, and those are the only sources that use Mix.
 func (m *Mix) MixRetardFb(fbs *[]RawType, errs *[]RawType) {
 	const mask = ^RawType(0x03)
 	if m.errorScale == 0.0 {
@@ -0,0 +1,225 @@
+package dastard
+
+import (
+	"fmt"
+	"math/cmplx"
+	"strings"
+	"time"
+
+	"gonum.org/v1/gonum/dsp/fourier"
+	"gonum.org/v1/gonum/dsp/window"
+)
+
+// noisePSDWindows maps each allowed (upper case) NoisePSDConfig.WindowFunction to its window.
+var noisePSDWindows = map[string]func([]float64) []float64{
+	"RECTANGULAR":    window.Rectangular,
+	"HANN":           window.Hann,
+	"HAMMING":        window.Hamming,
+	"BLACKMAN":       window.Blackman,
+	"BLACKMANHARRIS": window.BlackmanHarris,
+	"FLATTOP":        window.FlatTop,
+}
+
+// NoisePSDConfig is the RPC-usable structure for StartNoisePSD
+type NoisePSDConfig struct {
+	ChannelIndices []int
+	WindowLength   int    // samples per FFT; need not be a power of 2
+	WindowFunction string // "Hann" (the default if empty), "Hamming", "Blackman", "BlackmanHarris", "FlatTop", or "Rectangular"
+}
+
+// NoisePSD accumulates an averaged power spectral density of one channel's continuous data
+// by Welch's method: windows of WindowLength samples, overlapping by half, each with its
+// mean removed, are tapered by the window function and their periodograms averaged.
+type NoisePSD struct {
+	windowLength   int
+	windowFunction string
+	window         []float64
+	windowPower    float64 // sum of squared window values
+	fft            *fourier.FFT
+	buffer         []float64 // samples not yet used by a full window
+	sampleRate     float64
+	sum            []float64 // sum of the one-sided periodograms
+	nAverages      int
+	started        time.Time
+}
+
+// NewNoisePSD returns a new, empty NoisePSD, or an error if the window length or function is not valid.
+func NewNoisePSD(windowLength int, windowFunction string) (*NoisePSD, error) {
+	if windowLength < 2 {
+		return nil, fmt.Errorf("noise PSD WindowLength=%d, must be at least 2", windowLength)
+	}
+	if windowFunction == "" {
+		windowFunction = "Hann"
+	}
+	wfunc, ok := noisePSDWindows[strings.ToUpper(windowFunction)]
+	if !ok {
+		return nil, fmt.Errorf("noise PSD window %q is not one of Hann, Hamming, Blackman, BlackmanHarris, FlatTop, Rectangular",
+			windowFunction)
+	}
+	n := &NoisePSD{windowLength: windowLength, windowFunction: windowFunction}
+	n.window = make([]float64, windowLength)
+	for i := range n.window {
+		n.window[i] = 1.0
+	}
+	wfunc(n.window)
+	for _, w := range n.window {
+		n.windowPower += w * w
+	}
+	n.fft = fourier.NewFFT(windowLength)
+	n.sum = make([]float64, windowLength/2+1)
+	n.started = time.Now()
+	return n, nil
+}
+
+// Reset discards all accumulated spectra and buffered data.
+func (n *NoisePSD) Reset() {
+	for i := range n.sum {
+		n.sum[i] = 0
+	}
+	n.nAverages = 0
+	n.buffer = n.buffer[:0]
+	n.started = time.Now()
+}
+
+// AddSegment adds the data of one segment to the PSD. A data drop (or a change in the
+// sample rate, which also resets the accumulated spectra) means buffered data cannot be
+// joined to the new segment, so they are discarded.
+func (n *NoisePSD) AddSegment(segment *DataSegment) {
+	if segment.framePeriod <= 0 || segment.framesPerSample <= 0 {
+		return // a PSD is meaningless without a sample rate
+	}
+	rate := 1.0 / (float64(segment.framesPerSample) * segment.framePeriod.Seconds())
+	if n.sampleRate != rate {
+		if n.sampleRate != 0 {
+			n.Reset()
+		}
+		n.sampleRate = rate
+	}
+	if segment.droppedFrames > 0 {
+		n.buffer = n.buffer[:0]
+	}
+	if segment.signed {
+		for _, v := range segment.rawData {
+			n.buffer = append(n.buffer, float64(signedRawType(v)))
+		}
+	} else {
+		for _, v := range segment.rawData {
+			n.buffer = append(n.buffer, float64(v))
+		}
+	}
+
+	step := n.windowLength / 2
+	if step < 1 {
+		step = 1
+	}
+	seq := make([]float64, n.windowLength)
+	var coefs []complex128
+	used := 0
+	for used+n.windowLength <= len(n.buffer) {
+		data := n.buffer[used : used+n.windowLength]
+		mean := 0.0
+		for _, v := range data {
+			mean += v
+		}
+		mean /= float64(n.windowLength)
+		for i, v := range data {
+			seq[i] = (v - mean) * n.window[i]
+		}
+		coefs = n.fft.Coefficients(coefs, seq)
+		for k, c := range coefs {
+			n.sum[k] += real(c * cmplx.Conj(c))
+		}
+		n.nAverages++
+		used += step
+	}
+	n.buffer = append(n.buffer[:0], n.buffer[used:]...)
+}
+
+// NoisePSDResult is the averaged noise power spectral density of one channel. PSD[k] is the
+// one-sided PSD (in raw units squared per Hz) at frequency k*FrequencyStep. PSD is nil if no
+// window of data has been accumulated yet.
+type NoisePSDResult struct {
+	ChannelIndex   int
+	WindowLength   int
+	WindowFunction string
+	SampleRate     float64
+	FrequencyStep  float64
+	NAverages      int
+	PSD            []float64
+	Started        time.Time
+}
+
+// result returns the current averaged PSD.
+func (n *NoisePSD) result(channelIndex int) *NoisePSDResult {
+	r := &NoisePSDResult{ChannelIndex: channelIndex, WindowLength: n.windowLength,
+		WindowFunction: n.windowFunction, SampleRate: n.sampleRate, NAverages: n.nAverages,
+		Started: n.started}
+	if n.sampleRate > 0 {
+		r.FrequencyStep = n.sampleRate / float64(n.windowLength)
+	}
+	if n.nAverages == 0 {
+		return r
+	}
+	norm := 1.0 / (float64(n.nAverages) * n.sampleRate * n.windowPower)
+	r.PSD = make([]float64, len(n.sum))
+	for k, s := range n.sum {
+		r.PSD[k] = s * norm
+		// Double all but the DC and (for even lengths) Nyquist bins, to make the PSD one-sided.
+		if k > 0 && !(n.windowLength%2 == 0 && k == n.windowLength/2) {
+			r.PSD[k] *= 2
+		}
+	}
+	return r
+}
+
+// StartNoisePSD starts (or restarts, discarding earlier results) noise PSD accumulation on
+// each channel in config.ChannelIndices.
+func (ds *AnySource) StartNoisePSD(config *NoisePSDConfig) error {
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= len(ds.processors) {
+			return fmt.Errorf("channelIndex out of range, channelIndex=%v, len(ds.processors)=%v",
+				channelIndex, len(ds.processors))
+		}
+	}
+	if _, err := NewNoisePSD(config.WindowLength, config.WindowFunction); err != nil {
+		return err
+	}
+	for _, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].noisePSD, _ = NewNoisePSD(config.WindowLength, config.WindowFunction)
+	}
+	return nil
+}
+
+// StopNoisePSD stops noise PSD accumulation on the given channels (on all channels, if
+// channelIndices is empty), discarding their results.
+func (ds *AnySource) StopNoisePSD(channelIndices []int) error {
+	dsps, err := ds.noisePSDProcessors(channelIndices)
+	if err != nil {
+		return err
+	}
+	for _, dsp := range dsps {
+		dsp.noisePSD = nil
+	}
+	return nil
+}
+
+// NoisePSDs returns the averaged noise PSDs of the given channels (of all channels
+// accumulating a PSD, if channelIndices is empty).
+func (ds *AnySource) NoisePSDs(channelIndices []int) ([]*NoisePSDResult, error) {
+	dsps, err := ds.noisePSDProcessors(channelIndices)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*NoisePSDResult, 0, len(dsps))
+	for _, dsp := range dsps {
+		results = append(results, dsp.noisePSD.result(dsp.channelIndex))
+	}
+	return results, nil
+}
+
+// noisePSDProcessors returns the processors for the given channels, checking that each one
+// is accumulating a noise PSD. If channelIndices is empty, return all processors that are.
+func (ds *AnySource) noisePSDProcessors(channelIndices []int) ([]*DataStreamProcessor, error) {
+	hasNoisePSD := func(dsp *DataStreamProcessor) bool { return dsp.noisePSD != nil }
+	return ds.processorsForIndices(channelIndices, hasNoisePSD, "is not accumulating a noise PSD")
+}
@@ -0,0 +1,115 @@
+package dastard
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestNoisePSD(t *testing.T) {
+	if _, err := NewNoisePSD(1, "Hann"); err == nil {
+		t.Error("NewNoisePSD with window length 1 should fail")
+	}
+	if _, err := NewNoisePSD(64, "triangle-ish"); err == nil {
+		t.Error("NewNoisePSD with unknown window function should fail")
+	}
+
+	// White noise of variance sigma^2 has a one-sided PSD of 2*sigma^2/sampleRate.
+	const nwin = 256
+	const sigma = 20.0
+	const period = 10 * time.Microsecond
+	sampleRate := 1.0 / period.Seconds()
+	for _, wname := range []string{"", "rectangular", "Blackman"} {
+		n, err := NewNoisePSD(nwin, wname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rng := rand.New(rand.NewSource(1))
+		for seg := 0; seg < 50; seg++ {
+			data := make([]RawType, 1000)
+			for i := range data {
+				data[i] = RawType(30000 + rng.NormFloat64()*sigma)
+			}
+			n.AddSegment(&DataSegment{rawData: data, framesPerSample: 1, framePeriod: period})
+		}
+		r := n.result(3)
+		if r.ChannelIndex != 3 || len(r.PSD) != nwin/2+1 || r.SampleRate != sampleRate {
+			t.Fatalf("NoisePSD result has channel %d, %d PSD values, rate %v, want 3, %d, %v",
+				r.ChannelIndex, len(r.PSD), r.SampleRate, nwin/2+1, sampleRate)
+		}
+		if r.NAverages != (50*1000-nwin)/(nwin/2)+1 {
+			t.Errorf("NoisePSD averaged %d windows, want %d", r.NAverages, (50*1000-nwin)/(nwin/2)+1)
+		}
+		if math.Abs(r.FrequencyStep-sampleRate/nwin) > 1e-9 {
+			t.Errorf("NoisePSD FrequencyStep=%v, want %v", r.FrequencyStep, sampleRate/nwin)
+		}
+		mean := 0.0
+		for _, p := range r.PSD[1 : nwin/2] {
+			mean += p
+		}
+		mean /= float64(nwin/2 - 1)
+		expect := 2 * (sigma*sigma + 1.0/12) / sampleRate // includes quantization noise
+		if math.Abs(mean/expect-1) > 0.05 {
+			t.Errorf("NoisePSD window %q white noise level %v, want %v", wname, mean, expect)
+		}
+	}
+
+	// A sine wave should put its power at its own frequency.
+	n, _ := NewNoisePSD(nwin, "Hann")
+	data := make([]RawType, 4*nwin)
+	const bin = 20
+	for i := range data {
+		data[i] = RawType(int16(1000 * math.Sin(2*math.Pi*bin*float64(i)/nwin)))
+	}
+	n.AddSegment(&DataSegment{rawData: data, signed: true, framesPerSample: 1, framePeriod: period})
+	r := n.result(0)
+	peak := 0
+	for k, p := range r.PSD {
+		if p > r.PSD[peak] {
+			peak = k
+		}
+	}
+	if peak != bin {
+		t.Errorf("NoisePSD of sine wave peaks at bin %d, want %d", peak, bin)
+	}
+
+	// A data drop or a change of rate discards buffered data; a new rate discards results.
+	nbefore := r.NAverages
+	n.AddSegment(&DataSegment{rawData: data[:nwin/2-1], framesPerSample: 1, framePeriod: period})
+	n.AddSegment(&DataSegment{rawData: data[:2], framesPerSample: 1, framePeriod: period, droppedFrames: 5})
+	if n.nAverages != nbefore || len(n.buffer) != 2 {
+		t.Errorf("NoisePSD after data drop has %d averages and %d buffered, want %d and 2", n.nAverages, len(n.buffer), nbefore)
+	}
+	n.AddSegment(&DataSegment{rawData: data[:2], framesPerSample: 2, framePeriod: period})
+	if n.nAverages != 0 || len(n.buffer) != 2 || n.sampleRate != sampleRate/2 {
+		t.Errorf("NoisePSD after rate change has %d averages, %d buffered, rate %v", n.nAverages, len(n.buffer), n.sampleRate)
+	}
+	if r := n.result(0); r.PSD != nil {
+		t.Errorf("NoisePSD result with no averages has PSD %v, want nil", r.PSD)
+	}
+
+	// Start and stop through a data source.
+	ds := AnySource{nchan: 4}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config := &NoisePSDConfig{ChannelIndices: []int{0, 4}, WindowLength: 128}
+	if err := ds.StartNoisePSD(config); err == nil {
+		t.Error("StartNoisePSD succeeded with channel index out of range")
+	}
+	config.ChannelIndices = []int{0, 2}
+	if err := ds.StartNoisePSD(config); err != nil {
+		t.Error(err)
+	}
+	if _, err := ds.NoisePSDs([]int{1}); err == nil {
+		t.Error("NoisePSDs succeeded on a channel not accumulating a PSD")
+	}
+	if err := ds.StopNoisePSD([]int{0}); err != nil {
+		t.Error(err)
+	}
+	if results, err := ds.NoisePSDs(nil); err != nil || len(results) != 1 || results[0].ChannelIndex != 2 {
+		t.Errorf("NoisePSDs(nil) returned %v, %v, want channel 2 only", results, err)
+	}
+}
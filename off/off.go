@@ -1,4 +1,4 @@
-// Package off provides classes that write OFF files
+// Package off provides classes that write and read OFF files
 // OFF files store TES pulses projected into a linear basis
 // OFF files have a JSON header followed by a single newline
 // after the header records are written sequentially in little endian format
@@ -8,16 +8,23 @@
 // 8-15     int64     framecount
 // 16-23    int64     timestamp from time.Time.UnixNano()
 // 24-27    float32   pretriggerMean (from raw data, not from modeled pulse, really shouldn't be neccesary, just in case for now!)
-// 28-31    float32   residualStdDev (in raw data space, not Mahalanobis distance)
-// 32-Z     float32   the NumberOfBases model coefficients of the pulse projected in to the model
-// Z = 31+4*NumberOfBases
+// 28-31    float32   pretriggerDelta (slope of the pretrigger data times the number of pretrigger samples)
+// 32-35    float32   residualStdDev (in raw data space, not Mahalanobis distance)
+// 36-39    float32   filtValue (optimally filtered pulse height, NaN if no filter was loaded)
+// 40-43    float32   filtPhase (arrival-time phase estimate in samples, NaN if no arrival-time filter was loaded)
+// 44-Z     float32   the NumberOfBases model coefficients of the pulse projected in to the model
+// Z = 43+4*NumberOfBases
 package off
 
 import (
 	"bufio"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"time"
 
@@ -25,8 +32,8 @@ import (
 	"gonum.org/v1/gonum/mat"
 )
 
-// Writer writes OFF files
-type Writer struct {
+// Header is the JSON header of an OFF file
+type Header struct {
 	ChannelIndex              int
 	ChannelName               string
 	ChannelNumberMatchingName int
@@ -40,6 +47,27 @@ type Writer struct {
 	CreationInfo              CreationInfo
 	ReadoutInfo               TimeDivisionMultiplexingInfo
 	PixelInfo                 PixelInfo
+}
+
+// FileFormat is the name of the file format stored in each file header.
+const FileFormat = "OFF"
+
+// FileFormatVersion is the version of the file format written by Writer.
+const FileFormatVersion = "0.4.0"
+
+// recordHeaderLength is the number of bytes in each record before the model coefficients.
+const recordHeaderLength = 44
+
+// readableVersions gives the record header length of each file format version that Reader
+// can read. Version 0.3.0 records lack the filtValue and filtPhase (bytes 36-43).
+var readableVersions = map[string]int64{
+	"0.3.0":           36,
+	FileFormatVersion: recordHeaderLength,
+}
+
+// Writer writes OFF files
+type Writer struct {
+	Header
 
 	// items not serialized to JSON header
 	recordsWritten int
@@ -62,8 +90,8 @@ func NewWriter(fileName string, ChannelIndex int, ChannelName string, ChannelNum
 	writer.MaxPresamples = MaxPresamples
 	writer.MaxSamples = MaxSamples
 	writer.FramePeriodSeconds = FramePeriodSeconds
-	writer.FileFormat = "OFF"
-	writer.FileFormatVersion = "0.3.0"
+	writer.FileFormat = FileFormat
+	writer.FileFormatVersion = FileFormatVersion
 	writer.NumberOfBases, _ = Projectors.Dims()
 	writer.ModelInfo = ModelInfo{Projectors: *NewArrayJsoner(Projectors), Basis: *NewArrayJsoner(Basis),
 		Description: ModelDescription, projectors: Projectors, basis: Basis}
@@ -159,7 +187,8 @@ func (w *Writer) WriteHeader() error {
 
 // WriteRecord writes a record to the file
 func (w *Writer) WriteRecord(recordSamples int32, recordPreSamples int32, framecount int64,
-	timestamp int64, pretriggerMean float32, pretriggerDelta float32, residualStdDev float32, data []float32) error {
+	timestamp int64, pretriggerMean float32, pretriggerDelta float32, residualStdDev float32,
+	filtValue float32, filtPhase float32, data []float32) error {
 	if len(data) != w.NumberOfBases {
 		return fmt.Errorf("wrong number of bases, have %v, want %v", len(data), w.NumberOfBases)
 	}
@@ -184,6 +213,12 @@ func (w *Writer) WriteRecord(recordSamples int32, recordPreSamples int32, framec
 	if _, err := w.writer.Write(getbytes.FromFloat32(residualStdDev)); err != nil {
 		return err
 	}
+	if _, err := w.writer.Write(getbytes.FromFloat32(filtValue)); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(getbytes.FromFloat32(filtPhase)); err != nil {
+		return err
+	}
 	if _, err := w.writer.Write(getbytes.FromSliceFloat32(data)); err != nil {
 		return err
 	}
@@ -219,3 +254,204 @@ func (w *Writer) CreateFile() error {
 	w.writer = bufio.NewWriterSize(w.file, 32768)
 	return nil
 }
+
+// Record is one pulse record read from an OFF file
+type Record struct {
+	RecordSamples    int32
+	RecordPreSamples int32
+	Framecount       int64
+	Timestamp        int64 // from time.Time.UnixNano()
+	PretriggerMean   float32
+	PretriggerDelta  float32
+	ResidualStdDev   float32
+	FiltValue        float32
+	FiltPhase        float32
+	ModelCoefs       []float32 // the NumberOfBases model coefficients
+}
+
+// Reader reads OFF files
+type Reader struct {
+	Header
+	recordsStart int64 // file offset of the first record
+	recordLength int64
+	coefsOffset  int64 // offset of the model coefficients within a record
+	nrecords     int
+	nextRecord   int
+	file         *os.File
+	reader       *bufio.Reader
+}
+
+// OpenReader returns an active OFF file reader, or an error.
+func OpenReader(fileName string) (*Reader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("OFF file '%s': %v", fileName, err)
+	}
+	return r, nil
+}
+
+// newReader parses the header, projectors, and basis of an open OFF file.
+func newReader(f *os.File) (*Reader, error) {
+	r := &Reader{file: f}
+	dec := json.NewDecoder(f)
+	if err := dec.Decode(&r.Header); err != nil {
+		return nil, fmt.Errorf("could not parse header: %v", err)
+	}
+	if r.FileFormat != FileFormat {
+		return nil, fmt.Errorf("has format '%s', want '%s'", r.FileFormat, FileFormat)
+	}
+	var ok bool
+	if r.coefsOffset, ok = readableVersions[r.FileFormatVersion]; !ok {
+		return nil, fmt.Errorf("has version '%s', which cannot be read", r.FileFormatVersion)
+	}
+	// The header ends where the decoder stopped reading, and is followed by one newline.
+	read, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := io.Copy(ioutil.Discard, dec.Buffered())
+	if err != nil {
+		return nil, err
+	}
+	headerLength := read - unread + 1
+	if _, err := f.Seek(headerLength, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r.reader = bufio.NewReaderSize(f, 32768)
+
+	mi := &r.ModelInfo
+	if mi.projectors, err = readArray(r.reader, &mi.Projectors); err != nil {
+		return nil, fmt.Errorf("could not read projectors: %v", err)
+	}
+	if mi.basis, err = readArray(r.reader, &mi.Basis); err != nil {
+		return nil, fmt.Errorf("could not read basis: %v", err)
+	}
+	if r.NumberOfBases != mi.Projectors.Rows || r.NumberOfBases != mi.Basis.Cols ||
+		mi.Projectors.Cols != mi.Basis.Rows {
+		return nil, fmt.Errorf("has NumberOfBases %d, but projectors are %dx%d and basis is %dx%d",
+			r.NumberOfBases, mi.Projectors.Rows, mi.Projectors.Cols, mi.Basis.Rows, mi.Basis.Cols)
+	}
+	r.recordsStart = headerLength + 8*int64(mi.Projectors.Rows*mi.Projectors.Cols+mi.Basis.Rows*mi.Basis.Cols)
+	r.recordLength = r.coefsOffset + 4*int64(r.NumberOfBases)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r.nrecords = int((info.Size() - r.recordsStart) / r.recordLength)
+	return r, nil
+}
+
+// readArray reads the float64 binary data of an array described by aj.
+func readArray(reader io.Reader, aj *ArrayJsoner) (*mat.Dense, error) {
+	if aj.Rows <= 0 || aj.Cols <= 0 {
+		return nil, fmt.Errorf("invalid size %dx%d", aj.Rows, aj.Cols)
+	}
+	data := make([]float64, aj.Rows*aj.Cols)
+	if err := binary.Read(reader, binary.LittleEndian, data); err != nil {
+		return nil, err
+	}
+	return mat.NewDense(aj.Rows, aj.Cols, data), nil
+}
+
+// Projectors returns the projectors (NumberOfBases x samples) that computed the model coefficients.
+func (r *Reader) Projectors() *mat.Dense {
+	return r.ModelInfo.projectors
+}
+
+// Basis returns the basis (samples x NumberOfBases) used to model pulses.
+func (r *Reader) Basis() *mat.Dense {
+	return r.ModelInfo.basis
+}
+
+// NumberOfRecords returns the number of complete records in the file when it was opened.
+func (r *Reader) NumberOfRecords() int {
+	return r.nrecords
+}
+
+// NextRecord returns the next record in the file, or io.EOF after the last one.
+func (r *Reader) NextRecord() (*Record, error) {
+	if r.nextRecord >= r.nrecords {
+		return nil, io.EOF
+	}
+	buf := make([]byte, r.recordLength)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return nil, err
+	}
+	r.nextRecord++
+	return r.parseRecord(buf), nil
+}
+
+// ReadRecord returns record number i (counting from 0). It does not change which record
+// NextRecord returns.
+func (r *Reader) ReadRecord(i int) (*Record, error) {
+	if i < 0 || i >= r.nrecords {
+		return nil, fmt.Errorf("record %d out of range [0, %d)", i, r.nrecords)
+	}
+	buf := make([]byte, r.recordLength)
+	if _, err := r.file.ReadAt(buf, r.recordsStart+int64(i)*r.recordLength); err != nil {
+		return nil, err
+	}
+	return r.parseRecord(buf), nil
+}
+
+// SeekRecord makes record number i (counting from 0) the next one that NextRecord returns.
+func (r *Reader) SeekRecord(i int) error {
+	if i < 0 || i > r.nrecords {
+		return fmt.Errorf("record %d out of range [0, %d]", i, r.nrecords)
+	}
+	if _, err := r.file.Seek(r.recordsStart+int64(i)*r.recordLength, io.SeekStart); err != nil {
+		return err
+	}
+	r.reader.Reset(r.file)
+	r.nextRecord = i
+	return nil
+}
+
+// parseRecord decodes one record from its bytes in the file. FiltValue and FiltPhase are
+// NaN in files of versions that don't store them.
+func (r *Reader) parseRecord(buf []byte) *Record {
+	le := binary.LittleEndian
+	f32 := func(b []byte) float32 { return math.Float32frombits(le.Uint32(b)) }
+	rec := &Record{
+		RecordSamples:    int32(le.Uint32(buf[0:])),
+		RecordPreSamples: int32(le.Uint32(buf[4:])),
+		Framecount:       int64(le.Uint64(buf[8:])),
+		Timestamp:        int64(le.Uint64(buf[16:])),
+		PretriggerMean:   f32(buf[24:]),
+		PretriggerDelta:  f32(buf[28:]),
+		ResidualStdDev:   f32(buf[32:]),
+		FiltValue:        float32(math.NaN()),
+		FiltPhase:        float32(math.NaN()),
+		ModelCoefs:       make([]float32, r.NumberOfBases),
+	}
+	if r.coefsOffset >= recordHeaderLength {
+		rec.FiltValue = f32(buf[36:])
+		rec.FiltPhase = f32(buf[40:])
+	}
+	for i := range rec.ModelCoefs {
+		rec.ModelCoefs[i] = f32(buf[r.coefsOffset+4*int64(i):])
+	}
+	return rec
+}
+
+// ModeledPulse returns the pulse that the record's model coefficients represent: the
+// basis times the coefficients.
+func (r *Reader) ModeledPulse(rec *Record) []float64 {
+	coefs := make([]float64, len(rec.ModelCoefs))
+	for i, c := range rec.ModelCoefs {
+		coefs[i] = float64(c)
+	}
+	var pulse mat.VecDense
+	pulse.MulVec(r.ModelInfo.basis, mat.NewVecDense(len(coefs), coefs))
+	return pulse.RawVector().Data
+}
+
+// Close closes the OFF file reader.
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -3,9 +3,12 @@ package off
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"testing"
 
+	"github.com/usnistgov/dastard/getbytes"
 	"gonum.org/v1/gonum/mat"
 )
 
@@ -53,19 +56,19 @@ func TestOff(t *testing.T) {
 	w.Flush()
 	stat, _ := os.Stat("off_test.off")
 	sizeHeader := stat.Size()
-	if err := w.WriteRecord(0, 0, 123456, 0, 0, 0, .123456, make([]float32, 3)); err != nil {
+	if err := w.WriteRecord(0, 0, 123456, 0, 0, 0, .123456, 1234.5, 0.25, make([]float32, 3)); err != nil {
 		t.Error(err)
 	}
 	w.Flush()
 	stat, _ = os.Stat("off_test.off")
-	expectSize := sizeHeader + 36 + 4*3
+	expectSize := sizeHeader + 44 + 4*3
 	if stat.Size() != expectSize {
 		t.Errorf("wrong size, want %v, have %v", expectSize, stat.Size())
 	}
 	if w.recordsWritten != 1 {
 		t.Error("wrong number of records written, want 1, have", w.recordsWritten)
 	}
-	if err := w.WriteRecord(0, 0, 0, 0, 0, 0, 0, make([]float32, 10)); err == nil {
+	if err := w.WriteRecord(0, 0, 0, 0, 0, 0, 0, 0, 0, make([]float32, 10)); err == nil {
 		t.Error("should have complained about wrong number of bases")
 	}
 	w.Close()
@@ -103,3 +106,164 @@ func TestOff(t *testing.T) {
 		t.Errorf("OFF file says MaxPresamples=%d, want %d", x.MaxSamples, maxsamp)
 	}
 }
+
+func TestReader(t *testing.T) {
+	nbases := 2
+	nsamples := 3
+	projectors := mat.NewDense(nbases, nsamples, []float64{1, 0, 0, 0, 1, 0.5})
+	basis := mat.NewDense(nsamples, nbases, []float64{1, 0, 0, 1, 2, 3})
+	fileName := "off_reader_test.off"
+	defer os.Remove(fileName)
+	w := NewWriter(fileName, 4, "chan5", 5, 1, nsamples, 9.6e-6, projectors, basis, "model for reader test",
+		"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder",
+		TimeDivisionMultiplexingInfo{NumberOfRows: 8, NumberOfColumns: 1, NumberOfChans: 8, RowNum: 4},
+		PixelInfo{XPosition: 10, YPosition: -20, Name: "pixel5"})
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	const nrecords = 5
+	for i := 0; i < nrecords; i++ {
+		coefs := []float32{float32(i), float32(10 * i)}
+		if err := w.WriteRecord(int32(nsamples), 1, int64(1000*i), int64(2000*i), 100, 0.5, 1.5,
+			float32(i)+0.25, 0.125, coefs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	r, err := OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.ChannelName != "chan5" || r.ChannelIndex != 4 || r.NumberOfBases != nbases {
+		t.Errorf("OFF header has ChannelName=%q, ChannelIndex=%d, NumberOfBases=%d", r.ChannelName,
+			r.ChannelIndex, r.NumberOfBases)
+	}
+	if r.ReadoutInfo.NumberOfRows != 8 || r.ReadoutInfo.RowNum != 4 || r.PixelInfo.Name != "pixel5" ||
+		r.PixelInfo.YPosition != -20 || r.ModelInfo.Description != "model for reader test" {
+		t.Errorf("OFF header has ReadoutInfo %+v, PixelInfo %+v, ModelInfo.Description %q", r.ReadoutInfo,
+			r.PixelInfo, r.ModelInfo.Description)
+	}
+	if !mat.Equal(r.Projectors(), projectors) {
+		t.Errorf("OFF reader projectors differ from those written")
+	}
+	if !mat.Equal(r.Basis(), basis) {
+		t.Errorf("OFF reader basis differs from that written")
+	}
+	if r.NumberOfRecords() != nrecords {
+		t.Errorf("OFF reader NumberOfRecords()=%d, want %d", r.NumberOfRecords(), nrecords)
+	}
+
+	for i := 0; i < nrecords; i++ {
+		rec, err := r.NextRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Framecount != int64(1000*i) || rec.Timestamp != int64(2000*i) || rec.FiltValue != float32(i)+0.25 ||
+			rec.RecordSamples != int32(nsamples) || rec.RecordPreSamples != 1 || rec.PretriggerMean != 100 ||
+			rec.PretriggerDelta != 0.5 || rec.ResidualStdDev != 1.5 || rec.FiltPhase != 0.125 {
+			t.Errorf("OFF record %d is %+v", i, rec)
+		}
+		if len(rec.ModelCoefs) != nbases || rec.ModelCoefs[1] != float32(10*i) {
+			t.Errorf("OFF record %d has ModelCoefs %v, want [%d %d]", i, rec.ModelCoefs, i, 10*i)
+		}
+	}
+	if _, err := r.NextRecord(); err != io.EOF {
+		t.Errorf("OFF reader NextRecord() after the last record returns %v, want io.EOF", err)
+	}
+
+	rec, err := r.ReadRecord(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Framecount != 3000 {
+		t.Errorf("OFF reader ReadRecord(3) has Framecount %d, want 3000", rec.Framecount)
+	}
+	if _, err := r.ReadRecord(nrecords); err == nil {
+		t.Error("OFF reader ReadRecord past the end should fail")
+	}
+	if err := r.SeekRecord(2); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = r.NextRecord()
+	if err != nil || rec.Framecount != 2000 {
+		t.Fatalf("OFF reader NextRecord() after SeekRecord(2) returns %v, %v", rec, err)
+	}
+
+	// Record 2 has coefficients [2, 20]; the basis columns are [1 0 2] and [0 1 3].
+	pulse := r.ModeledPulse(rec)
+	expect := []float64{2, 20, 64}
+	for i := range expect {
+		if pulse[i] != expect[i] {
+			t.Errorf("OFF reader ModeledPulse = %v, want %v", pulse, expect)
+			break
+		}
+	}
+
+	if _, err := OpenReader("off_test.go"); err == nil {
+		t.Error("OpenReader on a non-OFF file should fail")
+	}
+}
+
+// TestReaderOldVersion checks that the reader handles files of version 0.3.0, whose records
+// lack filtValue and filtPhase, and rejects versions it doesn't know.
+func TestReaderOldVersion(t *testing.T) {
+	projectors := mat.NewDense(1, 2, []float64{1, 0})
+	basis := mat.NewDense(2, 1, []float64{1, 2})
+	fileName := "off_reader_v030_test.off"
+	defer os.Remove(fileName)
+	writeFile := func(version string) {
+		os.Remove(fileName)
+		w := NewWriter(fileName, 0, "chan1", 1, 1, 2, 1e-5, projectors, basis, "model for version test",
+			"DastardVersion Placeholder", "GitHash Placeholder", "SourceName Placeholder",
+			TimeDivisionMultiplexingInfo{}, PixelInfo{})
+		w.FileFormatVersion = version
+		if err := w.CreateFile(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteHeader(); err != nil {
+			t.Fatal(err)
+		}
+		// Write 2 records in the version 0.3.0 layout.
+		for i := 0; i < 2; i++ {
+			w.writer.Write(getbytes.FromInt32(2))
+			w.writer.Write(getbytes.FromInt32(1))
+			w.writer.Write(getbytes.FromInt64(int64(100 * i)))
+			w.writer.Write(getbytes.FromInt64(int64(200 * i)))
+			w.writer.Write(getbytes.FromSliceFloat32([]float32{10, 0.5, 1.5, float32(i) + 0.25}))
+		}
+		w.Close()
+	}
+
+	writeFile("0.3.0")
+	r, err := OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.NumberOfRecords() != 2 {
+		t.Errorf("OFF v0.3.0 reader NumberOfRecords()=%d, want 2", r.NumberOfRecords())
+	}
+	for i := 0; i < 2; i++ {
+		rec, err := r.NextRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Framecount != int64(100*i) || rec.Timestamp != int64(200*i) || rec.PretriggerMean != 10 ||
+			rec.ResidualStdDev != 1.5 || len(rec.ModelCoefs) != 1 || rec.ModelCoefs[0] != float32(i)+0.25 {
+			t.Errorf("OFF v0.3.0 record %d is %+v", i, rec)
+		}
+		if !math.IsNaN(float64(rec.FiltValue)) || !math.IsNaN(float64(rec.FiltPhase)) {
+			t.Errorf("OFF v0.3.0 record %d has FiltValue=%v, FiltPhase=%v, want NaN", i, rec.FiltValue, rec.FiltPhase)
+		}
+	}
+
+	writeFile("9.9.9")
+	if _, err := OpenReader(fileName); err == nil {
+		t.Error("OpenReader on an OFF file of unknown version should fail")
+	}
+}
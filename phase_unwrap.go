@@ -4,12 +4,12 @@ import "fmt"
 
 // PhaseUnwrapper makes phase values continous by adding integers as needed
 type PhaseUnwrapper struct {
-	lastVal       int16
-	offset        int16
+	lastVal       signedRawType
+	offset        signedRawType
 	fractionBits  uint // Before unwrapping, this many low bits are fractional ϕ0
 	lowBitsToDrop uint // Drop this many least significant bits in each value
-	onePi         int16
-	twoPi         int16
+	onePi         signedRawType
+	twoPi         signedRawType
 	highCount     int
 	lowCount      int
 	resetAfter    int  // jump back to near 0 after this many
@@ -30,7 +30,7 @@ func NewPhaseUnwrapper(fractionBits, lowBitsToDrop uint, enable bool, resetAfter
 	// or 32 for int16 or int32, but leave that parameter here...for now.
 	u.fractionBits = fractionBits
 	u.lowBitsToDrop = lowBitsToDrop
-	u.twoPi = int16(1) << (fractionBits - lowBitsToDrop)
+	u.twoPi = signedRawType(1) << (fractionBits - lowBitsToDrop)
 	u.onePi = u.twoPi >> 1
 	u.resetAfter = resetAfter
 	u.enable = enable
@@ -56,7 +56,7 @@ func (u *PhaseUnwrapper) UnwrapInPlace(data *[]RawType) {
 
 	// Enter this loop only if unwrapping is enabled
 	for i, rawVal := range *data {
-		v := int16(rawVal) >> drop
+		v := signedRawType(rawVal) >> drop
 		delta := v - u.lastVal
 		u.lastVal = v
 
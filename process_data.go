@@ -19,6 +19,8 @@ type DataStreamProcessor struct {
 	SampleRate           float64
 	LastTrigger          FrameIndex
 	LastEdgeMultiTrigger FrameIndex
+	LastNoiseTrigger     FrameIndex
+	lastNoiseVeto        FrameIndex
 	stream               DataStream
 	projectors           *mat.Dense
 	modelDescription     string
@@ -28,6 +30,12 @@ type DataStreamProcessor struct {
 	basis *mat.Dense
 	// if not projectors.IsEmpty basis must be size
 	// (NSamples, nbases) such that basis*modelCoefs = modeled_data
+	filter            *mat.VecDense // optimal filter of length NSamples, or nil if none is loaded
+	arrivalFilter     *mat.VecDense // optional arrival-time filter of length NSamples, or nil
+	filterDescription string
+	histogram         *Histogram        // accumulates a histogram of records, or nil if not histogramming
+	noisePSD          *NoisePSD         // accumulates a noise power spectrum, or nil if not
+	trainer           *ProjectorTrainer // trains projectors and basis from records, or nil if not training
 	DecimateState
 	TriggerState
 	DataPublisher
@@ -62,6 +70,33 @@ func (dsp *DataStreamProcessor) SetProjectorsBasis(projectors *mat.Dense, basis
 	return nil
 }
 
+// SetFilters sets the optimal filter and the (optional) arrival-time filter.
+// Both must have length NSamples; arrival may be nil.
+func (dsp *DataStreamProcessor) SetFilters(filter *mat.VecDense, arrival *mat.VecDense, description string) error {
+	if filter == nil || filter.Len() != dsp.NSamples {
+		return fmt.Errorf("filter has wrong size, want length %v", dsp.NSamples)
+	}
+	if arrival != nil && arrival.Len() != dsp.NSamples {
+		return fmt.Errorf("arrival-time filter has wrong size, has length %v, want %v", arrival.Len(), dsp.NSamples)
+	}
+	dsp.filter = filter
+	dsp.arrivalFilter = arrival
+	dsp.filterDescription = description
+	return nil
+}
+
+// removeFilters forgets the optimal and arrival-time filters, which disables filtering in analysis
+func (dsp *DataStreamProcessor) removeFilters() {
+	dsp.filter = nil
+	dsp.arrivalFilter = nil
+	dsp.filterDescription = ""
+}
+
+// HasFilter returns true if an optimal filter is loaded
+func (dsp *DataStreamProcessor) HasFilter() bool {
+	return dsp.filter != nil
+}
+
 // HasProjectors return true if projectors are loaded
 func (dsp *DataStreamProcessor) HasProjectors() bool {
 	return (dsp.projectors != nil) && (!dsp.projectors.IsEmpty())
@@ -82,6 +117,7 @@ func NewDataStreamProcessor(channelIndex int, broker *TriggerBroker, NPresamples
 	dsp.projectors = &mat.Dense{}       // dsp.projectors is set to zero value
 	dsp.basis = &mat.Dense{}            // dsp.basis is set to zero value
 	dsp.edgeMultiSetInitialState()      // set up edgeMulti in known state
+	dsp.noiseSetInitialState()          // forget any earlier noise triggers
 	return &dsp
 }
 
@@ -98,6 +134,8 @@ func (dsp *DataStreamProcessor) ConfigurePulseLengths(nsamp, npre int) {
 	// if nsamp or npre is invalid, panic, do not silently ignore
 	if dsp.NSamples != nsamp || dsp.NPresamples != npre {
 		dsp.removeProjectorsBasis()
+		dsp.removeFilters()
+		dsp.trainer = nil // records already collected have the wrong length
 		dsp.edgeMultiSetInitialState()
 	}
 	dsp.NSamples = nsamp
@@ -110,20 +148,41 @@ func (dsp *DataStreamProcessor) ConfigureTrigger(state TriggerState) {
 	dsp.LastTrigger = 0 // forget the Last Trigger, so that all channels will auto trigger
 	// at the same starting point when you send new trigger settings
 	dsp.edgeMultiSetInitialState()
+	dsp.noiseSetInitialState()
+}
+
+// noiseSetInitialState forgets the last noise trigger and veto.
+func (dsp *DataStreamProcessor) noiseSetInitialState() {
+	dsp.LastNoiseTrigger = math.MinInt64 / 4
+	dsp.lastNoiseVeto = math.MinInt64 / 4
 }
 
-func (dsp *DataStreamProcessor) processSegment(segment *DataSegment) {
+// processSegment processes one segment of data: it writes the raw stream, decimates, triggers,
+// analyzes, and publishes and writes the triggered records. Processing continues after a
+// write error, so that triggering and publishing are unaffected; the first such error is returned.
+func (dsp *DataStreamProcessor) processSegment(segment *DataSegment) error {
+	writeErr := dsp.DataPublisher.WriteRawSegment(segment) // save the undecimated stream, when enabled
 	dsp.DecimateData(segment)
+	if dsp.noisePSD != nil {
+		dsp.noisePSD.AddSegment(segment)
+	}
 	dsp.stream.AppendSegment(segment)
 	records, secondaries := dsp.TriggerData()
-	dsp.AnalyzeData(records)                                       // add analysis results to records in-place
-	if err := dsp.DataPublisher.PublishData(records); err != nil { // publish and save data, when enabled
-		panic(err)
+	dsp.AnalyzeData(records) // add analysis results to records in-place
+	if dsp.trainer != nil {
+		dsp.trainer.addRecords(records)
+		dsp.trainer.installIfReady(dsp)
 	}
-	if err := dsp.DataPublisher.PublishData(secondaries); err != nil { // publish and save data, when enabled
-		panic(err)
+	if dsp.histogram != nil {
+		dsp.histogram.AddRecords(records)
+	}
+	for _, recs := range [][]*DataRecord{records, secondaries} {
+		if err := dsp.DataPublisher.PublishData(recs); err != nil && writeErr == nil { // publish and save data, when enabled
+			writeErr = err
+		}
 	}
 	segment.processed = true
+	return writeErr
 }
 
 // DecimateData decimates data in-place.
@@ -140,7 +199,7 @@ func (dsp *DataStreamProcessor) DecimateData(segment *DataSegment) {
 		if segment.signed {
 			for i := 0; i < Nin; i++ {
 				j := i / level
-				cdata[j] += float64(int16(data[i]))
+				cdata[j] += float64(signedRawType(data[i]))
 			}
 		} else {
 			for i := 0; i < Nin; i++ {
@@ -155,10 +214,10 @@ func (dsp *DataStreamProcessor) DecimateData(segment *DataSegment) {
 
 		if segment.signed {
 			for i := 0; i < Nout; i++ {
-				// Trick for rounding to int16: don't let any numbers be negative
-				// because float->int is a truncation operation. If we remove the
-				// +65536 below, then 0 will be a "rounding attractor".
-				data[i] = RawType(int16(cdata[i]/float64(level) + 65536 + 0.5))
+				// Round with math.Floor, because float->int is a truncation operation,
+				// which would make 0 a "rounding attractor". Negative values wrap to
+				// their unsigned RawType representation.
+				data[i] = RawType(int64(math.Floor(cdata[i]/float64(level) + 0.5)))
 			}
 
 		} else {
@@ -188,7 +247,7 @@ func (dsp *DataStreamProcessor) AnalyzeData(records []*DataRecord) {
 		dataVec := *mat.NewVecDense(len(rec.data), make([]float64, len(rec.data)))
 		if rec.signed {
 			for i, v := range rec.data {
-				dataVec.SetVec(i, float64(int16(v)))
+				dataVec.SetVec(i, float64(signedRawType(v)))
 			}
 		} else {
 			for i, v := range rec.data {
@@ -230,11 +289,32 @@ func (dsp *DataStreamProcessor) AnalyzeData(records []*DataRecord) {
 		rec.pulseAverage = sum/N - ptm
 		meanSquare := sum2/N - 2*ptm*(sum/N) + ptm*ptm
 		rec.pulseRMS = math.Sqrt(meanSquare)
+
+		// Optimal filtering: filtValue = filter·(data-ptm), and the arrival phase (in samples) is
+		// estimated to first order as arrivalFilter·(data-ptm) / filtValue.
+		rec.filtValue = math.NaN()
+		rec.filtPhase = math.NaN()
+		if dsp.HasFilter() && dsp.filter.Len() == len(rec.data) {
+			var filtSum, arrivalSum float64
+			for i := 0; i < len(rec.data); i++ {
+				val = dataVec.AtVec(i) - ptm
+				filtSum += dsp.filter.AtVec(i) * val
+				if dsp.arrivalFilter != nil {
+					arrivalSum += dsp.arrivalFilter.AtVec(i) * val
+				}
+			}
+			rec.filtValue = filtSum
+			if dsp.arrivalFilter != nil && filtSum != 0 {
+				rec.filtPhase = arrivalSum / filtSum
+			}
+		}
+
 		if dsp.HasProjectors() {
 			rows, cols := dsp.projectors.Dims()
 			nbases := rows
 			if cols != len(rec.data) {
-				panic("projections for variable length records not implemented")
+				dsp.projectShortRecord(rec, &dataVec)
+				continue
 			}
 
 			modelCoefs.MulVec(dsp.projectors, &dataVec)
@@ -253,6 +333,37 @@ func (dsp *DataStreamProcessor) AnalyzeData(records []*DataRecord) {
 	}
 }
 
+// projectShortRecord computes model coefficients for a record shorter than the projectors,
+// such as those made by EdgeMultiMakeShortRecords. The record is aligned with the full-length
+// basis by its trigger sample, and the coefficients are the least-squares fit of the rows of
+// the basis that the record covers. (The projectors are not used: their noise weighting is
+// correct only for full-length records.) If the record does not fit within the basis or is too
+// short to determine all coefficients, the coefficients and residualStdDev are NaN.
+func (dsp *DataStreamProcessor) projectShortRecord(rec *DataRecord, dataVec *mat.VecDense) {
+	nsamp, nbases := dsp.basis.Dims()
+	n := len(rec.data)
+	offset := dsp.NPresamples - rec.presamples
+	rec.modelCoefs = make([]float64, nbases)
+	rec.residualStdDev = math.NaN()
+	for i := range rec.modelCoefs {
+		rec.modelCoefs[i] = math.NaN()
+	}
+	if offset < 0 || offset+n > nsamp || n < nbases {
+		return
+	}
+	basis := dsp.basis.Slice(offset, offset+n, 0, nbases)
+	var modelCoefs, modelFull, residual mat.VecDense
+	if err := modelCoefs.SolveVec(basis, dataVec); err != nil {
+		return // basis rows are singular or nearly so
+	}
+	modelFull.MulVec(basis, &modelCoefs)
+	residual.SubVec(dataVec, &modelFull)
+	mat.Col(rec.modelCoefs, 0, &modelCoefs)
+	residualSlice := make([]float64, n)
+	mat.Col(residualSlice, 0, &residual)
+	rec.residualStdDev = stdDev(residualSlice)
+}
+
 // return the uncorrected std deviation of a float slice
 func stdDev(a []float64) float64 {
 	if len(a) == 0 {
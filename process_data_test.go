@@ -81,6 +81,7 @@ func TestAnalyzeB(t *testing.T) {
 
 // TestAnalyzePre tests the DataChannel.AnalyzeData pretrigger computations
 func TestAnalyzePre(t *testing.T) {
+	skipUnlessRaw16(t)
 	data := make([]RawType, 20)
 	slopes := []float64{0, 1, 5, -2, -50, 0.333333, 1.5, 10.94}
 	firsts := []float64{40, 100, 1000}
@@ -117,6 +118,60 @@ func TestAnalyzePre(t *testing.T) {
 	}
 }
 
+// TestAnalyzeFilter tests the optimal filter and arrival-time computations of AnalyzeData.
+func TestAnalyzeFilter(t *testing.T) {
+	d := []RawType{10, 10, 10, 10, 15, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10}
+	rec := &DataRecord{data: d, presamples: 4}
+	records := []*DataRecord{rec}
+
+	dsp := &DataStreamProcessor{NPresamples: 4, NSamples: len(d), projectors: &mat.Dense{}, basis: &mat.Dense{}}
+	dsp.AnalyzeData(records)
+	if !math.IsNaN(rec.filtValue) || !math.IsNaN(rec.filtPhase) {
+		t.Errorf("AnalyzeData with no filter gives filtValue=%v, filtPhase=%v, want NaN, NaN", rec.filtValue, rec.filtPhase)
+	}
+
+	// A filter that computes the post-trigger average, and an "arrival" filter that picks sample 4.
+	filter := mat.NewVecDense(len(d), nil)
+	arrival := mat.NewVecDense(len(d), nil)
+	for i := 4; i < len(d); i++ {
+		filter.SetVec(i, 1.0/12.0)
+	}
+	arrival.SetVec(4, 1.0)
+	if err := dsp.SetFilters(mat.NewVecDense(3, nil), nil, "too short"); err == nil {
+		t.Error("SetFilters accepted a filter of the wrong length")
+	}
+	if err := dsp.SetFilters(filter, mat.NewVecDense(3, nil), "too short"); err == nil {
+		t.Error("SetFilters accepted an arrival-time filter of the wrong length")
+	}
+	if err := dsp.SetFilters(filter, nil, "average"); err != nil {
+		t.Error(err)
+	}
+	dsp.AnalyzeData(records)
+	if math.Abs(rec.filtValue-5.0) > 1e-9 || !math.IsNaN(rec.filtPhase) {
+		t.Errorf("AnalyzeData gives filtValue=%v, filtPhase=%v, want 5, NaN", rec.filtValue, rec.filtPhase)
+	}
+	if err := dsp.SetFilters(filter, arrival, "average"); err != nil {
+		t.Error(err)
+	}
+	dsp.AnalyzeData(records)
+	if math.Abs(rec.filtValue-5.0) > 1e-9 || math.Abs(rec.filtPhase-1.0) > 1e-9 {
+		t.Errorf("AnalyzeData gives filtValue=%v, filtPhase=%v, want 5, 1", rec.filtValue, rec.filtPhase)
+	}
+
+	// Records of the wrong length are not filtered.
+	short := &DataRecord{data: d[:10], presamples: 4}
+	dsp.AnalyzeData([]*DataRecord{short})
+	if !math.IsNaN(short.filtValue) {
+		t.Errorf("AnalyzeData on a short record gives filtValue=%v, want NaN", short.filtValue)
+	}
+
+	// Changing the record length removes the filters.
+	dsp.ConfigurePulseLengths(20, 5)
+	if dsp.HasFilter() {
+		t.Error("ConfigurePulseLengths did not remove the filters")
+	}
+}
+
 type RTExpect struct {
 	Max            float64
 	RMS            float64
@@ -137,6 +192,7 @@ func TestAnalyzeRealtimeBases(t *testing.T) {
 
 	// assign the projectors and basis
 	nbases := 3
+	nbases3 := nbases
 	projectors3 := mat.NewDense(nbases, dsp.NSamples,
 		[]float64{1, 0, 0, 0,
 			0, 1, 0, 0,
@@ -201,6 +257,49 @@ func TestAnalyzeRealtimeBases(t *testing.T) {
 		pretrigMean:    math.NaN(), pretrigDelta: math.NaN(), Avg: math.NaN(), Max: math.NaN(), RMS: math.NaN()}
 	testAnalyzeCheck(t, rec, expect, "Realtime D: 3 Bases, record truncated at front")
 
+	// Short records (as from EdgeMultiMakeShortRecords) are fit with the rows of the basis
+	// that they cover, aligned by the trigger sample.
+	basisPoly := mat.NewDense(dsp.NSamples, nbases3,
+		[]float64{1, 0, 0,
+			1, 1, 1,
+			1, 2, 4,
+			1, 3, 9})
+	if err := dsp.SetProjectorsBasis(projectors3, basisPoly, "polynomial model"); err != nil {
+		t.Error(err)
+	}
+	shortTests := []struct {
+		data       []RawType
+		presamples int
+		coefs      []float64
+	}{
+		{[]RawType{1, 2, 4}, 1, []float64{1, 0.5, 0.5}}, // truncated at end
+		{[]RawType{2, 4, 7}, 0, []float64{1, 0.5, 0.5}}, // truncated at front
+		{[]RawType{1, 2}, 1, nil},                       // too short to fit 3 bases
+		{[]RawType{1, 2, 3}, 2, nil},                    // more presamples than the basis allows
+	}
+	for i, st := range shortTests {
+		rec = &DataRecord{data: st.data, presamples: st.presamples}
+		dsp.AnalyzeData([]*DataRecord{rec})
+		if len(rec.modelCoefs) != nbases3 {
+			t.Errorf("short record %d has %d model coefficients, want %d", i, len(rec.modelCoefs), nbases3)
+			continue
+		}
+		if st.coefs == nil {
+			if !math.IsNaN(rec.modelCoefs[0]) || !math.IsNaN(rec.residualStdDev) {
+				t.Errorf("short record %d has coefs %v, residual %v, want NaN", i, rec.modelCoefs, rec.residualStdDev)
+			}
+			continue
+		}
+		for j, c := range st.coefs {
+			if math.Abs(rec.modelCoefs[j]-c) > 1e-9 {
+				t.Errorf("short record %d has coefs %v, want %v", i, rec.modelCoefs, st.coefs)
+				break
+			}
+		}
+		if math.Abs(rec.residualStdDev) > 1e-9 {
+			t.Errorf("short record %d has residualStdDev %v, want 0", i, rec.residualStdDev)
+		}
+	}
 }
 
 func testAnalyzeCheck(t *testing.T, rec *DataRecord, expect RTExpect, name string) {
@@ -252,6 +351,7 @@ func testAnalyzePretrigCheck(t *testing.T, rec *DataRecord, expect RTExpect, nam
 }
 
 func TestDataSignedness(t *testing.T) {
+	skipUnlessRaw16(t)
 	// Make sure PrepareRun produces the right answers.
 	var ts TriangleSource
 	ts.nchan = 4
@@ -0,0 +1,430 @@
+package dastard
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigProfile is a complete, named Dastard setup that can be saved and later re-applied.
+type ConfigProfile struct {
+	Name            string
+	Saved           time.Time
+	SourceName      string        // the name the source was started with, e.g. "SIMPULSESOURCE"
+	Source          SourceConfigs // only the configuration of source SourceName is set
+	Nsamples        int
+	Npresamp        int
+	Triggers        []FullTriggerState
+	Projectors      []ProjectorsBasisObject
+	Filters         []FilterObject
+	MixFractions    []float64
+	MapFile         string // "" if no map file is loaded
+	WritingBasePath string
+}
+
+// profileNameRegexp limits profile names to those that are safe as file names.
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+const profileSuffix = ".json"
+
+// profileDirectory returns the directory where profiles are stored.
+func profileDirectory() (string, error) {
+	if ConfigDirectory != "" {
+		return filepath.Join(ConfigDirectory, "profiles"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".dastard", "profiles"), nil
+}
+
+// profileFilename returns the file that stores the named profile.
+func profileFilename(name string) (string, error) {
+	if !profileNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("profile name %q is not valid: use only letters, digits, '_', '-', and '.'", name)
+	}
+	dir, err := profileDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+profileSuffix), nil
+}
+
+// sourceConfig returns a SourceConfigs with only the configuration of the named source set.
+func (sc *SourceConfigs) sourceConfig(sourceName string) SourceConfigs {
+	var result SourceConfigs
+	switch sourceName {
+	case "SIMPULSESOURCE":
+		result.SimPulse = sc.SimPulse
+	case "TRIANGLESOURCE":
+		result.Triangle = sc.Triangle
+	case "LANCEROSOURCE":
+		result.Lancero = sc.Lancero
+	case "ROACHSOURCE":
+		result.Roach = sc.Roach
+	case "ABACOSOURCE":
+		result.Abaco = sc.Abaco
+	case "TDMUDPSOURCE":
+		result.TDMUDP = sc.TDMUDP
+	case "LJHREPLAYSOURCE":
+		result.LJHReplay = sc.LJHReplay
+	case "RAWREPLAYSOURCE":
+		result.RawReplay = sc.RawReplay
+	case "TESSIMSOURCE":
+		result.TESSim = sc.TESSim
+	}
+	return result
+}
+
+// configureSources configures each source that has a configuration in configs.
+func (s *SourceControl) configureSources(configs *SourceConfigs) error {
+	var okay bool
+	if configs.SimPulse != nil {
+		if err := s.ConfigureSimPulseSource(configs.SimPulse, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.Triangle != nil {
+		if err := s.ConfigureTriangleSource(configs.Triangle, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.Lancero != nil {
+		if err := s.ConfigureLanceroSource(configs.Lancero, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.Roach != nil {
+		if err := s.ConfigureRoachSource(configs.Roach, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.Abaco != nil {
+		if err := s.ConfigureAbacoSource(configs.Abaco, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.TDMUDP != nil {
+		if err := s.ConfigureTDMUDPSource(configs.TDMUDP, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.LJHReplay != nil {
+		if err := s.ConfigureLJHReplaySource(configs.LJHReplay, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.RawReplay != nil {
+		if err := s.ConfigureRawReplaySource(configs.RawReplay, &okay); err != nil {
+			return err
+		}
+	}
+	if configs.TESSim != nil {
+		if err := s.ConfigureTESSimSource(configs.TESSim, &okay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeBase64 returns the base64 encoding of m's binary form.
+func encodeBase64(m encoding.BinaryMarshaler) (string, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// setAnalysis stores the per-channel projectors and filters in the profile.
+func (p *ConfigProfile) setAnalysis(analysis []channelAnalysis) error {
+	p.Projectors = nil
+	p.Filters = nil
+	var err error
+	for i, ca := range analysis {
+		if ca.projectors != nil {
+			pbo := ProjectorsBasisObject{ChannelIndex: i, ModelDescription: ca.modelDescription}
+			if pbo.ProjectorsBase64, err = encodeBase64(ca.projectors); err != nil {
+				return err
+			}
+			if pbo.BasisBase64, err = encodeBase64(ca.basis); err != nil {
+				return err
+			}
+			p.Projectors = append(p.Projectors, pbo)
+		}
+		if ca.filter != nil {
+			fo := FilterObject{ChannelIndex: i, Description: ca.filterDescription}
+			if fo.FilterBase64, err = encodeBase64(ca.filter); err != nil {
+				return err
+			}
+			if ca.arrivalFilter != nil {
+				if fo.ArrivalFilterBase64, err = encodeBase64(ca.arrivalFilter); err != nil {
+					return err
+				}
+			}
+			p.Filters = append(p.Filters, fo)
+		}
+	}
+	return nil
+}
+
+// restartSettings decodes the profile into the settings to restore after starting its
+// source. An error means the profile cannot be applied.
+func (p *ConfigProfile) restartSettings() (*restartSettings, error) {
+	if p.SourceName == "" {
+		return nil, fmt.Errorf("profile %q has no source name", p.Name)
+	}
+	settings := &restartSettings{sourceName: p.SourceName, triggers: p.Triggers, mix: p.MixFractions}
+	nchan := 0
+	for _, pbo := range p.Projectors {
+		if pbo.ChannelIndex >= nchan {
+			nchan = pbo.ChannelIndex + 1
+		}
+	}
+	for _, fo := range p.Filters {
+		if fo.ChannelIndex >= nchan {
+			nchan = fo.ChannelIndex + 1
+		}
+	}
+	settings.analysis = make([]channelAnalysis, nchan)
+	for i := range p.Projectors {
+		pbo := &p.Projectors[i]
+		if pbo.ChannelIndex < 0 {
+			return nil, fmt.Errorf("profile %q has projectors for channel %d", p.Name, pbo.ChannelIndex)
+		}
+		ca := &settings.analysis[pbo.ChannelIndex]
+		var err error
+		if ca.projectors, ca.basis, err = pbo.decode(); err != nil {
+			return nil, fmt.Errorf("profile %q has bad projectors for channel %d: %v", p.Name, pbo.ChannelIndex, err)
+		}
+		ca.modelDescription = pbo.ModelDescription
+	}
+	for i := range p.Filters {
+		fo := &p.Filters[i]
+		if fo.ChannelIndex < 0 {
+			return nil, fmt.Errorf("profile %q has filters for channel %d", p.Name, fo.ChannelIndex)
+		}
+		ca := &settings.analysis[fo.ChannelIndex]
+		var err error
+		if ca.filter, ca.arrivalFilter, err = fo.decode(); err != nil {
+			return nil, fmt.Errorf("profile %q has a bad filter for channel %d: %v", p.Name, fo.ChannelIndex, err)
+		}
+		ca.filterDescription = fo.Description
+	}
+	return settings, nil
+}
+
+// captureProfile returns the current setup of the active source as a profile.
+func (s *SourceControl) captureProfile(name string) (*ConfigProfile, error) {
+	p := &ConfigProfile{Name: name, Saved: time.Now(), SourceName: s.lastSourceName,
+		Source:   s.sourceConfigs.sourceConfig(s.lastSourceName),
+		Nsamples: s.status.Nsamples, Npresamp: s.status.Npresamp}
+	var analysis []channelAnalysis
+	f := func() {
+		p.Triggers = s.ActiveSource.ComputeFullTriggerState()
+		analysis = s.ActiveSource.analysisSettings()
+		ws := s.ActiveSource.ComputeWritingState()
+		p.WritingBasePath = ws.BasePath
+		s.queuedResults <- nil
+	}
+	if err := s.runLaterIfActive(f); err != nil {
+		return nil, err
+	}
+	if err := p.setAnalysis(analysis); err != nil {
+		return nil, err
+	}
+	if s.lastMix != nil {
+		p.MixFractions = make([]float64, len(s.lastMix))
+		copy(p.MixFractions, s.lastMix)
+	}
+	if s.mapServer != nil && s.mapServer.Map != nil {
+		p.MapFile = s.mapServer.Map.Filename
+	}
+	return p, nil
+}
+
+// applyProfile stops any active source, then configures and starts the profile's source
+// and restores the rest of the profile's setup.
+func (s *SourceControl) applyProfile(p *ConfigProfile) error {
+	settings, err := p.restartSettings()
+	if err != nil {
+		return err
+	}
+	if s.isSourceActive {
+		log.Printf("Stopping data source to apply profile %q\n", p.Name)
+		s.ActiveSource.Stop()
+		s.handlePossibleStoppedSource()
+		s.broadcastStatus()
+	}
+	if err := s.configureSources(&p.Source); err != nil {
+		return err
+	}
+	s.status.Nsamples = p.Nsamples
+	s.status.Npresamp = p.Npresamp
+	s.cancelRestart()
+	name := p.SourceName
+	if err := s.start(&name); err != nil {
+		return err
+	}
+	if err := s.restoreRestartSettings(settings); err != nil {
+		return err
+	}
+	if s.mapServer != nil {
+		var okay bool
+		if p.MapFile == "" {
+			s.mapServer.Unload(nil, &okay)
+		} else if err := s.mapServer.Load(&p.MapFile, &okay); err != nil {
+			return err
+		}
+	}
+	f := func() {
+		s.ActiveSource.setWritingBasePath(p.WritingBasePath)
+		s.broadcastWritingState()
+		s.queuedResults <- nil
+	}
+	return s.runLaterIfActive(f)
+}
+
+// SaveProfile saves the complete current setup of the active source as the named profile,
+// replacing any profile of the same name.
+func (s *SourceControl) SaveProfile(name *string, reply *bool) error {
+	*reply = false
+	filename, err := profileFilename(*name)
+	if err != nil {
+		return err
+	}
+	p, err := s.captureProfile(*name)
+	if err != nil {
+		return err
+	}
+	text, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(filename), 0775); err != nil {
+		return err
+	}
+	// Write a temporary file first, so a failed save can't destroy an existing profile.
+	tmpname := filename + ".tmp"
+	if err = ioutil.WriteFile(tmpname, text, 0664); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpname, filename); err != nil {
+		return err
+	}
+	log.Printf("Saved profile %q to %s\n", *name, filename)
+	*reply = true
+	return nil
+}
+
+// ListProfiles returns the names of all saved profiles, in alphabetical order.
+func (s *SourceControl) ListProfiles(dummy *string, reply *[]string) error {
+	dir, err := profileDirectory()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), profileSuffix)
+		if !f.IsDir() && strings.HasSuffix(f.Name(), profileSuffix) && profileNameRegexp.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	*reply = names
+	return nil
+}
+
+// DeleteProfile deletes the named profile.
+func (s *SourceControl) DeleteProfile(name *string, reply *bool) error {
+	*reply = false
+	filename, err := profileFilename(*name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(filename); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// loadProfile reads the named profile.
+func loadProfile(name string) (*ConfigProfile, error) {
+	filename, err := profileFilename(name)
+	if err != nil {
+		return nil, err
+	}
+	text, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p := new(ConfigProfile)
+	if err = json.Unmarshal(text, p); err != nil {
+		return nil, fmt.Errorf("could not read profile %q: %v", name, err)
+	}
+	p.Name = name
+	p.SourceName = strings.ToUpper(p.SourceName)
+	return p, nil
+}
+
+// ApplyProfile replaces the current setup with the named profile, restarting the data source.
+// It is all or nothing: if any part of the profile cannot be applied, the previous setup is
+// restored and an error returned. Writing must be stopped first.
+func (s *SourceControl) ApplyProfile(name *string, reply *bool) error {
+	*reply = false
+	p, err := loadProfile(*name)
+	if err != nil {
+		return err
+	}
+	if _, err = p.restartSettings(); err != nil {
+		return err
+	}
+	var previous *ConfigProfile
+	if s.isSourceActive {
+		if s.ActiveSource.WritingIsActive() {
+			return fmt.Errorf("Stop writing before applying a profile")
+		}
+		if previous, err = s.captureProfile(""); err != nil {
+			return err
+		}
+	}
+	previousConfigs := s.sourceConfigs.sourceConfig(p.SourceName)
+	previousNsamples, previousNpresamp := s.status.Nsamples, s.status.Npresamp
+
+	log.Printf("Applying profile %q\n", *name)
+	if err = s.applyProfile(p); err != nil {
+		log.Printf("Could not apply profile %q, restoring the previous setup: %v\n", *name, err)
+		if s.isSourceActive {
+			s.ActiveSource.Stop()
+			s.handlePossibleStoppedSource()
+		}
+		if err2 := s.configureSources(&previousConfigs); err2 != nil {
+			log.Printf("Could not restore the previous source configuration: %v\n", err2)
+		}
+		s.status.Nsamples, s.status.Npresamp = previousNsamples, previousNpresamp
+		if previous != nil {
+			if err2 := s.applyProfile(previous); err2 != nil {
+				log.Printf("Could not restore the previous setup: %v\n", err2)
+			}
+		}
+		s.broadcastStatus()
+		return fmt.Errorf("could not apply profile %q: %v", *name, err)
+	}
+	*reply = true
+	return nil
+}
@@ -0,0 +1,76 @@
+package dastard
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestProfileNames(t *testing.T) {
+	for _, name := range []string{"calibration", "science-2", "noise_run.v2", "A"} {
+		if _, err := profileFilename(name); err != nil {
+			t.Errorf("profileFilename(%q) error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".hidden", "../escape", "a/b", "with space"} {
+		if _, err := profileFilename(name); err == nil {
+			t.Errorf("profileFilename(%q) should error", name)
+		}
+	}
+	// Each instance keeps its profiles in its own config directory.
+	saved := ConfigDirectory
+	defer func() { ConfigDirectory = saved }()
+	ConfigDirectory = filepath.Join("instance5600", "config")
+	want := filepath.Join("instance5600", "config", "profiles", "calibration.json")
+	if name, err := profileFilename("calibration"); err != nil || name != want {
+		t.Errorf("profileFilename with ConfigDirectory=%q is %q (err %v), want %q", ConfigDirectory, name, err, want)
+	}
+}
+
+func TestProfileAnalysisRoundTrip(t *testing.T) {
+	analysis := make([]channelAnalysis, 3)
+	analysis[1].projectors = mat.NewDense(2, 4, []float64{1, 2, 3, 4, 5, 6, 7, 8})
+	analysis[1].basis = mat.NewDense(4, 2, []float64{8, 7, 6, 5, 4, 3, 2, 1})
+	analysis[1].modelDescription = "test model"
+	analysis[2].filter = mat.NewVecDense(4, []float64{-1, 1, 2, -2})
+	analysis[2].arrivalFilter = mat.NewVecDense(4, []float64{0, 1, 0, -1})
+	analysis[2].filterDescription = "test filter"
+
+	p := &ConfigProfile{Name: "test", SourceName: "SIMPULSESOURCE"}
+	if err := p.setAnalysis(analysis); err != nil {
+		t.Fatalf("setAnalysis error: %v", err)
+	}
+	if len(p.Projectors) != 1 || len(p.Filters) != 1 {
+		t.Fatalf("setAnalysis stored %d projectors and %d filters, want 1 and 1", len(p.Projectors), len(p.Filters))
+	}
+	settings, err := p.restartSettings()
+	if err != nil {
+		t.Fatalf("restartSettings error: %v", err)
+	}
+	if len(settings.analysis) != len(analysis) {
+		t.Fatalf("restartSettings gives analysis for %d channels, want %d", len(settings.analysis), len(analysis))
+	}
+	got := settings.analysis
+	if got[0].projectors != nil || got[0].filter != nil {
+		t.Errorf("channel 0 should have no projectors or filters")
+	}
+	if !mat.Equal(got[1].projectors, analysis[1].projectors) || !mat.Equal(got[1].basis, analysis[1].basis) ||
+		got[1].modelDescription != analysis[1].modelDescription {
+		t.Errorf("channel 1 projectors and basis do not survive the round trip")
+	}
+	if !mat.Equal(got[2].filter, analysis[2].filter) || !mat.Equal(got[2].arrivalFilter, analysis[2].arrivalFilter) ||
+		got[2].filterDescription != analysis[2].filterDescription {
+		t.Errorf("channel 2 filters do not survive the round trip")
+	}
+
+	p.Projectors[0].BasisBase64 = "not base64!"
+	if _, err := p.restartSettings(); err == nil {
+		t.Errorf("restartSettings should fail with a bad basis")
+	}
+	p.Projectors = nil
+	p.SourceName = ""
+	if _, err := p.restartSettings(); err == nil {
+		t.Errorf("restartSettings should fail with no source name")
+	}
+}
@@ -0,0 +1,355 @@
+package dastard
+
+import (
+	"fmt"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Projector training states, as reported in ProjectorTrainingStatus.State
+const (
+	trainingCollecting = "Collecting"
+	trainingComputing  = "Computing"
+	trainingWaiting    = "Waiting" // computed, but waiting for OFF writing to stop before installing
+	trainingInstalled  = "Installed"
+	trainingFailed     = "Failed"
+)
+
+// nFixedBases is the number of basis vectors that are not found by SVD: a constant, the
+// average pulse, and the derivative of the average pulse.
+const nFixedBases = 3
+
+// ProjectorTrainingConfig is the RPC-usable structure for TrainProjectors
+type ProjectorTrainingConfig struct {
+	ChannelIndices []int
+	NPulses        int // number of pulse records to collect per channel
+	NNoise         int // number of noise-trigger records to collect per channel
+	NBases         int // total number of basis vectors, at least 3 (the constant, average pulse, and its derivative)
+}
+
+// ProjectorTrainingStatus reports the progress of projector training in one channel.
+type ProjectorTrainingStatus struct {
+	ChannelIndex     int
+	State            string // "Collecting", "Computing", "Waiting", "Installed", or "Failed"
+	PulsesCollected  int
+	PulsesNeeded     int
+	NoiseCollected   int
+	NoiseNeeded      int
+	NBases           int
+	ModelDescription string // description of the installed model, once State is "Installed"
+	Error            string // why training failed, if State is "Failed"
+}
+
+// trainedModel is the result of the projector computation.
+type trainedModel struct {
+	projectors  *mat.Dense
+	basis       *mat.Dense
+	description string
+	err         error
+}
+
+// ProjectorTrainer collects pulse and noise records from one channel, computes a basis and
+// projectors from them, and installs the result in the channel's DataStreamProcessor.
+// Pulse records are all primary triggered records other than those of the noise trigger,
+// so the noise trigger must be enabled for training to finish. The result is not installed
+// while the channel writes an OFF file, as that would change the file's number of bases.
+type ProjectorTrainer struct {
+	nPulses   int
+	nNoise    int
+	nBases    int
+	nsamp     int
+	npre      int
+	pulses    [][]float64
+	noise     [][]float64
+	state     string
+	err       error
+	modelDesc string
+	result    chan trainedModel
+	model     trainedModel // the computed result, while waiting to install it
+}
+
+// NewProjectorTrainer returns a new ProjectorTrainer for records of nsamp samples with npre
+// presamples, or an error if the requested sizes are not possible.
+func NewProjectorTrainer(nPulses, nNoise, nBases, nsamp, npre int) (*ProjectorTrainer, error) {
+	if nBases < nFixedBases || nBases > nsamp {
+		return nil, fmt.Errorf("projector training NBases=%d, must be in [%d, %d]", nBases, nFixedBases, nsamp)
+	}
+	if nPulses < nBases {
+		return nil, fmt.Errorf("projector training NPulses=%d, must be at least NBases=%d", nPulses, nBases)
+	}
+	if nNoise < 1 {
+		return nil, fmt.Errorf("projector training NNoise=%d, must be positive", nNoise)
+	}
+	if npre < 1 {
+		return nil, fmt.Errorf("projector training needs records with presamples, have NPresamples=%d", npre)
+	}
+	t := &ProjectorTrainer{nPulses: nPulses, nNoise: nNoise, nBases: nBases, nsamp: nsamp, npre: npre,
+		state: trainingCollecting, result: make(chan trainedModel, 1)}
+	return t, nil
+}
+
+// addRecords stores copies of the records until enough of each kind are collected, then
+// starts computing the projectors in the background.
+func (t *ProjectorTrainer) addRecords(records []*DataRecord) {
+	if t.state != trainingCollecting {
+		return
+	}
+	for _, rec := range records {
+		if len(rec.data) != t.nsamp {
+			continue
+		}
+		if rec.noise {
+			if len(t.noise) < t.nNoise {
+				t.noise = append(t.noise, recordAsFloats(rec))
+			}
+		} else if len(t.pulses) < t.nPulses {
+			t.pulses = append(t.pulses, recordAsFloats(rec))
+		}
+	}
+	if len(t.pulses) == t.nPulses && len(t.noise) == t.nNoise {
+		t.state = trainingComputing
+		go func() {
+			t.result <- trainProjectors(t.pulses, t.noise, t.nBases, t.npre)
+		}()
+	}
+}
+
+// installIfReady installs the trained projectors and basis in dsp, if they have been computed
+// and dsp is not writing an OFF file.
+func (t *ProjectorTrainer) installIfReady(dsp *DataStreamProcessor) {
+	if t.state == trainingComputing {
+		select {
+		case t.model = <-t.result:
+			t.pulses = nil
+			t.noise = nil
+			t.state = trainingWaiting
+		default:
+			return
+		}
+	}
+	if t.state != trainingWaiting || dsp.DataPublisher.HasOFF() {
+		return
+	}
+	model := t.model
+	t.model = trainedModel{}
+	err := model.err
+	if err == nil {
+		err = dsp.SetProjectorsBasis(model.projectors, model.basis, model.description)
+	}
+	if err != nil {
+		t.state = trainingFailed
+		t.err = err
+		return
+	}
+	t.state = trainingInstalled
+	t.modelDesc = model.description
+}
+
+// status returns the current state of training.
+func (t *ProjectorTrainer) status(channelIndex int) *ProjectorTrainingStatus {
+	s := &ProjectorTrainingStatus{ChannelIndex: channelIndex, State: t.state,
+		PulsesCollected: len(t.pulses), PulsesNeeded: t.nPulses,
+		NoiseCollected: len(t.noise), NoiseNeeded: t.nNoise,
+		NBases: t.nBases, ModelDescription: t.modelDesc}
+	if t.state == trainingWaiting || t.state == trainingInstalled || t.state == trainingFailed {
+		s.PulsesCollected = t.nPulses
+		s.NoiseCollected = t.nNoise
+	}
+	if t.err != nil {
+		s.Error = t.err.Error()
+	}
+	return s
+}
+
+// recordAsFloats returns the record data as float64 values.
+func recordAsFloats(rec *DataRecord) []float64 {
+	x := make([]float64, len(rec.data))
+	if rec.signed {
+		for i, v := range rec.data {
+			x[i] = float64(signedRawType(v))
+		}
+	} else {
+		for i, v := range rec.data {
+			x[i] = float64(v)
+		}
+	}
+	return x
+}
+
+// trainProjectors computes a basis of nbases vectors and the matching projectors from the
+// pulse and noise records (all of equal length n).
+//
+// The noise autocorrelation gives the noise covariance R = L L^T. In the whitened space
+// (multiply by W = L^-1), the basis starts with the orthonormalized whitened constant,
+// average pulse, and average-pulse derivative. The rest are the leading left singular
+// vectors of the whitened pulses after projecting out those first vectors. With Bw the
+// orthonormal whitened basis, the basis is L Bw and the projectors are Bw^T W, which makes
+// the projections the noise-weighted least-squares fit of the basis to each record.
+func trainProjectors(pulses, noise [][]float64, nbases, npre int) trainedModel {
+	n := len(pulses[0])
+
+	// Noise covariance, from the (biased, hence positive semidefinite) autocorrelation
+	autocorr := make([]float64, n)
+	for _, rec := range noise {
+		x := subtractMean(rec, len(rec))
+		for k := 0; k < n; k++ {
+			sum := 0.0
+			for i := 0; i+k < n; i++ {
+				sum += x[i] * x[i+k]
+			}
+			autocorr[k] += sum / float64(n*len(noise))
+		}
+	}
+	if !(autocorr[0] > 0) {
+		return trainedModel{err: fmt.Errorf("projector training noise records have zero variance")}
+	}
+	cov := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			cov.SetSym(i, j, autocorr[j-i])
+		}
+		cov.SetSym(i, i, autocorr[0]*(1+1e-9)) // guard against a numerically singular covariance
+	}
+	var chol mat.Cholesky
+	if ok := chol.Factorize(cov); !ok {
+		return trainedModel{err: fmt.Errorf("projector training noise covariance is not positive definite")}
+	}
+	var L, W mat.TriDense
+	chol.LTo(&L)
+	if err := W.InverseTri(&L); err != nil {
+		return trainedModel{err: fmt.Errorf("projector training could not whiten the noise: %v", err)}
+	}
+
+	// Pulse records as columns, and the fixed basis vectors
+	data := mat.NewDense(n, len(pulses), nil)
+	avg := make([]float64, n)
+	for j, rec := range pulses {
+		data.SetCol(j, rec)
+		x := subtractMean(rec, npre)
+		for i := range avg {
+			avg[i] += x[i] / float64(len(pulses))
+		}
+	}
+	fixed := mat.NewDense(n, nFixedBases, nil)
+	for i := 0; i < n; i++ {
+		fixed.Set(i, 0, 1.0)
+		fixed.Set(i, 1, avg[i])
+		if i > 0 {
+			fixed.Set(i, 2, avg[i]-avg[i-1])
+		}
+	}
+
+	// Orthonormalize the whitened fixed vectors
+	var fixedW mat.Dense
+	fixedW.Mul(&W, fixed)
+	var qr mat.QR
+	qr.Factorize(&fixedW)
+	var Q, R mat.Dense
+	qr.QTo(&Q)
+	qr.RTo(&R)
+	for j := 0; j < nFixedBases; j++ {
+		if R.At(j, j) == 0 {
+			return trainedModel{err: fmt.Errorf("projector training average pulse is degenerate (flat or constant)")}
+		}
+	}
+	Qfixed := Q.Slice(0, n, 0, nFixedBases)
+
+	// SVD of the whitened pulses, with the fixed vectors projected out
+	var dataW, coefs, resid mat.Dense
+	dataW.Mul(&W, data)
+	coefs.Mul(Qfixed.T(), &dataW)
+	resid.Mul(Qfixed, &coefs)
+	resid.Sub(&dataW, &resid)
+	basisW := mat.NewDense(n, nbases, nil)
+	basisW.Slice(0, n, 0, nFixedBases).(*mat.Dense).Copy(Qfixed)
+	if nbases > nFixedBases {
+		var svd mat.SVD
+		if ok := svd.Factorize(&resid, mat.SVDThin); !ok {
+			return trainedModel{err: fmt.Errorf("projector training SVD failed")}
+		}
+		var U mat.Dense
+		svd.UTo(&U)
+		basisW.Slice(0, n, nFixedBases, nbases).(*mat.Dense).Copy(U.Slice(0, n, 0, nbases-nFixedBases))
+	}
+
+	basis := mat.NewDense(n, nbases, nil)
+	basis.Mul(&L, basisW)
+	projectors := mat.NewDense(nbases, n, nil)
+	projectors.Mul(basisW.T(), &W)
+	description := fmt.Sprintf("Dastard-trained: %d bases from %d pulses and %d noise records (SVD with noise whitening)",
+		nbases, len(pulses), len(noise))
+	return trainedModel{projectors: projectors, basis: basis, description: description}
+}
+
+// subtractMean returns a copy of x with the mean of its first nmean values subtracted.
+func subtractMean(x []float64, nmean int) []float64 {
+	mean := 0.0
+	for _, v := range x[:nmean] {
+		mean += v
+	}
+	mean /= float64(nmean)
+	y := make([]float64, len(x))
+	for i, v := range x {
+		y[i] = v - mean
+	}
+	return y
+}
+
+// TrainProjectors starts (or restarts) collecting records to train projectors and a basis
+// in each channel of config.ChannelIndices. When training finishes, the result replaces
+// any projectors and basis already loaded.
+func (ds *AnySource) TrainProjectors(config *ProjectorTrainingConfig) error {
+	for _, channelIndex := range config.ChannelIndices {
+		if channelIndex < 0 || channelIndex >= len(ds.processors) {
+			return fmt.Errorf("channelIndex out of range, channelIndex=%v, len(ds.processors)=%v",
+				channelIndex, len(ds.processors))
+		}
+	}
+	trainers := make([]*ProjectorTrainer, len(config.ChannelIndices))
+	for i, channelIndex := range config.ChannelIndices {
+		dsp := ds.processors[channelIndex]
+		t, err := NewProjectorTrainer(config.NPulses, config.NNoise, config.NBases, dsp.NSamples, dsp.NPresamples)
+		if err != nil {
+			return err
+		}
+		trainers[i] = t
+	}
+	for i, channelIndex := range config.ChannelIndices {
+		ds.processors[channelIndex].trainer = trainers[i]
+	}
+	return nil
+}
+
+// CancelProjectorTraining stops projector training in the given channels (in all channels,
+// if channelIndices is empty). Projectors that were already installed are kept.
+func (ds *AnySource) CancelProjectorTraining(channelIndices []int) error {
+	dsps, err := ds.trainingProcessors(channelIndices)
+	if err != nil {
+		return err
+	}
+	for _, dsp := range dsps {
+		dsp.trainer = nil
+	}
+	return nil
+}
+
+// ProjectorTrainingStatuses returns the state of projector training in the given channels
+// (in all channels with training started, if channelIndices is empty).
+func (ds *AnySource) ProjectorTrainingStatuses(channelIndices []int) ([]*ProjectorTrainingStatus, error) {
+	dsps, err := ds.trainingProcessors(channelIndices)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]*ProjectorTrainingStatus, 0, len(dsps))
+	for _, dsp := range dsps {
+		statuses = append(statuses, dsp.trainer.status(dsp.channelIndex))
+	}
+	return statuses, nil
+}
+
+// trainingProcessors returns the processors for the given channels, checking that each one
+// has projector training started. If channelIndices is empty, return all processors that do.
+func (ds *AnySource) trainingProcessors(channelIndices []int) ([]*DataStreamProcessor, error) {
+	hasTrainer := func(dsp *DataStreamProcessor) bool { return dsp.trainer != nil }
+	return ds.processorsForIndices(channelIndices, hasTrainer, "has no projector training started")
+}
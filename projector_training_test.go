@@ -0,0 +1,138 @@
+package dastard
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/usnistgov/dastard/off"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestProjectorTraining(t *testing.T) {
+	const nsamp = 100
+	const npre = 20
+	if _, err := NewProjectorTrainer(10, 10, 2, nsamp, npre); err == nil {
+		t.Error("NewProjectorTrainer with NBases=2 should fail")
+	}
+	if _, err := NewProjectorTrainer(3, 10, 4, nsamp, npre); err == nil {
+		t.Error("NewProjectorTrainer with NPulses<NBases should fail")
+	}
+	if _, err := NewProjectorTrainer(10, 0, 4, nsamp, npre); err == nil {
+		t.Error("NewProjectorTrainer with NNoise=0 should fail")
+	}
+
+	// Pulses of 2 shapes in white noise.
+	rng := rand.New(rand.NewSource(2))
+	shape := func(i int, tau float64) float64 {
+		if i < npre {
+			return 0
+		}
+		x := float64(i - npre)
+		return math.Exp(-x/tau) - math.Exp(-x/2)
+	}
+	makeRecord := func(a1, a2 float64, noise bool) *DataRecord {
+		data := make([]RawType, nsamp)
+		for i := range data {
+			data[i] = RawType(1000 + a1*shape(i, 20) + a2*shape(i, 50) + 3*rng.NormFloat64())
+		}
+		return &DataRecord{data: data, noise: noise}
+	}
+	tr, err := NewProjectorTrainer(50, 40, 5, nsamp, npre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsp := NewDataStreamProcessor(0, NewTriggerBroker(1), npre, nsamp)
+	dsp.trainer = tr
+	for b := 0; b < 10; b++ {
+		records := []*DataRecord{makeRecord(0, 0, true), makeRecord(0, 0, true), {data: make([]RawType, 5)}}
+		for j := 0; j < 6; j++ {
+			records = append(records, makeRecord(3000*rng.Float64(), 1000*rng.Float64(), false))
+		}
+		tr.addRecords(records)
+	}
+	if s := tr.status(0); s.State != trainingCollecting || s.PulsesCollected != 50 || s.NoiseCollected != 20 {
+		t.Errorf("ProjectorTrainer status %v, want Collecting with 50 pulses and 20 noise", s)
+	}
+	for tr.state == trainingCollecting {
+		tr.addRecords([]*DataRecord{makeRecord(0, 0, true)})
+	}
+	// The result is not installed while the channel writes an OFF file.
+	dsp.DataPublisher.OFF = &off.Writer{}
+	for i := 0; tr.state == trainingComputing; i++ {
+		if i > 1000 {
+			t.Fatal("ProjectorTrainer did not finish computing")
+		}
+		time.Sleep(5 * time.Millisecond)
+		tr.installIfReady(dsp)
+	}
+	if s := tr.status(0); s.State != trainingWaiting || dsp.HasProjectors() {
+		t.Fatalf("ProjectorTrainer status %v with projectors installed=%t while writing OFF, want Waiting and none",
+			s, dsp.HasProjectors())
+	}
+	dsp.DataPublisher.OFF = nil
+	tr.installIfReady(dsp)
+	if s := tr.status(0); s.State != trainingInstalled || s.Error != "" || s.ModelDescription == "" {
+		t.Fatalf("ProjectorTrainer status %v, want Installed", s)
+	}
+	if !dsp.HasProjectors() {
+		t.Fatal("ProjectorTrainer did not install projectors")
+	}
+
+	// Projectors times basis should be the identity, and the model should fit a new pulse
+	// to within the noise.
+	var pb mat.Dense
+	pb.Mul(dsp.projectors, dsp.basis)
+	if !mat.EqualApprox(&pb, eye(5), 1e-8) {
+		t.Errorf("trained projectors*basis is not the identity: %v", mat.Formatted(&pb))
+	}
+	rec := makeRecord(2000, 700, false)
+	x := mat.NewVecDense(nsamp, recordAsFloats(rec))
+	var coefs, model mat.VecDense
+	coefs.MulVec(dsp.projectors, x)
+	model.MulVec(dsp.basis, &coefs)
+	model.SubVec(x, &model)
+	if rms := mat.Norm(&model, 2) / math.Sqrt(nsamp); rms > 4 {
+		t.Errorf("trained basis fits a pulse with rms residual %v, want < 4", rms)
+	}
+
+	// Training with noise records of zero variance fails, and leaves the projectors alone.
+	flat := [][]float64{make([]float64, nsamp)}
+	if m := trainProjectors([][]float64{recordAsFloats(rec), recordAsFloats(rec), recordAsFloats(rec)}, flat, 3, npre); m.err == nil {
+		t.Error("trainProjectors with zero-variance noise should fail")
+	}
+
+	// Start and cancel through a data source.
+	ds := AnySource{nchan: 2}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config := &ProjectorTrainingConfig{ChannelIndices: []int{0, 2}, NPulses: 10, NNoise: 10, NBases: 3}
+	if err := ds.TrainProjectors(config); err == nil {
+		t.Error("TrainProjectors succeeded with channel index out of range")
+	}
+	config.ChannelIndices = []int{1}
+	if err := ds.TrainProjectors(config); err != nil {
+		t.Error(err)
+	}
+	if statuses, err := ds.ProjectorTrainingStatuses(nil); err != nil || len(statuses) != 1 || statuses[0].ChannelIndex != 1 {
+		t.Errorf("ProjectorTrainingStatuses(nil) returned %v, %v, want channel 1 only", statuses, err)
+	}
+	if err := ds.CancelProjectorTraining(nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := ds.ProjectorTrainingStatuses([]int{1}); err == nil {
+		t.Error("ProjectorTrainingStatuses succeeded after CancelProjectorTraining")
+	}
+}
+
+// eye returns the n x n identity matrix.
+func eye(n int) *mat.Dense {
+	m := mat.NewDense(n, n, nil)
+	for i := 0; i < n; i++ {
+		m.Set(i, i, 1)
+	}
+	return m
+}
@@ -2,6 +2,7 @@ package dastard
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"reflect"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/usnistgov/dastard/getbytes"
 	"github.com/usnistgov/dastard/ljh"
 	"github.com/usnistgov/dastard/off"
+	"github.com/usnistgov/dastard/rawstream"
 	"gonum.org/v1/gonum/mat"
 
 	czmq "github.com/zeromq/goczmq"
@@ -23,6 +25,7 @@ type DataPublisher struct {
 	LJH22            *ljh.Writer
 	LJH3             *ljh.Writer3
 	OFF              *off.Writer
+	RawStream        *rawstream.Writer
 	WritingPaused    bool
 	numberWritten    int // integrates up the total number written, reset any time writing starts or stops
 }
@@ -44,6 +47,9 @@ func (dp *DataPublisher) Flush() {
 	if dp.HasOFF() {
 		dp.OFF.Flush()
 	}
+	if dp.HasRawStream() {
+		dp.RawStream.Flush()
+	}
 }
 
 // SetOFF adds an OFF writer to dp, the .file attribute is nil, and will be instantiated upon next call to dp.WriteRecord
@@ -150,6 +156,62 @@ func (dp *DataPublisher) RemoveLJH22() {
 	dp.numberWritten = 0
 }
 
+// SetRawStream adds a raw stream writer to dp, the .file attribute is nil, and will be instantiated upon next call to dp.WriteRawSegment
+func (dp *DataPublisher) SetRawStream(ChannelIndex int, Timebase float64,
+	NumberOfRows, NumberOfColumns, NumberOfChans, rowNum, colNum int,
+	FileName, sourceName, chanName string, ChannelNumberMatchingName int) {
+	header := rawstream.Header{ChannelIndex: ChannelIndex,
+		ChannelName:               chanName,
+		ChannelNumberMatchingName: ChannelNumberMatchingName,
+		FramePeriodSeconds:        Timebase,
+		SampleBits:                rawTypeBits,
+		CreationInfo: rawstream.CreationInfo{DastardVersion: Build.Version, GitHash: Build.Githash,
+			SourceName: sourceName, CreationTime: time.Now()},
+		ReadoutInfo: rawstream.TimeDivisionMultiplexingInfo{NumberOfRows: NumberOfRows,
+			NumberOfColumns: NumberOfColumns, NumberOfChans: NumberOfChans,
+			ColumnNum: colNum, RowNum: rowNum},
+	}
+	dp.RawStream = rawstream.NewWriter(FileName, header)
+	dp.WritingPaused = false
+}
+
+// HasRawStream returns true if RawStream is non-nil, eg if writing the raw data stream is occuring
+func (dp *DataPublisher) HasRawStream() bool {
+	return dp.RawStream != nil
+}
+
+// RemoveRawStream closes any existing raw stream file and assign .RawStream=nil
+func (dp *DataPublisher) RemoveRawStream() {
+	if dp.RawStream != nil {
+		dp.RawStream.Close()
+	}
+	dp.RawStream = nil
+}
+
+// WriteRawSegment writes the full data segment to the raw stream file, if enabled and not paused.
+func (dp *DataPublisher) WriteRawSegment(segment *DataSegment) error {
+	if !dp.HasRawStream() || dp.WritingPaused {
+		return nil
+	}
+	if !dp.RawStream.HeaderWritten() {
+		// if the file doesn't exists yet, create it and write header
+		if err := dp.RawStream.CreateFile(); err != nil {
+			return err
+		}
+		dp.RawStream.Signed = segment.signed
+		dp.RawStream.VoltsPerArb = segment.voltsPerArb
+		if err := dp.RawStream.WriteHeader(); err != nil {
+			return err
+		}
+	}
+	if rawTypeBits == 32 {
+		return dp.RawStream.WriteChunk32(int64(segment.firstFramenum), segment.firstTime.UnixNano(),
+			int32(segment.framesPerSample), int32(segment.droppedFrames), rawTypeToUint32(segment.rawData))
+	}
+	return dp.RawStream.WriteChunk(int64(segment.firstFramenum), segment.firstTime.UnixNano(),
+		int32(segment.framesPerSample), int32(segment.droppedFrames), rawTypeToUint16(segment.rawData))
+}
+
 // HasPubRecords return true if publishing records on PortTrigs Pub is occuring
 func (dp *DataPublisher) HasPubRecords() bool {
 	return dp.PubRecordsChan != nil
@@ -207,10 +269,14 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 				if err != nil {
 					return err
 				}
-				dp.LJH22.WriteHeader(record.trigTime)
+				if err := dp.LJH22.WriteHeader(record.trigTime); err != nil {
+					return err
+				}
 			}
 			nano := record.trigTime.UnixNano()
-			dp.LJH22.WriteRecord(int64(record.trigFrame), int64(nano)/1000, rawTypeToUint16(record.data))
+			if err := dp.LJH22.WriteRecord(int64(record.trigFrame), int64(nano)/1000, rawTypeToUint16(record.data)); err != nil {
+				return err
+			}
 		}
 	}
 	if dp.HasLJH3() && !dp.WritingPaused {
@@ -221,10 +287,14 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 				if err != nil {
 					return err
 				}
-				dp.LJH3.WriteHeader()
+				if err := dp.LJH3.WriteHeader(); err != nil {
+					return err
+				}
 			}
 			nano := record.trigTime.UnixNano()
-			dp.LJH3.WriteRecord(int32(record.presamples+1), int64(record.trigFrame), int64(nano)/1000, rawTypeToUint16(record.data))
+			if err := dp.LJH3.WriteRecord(int32(record.presamples+1), int64(record.trigFrame), int64(nano)/1000, rawTypeToUint16(record.data)); err != nil {
+				return err
+			}
 		}
 	}
 	if dp.HasOFF() && !dp.WritingPaused {
@@ -242,7 +312,8 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 				modelCoefs[i] = float32(v)
 			}
 			err := dp.OFF.WriteRecord(int32(len(record.data)), int32(record.presamples), int64(record.trigFrame), record.trigTime.UnixNano(),
-				float32(record.pretrigMean), float32(record.pretrigDelta), float32(record.residualStdDev), modelCoefs)
+				float32(record.pretrigMean), float32(record.pretrigDelta), float32(record.residualStdDev),
+				float32(record.filtValue), float32(record.filtPhase), modelCoefs)
 			if err != nil {
 				return err
 			}
@@ -274,10 +345,12 @@ func (dp *DataPublisher) PublishData(records []*DataRecord) error {
 // float32: residualStdDev
 // uint64: UnixNano trigTime
 // uint64: trigFrame
+// float32: filtValue
+// float32: filtPhase
 //  end of first message packet
 //  modelCoefs, each coef is float32, length can vary
 func messageSummaries(rec *DataRecord) [][]byte {
-	const headerVersion = uint16(0)
+	const headerVersion = uint16(1)
 
 	header := new(bytes.Buffer)
 	header.Write(getbytes.FromUint16(uint16(rec.channelIndex)))
@@ -292,6 +365,8 @@ func messageSummaries(rec *DataRecord) [][]byte {
 	nano := rec.trigTime.UnixNano()
 	header.Write(getbytes.FromInt64(nano))
 	header.Write(getbytes.FromInt64(int64(rec.trigFrame)))
+	header.Write(getbytes.FromFloat32(float32(rec.filtValue)))
+	header.Write(getbytes.FromFloat32(float32(rec.filtPhase)))
 
 	return [][]byte{header.Bytes(), getbytes.FromSliceFloat64(rec.modelCoefs)}
 }
@@ -308,13 +383,14 @@ func messageSummaries(rec *DataRecord) [][]byte {
 // uint64: trigger time, in ns since epoch 1970
 // uint64: trigger frame #
 // end of first message packet
-// data, each sample is uint16, length given above
+// data, each sample is a RawType (uint16, or uint32 in raw32 builds), length given above
 func messageRecords(rec *DataRecord) [][]byte {
 
 	const headerVersion = uint8(0)
-	dataType := uint8(3)
+	// Type code 3 (2 if signed) for 16-bit RawType, or 5 (4) for 32-bit.
+	dataType := uint8(rawTypeBits/8 + 1)
 	if rec.signed { // DataSegment.signed is set deep within a source, then dsp.signed is set equal to DataSegment.signed in process data, then DataRecord.signed is set equal to dsp.signed upon record generation
-		dataType = uint8(2)
+		dataType = uint8(rawTypeBits / 8)
 	}
 	header := new(bytes.Buffer)
 	header.Write(getbytes.FromUint16(uint16(rec.channelIndex)))
@@ -374,7 +450,7 @@ func startSocket(port int, converter func(*DataRecord) [][]byte) (chan []*DataRe
 	const publishChannelDepth = 500 // not totally sure how to choose this, but it should probably be
 	// at least as large as number of channels
 	pubchan := make(chan []*DataRecord, publishChannelDepth)
-	hostname := fmt.Sprintf("tcp://*:%d", port)
+	hostname := zmqPubEndpoint(port)
 	pubSocket, err := czmq.NewPub(hostname)
 	if err != nil {
 		return nil, err
@@ -403,19 +479,37 @@ func startSocket(port int, converter func(*DataRecord) [][]byte) (chan []*DataRe
 // see https://stackoverflow.com/questions/11924196/convert-between-slices-of-different-types
 func rawTypeToBytes(d []RawType) []byte {
 	header := *(*reflect.SliceHeader)(unsafe.Pointer(&d))
-	header.Cap *= 2 // byte takes up half the space of RawType
-	header.Len *= 2
+	const ratio = int(unsafe.Sizeof(RawType(0)))
+	header.Cap *= ratio // byte takes up 1/ratio the space of RawType
+	header.Len *= ratio
 	data := *(*[]byte)(unsafe.Pointer(&header))
 	return data
 }
 
 // rawTypeToUint16convert a []RawType to []uint16 using unsafe
+// (or by copying the low 16 bits, if RawType is wider)
 func rawTypeToUint16(d []RawType) []uint16 {
+	if rawTypeBits != 16 {
+		data := make([]uint16, len(d))
+		for i, v := range d {
+			data[i] = uint16(v)
+		}
+		return data
+	}
 	header := *(*reflect.SliceHeader)(unsafe.Pointer(&d))
 	data := *(*[]uint16)(unsafe.Pointer(&header))
 	return data
 }
 
+// rawTypeToUint32 converts a []RawType to a new []uint32 by copying
+func rawTypeToUint32(d []RawType) []uint32 {
+	data := make([]uint32, len(d))
+	for i, v := range d {
+		data[i] = uint32(v)
+	}
+	return data
+}
+
 func bytesToRawType(b []byte) []RawType {
 	header := *(*reflect.SliceHeader)(unsafe.Pointer(&b))
 	const ratio = int(unsafe.Sizeof(RawType(0)))
@@ -425,6 +519,19 @@ func bytesToRawType(b []byte) []RawType {
 	return data
 }
 
+// wordsToRawType converts a []byte slice of little-endian 16-bit words to []RawType,
+// without copying unless RawType is wider than 16 bits.
+func wordsToRawType(b []byte) []RawType {
+	if rawTypeBits == 16 {
+		return bytesToRawType(b)
+	}
+	data := make([]RawType, len(b)/2)
+	for i := range data {
+		data[i] = RawType(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	return data
+}
+
 // bytesToInt32 converts a []byte slice to an []int32 slice, which is
 // how we interpret the raw Abaco data.
 func bytesToInt32(b []byte) []int32 {
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/usnistgov/dastard/off"
 	"gonum.org/v1/gonum/mat"
 )
 
@@ -123,6 +124,21 @@ func TestPublishData(t *testing.T) {
 	if dp.HasOFF() {
 		t.Error("HasOFF() true, want false")
 	}
+	offReader, err := off.OpenReader("testData/TestPublishData.off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offReader.Close()
+	if offReader.NumberOfRecords() != 3 || offReader.ChannelName != "chanName" {
+		t.Errorf("OFF file has %d records for channel %q, want 3 for chanName", offReader.NumberOfRecords(),
+			offReader.ChannelName)
+	}
+	if offRec, err := offReader.NextRecord(); err != nil {
+		t.Error(err)
+	} else if offRec.RecordSamples != int32(len(d)) || offRec.RecordPreSamples != 4 {
+		t.Errorf("OFF record has RecordSamples=%d, RecordPreSamples=%d, want %d, 4", offRec.RecordSamples,
+			offRec.RecordPreSamples, len(d))
+	}
 
 	if err := configurePubRecordsSocket(); err == nil {
 		t.Error("it should be an error to configurePubRecordsSocket twice")
@@ -138,6 +154,9 @@ func TestPublishData(t *testing.T) {
 		header := msg[0]
 		dtype := header[3]
 		expect := []uint8{3, 2}
+		if rawTypeBits == 32 {
+			expect = []uint8{5, 4}
+		}
 		if dtype != expect[i] {
 			t.Errorf("messageRecords with signed=%t gives dtype=%d, want %d",
 				signed, dtype, expect[i])
@@ -148,6 +167,7 @@ func TestPublishData(t *testing.T) {
 }
 
 func TestRawTypeToX(t *testing.T) {
+	skipUnlessRaw16(t)
 	d := []RawType{0xFFFF, 0x0101, 0xABCD, 0xEF01, 0x2345, 0x6789}
 	b := rawTypeToBytes(d)
 	encodedStr := hex.EncodeToString(b)
@@ -0,0 +1,250 @@
+package dastard
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/usnistgov/dastard/rawstream"
+)
+
+// RawReplaySource replays a directory of raw stream files (written with the WriteRaw
+// option of WriteControl) through the normal processing chain. Each chunk in the files
+// becomes one DataSegment, with the original frame numbers, times, and dropped-frame counts.
+type RawReplaySource struct {
+	directory      string
+	fastAsPossible bool
+	fileNames      []string
+	readers        []*rawstream.Reader
+	AnySource
+}
+
+// NewRawReplaySource creates a new RawReplaySource. It must be configured with a
+// directory to replay before it is started.
+func NewRawReplaySource() *RawReplaySource {
+	rs := new(RawReplaySource)
+	rs.name = "RawReplay"
+	return rs
+}
+
+// RawReplaySourceConfig holds the arguments needed to call RawReplaySource.Configure by RPC
+type RawReplaySourceConfig struct {
+	Directory      string // replay all *.raw files in this directory, one channel per file
+	FastAsPossible bool   // if false, pace the replay at the original sample rate
+}
+
+// Configure sets the directory of raw stream files to replay and the pacing.
+func (rs *RawReplaySource) Configure(config *RawReplaySourceConfig) error {
+	rs.sourceStateLock.Lock()
+	defer rs.sourceStateLock.Unlock()
+	if rs.sourceState != Inactive {
+		return fmt.Errorf("cannot Configure a RawReplaySource if it's not Inactive")
+	}
+	fileNames, err := filepath.Glob(filepath.Join(config.Directory, "*.raw"))
+	if err != nil {
+		return err
+	}
+	if len(fileNames) == 0 {
+		return fmt.Errorf("RawReplaySource found no *.raw files in directory '%s'", config.Directory)
+	}
+	rs.directory = config.Directory
+	rs.fastAsPossible = config.FastAsPossible
+	rs.fileNames = fileNames
+	return nil
+}
+
+// Sample opens all the raw stream files and determines the number of channels and the
+// sample rate. It is an error for the files to disagree on the frame period.
+func (rs *RawReplaySource) Sample() error {
+	if len(rs.fileNames) == 0 {
+		return fmt.Errorf("RawReplaySource has no files to replay; configure it first")
+	}
+	rs.closeFiles()
+	for _, fname := range rs.fileNames {
+		r, err := rawstream.OpenReader(fname)
+		if err != nil {
+			rs.closeFiles()
+			return err
+		}
+		rs.readers = append(rs.readers, r)
+		if r.FramePeriodSeconds <= 0 {
+			rs.closeFiles()
+			return fmt.Errorf("RawReplaySource file '%s' has invalid frame period %v", fname, r.FramePeriodSeconds)
+		}
+	}
+	sort.SliceStable(rs.readers, func(i, j int) bool {
+		return rs.readers[i].ChannelIndex < rs.readers[j].ChannelIndex
+	})
+
+	period := rs.readers[0].FramePeriodSeconds
+	for _, r := range rs.readers {
+		if math.Abs(r.FramePeriodSeconds/period-1) > 1e-6 {
+			rs.closeFiles()
+			return fmt.Errorf("RawReplaySource files have different frame periods %v and %v",
+				period, r.FramePeriodSeconds)
+		}
+	}
+	rs.nchan = len(rs.readers)
+	rs.sampleRate = 1.0 / period
+	rs.samplePeriod = time.Duration(roundint(1e9 * period))
+	return nil
+}
+
+// closeFiles closes all open raw stream files.
+func (rs *RawReplaySource) closeFiles() {
+	for _, r := range rs.readers {
+		r.Close()
+	}
+	rs.readers = nil
+}
+
+// PrepareChannels sets up the channel names, numbers, row/column codes, and
+// physical units from the information in the raw stream file headers.
+func (rs *RawReplaySource) PrepareChannels() error {
+	rs.channelsPerPixel = 1
+	rs.chanNames = make([]string, rs.nchan)
+	rs.chanNumbers = make([]int, rs.nchan)
+	rs.rowColCodes = make([]RowColCode, rs.nchan)
+	rs.voltsPerArb = make([]float32, rs.nchan)
+	known := make(map[string]bool)
+	for i, r := range rs.readers {
+		name := r.ChannelName
+		if name == "" {
+			name = fmt.Sprintf("chan%d", r.ChannelNumberMatchingName)
+		}
+		if known[name] {
+			return fmt.Errorf("RawReplaySource found channel name '%s' in more than one file", name)
+		}
+		known[name] = true
+		rs.chanNames[i] = name
+		rs.chanNumbers[i] = r.ChannelNumberMatchingName
+		ri := r.ReadoutInfo
+		if ri.NumberOfRows > 0 && ri.NumberOfColumns > 0 {
+			rs.rowColCodes[i] = rcCode(ri.RowNum, ri.ColumnNum, ri.NumberOfRows, ri.NumberOfColumns)
+		} else {
+			rs.rowColCodes[i] = rcCode(0, i, 1, rs.nchan)
+		}
+		rs.voltsPerArb[i] = r.VoltsPerArb
+		if rs.voltsPerArb[i] == 0 {
+			rs.voltsPerArb[i] = 1. / 65535.0
+		}
+	}
+	firstchan := rs.chanNumbers[0]
+	lastchan := rs.chanNumbers[rs.nchan-1]
+	if lastchan < firstchan {
+		firstchan, lastchan = lastchan, firstchan
+	}
+	rs.groupKeysSorted = []GroupIndex{{Firstchan: firstchan, Nchan: lastchan + 1 - firstchan}}
+	return nil
+}
+
+// StartRun launches the goroutine that replays the data stream.
+func (rs *RawReplaySource) StartRun() error {
+	go func() {
+		log.Printf("starting RawReplaySource with %d channels from %s, fast=%t\n",
+			rs.nchan, rs.directory, rs.fastAsPossible)
+		defer close(rs.nextBlock)
+		defer rs.closeFiles()
+
+		startTime := time.Now()
+		lastHeartbeat := startTime
+		var dataDuration, durationSinceHeartbeat time.Duration
+		var bytesSinceHeartbeat int
+		for {
+			block, err := rs.makeBlock()
+			if err == io.EOF {
+				log.Printf("RawReplaySource reached the end of all files in %s\n", rs.directory)
+				return
+			}
+			seg := block.segments[0]
+			blockDuration := time.Duration(len(seg.rawData)*seg.framesPerSample) * seg.framePeriod
+			dataDuration += blockDuration
+			if !rs.fastAsPossible && block.err == nil {
+				select {
+				case <-rs.abortSelf:
+					return
+				case <-time.After(time.Until(startTime.Add(dataDuration))):
+				}
+			}
+			select {
+			case <-rs.abortSelf:
+				return
+			case rs.nextBlock <- block:
+			}
+			if block.err != nil {
+				return
+			}
+			rs.lastread = time.Now()
+			durationSinceHeartbeat += blockDuration
+			bytesSinceHeartbeat += 2 * len(seg.rawData) * rs.nchan
+			if rs.heartbeats != nil && time.Since(lastHeartbeat) >= time.Second {
+				mb := float64(bytesSinceHeartbeat) / 1e6
+				rs.heartbeats <- Heartbeat{Running: true, Time: durationSinceHeartbeat.Seconds(),
+					HWactualMB: mb, DataMB: mb}
+				lastHeartbeat = time.Now()
+				durationSinceHeartbeat = 0
+				bytesSinceHeartbeat = 0
+			}
+		}
+	}()
+	return nil
+}
+
+// makeBlock reads the next chunk from every file and makes a data block of them.
+// Returns io.EOF when the files are exhausted. Other problems, including chunks that
+// do not match across channels, are returned as the block's err.
+func (rs *RawReplaySource) makeBlock() (*dataBlock, error) {
+	block := new(dataBlock)
+	block.segments = make([]DataSegment, rs.nchan)
+	for channelIndex, r := range rs.readers {
+		chunk, err := r.NextChunk()
+		if err == io.EOF && channelIndex == 0 {
+			return nil, err
+		}
+		if err != nil {
+			block.err = fmt.Errorf("RawReplaySource channel %d: %v", channelIndex, err)
+			return block, nil
+		}
+		if channelIndex > 0 {
+			seg0 := block.segments[0]
+			if FrameIndex(chunk.FirstFramenum) != seg0.firstFramenum || chunk.Len() != len(seg0.rawData) {
+				block.err = fmt.Errorf("RawReplaySource channel %d chunk (frame %d, length %d) does not match channel 0 (frame %d, length %d)",
+					channelIndex, chunk.FirstFramenum, chunk.Len(), seg0.firstFramenum, len(seg0.rawData))
+				return block, nil
+			}
+		}
+		if r.SampleBits > rawTypeBits {
+			block.err = fmt.Errorf("RawReplaySource channel %d has %d-bit samples, which need Dastard built with -tags raw32",
+				channelIndex, r.SampleBits)
+			return block, nil
+		}
+		data := make([]RawType, chunk.Len())
+		for i, v := range chunk.Data32 {
+			data[i] = RawType(v)
+		}
+		for i, v := range chunk.Data {
+			data[i] = RawType(v)
+		}
+		if r.Signed && r.SampleBits == 16 {
+			signExtend16(data)
+		}
+		fps := chunk.FramesPerSample
+		if fps < 1 {
+			fps = 1
+		}
+		block.segments[channelIndex] = DataSegment{
+			rawData:         data,
+			signed:          r.Signed,
+			framesPerSample: fps,
+			framePeriod:     rs.samplePeriod,
+			firstFramenum:   FrameIndex(chunk.FirstFramenum),
+			firstTime:       time.Unix(0, chunk.FirstTime),
+			droppedFrames:   chunk.DroppedFrames,
+		}
+	}
+	return block, nil
+}
@@ -0,0 +1,126 @@
+package dastard
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRawWriteAndReplay(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dastardTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Write the raw stream of a 2-channel source.
+	ds := AnySource{nchan: 2, name: "testsource"}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.sampleRate = 100000
+	if err := ds.PrepareRun(256, 1024); err != nil {
+		t.Fatal(err)
+	}
+	config := &WriteControlConfig{Request: "Start", Path: tmp, WriteRaw: true}
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatal(err)
+	}
+	dirname := filepath.Dir(ds.ComputeWritingState().FilenamePattern)
+	t0 := time.Unix(1600000000, 0)
+	period := 10 * time.Microsecond
+	nsamp := []int{1000, 700, 300}
+	firstFrames := []FrameIndex{0, 1000, 1705}
+	dropped := []int{0, 0, 5}
+	var written []*dataBlock
+	for b, n := range nsamp {
+		block := new(dataBlock)
+		block.segments = make([]DataSegment, ds.nchan)
+		for i := range block.segments {
+			data := make([]RawType, n)
+			for j := range data {
+				data[j] = RawType(1000*i + j + b)
+			}
+			ff := firstFrames[b]
+			block.segments[i] = DataSegment{rawData: data, framesPerSample: 1, framePeriod: period,
+				firstFramenum: ff, firstTime: t0.Add(time.Duration(ff) * period), droppedFrames: dropped[b]}
+		}
+		written = append(written, block)
+		if err := ds.ProcessSegments(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatal(err)
+	}
+	ds.Stop()
+
+	// Now read it back.
+	rs := NewRawReplaySource()
+	rconfig := RawReplaySourceConfig{Directory: tmp, FastAsPossible: true}
+	if err := rs.Configure(&rconfig); err == nil {
+		t.Errorf("RawReplaySource.Configure() succeeded on a directory with no raw files")
+	}
+	rconfig.Directory = dirname
+	if err := rs.Configure(&rconfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if rs.nchan != ds.nchan || rs.samplePeriod != period {
+		t.Errorf("RawReplaySource has nchan=%d, period %v, want %d, %v", rs.nchan, rs.samplePeriod, ds.nchan, period)
+	}
+	if err := rs.PrepareChannels(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < rs.nchan; i++ {
+		if rs.chanNames[i] != ds.chanNames[i] || rs.chanNumbers[i] != ds.chanNumbers[i] {
+			t.Errorf("RawReplaySource channel %d is %s (%d), want %s (%d)", i,
+				rs.chanNames[i], rs.chanNumbers[i], ds.chanNames[i], ds.chanNumbers[i])
+		}
+	}
+	for b, wblock := range written {
+		block, err := rs.makeBlock()
+		if err != nil || block.err != nil {
+			t.Fatalf("RawReplaySource.makeBlock() returned errors %v, %v", err, block.err)
+		}
+		for i, want := range wblock.segments {
+			seg := block.segments[i]
+			if seg.firstFramenum != want.firstFramenum || !seg.firstTime.Equal(want.firstTime) ||
+				seg.droppedFrames != want.droppedFrames || seg.framesPerSample != want.framesPerSample ||
+				seg.framePeriod != want.framePeriod {
+				t.Errorf("block %d chan %d replayed as %v, want %v", b, i, seg, want)
+			}
+			if len(seg.rawData) != len(want.rawData) {
+				t.Fatalf("block %d chan %d replayed with %d samples, want %d", b, i, len(seg.rawData), len(want.rawData))
+			}
+			for j, v := range want.rawData {
+				if seg.rawData[j] != v {
+					t.Errorf("block %d chan %d sample %d replayed as %d, want %d", b, i, j, seg.rawData[j], v)
+					break
+				}
+			}
+		}
+	}
+	if _, err := rs.makeBlock(); err != io.EOF {
+		t.Errorf("RawReplaySource.makeBlock() at end of files returned %v, want io.EOF", err)
+	}
+	rs.closeFiles()
+
+	// Run the source to the end of the files.
+	rs.noProcess = true
+	source := DataSource(rs)
+	if err := Start(source, nil, 256, 1024); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; source.Running(); i++ {
+		if i > 1000 {
+			t.Fatal("RawReplaySource did not stop at the end of its files")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !raw32
+// +build !raw32
+
+package dastard
+
+// RawType holds raw signal data. Build with the raw32 tag (go build -tags raw32) to make it
+// 32 bits wide, for sources with more than 16 bits of dynamic range.
+type RawType uint16
+
+// signedRawType is how RawType values are interpreted when the data are signed.
+type signedRawType int16
+
+// rawTypeBits is the size of a RawType, in bits.
+const rawTypeBits = 16
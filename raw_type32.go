@@ -0,0 +1,16 @@
+//go:build raw32
+// +build raw32
+
+package dastard
+
+// RawType holds raw signal data. This is the 32-bit version, selected by the raw32 build tag.
+// Sources with only 16 bits per sample (the TDM sources) extend their values to 32 bits,
+// and phase data from 16-bit words fill the high 16 bits. LJH files cannot store 32-bit
+// samples, so write OFF or raw stream files instead.
+type RawType uint32
+
+// signedRawType is how RawType values are interpreted when the data are signed.
+type signedRawType int32
+
+// rawTypeBits is the size of a RawType, in bits.
+const rawTypeBits = 32
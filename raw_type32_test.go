@@ -0,0 +1,183 @@
+//go:build raw32
+// +build raw32
+
+// These tests cover the 32-bit RawType. Run them with go test -tags raw32.
+
+package dastard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/usnistgov/dastard/packets"
+	"github.com/usnistgov/dastard/rawstream"
+)
+
+func TestRaw32Conversions(t *testing.T) {
+	if rawTypeBits != 32 || rawSignOffset != 0x80000000 {
+		t.Fatalf("rawTypeBits=%d, rawSignOffset=0x%x in a raw32 build", rawTypeBits, rawSignOffset)
+	}
+	data := []RawType{0, 1, 0x7fff, 0x8000, 0xffff}
+	signExtend16(data)
+	for i, want := range []RawType{0, 1, 0x7fff, 0xffff8000, 0xffffffff} {
+		if data[i] != want {
+			t.Errorf("signExtend16 gives data[%d]=0x%x, want 0x%x", i, data[i], want)
+		}
+	}
+	words := wordsToRawType([]byte{0x01, 0x00, 0xcd, 0xab, 0xff, 0xff})
+	for i, want := range []RawType{1, 0xabcd, 0xffff} {
+		if words[i] != want {
+			t.Errorf("wordsToRawType gives [%d]=0x%x, want 0x%x", i, words[i], want)
+		}
+	}
+	c := rawTypeToUint32([]RawType{0x12345678})
+	if len(c) != 1 || c[0] != 0x12345678 {
+		t.Errorf("rawTypeToUint32 gives %v, want [0x12345678]", c)
+	}
+}
+
+func TestRaw32Demux(t *testing.T) {
+	const nchan = 2
+	dims := []int16{nchan}
+	for _, rawWords := range []bool{false, true} {
+		group := NewAbacoGroup(GroupIndex{Firstchan: 0, Nchan: nchan}, false, 0)
+		group.unwrap = group.unwrap[:0]
+		group.rawWords = rawWords
+		p16 := packets.NewPacket(10, 20, 0, 0)
+		p16.NewData([]int16{1, -1, -2, 0x7fff}, dims)
+		p32 := packets.NewPacket(10, 20, 1, 0)
+		p32.NewData([]int32{-70000, 1<<20 + 5, 3, -1}, dims)
+		group.queue = append(group.queue, p16, p32)
+
+		copies := [][]RawType{make([]RawType, 4), make([]RawType, 4)}
+		group.demuxData(copies, 4)
+		want := [][]RawType{
+			{0x10000, 0xfffe0000, RawType(0xffffffff - 69999), 3},
+			{0xffff0000, 0x7fff0000, 1<<20 + 5, 0xffffffff},
+		}
+		if rawWords {
+			want[0][0], want[0][1] = 1, 0xfffe
+			want[1][0], want[1][1] = 0xffff, 0x7fff
+		}
+		for i := range want {
+			for j := range want[i] {
+				if copies[i][j] != want[i][j] {
+					t.Errorf("demuxData(rawWords=%t) gives [%d][%d]=0x%x, want 0x%x", rawWords, i, j,
+						copies[i][j], want[i][j])
+				}
+			}
+		}
+	}
+}
+
+func TestRaw32Unwrap(t *testing.T) {
+	const bits2drop = 4
+	pu := NewPhaseUnwrapper(rawTypeBits, bits2drop, true, 100)
+	// A sawtooth of 4 steps per ϕ0 should unwrap to a line.
+	const step = 1 << (rawTypeBits - 2)
+	data := make([]RawType, 8)
+	for i := range data {
+		data[i] = RawType(i * step)
+	}
+	pu.UnwrapInPlace(&data)
+	for i, v := range data {
+		if want := RawType(i * (step >> bits2drop)); v != want {
+			t.Errorf("UnwrapInPlace data[%d]=0x%x, want 0x%x", i, v, want)
+		}
+	}
+}
+
+func TestRaw32Processing(t *testing.T) {
+	neg := func(v int32) RawType { return RawType(v) }
+	data := []RawType{neg(-100000), neg(-100002), 100000, 100001, neg(-3), 2}
+	seg := &DataSegment{rawData: data, signed: true}
+	dsp := NewDataStreamProcessor(0, nil, 256, 1024)
+	dsp.DecimateLevel = 2
+	dsp.Decimate = true
+	dsp.DecimateAvgMode = true
+	dsp.DecimateData(seg)
+	for i, want := range []RawType{neg(-100001), 100001, 0} {
+		if seg.rawData[i] != want {
+			t.Errorf("DecimateData signed gives [%d]=%d, want %d", i, int32(seg.rawData[i]), int32(want))
+		}
+	}
+
+	rec := &DataRecord{data: []RawType{neg(-70000), neg(-70000), 200000}, presamples: 2, signed: true}
+	dsp.AnalyzeData([]*DataRecord{rec})
+	if rec.pretrigMean != -70000 || rec.peakValue != 270000 {
+		t.Errorf("AnalyzeData signed gives pretrigMean=%f, peak=%f, want -70000, 270000",
+			rec.pretrigMean, rec.peakValue)
+	}
+
+	rec.signed = false
+	if msg := messageRecords(rec); msg[0][3] != 5 || len(msg[1]) != 12 {
+		t.Errorf("messageRecords unsigned gives data type %d and %d data bytes, want 5 and 12",
+			msg[0][3], len(msg[1]))
+	}
+	rec.signed = true
+	if msg := messageRecords(rec); msg[0][3] != 4 {
+		t.Errorf("messageRecords signed gives data type %d, want 4", msg[0][3])
+	}
+}
+
+func TestRaw32Writing(t *testing.T) {
+	var ds AnySource
+	config := WriteControlConfig{Request: "Start", Path: os.TempDir(), WriteLJH22: true}
+	if err := ds.writeControlStart(&config); err == nil {
+		t.Error("WriteControl with LJH22 succeeded in a raw32 build, want error")
+	}
+
+	tmp, err := ioutil.TempDir("", "raw32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	filename := path.Join(tmp, "chan1.raw")
+	var dp DataPublisher
+	dp.SetRawStream(0, 1e-6, 1, 1, 1, 0, 0, filename, "test", "chan1", 1)
+	data := []RawType{0, 70000, 0xffffffff}
+	seg := DataSegment{rawData: data, framesPerSample: 1, firstFramenum: 10, firstTime: time.Now()}
+	if err := dp.WriteRawSegment(&seg); err != nil {
+		t.Fatal(err)
+	}
+	dp.RemoveRawStream()
+
+	r, err := rawstream.OpenReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.SampleBits != 32 {
+		t.Errorf("raw stream SampleBits=%d, want 32", r.SampleBits)
+	}
+	chunk, err := r.NextChunk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Len() != len(data) {
+		t.Fatalf("raw stream chunk has %d samples, want %d", chunk.Len(), len(data))
+	}
+	for i, v := range chunk.Data32 {
+		if RawType(v) != data[i] {
+			t.Errorf("raw stream sample[%d]=%d, want %d", i, v, data[i])
+		}
+	}
+}
+
+func TestRaw32ParsePacket(t *testing.T) {
+	buf := new(bytes.Buffer)
+	header := []interface{}{uint8(0), uint8(1), uint16(1), uint16(2), uint16(2), uint64(0)}
+	for _, v := range header {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	binary.Write(buf, binary.BigEndian, []uint32{0x12345678, 0xfffffffe})
+	_, data := parsePacket(buf.Bytes())
+	if len(data) != 2 || data[0] != 0x12345678 || data[1] != 0xfffffffe {
+		t.Errorf("parsePacket of 4-byte words gives %x, want [12345678 fffffffe]", data)
+	}
+}
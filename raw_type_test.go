@@ -0,0 +1,57 @@
+package dastard
+
+import (
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Helpers so that the tests run in both 16-bit and raw32 builds. LJH files can store only
+// 16-bit raw data, so tests of writing use OFF or raw stream files in raw32 builds.
+
+// testWritesLJH is whether the tests can write LJH files in this build.
+const testWritesLJH = rawTypeBits == 16
+
+// skipUnlessRaw16 skips a test that assumes a 16-bit RawType. The tests in
+// raw_type32_test.go cover the same code for a 32-bit RawType.
+func skipUnlessRaw16(t *testing.T) {
+	if rawTypeBits != 16 {
+		t.Skipf("test assumes a 16-bit RawType, but this build has %d bits", rawTypeBits)
+	}
+}
+
+// testWriteConfig returns a request to write in path, in LJH 2.2 files (or raw stream
+// files, in raw32 builds).
+func testWriteConfig(request, path string) *WriteControlConfig {
+	return &WriteControlConfig{Request: request, Path: path, WriteLJH22: testWritesLJH, WriteRaw: !testWritesLJH}
+}
+
+// testRecordWriteConfig returns a request to start writing records in path, in LJH 2.2
+// files, and the extension of those files. In raw32 builds, it loads projectors into every
+// channel of ds and requests OFF files instead.
+func testRecordWriteConfig(t *testing.T, ds *AnySource, path string) (*WriteControlConfig, string) {
+	if testWritesLJH {
+		return &WriteControlConfig{Request: "Start", Path: path, WriteLJH22: true}, "ljh"
+	}
+	const nbases = 1
+	for _, dsp := range ds.processors {
+		nsamples := dsp.NSamples
+		projectors := mat.NewDense(nbases, nsamples, make([]float64, nbases*nsamples))
+		basis := mat.NewDense(nsamples, nbases, make([]float64, nbases*nsamples))
+		if err := dsp.SetProjectorsBasis(projectors, basis, "test model"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &WriteControlConfig{Request: "Start", Path: path, WriteOFF: true}, "off"
+}
+
+// testRecordsWritten returns the number of records dp has written to its LJH 2.2 or OFF file.
+func testRecordsWritten(dp *DataPublisher) int {
+	switch {
+	case dp.HasLJH22():
+		return dp.LJH22.RecordsWritten
+	case dp.HasOFF():
+		return dp.OFF.RecordsWritten()
+	}
+	return 0
+}
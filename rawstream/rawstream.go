@@ -0,0 +1,304 @@
+// Package rawstream provides classes that read or write the continuous (untriggered)
+// raw data stream of one channel.
+// Raw stream files have a one-line JSON header followed by a single newline.
+// After the header, chunks of data are written sequentially in little endian format.
+// Each chunk holds the data of one DataSegment, as it was received from the data source.
+// bytes    type      meaning
+// 0-7      int64     firstFramenum (frame number of the first sample in the chunk)
+// 8-15     int64     firstTime, time of the first sample, from time.Time.UnixNano()
+// 16-19    int32     framesPerSample (normally 1, but can be larger if decimated)
+// 20-23    int32     droppedFrames (normally 0, positive if frames were dropped before this chunk)
+// 24-27    int32     N = number of samples in the chunk
+// 28-Z     uint16    the N raw data samples (uint32 if the header's SampleBits is 32)
+// Z = 27+2*N (or 27+4*N)
+// Files before version 0.2.0 have no SampleBits in the header; their samples are uint16.
+package rawstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/usnistgov/dastard/getbytes"
+)
+
+// FileFormat is the name of the file format stored in each file header.
+const FileFormat = "DASTARD RAW STREAM"
+
+// FileFormatVersion is the version of the file format written by Writer.
+const FileFormatVersion = "0.2.0"
+
+// chunkHeaderLength is the number of bytes in each chunk before the data.
+const chunkHeaderLength = 28
+
+// Header contains the information stored in the JSON header of a raw stream file.
+type Header struct {
+	FileFormat                string
+	FileFormatVersion         string
+	ChannelIndex              int
+	ChannelName               string
+	ChannelNumberMatchingName int
+	FramePeriodSeconds        float64
+	Signed                    bool
+	VoltsPerArb               float32
+	SampleBits                int // 16 or 32
+	CreationInfo              CreationInfo
+	ReadoutInfo               TimeDivisionMultiplexingInfo
+}
+
+// CreationInfo stores info related to file creation for printing to the file header, aids with json formatting
+type CreationInfo struct {
+	DastardVersion string
+	GitHash        string
+	SourceName     string
+	CreationTime   time.Time
+}
+
+// TimeDivisionMultiplexingInfo stores info related to tdm readout for printing to the file header, aids with json formatting
+type TimeDivisionMultiplexingInfo struct {
+	NumberOfRows    int
+	NumberOfColumns int
+	NumberOfChans   int
+	ColumnNum       int
+	RowNum          int
+}
+
+// Chunk is one contiguous block of raw data samples.
+type Chunk struct {
+	FirstFramenum   int64
+	FirstTime       int64 // UnixNano
+	FramesPerSample int
+	DroppedFrames   int
+	Data            []uint16 // the samples, if the file has 16-bit samples
+	Data32          []uint32 // the samples, if the file has 32-bit samples
+}
+
+// Len returns the number of samples in the chunk.
+func (c *Chunk) Len() int {
+	if c.Data32 != nil {
+		return len(c.Data32)
+	}
+	return len(c.Data)
+}
+
+// Writer writes raw stream files
+type Writer struct {
+	Header
+
+	// items not serialized to JSON header
+	chunksWritten  int
+	samplesWritten int
+	fileName       string
+	headerWritten  bool
+	file           *os.File
+	writer         *bufio.Writer
+}
+
+// NewWriter creates a new raw stream writer. No file is created until CreateFile is called.
+// The header's SampleBits may be 16 or 32; 0 means 16.
+func NewWriter(fileName string, header Header) *Writer {
+	w := new(Writer)
+	w.Header = header
+	w.FileFormat = FileFormat
+	w.FileFormatVersion = FileFormatVersion
+	if w.SampleBits == 0 {
+		w.SampleBits = 16
+	}
+	w.fileName = fileName
+	return w
+}
+
+// CreateFile creates a file at w.fileName
+// must be called before WriteHeader or WriteChunk
+func (w *Writer) CreateFile() error {
+	if w.file != nil {
+		return errors.New("file already exists")
+	}
+	file, err := os.Create(w.fileName)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.writer = bufio.NewWriterSize(w.file, 65536)
+	return nil
+}
+
+// HeaderWritten returns true if header has been written.
+func (w *Writer) HeaderWritten() bool {
+	return w.headerWritten
+}
+
+// ChunksWritten returns the number of chunks written.
+func (w *Writer) ChunksWritten() int {
+	return w.chunksWritten
+}
+
+// SamplesWritten returns the number of data samples written in all chunks.
+func (w *Writer) SamplesWritten() int {
+	return w.samplesWritten
+}
+
+// WriteHeader writes a header to the file
+func (w *Writer) WriteHeader() error {
+	if w.headerWritten {
+		return errors.New("header already written")
+	}
+	if w.SampleBits != 16 && w.SampleBits != 32 {
+		return fmt.Errorf("raw stream SampleBits=%d, must be 16 or 32", w.SampleBits)
+	}
+	s, err := json.Marshal(w.Header)
+	if err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(s); err != nil {
+		return err
+	}
+	if _, err := w.writer.WriteString("\n"); err != nil {
+		return err
+	}
+	w.headerWritten = true
+	return nil
+}
+
+// WriteChunk writes one chunk of 16-bit data to the file
+func (w *Writer) WriteChunk(firstFramenum int64, firstTime int64, framesPerSample int32,
+	droppedFrames int32, data []uint16) error {
+	if w.SampleBits != 16 {
+		return fmt.Errorf("cannot write 16-bit samples to a raw stream with SampleBits=%d", w.SampleBits)
+	}
+	return w.writeChunk(firstFramenum, firstTime, framesPerSample, droppedFrames, len(data),
+		getbytes.FromSliceUint16(data))
+}
+
+// WriteChunk32 writes one chunk of 32-bit data to the file
+func (w *Writer) WriteChunk32(firstFramenum int64, firstTime int64, framesPerSample int32,
+	droppedFrames int32, data []uint32) error {
+	if w.SampleBits != 32 {
+		return fmt.Errorf("cannot write 32-bit samples to a raw stream with SampleBits=%d", w.SampleBits)
+	}
+	return w.writeChunk(firstFramenum, firstTime, framesPerSample, droppedFrames, len(data),
+		getbytes.FromSliceUint32(data))
+}
+
+// writeChunk writes the chunk header, then the nsamp samples already converted to bytes.
+func (w *Writer) writeChunk(firstFramenum int64, firstTime int64, framesPerSample int32,
+	droppedFrames int32, nsamp int, data []byte) error {
+	if !w.headerWritten {
+		return errors.New("cannot write a chunk before the header")
+	}
+	if _, err := w.writer.Write(getbytes.FromInt64(firstFramenum)); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(getbytes.FromInt64(firstTime)); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(getbytes.FromInt32(framesPerSample)); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(getbytes.FromInt32(droppedFrames)); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(getbytes.FromInt32(int32(nsamp))); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	w.chunksWritten++
+	w.samplesWritten += nsamp
+	return nil
+}
+
+// Flush flushes the write buffer
+func (w Writer) Flush() {
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+}
+
+// Close closes the file, it flushes the bufio.Writer first
+func (w Writer) Close() {
+	w.Flush()
+	if w.file != nil {
+		w.file.Close()
+	}
+}
+
+// Reader reads raw stream files
+type Reader struct {
+	Header
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// OpenReader returns an active raw stream file reader, or an error.
+func OpenReader(fileName string) (*Reader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{file: f, reader: bufio.NewReaderSize(f, 65536)}
+	line, err := r.reader.ReadBytes('\n')
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("raw stream file '%s': could not read header: %v", fileName, err)
+	}
+	if err := json.Unmarshal(line, &r.Header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("raw stream file '%s': could not parse header: %v", fileName, err)
+	}
+	if r.FileFormat != FileFormat {
+		f.Close()
+		return nil, fmt.Errorf("raw stream file '%s' has format '%s', want '%s'", fileName, r.FileFormat, FileFormat)
+	}
+	if r.SampleBits == 0 {
+		r.SampleBits = 16
+	}
+	if r.SampleBits != 16 && r.SampleBits != 32 {
+		f.Close()
+		return nil, fmt.Errorf("raw stream file '%s' has SampleBits=%d, want 16 or 32", fileName, r.SampleBits)
+	}
+	return r, nil
+}
+
+// NextChunk returns the next chunk in the file, or io.EOF after the last one.
+func (r *Reader) NextChunk() (*Chunk, error) {
+	var hdr [chunkHeaderLength]byte
+	if _, err := io.ReadFull(r.reader, hdr[:]); err != nil {
+		return nil, err
+	}
+	c := new(Chunk)
+	c.FirstFramenum = int64(binary.LittleEndian.Uint64(hdr[0:]))
+	c.FirstTime = int64(binary.LittleEndian.Uint64(hdr[8:]))
+	c.FramesPerSample = int(int32(binary.LittleEndian.Uint32(hdr[16:])))
+	c.DroppedFrames = int(int32(binary.LittleEndian.Uint32(hdr[20:])))
+	n := int(int32(binary.LittleEndian.Uint32(hdr[24:])))
+	if n < 0 {
+		return nil, fmt.Errorf("raw stream file '%s' has chunk of invalid length %d", r.file.Name(), n)
+	}
+	var data interface{}
+	if r.SampleBits == 32 {
+		c.Data32 = make([]uint32, n)
+		data = c.Data32
+	} else {
+		c.Data = make([]uint16, n)
+		data = c.Data
+	}
+	if err := binary.Read(r.reader, binary.LittleEndian, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the raw stream file reader.
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,159 @@
+package rawstream
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "rawstream_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := filepath.Join(tempDir, "test_chan1.raw")
+
+	header := Header{ChannelIndex: 3, ChannelName: "chan1", ChannelNumberMatchingName: 1,
+		FramePeriodSeconds: 9.6e-6, Signed: true, VoltsPerArb: 0.5,
+		ReadoutInfo: TimeDivisionMultiplexingInfo{NumberOfRows: 4, NumberOfColumns: 1, RowNum: 2}}
+	w := NewWriter(fileName, header)
+	if err := w.WriteChunk(0, 0, 1, 0, []uint16{1}); err == nil {
+		t.Error("WriteChunk before CreateFile and WriteHeader should fail")
+	}
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateFile(); err == nil {
+		t.Error("CreateFile twice should fail")
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.HeaderWritten() {
+		t.Error("HeaderWritten() false after WriteHeader")
+	}
+	if err := w.WriteHeader(); err == nil {
+		t.Error("WriteHeader twice should fail")
+	}
+	if err := w.WriteChunk32(0, 0, 1, 0, []uint32{1}); err == nil {
+		t.Error("WriteChunk32 to a 16-bit raw stream should fail")
+	}
+	chunks := []Chunk{
+		{FirstFramenum: 1000, FirstTime: 123456789, FramesPerSample: 1, DroppedFrames: 0,
+			Data: []uint16{1, 2, 3, 4, 5}},
+		{FirstFramenum: 1010, FirstTime: 123556789, FramesPerSample: 1, DroppedFrames: 5,
+			Data: []uint16{10, 20, 30}},
+		{FirstFramenum: 1013, FirstTime: 123586789, FramesPerSample: 2, DroppedFrames: 0,
+			Data: []uint16{}},
+	}
+	for _, c := range chunks {
+		if err := w.WriteChunk(c.FirstFramenum, c.FirstTime, int32(c.FramesPerSample),
+			int32(c.DroppedFrames), c.Data); err != nil {
+			t.Error(err)
+		}
+	}
+	if w.ChunksWritten() != 3 || w.SamplesWritten() != 8 {
+		t.Errorf("Writer wrote %d chunks and %d samples, want 3 and 8", w.ChunksWritten(), w.SamplesWritten())
+	}
+	w.Close()
+
+	r, err := OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	header.FileFormat = FileFormat
+	header.FileFormatVersion = FileFormatVersion
+	header.SampleBits = 16
+	if !reflect.DeepEqual(r.Header, header) {
+		t.Errorf("Reader header is %v, want %v", r.Header, header)
+	}
+	for i, want := range chunks {
+		c, err := r.NextChunk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*c, want) {
+			t.Errorf("chunk %d is %v, want %v", i, *c, want)
+		}
+	}
+	if _, err := r.NextChunk(); err != io.EOF {
+		t.Errorf("NextChunk at end of file returns %v, want io.EOF", err)
+	}
+
+	if _, err := OpenReader("rawstream.go"); err == nil {
+		t.Error("OpenReader succeeded on a non-raw stream file")
+	}
+	if _, err := OpenReader(filepath.Join(tempDir, "doesnt_exist.raw")); err == nil {
+		t.Error("OpenReader succeeded on a non-existent file")
+	}
+}
+
+func TestWriteRead32(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "rawstream_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := filepath.Join(tempDir, "test_chan2.raw")
+
+	w := NewWriter(fileName, Header{ChannelName: "chan2", SampleBits: 32})
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChunk(0, 0, 1, 0, []uint16{1}); err == nil {
+		t.Error("WriteChunk to a 32-bit raw stream should fail")
+	}
+	want := Chunk{FirstFramenum: 50, FirstTime: 987654321, FramesPerSample: 1, DroppedFrames: 2,
+		Data32: []uint32{0, 1, 0x10000, 0xfffffffe}}
+	if err := w.WriteChunk32(want.FirstFramenum, want.FirstTime, int32(want.FramesPerSample),
+		int32(want.DroppedFrames), want.Data32); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	r, err := OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.SampleBits != 32 {
+		t.Errorf("Reader SampleBits=%d, want 32", r.SampleBits)
+	}
+	c, err := r.NextChunk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*c, want) || c.Len() != len(want.Data32) {
+		t.Errorf("chunk is %v, want %v", *c, want)
+	}
+
+	// Files written before SampleBits existed hold 16-bit samples.
+	oldName := filepath.Join(tempDir, "old_chan1.raw")
+	if err := ioutil.WriteFile(oldName, []byte(`{"FileFormat":"DASTARD RAW STREAM","FileFormatVersion":"0.1.0"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err = OpenReader(oldName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.SampleBits != 16 {
+		t.Errorf("Reader of a version 0.1.0 file has SampleBits=%d, want 16", r.SampleBits)
+	}
+	w = NewWriter(filepath.Join(tempDir, "bad.raw"), Header{SampleBits: 8})
+	if err := w.CreateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(); err == nil {
+		t.Error("WriteHeader with SampleBits=8 should fail")
+	}
+	w.Close()
+}
@@ -28,11 +28,12 @@ type RoachSource struct {
 	AnySource
 }
 
-const roachFractionBits = 14
+const roachFractionBits = rawTypeBits - 2
 const roachBitsToDrop = 2
 
 // That is, ROACH data is of the form ii.bbbb bbbb bbbb bb with 2 integer bits
 // and 14 fractional bits. In the unwrapping process, we drop 2, making it 4/12.
+// (With the raw32 build tag, there are 30 fractional bits, and it becomes 4/28.)
 
 // NewRoachDevice creates a new RoachDevice.
 func NewRoachDevice(host string, rate float64) (dev *RoachDevice, err error) {
@@ -74,20 +75,23 @@ func parsePacket(packet []byte) (header packetHeader, data []RawType) {
 	wordLen := int(1 << (header.Flags & 0x3)) // data word length in bytes
 	switch wordLen {
 	case 2:
-		if err := binary.Read(buf, binary.BigEndian, &data); err != nil {
+		// 16-bit words fill the most significant bits of a wider RawType.
+		data2 := make([]uint16, header.Nchan*header.Nsamp)
+		if err := binary.Read(buf, binary.BigEndian, &data2); err != nil {
 			panic(fmt.Sprintln("binary.Read failed:", err))
 		}
+		for i, v := range data2 {
+			data[i] = RawType(v) << (rawTypeBits - 16)
+		}
 	case 4:
-		// Throw away the 2 least-significant bytes from each 4 byte word.
-		// Because binary.Read does the big->little endian swapping, but only
-		// within the 16-bit words of data4[:], we have data4[0] representing
-		// the most significant 16 bits of 32, and data4[1] the least.
-		data4 := make([]RawType, header.Nchan*header.Nsamp*2)
+		// Throw away the least-significant bytes from each 4 byte word that
+		// don't fit in a RawType (the 2 lowest, unless built with the raw32 tag).
+		data4 := make([]uint32, header.Nchan*header.Nsamp)
 		if err := binary.Read(buf, binary.BigEndian, &data4); err != nil {
 			panic(fmt.Sprintln("binary.Read failed:", err))
 		}
-		for i := range data {
-			data[i] = data4[i*2]
+		for i, v := range data4 {
+			data[i] = RawType(v >> (32 - rawTypeBits))
 		}
 	default:
 		msg := fmt.Sprintf("wordLen %v not implemented. Header: %v", wordLen, header)
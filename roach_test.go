@@ -108,9 +108,11 @@ func TestRoachDevice(t *testing.T) {
 			t.Errorf("RoachDevice block has %d data segments, want %d", len(block.segments), dev.nchan)
 		}
 		for i, seg := range block.segments {
-			if seg.rawData[0] != RawType(i/4) {
+			// 16-bit words fill the high bits of a RawType, then 2 bits are dropped.
+			want := RawType(i) << (rawTypeBits - 16) >> roachBitsToDrop
+			if seg.rawData[0] != want {
 				t.Errorf("RoachDevice block.segments[%d][0] = %d, want %d",
-					i, seg.rawData[0], i/4)
+					i, seg.rawData[0], want)
 			}
 			if len(seg.rawData) != block.nSamp {
 				t.Errorf("RoachDevice block.segments[%d] length=%d, want %d", i, len(seg.rawData), block.nSamp)
@@ -194,9 +196,11 @@ func TestRoachSource(t *testing.T) {
 			t.Errorf("RoachSource block has %d data segments, want %d", len(block.segments), dev.nchan)
 		}
 		for i, seg := range block.segments {
-			if seg.rawData[0] != RawType(i/4) {
+			// 16-bit words fill the high bits of a RawType, then 2 bits are dropped.
+			want := RawType(i) << (rawTypeBits - 16) >> roachBitsToDrop
+			if seg.rawData[0] != want {
 				t.Errorf("RoachSource block.segments[%d][0] = %d, want %d",
-					i, seg.rawData[0], i/4)
+					i, seg.rawData[0], want)
 			}
 			if len(seg.rawData) != block.nSamp {
 				t.Errorf("RoachSource block.segments[%d] length=%d, want %d", i, len(seg.rawData), block.nSamp)
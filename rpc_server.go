@@ -14,6 +14,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -31,11 +32,27 @@ type SourceControl struct {
 	roach          *RoachSource
 	abaco          *AbacoSource
 	erroring       *ErroringSource
+	ljhReplay      *LJHReplaySource
+	rawReplay      *RawReplaySource
+	tesSim         *TESSimSource
+	tdmUDP         *TDMUDPSource
 	ActiveSource   DataSource
 	isSourceActive bool
 	mapServer      *MapServer
 
+	// For restarting a source automatically after an error
+	lastSourceName  string              // the name given to the last successful Start
+	lastWriteConfig *WriteControlConfig // the config that last started writing
+	lastMix         []float64           // the mix fractions last reported by the source
+	restart         autoRestarter
+
+	sequencer runSequencer     // runs scripted sequences of steps
+	diskSpace diskSpaceMonitor // pauses or stops writing when the disk is nearly full
+
+	savedGroupTrigger GroupTriggerState // group trigger connections read from the config file
+
 	status        ServerStatus
+	sourceConfigs SourceConfigs // the last successful configuration of each source
 	clientUpdates chan<- ClientUpdate
 	totalData     Heartbeat
 	heartbeats    chan Heartbeat
@@ -43,6 +60,10 @@ type SourceControl struct {
 	// For queueing up RPC requests for later execution and getting the result
 	queuedRequests chan func()
 	queuedResults  chan error
+
+	// lock serializes RPC requests (from all connections) with background tasks
+	// such as restarts, sequences, and periodic checks that also use SourceControl.
+	lock sync.Mutex
 }
 
 // NewSourceControl creates a new SourceControl object with correctly initialized
@@ -56,6 +77,10 @@ func NewSourceControl() *SourceControl {
 	sc.simPulses = NewSimPulseSource()
 	sc.triangle = NewTriangleSource()
 	sc.erroring = NewErroringSource()
+	sc.ljhReplay = NewLJHReplaySource()
+	sc.rawReplay = NewRawReplaySource()
+	sc.tesSim = NewTESSimSource()
+	sc.tdmUDP = NewTDMUDPSource()
 	lan, _ := NewLanceroSource()
 	sc.lancero = lan
 	sc.roach, _ = NewRoachSource()
@@ -64,11 +89,18 @@ func NewSourceControl() *SourceControl {
 	sc.simPulses.heartbeats = sc.heartbeats
 	sc.triangle.heartbeats = sc.heartbeats
 	sc.erroring.heartbeats = sc.heartbeats
+	sc.ljhReplay.heartbeats = sc.heartbeats
+	sc.rawReplay.heartbeats = sc.heartbeats
+	sc.tesSim.heartbeats = sc.heartbeats
+	sc.tdmUDP.heartbeats = sc.heartbeats
 	sc.lancero.heartbeats = sc.heartbeats
 	sc.roach.heartbeats = sc.heartbeats
 	sc.abaco.heartbeats = sc.heartbeats
 
 	sc.status.ChanGroups = make([]GroupIndex, 0)
+	sc.restart.policy = defaultAutoRestartPolicy
+	sc.sequencer.status.State = "Idle"
+	sc.diskSpace.guard = defaultDiskSpaceGuard
 	return sc
 }
 
@@ -82,6 +114,7 @@ type ServerStatus struct {
 	SamplePeriod           time.Duration // time per sample
 	ChanGroups             []GroupIndex  // the channel groups
 	ChannelsWithProjectors []int         // move this to something that reports mix also? and experimentStateLabel
+	ChannelsWithFilters    []int         // channels with an optimal filter loaded
 	// TODO: maybe bytes/sec data rate...?
 }
 
@@ -109,6 +142,10 @@ func (s *SourceControl) ConfigureTriangleSource(args *TriangleSourceConfig, repl
 	log.Printf("ConfigureTriangleSource: %d chan, rate=%.3f\n", args.Nchan, args.SampleRate)
 	err := s.triangle.Configure(args)
 	s.clientUpdates <- ClientUpdate{"TRIANGLE", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.Triangle = &config
+	}
 	*reply = (err == nil)
 	log.Printf("Result is okay=%t and state={%d chan, rate=%.3f}\n", *reply, s.triangle.nchan, s.triangle.sampleRate)
 	return err
@@ -119,11 +156,58 @@ func (s *SourceControl) ConfigureSimPulseSource(args *SimPulseSourceConfig, repl
 	log.Printf("ConfigureSimPulseSource: %d chan, rate=%.3f\n", args.Nchan, args.SampleRate)
 	err := s.simPulses.Configure(args)
 	s.clientUpdates <- ClientUpdate{"SIMPULSE", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.SimPulse = &config
+	}
 	*reply = (err == nil)
 	log.Printf("Result is okay=%t and state={%d chan, rate=%.3f}\n", *reply, s.simPulses.nchan, s.simPulses.sampleRate)
 	return err
 }
 
+// ConfigureLJHReplaySource configures the source that replays a directory of LJH files.
+func (s *SourceControl) ConfigureLJHReplaySource(args *LJHReplaySourceConfig, reply *bool) error {
+	log.Printf("ConfigureLJHReplaySource: directory %s, fast=%t\n", args.Directory, args.FastAsPossible)
+	err := s.ljhReplay.Configure(args)
+	s.clientUpdates <- ClientUpdate{"LJHREPLAY", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.LJHReplay = &config
+	}
+	*reply = (err == nil)
+	log.Printf("Result is okay=%t\n", *reply)
+	return err
+}
+
+// ConfigureRawReplaySource configures the source that replays a directory of raw stream files.
+func (s *SourceControl) ConfigureRawReplaySource(args *RawReplaySourceConfig, reply *bool) error {
+	log.Printf("ConfigureRawReplaySource: directory %s, fast=%t\n", args.Directory, args.FastAsPossible)
+	err := s.rawReplay.Configure(args)
+	s.clientUpdates <- ClientUpdate{"RAWREPLAY", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.RawReplay = &config
+	}
+	*reply = (err == nil)
+	log.Printf("Result is okay=%t\n", *reply)
+	return err
+}
+
+// ConfigureTESSimSource configures the source of simulated TES array data.
+func (s *SourceControl) ConfigureTESSimSource(args *TESSimSourceConfig, reply *bool) error {
+	log.Printf("ConfigureTESSimSource: %d chan, rate=%.3f, pulse rate=%.3f\n", args.Nchan, args.SampleRate,
+		args.PulseRate)
+	err := s.tesSim.Configure(args)
+	s.clientUpdates <- ClientUpdate{"TESSIM", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.TESSim = &config
+	}
+	*reply = (err == nil)
+	log.Printf("Result is okay=%t\n", *reply)
+	return err
+}
+
 // ConfigureLanceroSource configures the lancero cards.
 func (s *SourceControl) ConfigureLanceroSource(args *LanceroSourceConfig, reply *bool) error {
 	log.Printf("ConfigureLanceroSource: mask 0x%4.4x  active cards: %v\n", args.FiberMask, args.ActiveCards)
@@ -131,6 +215,10 @@ func (s *SourceControl) ConfigureLanceroSource(args *LanceroSourceConfig, reply
 	// Remember any errors for later, when we try to start the source.
 	s.lancero.configError = err
 	s.clientUpdates <- ClientUpdate{"LANCERO", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.Lancero = &config
+	}
 	*reply = (err == nil)
 	log.Printf("Result is okay=%t and state={%d MHz clock, %d cards}\n", *reply, s.lancero.clockMHz, s.lancero.ncards)
 	return err
@@ -141,6 +229,24 @@ func (s *SourceControl) ConfigureAbacoSource(args *AbacoSourceConfig, reply *boo
 	log.Printf("ConfigureAbacoSource: \n")
 	err := s.abaco.Configure(args)
 	s.clientUpdates <- ClientUpdate{"ABACO", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.Abaco = &config
+	}
+	*reply = (err == nil)
+	log.Printf("Result is okay=%t\n", *reply)
+	return err
+}
+
+// ConfigureTDMUDPSource configures the source of TDM data sent by UDP.
+func (s *SourceControl) ConfigureTDMUDPSource(args *TDMUDPSourceConfig, reply *bool) error {
+	log.Printf("ConfigureTDMUDPSource: %v, nsamp=%d, rate=%.3f\n", args.HostPortUDP, args.Nsamp, args.SampleRate)
+	err := s.tdmUDP.Configure(args)
+	s.clientUpdates <- ClientUpdate{"TDMUDP", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.TDMUDP = &config
+	}
 	*reply = (err == nil)
 	log.Printf("Result is okay=%t\n", *reply)
 	return err
@@ -151,11 +257,23 @@ func (s *SourceControl) ConfigureRoachSource(args *RoachSourceConfig, reply *boo
 	log.Printf("ConfigureRoachSource: \n")
 	err := s.roach.Configure(args)
 	s.clientUpdates <- ClientUpdate{"ROACH", args}
+	if err == nil {
+		config := *args
+		s.sourceConfigs.Roach = &config
+	}
 	*reply = (err == nil)
 	log.Printf("Result is okay=%t\n", *reply)
 	return err
 }
 
+// serially runs f while holding the lock that serializes RPC requests. Goroutines
+// other than the RPC server must use it to call SourceControl methods.
+func (s *SourceControl) serially(f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f()
+}
+
 // runLaterIfActive will return error if source is Inactive; otherwise it will
 // run the closure f at an appropriate point in the data handling cycle
 // and return any error sent on s.queuedRequests.
@@ -177,16 +295,19 @@ type MixFractionObject struct {
 // mix = fb + mixFraction*err/Nsamp
 // This MixFractionObject contains mix fractions as reported by autotune, where error/Nsamp
 // is used. Thus, we will internally store not MixFraction, but errorScale := MixFraction/Nsamp.
-// Supported by LanceroSource only.
+// Supported by the TDM sources (LanceroSource and TDMUDPSource) only.
 //
 // This does not need to be sent on the queuedRequests channel, because internally
-// LanceroSource.ConfigureMixFraction will queue these requests. The reason is that
+// the source's ConfigureMixFraction will queue these requests. The reason is that
 // queuedRequests is for keeping RPC requests separate from the data-*processing* step.
-// But changes to the mix settings need to be kept separate from LanceroSource.distrubuteData,
+// But changes to the mix settings need to be kept separate from the source's distributeData,
 // which is part of the data-*production* step, not the data-processing step.
 func (s *SourceControl) ConfigureMixFraction(mfo *MixFractionObject, reply *bool) error {
 	currentMix, err := s.ActiveSource.ConfigureMixFraction(mfo)
 	*reply = (err == nil)
+	if err == nil {
+		s.lastMix = currentMix
+	}
 	s.broadcastMixState(currentMix)
 	return err
 }
@@ -212,26 +333,35 @@ type ProjectorsBasisObject struct {
 	ModelDescription string
 }
 
-// ConfigureProjectorsBasis takes ProjectorsBase64 which must a base64 encoded string with binary data matching that from mat.Dense.MarshalBinary
-func (s *SourceControl) ConfigureProjectorsBasis(pbo *ProjectorsBasisObject, reply *bool) error {
-	*reply = false
+// decode returns the projectors and basis encoded in pbo.
+func (pbo *ProjectorsBasisObject) decode() (projectors, basis *mat.Dense, err error) {
 	projectorsBytes, err := base64.StdEncoding.DecodeString(pbo.ProjectorsBase64)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	basisBytes, err := base64.StdEncoding.DecodeString(pbo.BasisBase64)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	var projectors, basis mat.Dense
+	projectors, basis = new(mat.Dense), new(mat.Dense)
 	if err = projectors.UnmarshalBinary(projectorsBytes); err != nil {
-		return err
+		return nil, nil, err
 	}
 	if err = basis.UnmarshalBinary(basisBytes); err != nil {
+		return nil, nil, err
+	}
+	return projectors, basis, nil
+}
+
+// ConfigureProjectorsBasis takes ProjectorsBase64 which must a base64 encoded string with binary data matching that from mat.Dense.MarshalBinary
+func (s *SourceControl) ConfigureProjectorsBasis(pbo *ProjectorsBasisObject, reply *bool) error {
+	*reply = false
+	projectors, basis, err := pbo.decode()
+	if err != nil {
 		return err
 	}
 	f := func() {
-		errcpb := s.ActiveSource.ConfigureProjectorsBases(pbo.ChannelIndex, &projectors, &basis, pbo.ModelDescription)
+		errcpb := s.ActiveSource.ConfigureProjectorsBases(pbo.ChannelIndex, projectors, basis, pbo.ModelDescription)
 		if errcpb == nil {
 			s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
 		}
@@ -242,6 +372,171 @@ func (s *SourceControl) ConfigureProjectorsBasis(pbo *ProjectorsBasisObject, rep
 	return err
 }
 
+// TrainProjectors starts collecting pulse and noise records in the given channels, from
+// which Dastard will compute and install projectors and a basis (replacing those loaded by
+// ConfigureProjectorsBasis). Noise records come only from the noise trigger, so it must be on.
+func (s *SourceControl) TrainProjectors(config *ProjectorTrainingConfig, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.TrainProjectors(config)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// CancelProjectorTraining stops projector training in the given channels (all channels if
+// the list is empty). Any projectors already installed by training are kept.
+func (s *SourceControl) CancelProjectorTraining(channelIndices *[]int, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.CancelProjectorTraining(*channelIndices)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ProjectorTrainingStatus reports the progress (and result) of projector training in the
+// given channels (all channels where training was started, if the list is empty).
+func (s *SourceControl) ProjectorTrainingStatus(channelIndices *[]int, reply *[]*ProjectorTrainingStatus) error {
+	f := func() {
+		statuses, err := s.ActiveSource.ProjectorTrainingStatuses(*channelIndices)
+		if err == nil {
+			*reply = statuses
+			s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
+}
+
+// FilterObject is the RPC-usable structure for ConfigureFilter
+type FilterObject struct {
+	ChannelIndex        int
+	FilterBase64        string // optimal filter, required
+	ArrivalFilterBase64 string // arrival-time filter, optional (empty string means none)
+	Description         string
+}
+
+// decode returns the optimal filter and arrival-time filter (nil if none) encoded in fo.
+func (fo *FilterObject) decode() (filter, arrival *mat.VecDense, err error) {
+	filterBytes, err := base64.StdEncoding.DecodeString(fo.FilterBase64)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter = new(mat.VecDense)
+	if err = filter.UnmarshalBinary(filterBytes); err != nil {
+		return nil, nil, err
+	}
+	if len(fo.ArrivalFilterBase64) > 0 {
+		arrivalBytes, err := base64.StdEncoding.DecodeString(fo.ArrivalFilterBase64)
+		if err != nil {
+			return nil, nil, err
+		}
+		arrival = new(mat.VecDense)
+		if err = arrival.UnmarshalBinary(arrivalBytes); err != nil {
+			return nil, nil, err
+		}
+	}
+	return filter, arrival, nil
+}
+
+// ConfigureFilter loads an optimal filter and optional arrival-time filter for one channel.
+// FilterBase64 and ArrivalFilterBase64 must be base64 encoded strings with binary data
+// matching that from mat.VecDense.MarshalBinary, of length equal to the record length.
+func (s *SourceControl) ConfigureFilter(fo *FilterObject, reply *bool) error {
+	*reply = false
+	filter, arrival, err := fo.decode()
+	if err != nil {
+		return err
+	}
+	f := func() {
+		errcf := s.ActiveSource.ConfigureFilters(fo.ChannelIndex, filter, arrival, fo.Description)
+		if errcf == nil {
+			s.status.ChannelsWithFilters = s.ActiveSource.ChannelsWithFilters()
+		}
+		s.queuedResults <- errcf
+	}
+	err = s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ConfigureHistograms sets up (or, with Nbins=0, turns off) histograms of one record
+// quantity for the given channels. Any existing counts in those channels are discarded.
+func (s *SourceControl) ConfigureHistograms(hco *HistogramConfigObject, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.ConfigureHistograms(hco)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ResetHistograms zeros the histograms of the given channels (all channels if the list is empty).
+func (s *SourceControl) ResetHistograms(channelIndices *[]int, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.ResetHistograms(*channelIndices)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// HistogramSnapshot returns a copy of the histograms of the given channels (all channels
+// with histograms if the list is empty). The same snapshots are also published on the
+// histogram port right away, without waiting for the next periodic publication.
+func (s *SourceControl) HistogramSnapshot(channelIndices *[]int, reply *[]*HistogramSnapshot) error {
+	f := func() {
+		snapshots, err := s.ActiveSource.HistogramSnapshots(*channelIndices)
+		if err == nil {
+			*reply = snapshots
+			if PubHistogramsChan != nil && len(snapshots) > 0 {
+				select {
+				case PubHistogramsChan <- snapshots:
+				default: // never block the data processing loop to publish histograms
+				}
+			}
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
+}
+
+// StartNoisePSD starts (or restarts) accumulating averaged noise power spectral densities of
+// the continuous data in the given channels.
+func (s *SourceControl) StartNoisePSD(config *NoisePSDConfig, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.StartNoisePSD(config)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// StopNoisePSD stops accumulating noise PSDs in the given channels (all channels if the list is empty).
+func (s *SourceControl) StopNoisePSD(channelIndices *[]int, reply *bool) error {
+	f := func() {
+		s.queuedResults <- s.ActiveSource.StopNoisePSD(*channelIndices)
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// NoisePSD returns the averaged noise PSDs of the given channels (all channels accumulating
+// a PSD if the list is empty). The results are also broadcast as a NOISEPSD status message.
+func (s *SourceControl) NoisePSD(channelIndices *[]int, reply *[]*NoisePSDResult) error {
+	f := func() {
+		results, err := s.ActiveSource.NoisePSDs(*channelIndices)
+		if err == nil {
+			*reply = results
+			s.clientUpdates <- ClientUpdate{"NOISEPSD", results}
+		}
+		s.queuedResults <- err
+	}
+	return s.runLaterIfActive(f)
+}
+
 // SizeObject is the RPC-usable structure for ConfigurePulseLengths to change pulse record sizes.
 type SizeObject struct {
 	Nsamp int
@@ -267,6 +562,8 @@ func (s *SourceControl) ConfigurePulseLengths(sizes SizeObject, reply *bool) err
 		if err == nil {
 			s.status.Npresamp = sizes.Npre
 			s.status.Nsamples = sizes.Nsamp
+			s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+			s.status.ChannelsWithFilters = s.ActiveSource.ChannelsWithFilters()
 		}
 		s.broadcastStatus()
 		s.queuedResults <- err
@@ -277,8 +574,22 @@ func (s *SourceControl) ConfigurePulseLengths(sizes SizeObject, reply *bool) err
 }
 
 // Start will identify the source given by sourceName and Sample then Start it.
+// Any automatic restart that is waiting to happen is cancelled.
 func (s *SourceControl) Start(sourceName *string, reply *bool) error {
 	*reply = false
+	if s.isSourceActive {
+		return fmt.Errorf("already have active source, do not start")
+	}
+	s.cancelRestart()
+	if err := s.start(sourceName); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// start does the work of Start: identify the source, then Sample and Start it.
+func (s *SourceControl) start(sourceName *string) error {
 	if s.isSourceActive {
 		return fmt.Errorf("already have active source, do not start")
 	}
@@ -304,6 +615,22 @@ func (s *SourceControl) Start(sourceName *string, reply *bool) error {
 		s.ActiveSource = DataSource(s.abaco)
 		s.status.SourceName = "Abaco"
 
+	case "TDMUDPSOURCE":
+		s.ActiveSource = DataSource(s.tdmUDP)
+		s.status.SourceName = "TDMUDP"
+
+	case "LJHREPLAYSOURCE":
+		s.ActiveSource = DataSource(s.ljhReplay)
+		s.status.SourceName = "LJHReplay"
+
+	case "RAWREPLAYSOURCE":
+		s.ActiveSource = DataSource(s.rawReplay)
+		s.status.SourceName = "RawReplay"
+
+	case "TESSIMSOURCE":
+		s.ActiveSource = DataSource(s.tesSim)
+		s.status.SourceName = "TESSim"
+
 	case "ERRORINGSOURCE":
 		s.ActiveSource = DataSource(s.erroring)
 		s.status.SourceName = "Erroring"
@@ -320,14 +647,15 @@ func (s *SourceControl) Start(sourceName *string, reply *bool) error {
 		return err
 	}
 	s.isSourceActive = true
+	s.lastSourceName = name
 	s.status.SamplePeriod = s.ActiveSource.SamplePeriod()
 	s.status.Nchannels = s.ActiveSource.Nchan()
 	s.status.ChanGroups = s.ActiveSource.ChanGroups()
 	s.broadcastStatus()
 	s.broadcastTriggerState()
+	s.broadcastGroupTrigger()
 	s.broadcastChannelNames()
 	s.storeChannelGroups()
-	*reply = true
 	return nil
 }
 
@@ -355,9 +683,7 @@ func (s *SourceControl) handlePossibleStoppedSource() {
 		s.clientUpdates <- ClientUpdate{"STATUS", s.status}
 		s.heartbeats <- Heartbeat{Running: false}
 
-		if s.ActiveSource.ShouldAutoRestart() {
-			log.Println("dastard is aware it should AutoRestart, but it's not implemented yet")
-		}
+		s.superviseStoppedSource()
 	}
 }
 
@@ -379,7 +705,13 @@ type WriteControlConfig struct {
 	WriteLJH22      bool   // turn on one or more file formats
 	WriteOFF        bool
 	WriteLJH3       bool
+	WriteRaw        bool // write the continuous, untriggered data stream
 	MapInternalOnly *Map // for dastard internal use only, used to pass map info to DataStreamProcessors
+	WritingLimits        // optional conditions for writing to stop on its own (used by "Start" only)
+	RotationPolicy       // optional conditions for continuing in new files (used by "Start" only)
+
+	// for dastard internal use only, used to record the source configuration in the run manifest
+	SourceConfigsInternalOnly *SourceConfigs
 }
 
 // mapError is used in WriteControl to indicate a map related error
@@ -395,9 +727,36 @@ func (m mapError) Error() string {
 func (s *SourceControl) WriteControl(config *WriteControlConfig, reply *bool) error {
 
 	config.MapInternalOnly = s.mapServer.Map
+	sourceConfigs := s.sourceConfigs.sourceConfig(s.lastSourceName)
+	config.SourceConfigsInternalOnly = &sourceConfigs
+	if s.isSourceActive {
+		var path string
+		switch request := strings.ToUpper(config.Request); {
+		case strings.HasPrefix(request, "START"):
+			path = config.Path
+			if path == "" {
+				path = s.ActiveSource.ComputeWritingState().BasePath
+			}
+		case strings.HasPrefix(request, "UNPAUSE"):
+			path = filepath.Dir(s.ActiveSource.ComputeWritingState().FilenamePattern)
+		}
+		if path != "" {
+			if err := s.checkDiskSpaceBeforeWriting(path); err != nil {
+				*reply = false
+				return err
+			}
+		}
+	}
 	f := func() {
 		err := s.ActiveSource.WriteControl(config)
 		if err == nil {
+			switch request := strings.ToUpper(config.Request); {
+			case strings.HasPrefix(request, "START"):
+				wc := *config
+				s.lastWriteConfig = &wc
+			case strings.HasPrefix(request, "STOP"):
+				s.lastWriteConfig = nil
+			}
 			s.broadcastWritingState()
 		}
 		s.queuedResults <- err
@@ -524,6 +883,7 @@ func (s *SourceControl) CoupleErrToFB(couple *bool, reply *bool) error {
 		}
 		err := s.ActiveSource.SetCoupling(c)
 		s.clientUpdates <- ClientUpdate{"TRIGCOUPLING", c}
+		s.broadcastGroupTrigger()
 		s.queuedResults <- err
 	}
 	err := s.runLaterIfActive(f)
@@ -540,6 +900,28 @@ func (s *SourceControl) CoupleFBToErr(couple *bool, reply *bool) error {
 		}
 		err := s.ActiveSource.SetCoupling(c)
 		s.clientUpdates <- ClientUpdate{"TRIGCOUPLING", c}
+		s.broadcastGroupTrigger()
+		s.queuedResults <- err
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// AddGroupTriggerCoupling adds the given source -> receiver group trigger connections.
+func (s *SourceControl) AddGroupTriggerCoupling(gts *GroupTriggerState, reply *bool) error {
+	return s.changeGroupTrigger(true, gts, reply)
+}
+
+// DeleteGroupTriggerCoupling removes the given source -> receiver group trigger connections.
+func (s *SourceControl) DeleteGroupTriggerCoupling(gts *GroupTriggerState, reply *bool) error {
+	return s.changeGroupTrigger(false, gts, reply)
+}
+
+func (s *SourceControl) changeGroupTrigger(turnOn bool, gts *GroupTriggerState, reply *bool) error {
+	f := func() {
+		err := s.ActiveSource.ChangeGroupTrigger(turnOn, gts)
+		s.broadcastGroupTrigger()
 		s.queuedResults <- err
 	}
 	err := s.runLaterIfActive(f)
@@ -547,6 +929,52 @@ func (s *SourceControl) CoupleFBToErr(couple *bool, reply *bool) error {
 	return err
 }
 
+// AddGroupTriggerRule adds all group trigger connections implied by a rule: every channel
+// in the same GroupIndex as each source, and/or the N nearest neighbors of each source.
+// Neighbors are found by pixel location if a TES map is loaded, or by channel number otherwise.
+func (s *SourceControl) AddGroupTriggerRule(rule *GroupTriggerRule, reply *bool) error {
+	m := s.mapServer.Map
+	f := func() {
+		gts, err := s.ActiveSource.GroupTriggerRuleConnections(rule, m)
+		if err == nil {
+			err = s.ActiveSource.ChangeGroupTrigger(true, gts)
+		}
+		s.broadcastGroupTrigger()
+		s.queuedResults <- err
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// ClearGroupTriggerCoupling removes all group trigger connections.
+func (s *SourceControl) ClearGroupTriggerCoupling(dummy *string, reply *bool) error {
+	f := func() {
+		gts := s.ActiveSource.ComputeGroupTriggerState()
+		err := s.ActiveSource.ChangeGroupTrigger(false, &gts)
+		s.broadcastGroupTrigger()
+		s.queuedResults <- err
+	}
+	err := s.runLaterIfActive(f)
+	*reply = (err == nil)
+	return err
+}
+
+// RestoreGroupTriggerCoupling adds the group trigger connections saved in the config file
+// when Dastard started. It fails (and adds none) if any doesn't fit the active source.
+func (s *SourceControl) RestoreGroupTriggerCoupling(dummy *string, reply *bool) error {
+	return s.changeGroupTrigger(true, &s.savedGroupTrigger, reply)
+}
+
+// GroupTriggerCoupling returns all current group trigger connections.
+func (s *SourceControl) GroupTriggerCoupling(dummy *string, reply *GroupTriggerState) error {
+	f := func() {
+		*reply = s.ActiveSource.ComputeGroupTriggerState()
+		s.queuedResults <- nil
+	}
+	return s.runLaterIfActive(f)
+}
+
 func (s *SourceControl) broadcastHeartbeat() {
 	s.clientUpdates <- ClientUpdate{"ALIVE", s.totalData}
 	s.totalData.HWactualMB = 0
@@ -574,6 +1002,13 @@ func (s *SourceControl) broadcastTriggerState() {
 	}
 }
 
+func (s *SourceControl) broadcastGroupTrigger() {
+	if s.isSourceActive && s.status.Running {
+		state := s.ActiveSource.ComputeGroupTriggerState()
+		s.clientUpdates <- ClientUpdate{"GROUPTRIGGER", state}
+	}
+}
+
 func (s *SourceControl) broadcastMixState(mix []float64) {
 	s.clientUpdates <- ClientUpdate{"MIX", mix}
 }
@@ -616,6 +1051,66 @@ func (s *SourceControl) SendAllStatus(dummy *string, reply *bool) error {
 	return nil
 }
 
+// SourceConfigs holds the configuration of each data source (nil if never configured).
+type SourceConfigs struct {
+	SimPulse  *SimPulseSourceConfig
+	Triangle  *TriangleSourceConfig
+	LJHReplay *LJHReplaySourceConfig
+	RawReplay *RawReplaySourceConfig
+	TESSim    *TESSimSourceConfig
+	Lancero   *LanceroSourceConfig
+	Abaco     *AbacoSourceConfig
+	TDMUDP    *TDMUDPSourceConfig
+	Roach     *RoachSourceConfig
+}
+
+// DastardConfig is the reply to GetConfig: the state that the status messages report,
+// gathered at one moment. All but Status and Sources describe the running source, so
+// they are empty when no source is running.
+type DastardConfig struct {
+	Status            ServerStatus
+	Sources           SourceConfigs
+	Triggers          []FullTriggerState
+	GroupTrigger      GroupTriggerState
+	Writing           *WritingState
+	MixFractions      []float64
+	ChannelNames      []string
+	ProjectorTraining []*ProjectorTrainingStatus
+}
+
+// GetStatus returns the server status, as in the STATUS message.
+func (s *SourceControl) GetStatus(dummy *string, reply *ServerStatus) error {
+	s.handlePossibleStoppedSource()
+	*reply = s.status
+	return nil
+}
+
+// GetConfig returns the complete current configuration in one reply, so clients need not
+// subscribe to the status messages and wait for a broadcast to learn it.
+func (s *SourceControl) GetConfig(dummy *string, reply *DastardConfig) error {
+	s.handlePossibleStoppedSource()
+	reply.Sources = s.sourceConfigs
+	if s.isSourceActive && s.status.Running {
+		f := func() {
+			reply.Triggers = s.ActiveSource.ComputeFullTriggerState()
+			reply.GroupTrigger = s.ActiveSource.ComputeGroupTriggerState()
+			writing := s.ActiveSource.ComputeWritingState()
+			reply.Writing = &writing
+			reply.ChannelNames = s.ActiveSource.ChannelNames()
+			training, err := s.ActiveSource.ProjectorTrainingStatuses([]int{})
+			reply.ProjectorTraining = training
+			s.status.ChannelsWithProjectors = s.ActiveSource.ChannelsWithProjectors()
+			s.queuedResults <- err
+		}
+		if err := s.runLaterIfActive(f); err != nil {
+			return err
+		}
+		reply.MixFractions = s.lastMix
+	}
+	reply.Status = s.status
+	return nil
+}
+
 // RunRPCServer sets up and runs a permanent JSON-RPC server.
 // If `block`, it will block until Ctrl-C and gracefully shut down.
 // (The intention is that block=true in normal operation, but false for certain tests.)
@@ -637,6 +1132,7 @@ func RunRPCServer(portrpc int, block bool) {
 	var err error
 	var okay bool
 	var spc SimPulseSourceConfig
+	configLock.Lock()
 	log.Printf("Dastard is using config file %s\n", viper.ConfigFileUsed())
 	err = viper.UnmarshalKey("simpulse", &spc)
 	if spc.Nchan == 0 { // default to a valid Nchan value to avoid ConfigureSimPulseSource throwing an error
@@ -677,6 +1173,13 @@ func RunRPCServer(portrpc int, block bool) {
 		// intentionally not checking for configure errors since it might fail on non abaco systems
 	}
 
+	var tdmc TDMUDPSourceConfig
+	err = viper.UnmarshalKey("tdmudp", &tdmc)
+	if err == nil && len(tdmc.HostPortUDP) > 0 {
+		_ = sourceControl.ConfigureTDMUDPSource(&tdmc, &okay)
+		// intentionally not checking for configure errors since it might fail on non TDM UDP systems
+	}
+
 	var rsc RoachSourceConfig
 	err = viper.UnmarshalKey("roach", &rsc)
 	if err == nil {
@@ -684,6 +1187,26 @@ func RunRPCServer(portrpc int, block bool) {
 		// intentionally not checking for configure errors since it might fail on non roach systems
 	}
 
+	var ljhrc LJHReplaySourceConfig
+	err = viper.UnmarshalKey("ljhreplay", &ljhrc)
+	if err == nil && ljhrc.Directory != "" {
+		_ = sourceControl.ConfigureLJHReplaySource(&ljhrc, &okay)
+		// intentionally not checking for configure errors: the saved directory might no longer exist
+	}
+	var rawrc RawReplaySourceConfig
+	err = viper.UnmarshalKey("rawreplay", &rawrc)
+	if err == nil && rawrc.Directory != "" {
+		_ = sourceControl.ConfigureRawReplaySource(&rawrc, &okay)
+		// intentionally not checking for configure errors: the saved directory might no longer exist
+	}
+	var tessc TESSimSourceConfig
+	err = viper.UnmarshalKey("tessim", &tessc)
+	if err == nil && tessc.Nchan > 0 {
+		if err0 := sourceControl.ConfigureTESSimSource(&tessc, &okay); err0 != nil {
+			log.Print("failed to configure the TES simulation source: ", err0)
+		}
+	}
+
 	err = viper.UnmarshalKey("status", &sourceControl.status)
 	sourceControl.status.Running = false
 	sourceControl.ActiveSource = sourceControl.triangle
@@ -700,12 +1223,35 @@ func RunRPCServer(portrpc int, block bool) {
 		sourceControl.clientUpdates <- ClientUpdate{"WRITING", wsSend}
 	}
 
+	// Group trigger connections are restored only on request, as they might not suit the next source.
+	err = viper.UnmarshalKey("grouptrigger", &sourceControl.savedGroupTrigger)
+	if err != nil {
+		sourceControl.savedGroupTrigger = GroupTriggerState{}
+	}
+
 	var mapFileName string
 	err = viper.UnmarshalKey("tesmapfile", &mapFileName)
 	if err == nil {
 		_ = mapServer.Load(&mapFileName, &okay)
 		// intentionally not checking for error, it ok if we fail to load a map file
 	}
+	configLock.Unlock()
+
+	// Regularly check whether the source has stopped on its own (so it can be restarted)
+	go func() {
+		ticker := time.Tick(2 * time.Second)
+		for range ticker {
+			sourceControl.serially(sourceControl.handlePossibleStoppedSource)
+		}
+	}()
+
+	// Regularly check the free space on the disk being written to
+	go func() {
+		ticker := time.Tick(diskSpaceCheckPeriod)
+		for range ticker {
+			sourceControl.serially(sourceControl.checkDiskSpace)
+		}
+	}()
 
 	// Regularly broadcast a "heartbeat" containing data rate to all clients
 	go func() {
@@ -733,8 +1279,7 @@ func RunRPCServer(portrpc int, block bool) {
 			log.Fatal(err)
 		}
 		server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-		port := fmt.Sprintf(":%d", portrpc)
-		listener, err := net.Listen("tcp", port)
+		listener, err := net.Listen("tcp", rpcListenAddress(portrpc))
 		if err != nil {
 			panic(fmt.Sprint("listen error:", err))
 		}
@@ -744,10 +1289,10 @@ func RunRPCServer(portrpc int, block bool) {
 			} else {
 				log.Printf("new connection established\n")
 				go func() { // this is equivalent to ServeCodec, except all requests from a single connection
-					// are handled SYNCHRONOUSLY, so sourceControl doesn't need a lock
-					// requests from multiple connections are still asynchronous, but we could add slice of
-					// connections and loop over it instead of launch a goroutine per connection
-					codec := jsonrpc.NewServerCodec(conn)
+					// are handled SYNCHRONOUSLY, and the serialCodec holds sourceControl.lock
+					// while each request runs, so requests from different connections (and background
+					// tasks) never run at the same time
+					codec := serialCodec{jsonrpc.NewServerCodec(conn), &sourceControl.lock}
 					for {
 						err := server.ServeRequest(codec)
 						if err != nil {
@@ -769,5 +1314,25 @@ func RunRPCServer(portrpc int, block bool) {
 	signal.Notify(interruptCatcher, os.Interrupt)
 	<-interruptCatcher
 	dummy := "dummy"
-	sourceControl.Stop(&dummy, &okay)
+	sourceControl.serially(func() { sourceControl.Stop(&dummy, &okay) })
+}
+
+// serialCodec is an rpc.ServerCodec that holds a lock from when it reads a request's
+// body until it writes the response, so that the request runs under the lock.
+// rpc.Server.ServeRequest writes a response for every request body it reads.
+type serialCodec struct {
+	rpc.ServerCodec
+	lock *sync.Mutex
+}
+
+// ReadRequestBody takes the lock, then reads the request body.
+func (c serialCodec) ReadRequestBody(body interface{}) error {
+	c.lock.Lock()
+	return c.ServerCodec.ReadRequestBody(body)
+}
+
+// WriteResponse releases the lock, then writes the response.
+func (c serialCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.lock.Unlock()
+	return c.ServerCodec.WriteResponse(r, body)
 }
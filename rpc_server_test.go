@@ -9,6 +9,7 @@ import (
 	"net/rpc/jsonrpc"
 	"os"
 	"os/user"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -62,12 +63,14 @@ func TestServer(t *testing.T) {
 	}
 
 	// Test the viper config
+	configLock.Lock()
 	if hp := viper.GetInt("harrypotter"); hp != harrypotter {
 		t.Errorf("viper.GetInt(%q) returns %d, want %d", "harrypotter", hp, harrypotter)
 	}
 	if now := viper.Get("currenttime"); now == nil {
 		t.Errorf("viper.Get(\"currenttime\") returns nil")
 	}
+	configLock.Unlock()
 
 	var okay bool
 
@@ -120,6 +123,66 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Error("Error calling SourceControl.SendAllStatus():", err)
 	}
+	var serverStatus ServerStatus
+	if err = client.Call("SourceControl.GetStatus", &dummy, &serverStatus); err != nil {
+		t.Error("Error calling SourceControl.GetStatus():", err)
+	} else if !serverStatus.Running || serverStatus.SourceName != "SimPulses" || serverStatus.Nchannels != simConfig.Nchan {
+		t.Errorf("SourceControl.GetStatus() = %+v, want running SimPulses with %d channels", serverStatus,
+			simConfig.Nchan)
+	}
+	var dconfig DastardConfig
+	if err = client.Call("SourceControl.GetConfig", &dummy, &dconfig); err != nil {
+		t.Error("Error calling SourceControl.GetConfig():", err)
+	} else {
+		if !dconfig.Status.Running {
+			t.Errorf("SourceControl.GetConfig() Status.Running=false, want true")
+		}
+		if dconfig.Sources.SimPulse == nil || dconfig.Sources.SimPulse.Nchan != simConfig.Nchan {
+			t.Errorf("SourceControl.GetConfig() Sources.SimPulse=%v, want Nchan=%d", dconfig.Sources.SimPulse, simConfig.Nchan)
+		}
+		if len(dconfig.Triggers) == 0 {
+			t.Errorf("SourceControl.GetConfig() returned no trigger states")
+		}
+		if len(dconfig.ChannelNames) != simConfig.Nchan {
+			t.Errorf("SourceControl.GetConfig() returned %d channel names, want %d", len(dconfig.ChannelNames), simConfig.Nchan)
+		}
+		if dconfig.Writing == nil {
+			t.Errorf("SourceControl.GetConfig() returned no writing state")
+		}
+	}
+
+	// Save, list, and apply a named profile
+	profileName := "dastard_test_profile"
+	if err = client.Call("SourceControl.SaveProfile", &profileName, &okay); err != nil || !okay {
+		t.Error("Error calling SourceControl.SaveProfile():", err)
+	}
+	var profiles []string
+	if err = client.Call("SourceControl.ListProfiles", &dummy, &profiles); err != nil {
+		t.Error("Error calling SourceControl.ListProfiles():", err)
+	} else if !containsString(profiles, profileName) {
+		t.Errorf("SourceControl.ListProfiles() = %v, want it to include %q", profiles, profileName)
+	}
+	if err = client.Call("SourceControl.ApplyProfile", &profileName, &okay); err != nil || !okay {
+		t.Error("Error calling SourceControl.ApplyProfile():", err)
+	}
+	if err = client.Call("SourceControl.GetStatus", &dummy, &serverStatus); err != nil || !serverStatus.Running {
+		t.Errorf("Source not running after SourceControl.ApplyProfile(): %v, %v", err, serverStatus)
+	}
+	badName := "../bad profile"
+	if err = client.Call("SourceControl.SaveProfile", &badName, &okay); err == nil {
+		t.Errorf("Expected error calling SourceControl.SaveProfile(%q) with a bad name", badName)
+	}
+	missingName := "dastard_test_no_such_profile"
+	if err = client.Call("SourceControl.ApplyProfile", &missingName, &okay); err == nil {
+		t.Errorf("Expected error calling SourceControl.ApplyProfile(%q) on a missing profile", missingName)
+	}
+	if err = client.Call("SourceControl.DeleteProfile", &profileName, &okay); err != nil || !okay {
+		t.Error("Error calling SourceControl.DeleteProfile():", err)
+	}
+	if err = client.Call("SourceControl.ListProfiles", &dummy, &profiles); err != nil || containsString(profiles, profileName) {
+		t.Errorf("SourceControl.ListProfiles() = %v after deleting %q, err=%v", profiles, profileName, err)
+	}
+
 	time.Sleep(time.Millisecond * 400)
 	sizes := SizeObject{Nsamp: 800, Npre: 200}
 	err = client.Call("SourceControl.ConfigurePulseLengths", &sizes, &okay)
@@ -138,6 +201,12 @@ func TestServer(t *testing.T) {
 	if !okay {
 		t.Errorf("SourceControl.Stop(\"%s\") returns !okay, want okay", sourceName)
 	}
+	dconfig = DastardConfig{}
+	if err = client.Call("SourceControl.GetConfig", &dummy, &dconfig); err != nil {
+		t.Error("Error calling SourceControl.GetConfig() with no source running:", err)
+	} else if dconfig.Status.Running || len(dconfig.Triggers) > 0 || dconfig.Writing != nil || dconfig.Sources.SimPulse == nil {
+		t.Errorf("SourceControl.GetConfig() with no source running = %+v, want only status and source configs", dconfig)
+	}
 	err = client.Call("SourceControl.ConfigurePulseLengths", &sizes, &okay)
 	if err == nil {
 		t.Errorf("Expected error calling SourceControl.ConfigurePulseLengths(%v) when source stopped, saw none", sizes)
@@ -195,6 +264,79 @@ func TestServer(t *testing.T) {
 	if !okay {
 		t.Errorf("SourceControl.ConfigureProjectorsBasis(\"%s\") returns !okay, want okay", sourceName)
 	}
+	filterBytes, err := mat.NewVecDense(cols, make([]float64, cols)).MarshalBinary()
+	if err != nil {
+		t.Error(err)
+	}
+	fo := FilterObject{ChannelIndex: 0, FilterBase64: base64.StdEncoding.EncodeToString(filterBytes),
+		ArrivalFilterBase64: base64.StdEncoding.EncodeToString(filterBytes)}
+	if err = client.Call("SourceControl.ConfigureFilter", &fo, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.ConfigureFilter returns %v, okay=%t, want nil, true", err, okay)
+	}
+	badFilterBytes, _ := mat.NewVecDense(cols+1, make([]float64, cols+1)).MarshalBinary()
+	fo.FilterBase64 = base64.StdEncoding.EncodeToString(badFilterBytes)
+	if err = client.Call("SourceControl.ConfigureFilter", &fo, &okay); err == nil {
+		t.Error("SourceControl.ConfigureFilter should fail with wrong-length filter")
+	}
+	hco := HistogramConfigObject{ChannelIndices: []int{0, 1},
+		HistogramConfig: HistogramConfig{Quantity: "PeakValue", Nbins: 100, Min: 0, Max: 1000}}
+	if err = client.Call("SourceControl.ConfigureHistograms", &hco, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.ConfigureHistograms returns %v, okay=%t, want nil, true", err, okay)
+	}
+	hco.Quantity = "NotAQuantity"
+	if err = client.Call("SourceControl.ConfigureHistograms", &hco, &okay); err == nil {
+		t.Error("SourceControl.ConfigureHistograms should fail with an unknown quantity")
+	}
+	histIndices := []int{1}
+	if err = client.Call("SourceControl.ResetHistograms", &histIndices, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.ResetHistograms returns %v, okay=%t, want nil, true", err, okay)
+	}
+	var snapshots []*HistogramSnapshot
+	if err = client.Call("SourceControl.HistogramSnapshot", &histIndices, &snapshots); err != nil {
+		t.Errorf("SourceControl.HistogramSnapshot returns %v", err)
+	} else if len(snapshots) != 1 || snapshots[0].ChannelIndex != 1 || len(snapshots[0].Counts) != 100 {
+		t.Errorf("SourceControl.HistogramSnapshot returns %v, want 1 snapshot of channel 1 with 100 bins", snapshots)
+	}
+	psdConfig := NoisePSDConfig{ChannelIndices: []int{0, 1}, WindowLength: 64}
+	if err = client.Call("SourceControl.StartNoisePSD", &psdConfig, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.StartNoisePSD returns %v, okay=%t, want nil, true", err, okay)
+	}
+	psdConfig.WindowFunction = "NotAWindow"
+	if err = client.Call("SourceControl.StartNoisePSD", &psdConfig, &okay); err == nil {
+		t.Error("SourceControl.StartNoisePSD should fail with an unknown window function")
+	}
+	var psds []*NoisePSDResult
+	if err = client.Call("SourceControl.NoisePSD", &histIndices, &psds); err != nil {
+		t.Errorf("SourceControl.NoisePSD returns %v", err)
+	} else if len(psds) != 1 || psds[0].ChannelIndex != 1 || psds[0].WindowLength != 64 {
+		t.Errorf("SourceControl.NoisePSD returns %v, want 1 PSD of channel 1 with window length 64", psds)
+	}
+	if err = client.Call("SourceControl.StopNoisePSD", &histIndices, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.StopNoisePSD returns %v, okay=%t, want nil, true", err, okay)
+	}
+	if err = client.Call("SourceControl.NoisePSD", &histIndices, &psds); err == nil {
+		t.Error("SourceControl.NoisePSD should fail on a channel after StopNoisePSD")
+	}
+	trainConfig := ProjectorTrainingConfig{ChannelIndices: []int{0, 1}, NPulses: 20, NNoise: 20, NBases: 4}
+	if err = client.Call("SourceControl.TrainProjectors", &trainConfig, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.TrainProjectors returns %v, okay=%t, want nil, true", err, okay)
+	}
+	trainConfig.NBases = 2
+	if err = client.Call("SourceControl.TrainProjectors", &trainConfig, &okay); err == nil {
+		t.Error("SourceControl.TrainProjectors should fail with too few bases")
+	}
+	var tstatus []*ProjectorTrainingStatus
+	if err = client.Call("SourceControl.ProjectorTrainingStatus", &histIndices, &tstatus); err != nil {
+		t.Errorf("SourceControl.ProjectorTrainingStatus returns %v", err)
+	} else if len(tstatus) != 1 || tstatus[0].ChannelIndex != 1 || tstatus[0].NBases != 4 {
+		t.Errorf("SourceControl.ProjectorTrainingStatus returns %v, want status of channel 1 with 4 bases", tstatus)
+	}
+	if err = client.Call("SourceControl.CancelProjectorTraining", &histIndices, &okay); err != nil || !okay {
+		t.Errorf("SourceControl.CancelProjectorTraining returns %v, okay=%t, want nil, true", err, okay)
+	}
+	if err = client.Call("SourceControl.ProjectorTrainingStatus", &histIndices, &tstatus); err == nil {
+		t.Error("SourceControl.ProjectorTrainingStatus should fail on a channel after CancelProjectorTraining")
+	}
 	mfo := MixFractionObject{[]int{0}, []float64{1.0}}
 	if err1 := client.Call("SourceControl.ConfigureMixFraction", &mfo, &okay); err1 == nil {
 		t.Error("error on ConfigureMixFraction expected for non-mixable source")
@@ -211,12 +353,38 @@ func TestServer(t *testing.T) {
 			t.Error("expected error on CoupleErrToFB when non-Lancero source is active")
 		}
 	}
+	rule := GroupTriggerRule{Sources: []int{1}, NearestNeighbors: 2}
+	if err1 := client.Call("SourceControl.AddGroupTriggerRule", &rule, &okay); err1 != nil {
+		t.Error("error on AddGroupTriggerRule:", err1)
+	}
+	gts := GroupTriggerState{Connections: map[int][]int{3: {0}}}
+	if err1 := client.Call("SourceControl.AddGroupTriggerCoupling", &gts, &okay); err1 != nil {
+		t.Error("error on AddGroupTriggerCoupling:", err1)
+	}
+	if true { // prevent variables from persisting
+		var state GroupTriggerState
+		expect := map[int][]int{1: {0, 2}, 3: {0}}
+		if err1 := client.Call("SourceControl.GroupTriggerCoupling", &dummy, &state); err1 != nil {
+			t.Error("error on GroupTriggerCoupling:", err1)
+		} else if !reflect.DeepEqual(state.Connections, expect) {
+			t.Errorf("GroupTriggerCoupling returns %v, want %v", state.Connections, expect)
+		}
+		if err1 := client.Call("SourceControl.ClearGroupTriggerCoupling", &dummy, &okay); err1 != nil {
+			t.Error("error on ClearGroupTriggerCoupling:", err1)
+		}
+		state = GroupTriggerState{}
+		if err1 := client.Call("SourceControl.GroupTriggerCoupling", &dummy, &state); err1 != nil {
+			t.Error("error on GroupTriggerCoupling:", err1)
+		} else if len(state.Connections) != 0 {
+			t.Errorf("GroupTriggerCoupling returns %v after clearing, want none", state.Connections)
+		}
+	}
 	path, err := ioutil.TempDir("", "dastard_test")
 	if err != nil {
 		t.Fatal("Could not open temporary directory")
 	}
 	defer os.RemoveAll(path) // clean up test files
-	wconfig := WriteControlConfig{Request: "Start", Path: path, WriteLJH22: true}
+	wconfig := *testWriteConfig("Start", path)
 	// we currently have a 240 channel map loaded, but only have 4 channels, so this should error and invalidate the map file
 	if err1 := client.Call("SourceControl.WriteControl", &wconfig, &okay); err1 == nil {
 		t.Error("expected an error because we should have a 240 channel map loaded instead of a 4 channel map", err1)
@@ -302,12 +470,33 @@ func TestServer(t *testing.T) {
 	if err == nil {
 		t.Errorf("Expected error on server with SourceControl.ConfigureTriangleSource() when Nchan<1")
 	}
+	replayConfig := LJHReplaySourceConfig{Directory: "/doesnt_exist/no_ljh_files"}
+	err = client.Call("SourceControl.ConfigureLJHReplaySource", &replayConfig, &okay)
+	if err == nil {
+		t.Errorf("Expected error on server with SourceControl.ConfigureLJHReplaySource() with no LJH files")
+	}
+	sourceName = "LJHReplaySource"
+	if err = client.Call("SourceControl.Start", &sourceName, &okay); err == nil {
+		t.Errorf("Expected error on server with SourceControl.Start(\"%s\") when not configured", sourceName)
+	}
+	rawConfig := RawReplaySourceConfig{Directory: "/doesnt_exist/no_raw_files"}
+	err = client.Call("SourceControl.ConfigureRawReplaySource", &rawConfig, &okay)
+	if err == nil {
+		t.Errorf("Expected error on server with SourceControl.ConfigureRawReplaySource() with no raw files")
+	}
+	sourceName = "RawReplaySource"
+	if err = client.Call("SourceControl.Start", &sourceName, &okay); err == nil {
+		t.Errorf("Expected error on server with SourceControl.Start(\"%s\") when not configured", sourceName)
+	}
 
 	// here test all methods that expect an active source to make sure they error appropriatley
 	// otherwise you will get incomprehensible stack traces when they error unexpectedly
 	if err1 := client.Call("SourceControl.ConfigureProjectorsBasis", &pbo, &okay); err1 == nil {
 		t.Error("expected error on ConfigureProjectorsBasiswhen no source is active")
 	}
+	if err1 := client.Call("SourceControl.ConfigureFilter", &fo, &okay); err1 == nil {
+		t.Error("expected error on ConfigureFilter when no source is active")
+	}
 	if err1 := client.Call("SourceControl.Stop", sourceName, &okay); err1 == nil {
 		t.Errorf("expected error stopping source when no source is active")
 	}
@@ -325,6 +514,9 @@ func TestServer(t *testing.T) {
 			t.Error("expected error on CoupleErrToFB when no source is active")
 		}
 	}
+	if err1 := client.Call("SourceControl.AddGroupTriggerCoupling", &gts, &okay); err1 == nil {
+		t.Error("expected error on AddGroupTriggerCoupling when no source is active")
+	}
 
 	// lancero source should fail
 	sourceName = "LanceroSource"
@@ -391,7 +583,7 @@ func setupViper() error {
 	}
 
 	// Set up different ports for testing than you'd use otherwise
-	setPortnumbers(33300)
+	SetPortnumbers(33300)
 
 	// Write output files in a temporary file
 	ws := WritingState{BasePath: "/tmp"}
@@ -426,6 +618,62 @@ func TestErroringSourceRPC(t *testing.T) {
 	}
 }
 
+func TestRestoreGroupTrigger(t *testing.T) {
+	s := NewSourceControl()
+	s.mapServer = newMapServer()
+	updates := make(chan ClientUpdate)
+	s.clientUpdates = updates
+	go func() {
+		for range updates {
+		}
+	}()
+	go func() {
+		for range s.heartbeats {
+		}
+	}()
+	s.status.Npresamp = 50
+	s.status.Nsamples = 100
+	var okay bool
+	if err := s.ConfigureTriangleSource(&TriangleSourceConfig{Nchan: 2, SampleRate: 10000, Min: 100, Max: 200},
+		&okay); err != nil {
+		t.Fatal(err)
+	}
+	sourceName := "TriangleSource"
+	if err := s.Start(&sourceName, &okay); err != nil {
+		t.Fatal(err)
+	}
+	dummy := ""
+	defer s.Stop(&dummy, &okay)
+
+	// Saved connections are not added until requested.
+	s.savedGroupTrigger = GroupTriggerState{Connections: map[int][]int{0: {1}, 1: {0}}}
+	var state GroupTriggerState
+	if err := s.GroupTriggerCoupling(&dummy, &state); err != nil || len(state.Connections) != 0 {
+		t.Errorf("new source has group trigger connections %v (err %v), want none", state.Connections, err)
+	}
+	if err := s.RestoreGroupTriggerCoupling(&dummy, &okay); err != nil {
+		t.Error("RestoreGroupTriggerCoupling failed:", err)
+	}
+	if err := s.GroupTriggerCoupling(&dummy, &state); err != nil ||
+		!reflect.DeepEqual(state.Connections, s.savedGroupTrigger.Connections) {
+		t.Errorf("restored group trigger connections %v (err %v), want %v", state.Connections, err,
+			s.savedGroupTrigger.Connections)
+	}
+
+	// Saved connections that don't fit the source are rejected.
+	if err := s.ClearGroupTriggerCoupling(&dummy, &okay); err != nil {
+		t.Error(err)
+	}
+	s.savedGroupTrigger = GroupTriggerState{Connections: map[int][]int{0: {1}, 1: {5}}}
+	if err := s.RestoreGroupTriggerCoupling(&dummy, &okay); err == nil || okay {
+		t.Error("RestoreGroupTriggerCoupling should fail when a channel is out of range")
+	}
+	state = GroupTriggerState{}
+	if err := s.GroupTriggerCoupling(&dummy, &state); err != nil || len(state.Connections) != 0 {
+		t.Errorf("failed restore left group trigger connections %v (err %v), want none", state.Connections, err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	// set log to write to a file
 	f, err := os.Create("dastardtestlogfile")
@@ -462,3 +710,12 @@ func TestMain(m *testing.M) {
 	close(abort)
 	os.Exit(result)
 }
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
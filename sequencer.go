@@ -0,0 +1,303 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SequenceStep is one step of a run sequence. Action says what the step does, and the other
+// fields hold the arguments that the action needs:
+//
+//	StartSource       SourceName (as for Start)
+//	StopSource
+//	ApplyProfile      Profile
+//	ConfigureTriggers Triggers
+//	StartWriting      Write (the file formats and Path; Request is ignored), Label (optional)
+//	PauseWriting
+//	UnpauseWriting    Label (optional)
+//	StopWriting
+//	SetStateLabel     Label
+//	Wait              Seconds
+//	WaitRecords       Records: wait until this many records (all channels together) are written
+type SequenceStep struct {
+	Action     string
+	SourceName string
+	Profile    string
+	Triggers   *FullTriggerState
+	Write      *WriteControlConfig
+	Label      string
+	Seconds    float64
+	Records    int
+}
+
+// SequenceStatus reports the progress of a run sequence. It is sent to clients as a
+// SEQUENCE status message when each step begins and when the sequence ends.
+type SequenceStatus struct {
+	State   string // "Idle", "Running", "Done", "Failed", or "Aborted"
+	Nsteps  int
+	Step    int    // index of the current (or failed) step; Nsteps when Done
+	Action  string // action of the current step
+	Started time.Time
+	Updated time.Time
+	Error   string // why the sequence failed, if State is "Failed"
+}
+
+// runSequencer is the bookkeeping for SourceControl's run sequencer.
+type runSequencer struct {
+	sync.Mutex
+	status SequenceStatus
+	abort  chan struct{} // closed to abort the running sequence
+}
+
+// sequenceRecordsPollPeriod is how often a WaitRecords step checks the number written.
+const sequenceRecordsPollPeriod = 100 * time.Millisecond
+
+// validate checks that a step has a known action and the arguments it needs.
+func (step *SequenceStep) validate() error {
+	switch strings.ToUpper(step.Action) {
+	case "STARTSOURCE":
+		if step.SourceName == "" {
+			return fmt.Errorf("StartSource needs a SourceName")
+		}
+	case "APPLYPROFILE":
+		if _, err := profileFilename(step.Profile); err != nil {
+			return err
+		}
+	case "CONFIGURETRIGGERS":
+		if step.Triggers == nil {
+			return fmt.Errorf("ConfigureTriggers needs Triggers")
+		}
+	case "STARTWRITING":
+		if step.Write == nil {
+			return fmt.Errorf("StartWriting needs a Write configuration")
+		}
+	case "SETSTATELABEL":
+		if step.Label == "" {
+			return fmt.Errorf("SetStateLabel needs a Label")
+		}
+	case "WAIT":
+		if step.Seconds < 0 {
+			return fmt.Errorf("Wait needs Seconds >= 0, have %f", step.Seconds)
+		}
+	case "WAITRECORDS":
+		if step.Records <= 0 {
+			return fmt.Errorf("WaitRecords needs Records > 0, have %d", step.Records)
+		}
+	case "STOPSOURCE", "PAUSEWRITING", "UNPAUSEWRITING", "STOPWRITING":
+	default:
+		return fmt.Errorf("sequence action %q is not recognized", step.Action)
+	}
+	return nil
+}
+
+// RunSequence checks a list of steps, then runs them in order in the background. Progress is
+// reported in SEQUENCE status messages. Only one sequence can run at a time.
+func (s *SourceControl) RunSequence(steps *[]SequenceStep, reply *bool) error {
+	*reply = false
+	if len(*steps) == 0 {
+		return fmt.Errorf("sequence has no steps")
+	}
+	for i := range *steps {
+		if err := (*steps)[i].validate(); err != nil {
+			return fmt.Errorf("sequence step %d: %v", i, err)
+		}
+	}
+	s.sequencer.Lock()
+	defer s.sequencer.Unlock()
+	if s.sequencer.status.State == "Running" {
+		return fmt.Errorf("a sequence is already running (step %d of %d)", s.sequencer.status.Step,
+			s.sequencer.status.Nsteps)
+	}
+	now := time.Now()
+	s.sequencer.status = SequenceStatus{State: "Running", Nsteps: len(*steps), Started: now, Updated: now}
+	s.sequencer.abort = make(chan struct{})
+	stepsCopy := make([]SequenceStep, len(*steps))
+	copy(stepsCopy, *steps)
+	go s.runSequence(stepsCopy, s.sequencer.abort)
+	*reply = true
+	return nil
+}
+
+// AbortSequence stops the running sequence before its next step, or during a Wait or
+// WaitRecords step. The data source and writing are left as they are.
+func (s *SourceControl) AbortSequence(dummy *string, reply *bool) error {
+	*reply = false
+	s.sequencer.Lock()
+	defer s.sequencer.Unlock()
+	if s.sequencer.status.State != "Running" {
+		return fmt.Errorf("no sequence is running")
+	}
+	select {
+	case <-s.sequencer.abort:
+	default:
+		close(s.sequencer.abort)
+	}
+	*reply = true
+	return nil
+}
+
+// SequenceStatus returns the progress of the current (or most recent) sequence.
+func (s *SourceControl) SequenceStatus(dummy *string, reply *SequenceStatus) error {
+	s.sequencer.Lock()
+	defer s.sequencer.Unlock()
+	*reply = s.sequencer.status
+	return nil
+}
+
+// updateSequenceStatus changes the sequence status and reports it to clients.
+func (s *SourceControl) updateSequenceStatus(update func(*SequenceStatus)) {
+	s.sequencer.Lock()
+	update(&s.sequencer.status)
+	s.sequencer.status.Updated = time.Now()
+	status := s.sequencer.status
+	s.sequencer.Unlock()
+	if s.clientUpdates != nil {
+		s.clientUpdates <- ClientUpdate{"SEQUENCE", status}
+	}
+}
+
+// runSequence runs the steps in order. If a step fails, it stops writing (so that no files
+// are left open in an unknown state) and ends the sequence.
+func (s *SourceControl) runSequence(steps []SequenceStep, abort <-chan struct{}) {
+	for i := range steps {
+		step := &steps[i]
+		s.updateSequenceStatus(func(status *SequenceStatus) {
+			status.Step = i
+			status.Action = step.Action
+		})
+		log.Printf("Sequence step %d of %d: %s\n", i+1, len(steps), step.Action)
+		err := s.runSequenceStep(step, abort)
+		select {
+		case <-abort:
+			log.Printf("Sequence aborted at step %d of %d\n", i+1, len(steps))
+			s.updateSequenceStatus(func(status *SequenceStatus) { status.State = "Aborted" })
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("Sequence failed at step %d of %d (%s): %v\n", i+1, len(steps), step.Action, err)
+			s.serially(s.stopSequenceWriting)
+			s.updateSequenceStatus(func(status *SequenceStatus) {
+				status.State = "Failed"
+				status.Error = err.Error()
+			})
+			return
+		}
+	}
+	s.updateSequenceStatus(func(status *SequenceStatus) {
+		status.State = "Done"
+		status.Step = len(steps)
+		status.Action = ""
+	})
+}
+
+// stopSequenceWriting stops writing, if it's active, after a sequence fails.
+func (s *SourceControl) stopSequenceWriting() {
+	var writing bool
+	f := func() {
+		writing = s.ActiveSource.WritingIsActive()
+		s.queuedResults <- nil
+	}
+	if err := s.runLaterIfActive(f); err != nil || !writing {
+		return
+	}
+	var okay bool
+	if err := s.WriteControl(&WriteControlConfig{Request: "Stop"}, &okay); err != nil {
+		log.Printf("Could not stop writing after the sequence failed: %v\n", err)
+	}
+}
+
+// runSequenceStep runs one step, returning early from a wait if the sequence is aborted.
+// Steps other than waits run serially with RPC requests, as if a client had made them.
+func (s *SourceControl) runSequenceStep(step *SequenceStep, abort <-chan struct{}) error {
+	switch strings.ToUpper(step.Action) {
+	case "WAIT":
+		select {
+		case <-time.After(time.Duration(step.Seconds * float64(time.Second))):
+		case <-abort:
+		}
+		return nil
+	case "WAITRECORDS":
+		return s.waitForRecords(step.Records, abort)
+	}
+	var err error
+	s.serially(func() { err = s.runSequenceAction(step) })
+	return err
+}
+
+// runSequenceAction runs one step that isn't a wait.
+func (s *SourceControl) runSequenceAction(step *SequenceStep) error {
+	var okay bool
+	dummy := ""
+	switch strings.ToUpper(step.Action) {
+	case "STARTSOURCE":
+		name := step.SourceName
+		return s.Start(&name, &okay)
+	case "STOPSOURCE":
+		return s.Stop(&dummy, &okay)
+	case "APPLYPROFILE":
+		name := step.Profile
+		return s.ApplyProfile(&name, &okay)
+	case "CONFIGURETRIGGERS":
+		state := *step.Triggers
+		return s.ConfigureTriggers(&state, &okay)
+	case "STARTWRITING":
+		config := *step.Write
+		config.Request = "Start"
+		if err := s.WriteControl(&config, &okay); err != nil {
+			return err
+		}
+		if step.Label != "" {
+			return s.SetExperimentStateLabel(&StateLabelConfig{Label: step.Label, WaitForError: true}, &okay)
+		}
+	case "PAUSEWRITING":
+		return s.WriteControl(&WriteControlConfig{Request: "Pause"}, &okay)
+	case "UNPAUSEWRITING":
+		request := "Unpause"
+		if step.Label != "" {
+			request += " " + step.Label
+		}
+		return s.WriteControl(&WriteControlConfig{Request: request}, &okay)
+	case "STOPWRITING":
+		return s.WriteControl(&WriteControlConfig{Request: "Stop"}, &okay)
+	case "SETSTATELABEL":
+		return s.SetExperimentStateLabel(&StateLabelConfig{Label: step.Label, WaitForError: true}, &okay)
+	default:
+		return fmt.Errorf("sequence action %q is not recognized", step.Action)
+	}
+	return nil
+}
+
+// waitForRecords waits until at least n records have been written since writing started.
+func (s *SourceControl) waitForRecords(n int, abort <-chan struct{}) error {
+	ticker := time.NewTicker(sequenceRecordsPollPeriod)
+	defer ticker.Stop()
+	for {
+		var written int
+		var writing bool
+		f := func() {
+			written = s.ActiveSource.totalNumberWritten()
+			writing = s.ActiveSource.WritingIsActive()
+			s.queuedResults <- nil
+		}
+		var err error
+		s.serially(func() { err = s.runLaterIfActive(f) })
+		if err != nil {
+			return err
+		}
+		if written >= n {
+			return nil
+		}
+		if !writing {
+			return fmt.Errorf("writing stopped after %d of %d records", written, n)
+		}
+		select {
+		case <-ticker.C:
+		case <-abort:
+			return nil
+		}
+	}
+}
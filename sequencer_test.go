@@ -0,0 +1,160 @@
+package dastard
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSequenceValidation(t *testing.T) {
+	bad := []SequenceStep{
+		{Action: "Dance"},
+		{Action: "StartSource"},
+		{Action: "ApplyProfile", Profile: "../x"},
+		{Action: "ConfigureTriggers"},
+		{Action: "StartWriting"},
+		{Action: "SetStateLabel"},
+		{Action: "Wait", Seconds: -1},
+		{Action: "WaitRecords"},
+	}
+	for _, step := range bad {
+		if err := step.validate(); err == nil {
+			t.Errorf("SequenceStep %+v should fail validation", step)
+		}
+	}
+	good := []SequenceStep{
+		{Action: "startsource", SourceName: "TriangleSource"},
+		{Action: "StopSource"},
+		{Action: "PauseWriting"},
+		{Action: "Wait", Seconds: 0},
+		{Action: "WaitRecords", Records: 1},
+	}
+	for _, step := range good {
+		if err := step.validate(); err != nil {
+			t.Errorf("SequenceStep %+v fails validation: %v", step, err)
+		}
+	}
+}
+
+func TestSequencer(t *testing.T) {
+	s := NewSourceControl()
+	s.mapServer = newMapServer()
+	updates := make(chan ClientUpdate)
+	s.clientUpdates = updates
+	s.mapServer.clientUpdates = updates
+	statuses := make(chan SequenceStatus, 100)
+	go func() {
+		for u := range updates {
+			if u.tag == "SEQUENCE" {
+				statuses <- u.state.(SequenceStatus)
+			}
+		}
+	}()
+	go func() {
+		for range s.heartbeats {
+		}
+	}()
+	s.status.Npresamp = 50
+	s.status.Nsamples = 100
+	var okay bool
+	if err := s.ConfigureTriangleSource(&TriangleSourceConfig{Nchan: 2, SampleRate: 10000, Min: 100, Max: 200},
+		&okay); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "dastard_sequencer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	waitFor := func(state string) SequenceStatus {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case status := <-statuses:
+				if status.State == state {
+					return status
+				}
+				if status.State != "Running" {
+					t.Fatalf("sequence ended with %+v, want state %s", status, state)
+				}
+			case <-timeout:
+				t.Fatalf("sequence did not reach state %s", state)
+			}
+		}
+	}
+
+	triggers := FullTriggerState{ChannelIndices: []int{0, 1},
+		TriggerState: TriggerState{AutoTrigger: true, AutoDelay: 10 * time.Millisecond}}
+	waitStep := SequenceStep{Action: "WaitRecords", Records: 20}
+	if !testWritesLJH {
+		waitStep = SequenceStep{Action: "Wait", Seconds: 0.1} // raw stream files have no records to count
+	}
+	steps := []SequenceStep{
+		{Action: "StartSource", SourceName: "TriangleSource"},
+		{Action: "ConfigureTriggers", Triggers: &triggers},
+		{Action: "StartWriting", Write: testWriteConfig("", dir), Label: "calibration"},
+		waitStep,
+		{Action: "PauseWriting"},
+		{Action: "UnpauseWriting", Label: "science"},
+		{Action: "SetStateLabel", Label: "noise"},
+		{Action: "Wait", Seconds: 0.01},
+		{Action: "StopWriting"},
+		{Action: "StopSource"},
+	}
+	if err := s.RunSequence(&steps, &okay); err != nil || !okay {
+		t.Fatalf("RunSequence failed: %v", err)
+	}
+	if err := s.RunSequence(&steps, &okay); err == nil {
+		t.Error("RunSequence should fail while another sequence is running")
+	}
+	status := waitFor("Done")
+	if status.Step != len(steps) || status.Nsteps != len(steps) {
+		t.Errorf("finished sequence status %+v, want Step=Nsteps=%d", status, len(steps))
+	}
+	if s.isSourceActive {
+		t.Error("source still active after the sequence stopped it")
+	}
+
+	// A failing step should stop writing and end the sequence.
+	steps = []SequenceStep{
+		{Action: "StartSource", SourceName: "TriangleSource"},
+		{Action: "StartWriting", Write: testWriteConfig("", dir)},
+		{Action: "StartSource", SourceName: "TriangleSource"},
+		{Action: "StopSource"},
+	}
+	if err := s.RunSequence(&steps, &okay); err != nil {
+		t.Fatalf("RunSequence failed: %v", err)
+	}
+	status = waitFor("Failed")
+	if status.Step != 2 || status.Error == "" {
+		t.Errorf("failed sequence status %+v, want failure at step 2 with an error", status)
+	}
+	if s.ActiveSource.WritingIsActive() {
+		t.Error("writing still active after the sequence failed")
+	}
+
+	// Abort a sequence while it waits.
+	steps = []SequenceStep{{Action: "Wait", Seconds: 100}, {Action: "StopSource"}}
+	if err := s.RunSequence(&steps, &okay); err != nil {
+		t.Fatalf("RunSequence failed: %v", err)
+	}
+	dummy := ""
+	time.Sleep(10 * time.Millisecond)
+	if err := s.AbortSequence(&dummy, &okay); err != nil {
+		t.Errorf("AbortSequence failed: %v", err)
+	}
+	waitFor("Aborted")
+	if !s.isSourceActive {
+		t.Error("aborted sequence should not have stopped the source")
+	}
+	var final SequenceStatus
+	if err := s.SequenceStatus(&dummy, &final); err != nil || final.State != "Aborted" {
+		t.Errorf("SequenceStatus = %+v, %v, want state Aborted", final, err)
+	}
+	if err := s.AbortSequence(&dummy, &okay); err == nil {
+		t.Error("AbortSequence should fail when no sequence is running")
+	}
+	s.Stop(&dummy, &okay)
+}
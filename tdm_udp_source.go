@@ -0,0 +1,391 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// TDMUDPSource is a DataSource that reads time-division multiplexed (TDM) data sent as
+// packets.Packet streams over UDP, rather than through a Lancero card. Each packet stream
+// carries one column of the TDM readout: its channel offset identifies the column, and each
+// frame holds 2*nrows values, the error and then the feedback for each row in turn.
+// UDP ports 4400-4699 are reserved for these systems (see PORTS.md).
+type TDMUDPSource struct {
+	udpReceivers             []*AbacoUDPReceiver
+	producers                []PacketProducer
+	groups                   map[GroupIndex]*AbacoGroup
+	columnKeys               []GroupIndex // packet groups, one per column, in column order
+	nrows                    int
+	ncols                    int
+	nsamp                    int
+	configuredRate           float64 // sample rate from the configuration (or 0 to learn it)
+	firstRowChanNum          int     // Channel number of the 1st row (default 1)
+	Mix                      []*Mix
+	mixRequests              chan *MixFractionObject
+	currentMix               chan []float64 // allows ConfigureMixFraction to return the currentMix race free
+	readPeriod               time.Duration
+	buffersChan              chan AbacoBuffersType
+	externalTriggerLastState bool
+	AnySource
+}
+
+// NewTDMUDPSource creates a new TDMUDPSource.
+func NewTDMUDPSource() *TDMUDPSource {
+	source := new(TDMUDPSource)
+	source.name = "TDMUDP"
+	source.channelsPerPixel = 2
+	source.groups = make(map[GroupIndex]*AbacoGroup)
+
+	// Set up mix requests/replies to go on channels with a modest buffer size.
+	const MIXDEPTH = 10 // How many active mix requests allowed before RPC backs up
+	source.mixRequests = make(chan *MixFractionObject, MIXDEPTH)
+	source.currentMix = make(chan []float64, MIXDEPTH)
+	return source
+}
+
+// TDMUDPSourceConfig holds the arguments needed to call TDMUDPSource.Configure by RPC.
+type TDMUDPSourceConfig struct {
+	HostPortUDP []string // host:port pairs to listen for UDP packets
+	Nsamp       int      // number of ADC samples summed in each error value
+	SampleRate  float64  // frame rate, or 0 to learn it from the packet timestamps
+	FirstRow    int      // Channel number of the 1st row (default 1)
+}
+
+// Configure sets up the UDP receivers and the readout facts that the packets don't carry.
+func (ts *TDMUDPSource) Configure(config *TDMUDPSourceConfig) error {
+	// Make sure entries in the HostPortUDP slice are unique and sorted
+	hpseen := make(map[string]bool)
+	i := 0
+	for _, hp := range config.HostPortUDP {
+		if !hpseen[hp] {
+			hpseen[hp] = true
+			config.HostPortUDP[i] = hp
+			i++
+		}
+	}
+	config.HostPortUDP = config.HostPortUDP[:i]
+	sort.Strings(config.HostPortUDP)
+
+	ts.sourceStateLock.Lock()
+	defer ts.sourceStateLock.Unlock()
+	if ts.sourceState != Inactive {
+		return fmt.Errorf("cannot Configure a TDMUDPSource if it's not Inactive")
+	}
+	if len(config.HostPortUDP) == 0 {
+		return fmt.Errorf("TDMUDPSourceConfig.HostPortUDP is empty, need at least one host:port")
+	}
+	if config.Nsamp > 16 || config.Nsamp < 1 {
+		return fmt.Errorf("TDMUDPSourceConfig.Nsamp=%d but requires 1<=NSAMP<=16", config.Nsamp)
+	}
+	if config.SampleRate < 0 {
+		return fmt.Errorf("TDMUDPSourceConfig.SampleRate=%v but requires a non-negative rate", config.SampleRate)
+	}
+	if config.FirstRow == 0 {
+		config.FirstRow = 1
+	}
+
+	// Bind servers at each host:port pair in the list of requested UDP receivers
+	udpReceivers := make([]*AbacoUDPReceiver, 0)
+	producers := make([]PacketProducer, 0)
+	for _, hostport := range config.HostPortUDP {
+		device, err := NewAbacoUDPReceiver(hostport)
+		if err != nil {
+			fmt.Printf("Could not bind server at udp://%s/, %v\n", hostport, err)
+			return err
+		}
+		udpReceivers = append(udpReceivers, device)
+		producers = append(producers, device)
+	}
+	ts.udpReceivers = udpReceivers
+	ts.producers = producers
+	ts.nsamp = config.Nsamp
+	ts.configuredRate = config.SampleRate
+	ts.firstRowChanNum = config.FirstRow
+	return nil
+}
+
+// Delete closes all UDP servers.
+func (ts *TDMUDPSource) Delete() {
+	ts.closeDevices()
+}
+
+// Sample determines key data facts by sampling some initial data.
+// The UDP servers are closed if the data don't make sense, so they can be configured again.
+func (ts *TDMUDPSource) Sample() (err error) {
+	if len(ts.producers) <= 0 {
+		return fmt.Errorf("No TDM UDP receivers are active")
+	}
+	defer func() {
+		if err != nil {
+			ts.closeDevices()
+		}
+	}()
+
+	// TDM data are not phases, so the groups do no phase unwrapping.
+	newGroup := func(cidx GroupIndex) *AbacoGroup {
+		g := NewAbacoGroup(cidx, false, 0)
+		g.unwrap = g.unwrap[:0]
+		g.rawWords = true
+		return g
+	}
+	groups, keys, err := sampleGroups(ts.producers, newGroup)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("TDMUDPSource received no packets")
+	}
+	ts.groups = groups
+	ts.columnKeys = keys
+	ts.ncols = len(keys)
+	ts.nrows = keys[0].Nchan / 2
+	for _, k := range keys {
+		if k.Nchan%2 != 0 {
+			return fmt.Errorf("TDM column %v has an odd number of values per frame, need error+feedback pairs", k)
+		}
+		if k.Nchan/2 != ts.nrows {
+			return fmt.Errorf("TDM column %v has %d rows, but column %v has %d", k, k.Nchan/2, keys[0], ts.nrows)
+		}
+	}
+	ts.nchan = 2 * ts.nrows * ts.ncols
+
+	ts.sampleRate = ts.configuredRate
+	if ts.sampleRate == 0 {
+		ts.sampleRate = groups[keys[0]].sampleRate
+	}
+	if ts.sampleRate <= 0 {
+		return fmt.Errorf("TDMUDPSource could not learn the sample rate from packet timestamps; configure SampleRate")
+	}
+	ts.samplePeriod = time.Duration(roundint(1e9 / ts.sampleRate))
+
+	ts.Mix = make([]*Mix, ts.nchan)
+	for i := range ts.Mix {
+		ts.Mix[i] = &Mix{}
+	}
+	ts.voltsPerArb = make([]float32, ts.nchan)
+	for i := 0; i < ts.nchan; i += 2 {
+		ts.voltsPerArb[i] = 1.0 / (4096. * float32(ts.nsamp))
+	}
+	for i := 1; i < ts.nchan; i += 2 {
+		ts.voltsPerArb[i] = 1. / 65535.0
+	}
+	return nil
+}
+
+// PrepareChannels configures a TDMUDPSource by initializing all data structures that
+// have to do with channels and their naming/numbering.
+func (ts *TDMUDPSource) PrepareChannels() error {
+	ts.channelsPerPixel = 2
+	ts.rowColCodes = make([]RowColCode, ts.nchan)
+	ts.chanNames = make([]string, ts.nchan)
+	ts.chanNumbers = make([]int, ts.nchan)
+	ts.groupKeysSorted = make([]GroupIndex, 0)
+	index := 0
+	cnum := ts.firstRowChanNum
+	for col := 0; col < ts.ncols; col++ {
+		ts.groupKeysSorted = append(ts.groupKeysSorted, GroupIndex{Firstchan: cnum, Nchan: ts.nrows})
+		for row := 0; row < ts.nrows; row++ {
+			ts.chanNames[index] = fmt.Sprintf("err%d", cnum)
+			ts.chanNumbers[index] = cnum
+			ts.rowColCodes[index] = rcCode(row, col, ts.nrows, ts.ncols)
+			index++
+			ts.chanNames[index] = fmt.Sprintf("chan%d", cnum)
+			ts.chanNumbers[index] = cnum
+			ts.rowColCodes[index] = rcCode(row, col, ts.nrows, ts.ncols)
+			index++
+			cnum++
+		}
+	}
+	return nil
+}
+
+// StartRun discards existing data, then launches a goroutine to consume data.
+func (ts *TDMUDPSource) StartRun() error {
+	for _, pp := range ts.producers {
+		pp.discardStale()
+	}
+	ts.externalTriggerLastState = false
+	ts.buffersChan = make(chan AbacoBuffersType, 100)
+	ts.readPeriod = 50 * time.Millisecond
+	go ts.readerMainLoop()
+	return nil
+}
+
+func (ts *TDMUDPSource) readerMainLoop() {
+	defer close(ts.buffersChan)
+	const timeoutPeriod = 5 * time.Second
+	timeout := time.NewTimer(timeoutPeriod)
+	ticker := time.NewTicker(ts.readPeriod)
+	defer ticker.Stop()
+	defer timeout.Stop()
+	ts.lastread = time.Now()
+
+	for {
+		select {
+		case <-ts.abortSelf:
+			log.Printf("TDM UDP read was aborted")
+			return
+
+		case <-timeout.C:
+			log.Printf("TDM UDP read timed out after %v", timeoutPeriod)
+			return
+
+		case <-ticker.C:
+			buffers := readGroups(ts.producers, ts.groups, ts.columnKeys, ts.nchan)
+			if buffers.datacopies == nil {
+				continue
+			}
+			buffers.timeDiff = buffers.lastSampleTime.Sub(ts.lastread)
+			ts.lastread = buffers.lastSampleTime
+
+			if len(ts.buffersChan) == cap(ts.buffersChan) {
+				msg := fmt.Sprintf("internal buffersChan full, len %v, capacity %v", len(ts.buffersChan), cap(ts.buffersChan))
+				fmt.Printf("Panic! %s\n", msg)
+				panic(msg)
+			}
+			ts.buffersChan <- buffers
+			if buffers.totalBytes > 0 {
+				timeout.Reset(timeoutPeriod)
+			}
+		}
+	}
+}
+
+// getNextBlock returns the channel on which data sources send data and any errors.
+// This goroutine will end by putting a valid or error-ish dataBlock onto ts.nextBlock.
+// If the block has a non-nil error, this goroutine will also close ts.nextBlock.
+// As in LanceroSource, it also handles any mixRequests between blocks.
+func (ts *TDMUDPSource) getNextBlock() chan *dataBlock {
+	panicTime := time.Duration(cap(ts.buffersChan)) * ts.readPeriod
+	go func() {
+		for {
+			select {
+			case <-time.After(panicTime):
+				panic(fmt.Sprintf("timeout, no data from TDM UDP after %v / readPeriod is %v", panicTime, ts.readPeriod))
+
+			case mfo := <-ts.mixRequests:
+				for i, index := range mfo.ChannelIndices {
+					fraction := mfo.MixFractions[i]
+					ts.Mix[index].errorScale = fraction / float64(ts.nsamp)
+				}
+				mixFrac := make([]float64, len(ts.Mix))
+				for i, m := range ts.Mix {
+					mixFrac[i] = m.errorScale * float64(ts.nsamp)
+				}
+				ts.currentMix <- mixFrac
+
+			case buffersMsg, ok := <-ts.buffersChan:
+				//  Check is buffersChan closed? Recognize that by receiving zero values and/or being drained.
+				if buffersMsg.datacopies == nil || !ok {
+					if err := ts.closeDevices(); err != nil {
+						block := new(dataBlock)
+						block.err = err
+						ts.nextBlock <- block
+					}
+					close(ts.nextBlock)
+					return
+				}
+
+				// ts.buffersChan contained valid data, so act on it.
+				block := ts.distributeData(buffersMsg)
+				ts.nextBlock <- block
+				if block.err != nil {
+					close(ts.nextBlock)
+				}
+				return
+			}
+		}
+	}()
+	return ts.nextBlock
+}
+
+// distributeData turns the demultiplexed error and feedback data into a dataBlock. As in
+// LanceroSource, it scans the feedback for external triggers and then applies the Mix.
+func (ts *TDMUDPSource) distributeData(buffersMsg AbacoBuffersType) *dataBlock {
+	datacopies := buffersMsg.datacopies
+	lastSampleTime := buffersMsg.lastSampleTime
+	framesUsed := len(datacopies[0])
+
+	// Backtrack to find the time associated with the first sample.
+	segDuration := time.Duration(roundint((1e9 * float64(framesUsed-1)) / ts.sampleRate))
+	firstTime := lastSampleTime.Add(-segDuration)
+	block := new(dataBlock)
+	nchan := len(datacopies)
+	block.segments = make([]DataSegment, nchan)
+
+	// The external trigger is the 2nd least significant bit of the feedback, exactly as in
+	// LanceroSource.distributeData. It is redundant across columns, so scan only the first.
+	// Search before the Mix, which alters the feedback in place.
+	externalTriggerRowcounts := make([]int64, 0)
+	nrows := ts.nrows
+	for frame := 0; frame < framesUsed; frame++ {
+		for row := 0; row < nrows; row++ {
+			channelIndex := row*2 + 1
+			v := datacopies[channelIndex][frame]
+			externalTriggerState := (v & 0x02) == 0x02
+			if externalTriggerState && !ts.externalTriggerLastState {
+				externalTriggerRowcounts = append(externalTriggerRowcounts, (int64(frame)+int64(ts.nextFrameNum))*int64(nrows)+int64(row))
+			}
+			ts.externalTriggerLastState = externalTriggerState
+		}
+	}
+	block.externalTriggerRowcounts = externalTriggerRowcounts
+
+	// The columns arrive in channel order, so unlike Lancero data no reordering is needed.
+	for channelIndex := 0; channelIndex < nchan; channelIndex++ {
+		data := datacopies[channelIndex]
+		isFeedbackChannel := (channelIndex%2 == 1)
+		if isFeedbackChannel {
+			errData := datacopies[channelIndex-1]
+			ts.Mix[channelIndex].MixRetardFb(&data, &errData)
+		} else {
+			signExtend16(data)
+		}
+		seg := DataSegment{
+			rawData:         data,
+			framesPerSample: 1, // This will be changed later if decimating
+			framePeriod:     ts.samplePeriod,
+			firstFramenum:   ts.nextFrameNum,
+			firstTime:       firstTime,
+			signed:          !isFeedbackChannel,
+			droppedFrames:   buffersMsg.droppedFrames,
+		}
+		block.segments[channelIndex] = seg
+		block.nSamp = len(data)
+	}
+	ts.nextFrameNum += FrameIndex(framesUsed)
+	if ts.heartbeats != nil {
+		pmb := float64(buffersMsg.totalBytes) / 1e6
+		hwmb := float64(buffersMsg.totalBytes-buffersMsg.droppedBytes) / 1e6
+		ts.heartbeats <- Heartbeat{Running: true, HWactualMB: hwmb, DataMB: pmb,
+			Time: buffersMsg.timeDiff.Seconds()}
+	}
+	return block
+}
+
+// ConfigureMixFraction sets the MixFraction potentially for many channels, returns the list of current mix values
+// mix = fb + errorScale*err
+func (ts *TDMUDPSource) ConfigureMixFraction(mfo *MixFractionObject) ([]float64, error) {
+	for _, channelIndex := range mfo.ChannelIndices {
+		if channelIndex >= len(ts.Mix) || channelIndex < 0 {
+			return nil, fmt.Errorf("channelIndex %v out of bounds", channelIndex)
+		}
+		if channelIndex%2 == 0 {
+			return nil, fmt.Errorf("channelIndex %v is even, only odd channels (feedback) allowed", channelIndex)
+		}
+	}
+	ts.mixRequests <- mfo
+	current := <-ts.currentMix // retrieve current mix race-free
+	return current, nil
+}
+
+// closeDevices closes all UDP servers.
+func (ts *TDMUDPSource) closeDevices() error {
+	for _, pp := range ts.producers {
+		pp.stop()
+	}
+	ts.producers = ts.producers[:0]
+	return nil
+}
@@ -0,0 +1,214 @@
+package dastard
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/usnistgov/dastard/packets"
+)
+
+func TestTDMUDPDistribute(t *testing.T) {
+	ts := NewTDMUDPSource()
+	ts.nrows = 2
+	ts.ncols = 2
+	ts.nsamp = 4
+	ts.nchan = 8
+	ts.sampleRate = 1000
+	ts.samplePeriod = time.Millisecond
+	ts.nextFrameNum = 100
+	ts.Mix = make([]*Mix, ts.nchan)
+	for i := range ts.Mix {
+		ts.Mix[i] = &Mix{}
+	}
+	ts.Mix[3].errorScale = 0.5
+
+	// External trigger bit in column 0 on all rows of frames 1-2, then on row 1 of frame 4.
+	// Column 1 has the bit set throughout, which must be ignored.
+	const nframes = 6
+	datacopies := make([][]RawType, ts.nchan)
+	for i := range datacopies {
+		datacopies[i] = make([]RawType, nframes)
+		for j := range datacopies[i] {
+			datacopies[i][j] = RawType(1000*(i+1) + 4*j)
+		}
+	}
+	for j := range datacopies[2] {
+		datacopies[2][j] = RawType(0xfff6) // error value -10
+	}
+	datacopies[1][1] |= 0x02
+	datacopies[1][2] |= 0x02
+	datacopies[3][1] |= 0x02
+	datacopies[3][2] |= 0x02
+	datacopies[3][4] |= 0x02
+	for _, i := range []int{5, 7} {
+		for j := range datacopies[i] {
+			datacopies[i][j] |= 0x02
+		}
+	}
+	block := ts.distributeData(AbacoBuffersType{datacopies: datacopies, lastSampleTime: time.Now(),
+		droppedFrames: 3})
+	want := []int64{101*2 + 0, 104*2 + 1}
+	if len(block.externalTriggerRowcounts) != len(want) {
+		t.Fatalf("TDMUDPSource external triggers %v, want %v", block.externalTriggerRowcounts, want)
+	}
+	for i := range want {
+		if block.externalTriggerRowcounts[i] != want[i] {
+			t.Errorf("TDMUDPSource external triggers %v, want %v", block.externalTriggerRowcounts, want)
+		}
+	}
+	if ts.nextFrameNum != 100+nframes {
+		t.Errorf("TDMUDPSource.nextFrameNum=%d, want %d", ts.nextFrameNum, 100+nframes)
+	}
+	for i, seg := range block.segments {
+		if seg.signed != (i%2 == 0) || seg.firstFramenum != 100 || seg.droppedFrames != 3 {
+			t.Errorf("TDMUDPSource segment %d signed=%t, firstFramenum=%d, droppedFrames=%d", i, seg.signed,
+				seg.firstFramenum, seg.droppedFrames)
+		}
+	}
+	// Feedback is retarded by one frame with the 2 trigger bits masked, then mixed with error -10.
+	for j := 1; j < nframes; j++ {
+		if want := RawType(2000+4*(j-1)) &^ 0x03; block.segments[1].rawData[j] != want {
+			t.Errorf("TDMUDPSource unmixed feedback[%d]=%d, want %d", j, block.segments[1].rawData[j], want)
+		}
+		if want := RawType(4000+4*(j-1))&^0x03 - 5; block.segments[3].rawData[j] != want {
+			t.Errorf("TDMUDPSource mixed feedback[%d]=%d, want %d", j, block.segments[3].rawData[j], want)
+		}
+	}
+}
+
+func TestTDMUDPSource(t *testing.T) {
+	ts := NewTDMUDPSource()
+	if err := ts.Configure(&TDMUDPSourceConfig{Nsamp: 4}); err == nil {
+		t.Error("TDMUDPSource.Configure with no UDP ports succeeded, want error")
+	}
+	if err := ts.Configure(&TDMUDPSourceConfig{HostPortUDP: []string{"localhost:4400"}}); err == nil {
+		t.Error("TDMUDPSource.Configure with Nsamp=0 succeeded, want error")
+	}
+	hostports := []string{"localhost:4401", "localhost:4400", "localhost:4401"}
+	config := TDMUDPSourceConfig{HostPortUDP: hostports, Nsamp: 4, FirstRow: 10}
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.HostPortUDP) != 2 {
+		t.Errorf("TDMUDPSource.Configure() returns with repeats in HostPortUDP=%v", config.HostPortUDP)
+	}
+
+	// Send 2 columns of 3 rows, one column per port, at 10000 frames per second.
+	// The packet timestamps count at 10 MHz, 1000 counts per frame.
+	const nrows = 3
+	const ncols = 2
+	const framesPerPacket = 50
+	const sampleRate = 10000
+	abortSupply := make(chan struct{})
+	supplyDone := make(chan struct{})
+	go func() {
+		defer close(supplyDone)
+		conns := make([]*packetConn, ncols)
+		for col := range conns {
+			var err error
+			if conns[col], err = dialPacketConn(config.HostPortUDP[col], col*2*nrows, 2*nrows); err != nil {
+				t.Error(err)
+				return
+			}
+			defer conns[col].Close()
+		}
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		frame := 0
+		for {
+			select {
+			case <-abortSupply:
+				return
+			case <-ticker.C:
+				for col, conn := range conns {
+					d := make([]int16, 0, 2*nrows*framesPerPacket)
+					for f := frame; f < frame+framesPerPacket; f++ {
+						for row := 0; row < nrows; row++ {
+							fb := int16(100 * (row + 1))
+							if col == 0 && row == 1 && f%1000 < 10 {
+								fb |= 0x02
+							}
+							d = append(d, int16(-row), fb)
+						}
+					}
+					if err := conn.send(d, uint64(frame)*1000); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				frame += framesPerPacket
+			}
+		}
+	}()
+	defer func() {
+		close(abortSupply)
+		<-supplyDone
+	}()
+
+	ds := DataSource(ts)
+	if err := Start(ds, nil, 256, 1024); err != nil {
+		t.Fatalf("TDMUDPSource could not be started: %v", err)
+	}
+	if ts.nchan != 2*nrows*ncols || ts.nrows != nrows || ts.ncols != ncols {
+		t.Errorf("TDMUDPSource has %d chan, %d rows, %d cols, want %d, %d, %d", ts.nchan, ts.nrows, ts.ncols,
+			2*nrows*ncols, nrows, ncols)
+	}
+	if ts.sampleRate < 0.99*sampleRate || ts.sampleRate > 1.01*sampleRate {
+		t.Errorf("TDMUDPSource sample rate %v, want %v from the packet timestamps", ts.sampleRate, sampleRate)
+	}
+	names := ds.ChannelNames()
+	for i, want := range []string{"err10", "chan10", "err11", "chan11", "err12", "chan12", "err13"} {
+		if names[i] != want {
+			t.Errorf("TDMUDPSource channel name[%d]=%s, want %s", i, names[i], want)
+		}
+	}
+	if rc := ts.rowColCodes[2*nrows+3]; rc.row() != 1 || rc.col() != 1 || rc.rows() != nrows || rc.cols() != ncols {
+		t.Errorf("TDMUDPSource rowColCode for chan index %d is %v", 2*nrows+3, rc)
+	}
+
+	mfo := MixFractionObject{ChannelIndices: []int{0}, MixFractions: []float64{1.0}}
+	if _, err := ts.ConfigureMixFraction(&mfo); err == nil {
+		t.Error("TDMUDPSource.ConfigureMixFraction on an error channel succeeded, want error")
+	}
+	mfo = MixFractionObject{ChannelIndices: []int{3}, MixFractions: []float64{1.0}}
+	mix, err := ts.ConfigureMixFraction(&mfo)
+	if err != nil {
+		t.Error(err)
+	} else if len(mix) != ts.nchan || mix[3] != 1.0 {
+		t.Errorf("TDMUDPSource.ConfigureMixFraction returns %v, want %v at index 3", mix, 1.0)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	ds.Stop()
+	ts.RunDoneWait()
+	if ts.nextFrameNum == 0 {
+		t.Error("TDMUDPSource produced no data")
+	}
+	if ts.writingState.externalTriggerNumberObserved == 0 {
+		t.Error("TDMUDPSource saw no external triggers")
+	}
+}
+
+// packetConn sends one column of TDM data as packets to a UDP port.
+type packetConn struct {
+	p     *packets.Packet
+	nchan int
+	net.Conn
+}
+
+func dialPacketConn(hostport string, offset, nchan int) (*packetConn, error) {
+	conn, err := net.Dial("udp", hostport)
+	if err != nil {
+		return nil, fmt.Errorf("could not dial %s: %v", hostport, err)
+	}
+	return &packetConn{p: packets.NewPacket(10, 20, 0, offset), nchan: nchan, Conn: conn}, nil
+}
+
+func (pc *packetConn) send(data []int16, timestamp uint64) error {
+	pc.p.NewData(data, []int16{int16(pc.nchan)})
+	pc.p.SetTimestamp(&packets.PacketTimestamp{T: timestamp, Rate: 1e7})
+	_, err := pc.Write(pc.p.Bytes())
+	return err
+}
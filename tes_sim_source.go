@@ -0,0 +1,338 @@
+package dastard
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// TESSimSource simulates a TES array: pulses arrive at random (Poisson) times, with sizes
+// drawn from a line spectrum, on a noisy and drifting baseline, with optional crosstalk
+// between neighboring channels.
+type TESSimSource struct {
+	config     TESSimSourceConfig
+	lines      []SpectralLine
+	cumulative []float64 // cumulative intensity of lines, normalized to end at 1
+	rng        *rand.Rand
+	blockLen   int
+	timeperbuf time.Duration
+	tailLen    int     // samples after arrival that a pulse is simulated
+	peakScale  float64 // makes the peak of a unit-amplitude pulse equal 1
+	channels   []tesSimChannel
+	AnySource
+}
+
+// tesSimChannel holds the state of one simulated channel between blocks.
+type tesSimChannel struct {
+	nextArrival float64       // sample index of the next pulse arrival
+	pulses      []tesSimPulse // pulses whose tails are still being simulated
+	pink        []float64     // state of the low-pass filters that make 1/f noise
+}
+
+// tesSimPulse is one pulse (or crosstalk from one) in a channel.
+type tesSimPulse struct {
+	arrival   float64 // sample index, not necessarily an integer
+	amplitude float64 // raw units
+}
+
+// SpectralLine is one line of a simulated x-ray spectrum.
+type SpectralLine struct {
+	Energy    float64 // line energy (eV)
+	Intensity float64 // relative intensity
+	Width     float64 // natural (Lorentzian) full width at half maximum (eV)
+}
+
+// MnKLines is a simplified Mn K-alpha and K-beta spectrum, the default TESSimSource spectrum.
+var MnKLines = []SpectralLine{
+	{Energy: 5898.75, Intensity: 0.58, Width: 2.47}, // K-alpha 1
+	{Energy: 5887.65, Intensity: 0.29, Width: 2.92}, // K-alpha 2
+	{Energy: 6490.45, Intensity: 0.13, Width: 1.83}, // K-beta
+}
+
+// TESSimSourceConfig holds the arguments needed to call TESSimSource.Configure by RPC.
+// Times are in seconds; levels and noise are in raw units.
+type TESSimSourceConfig struct {
+	Nchan       int
+	SampleRate  float64
+	Pedestal    float64        // baseline level
+	PulseRate   float64        // mean rate of pulse arrivals per channel (per second)
+	Lines       []SpectralLine // spectrum of pulse energies; empty means MnKLines
+	Gain        float64        // pulse amplitude per eV of energy
+	Resolution  float64        // detector energy resolution, full width at half maximum (eV)
+	RiseTime    float64        // exponential rise time constant
+	FallTime    float64        // exponential fall time constant
+	WhiteNoise  float64        // rms of Gaussian white noise
+	PinkNoise   float64        // rms of 1/f noise
+	Drift       float64        // amplitude of a sinusoidal baseline drift
+	DriftPeriod float64        // period of the baseline drift
+	Crosstalk   float64        // fraction of each pulse that also appears in the neighboring channels
+	Seed        int64          // seed for the random numbers (0 means seed from the clock)
+}
+
+// tesSimBlockTime is the (approximate) length of time in each block of data.
+const tesSimBlockTime = 50 * time.Millisecond
+
+// tesSimPinkPoles is the number of low-pass filters whose sum approximates 1/f noise.
+const tesSimPinkPoles = 12
+
+// NewTESSimSource creates a new TESSimSource.
+func NewTESSimSource() *TESSimSource {
+	ts := new(TESSimSource)
+	ts.name = "TESSim"
+	return ts
+}
+
+// Configure checks the configuration and sets up the simulation.
+func (ts *TESSimSource) Configure(config *TESSimSourceConfig) error {
+	if config.Nchan < 1 {
+		return fmt.Errorf("TESSimSource.Configure() asked for %d channels, should be > 0", config.Nchan)
+	}
+	if config.SampleRate <= 0 {
+		return fmt.Errorf("TESSimSource.Configure() asked for SampleRate %v, should be > 0", config.SampleRate)
+	}
+	if config.RiseTime <= 0 || config.FallTime <= config.RiseTime {
+		return fmt.Errorf("TESSimSource needs 0 < RiseTime < FallTime, have %v, %v", config.RiseTime,
+			config.FallTime)
+	}
+	if config.PulseRate < 0 || config.Gain < 0 || config.Resolution < 0 || config.WhiteNoise < 0 ||
+		config.PinkNoise < 0 || config.Drift < 0 || config.Crosstalk < 0 {
+		return fmt.Errorf("TESSimSource configuration must not have negative rates, gain, or noise: %+v", *config)
+	}
+	if config.Drift > 0 && config.DriftPeriod <= 0 {
+		return fmt.Errorf("TESSimSource needs DriftPeriod > 0 when Drift > 0")
+	}
+	lines := config.Lines
+	if len(lines) == 0 {
+		lines = MnKLines
+	}
+	cumulative := make([]float64, len(lines))
+	total := 0.0
+	for i, line := range lines {
+		if line.Intensity < 0 || line.Width < 0 {
+			return fmt.Errorf("TESSimSource line %d has negative intensity or width: %+v", i, line)
+		}
+		total += line.Intensity
+		cumulative[i] = total
+	}
+	if total <= 0 {
+		return fmt.Errorf("TESSimSource lines have no intensity")
+	}
+	for i := range cumulative {
+		cumulative[i] /= total
+	}
+
+	ts.sourceStateLock.Lock()
+	defer ts.sourceStateLock.Unlock()
+	if ts.sourceState != Inactive {
+		return fmt.Errorf("cannot Configure a TESSimSource if it's not Inactive")
+	}
+	ts.config = *config
+	ts.lines = lines
+	ts.cumulative = cumulative
+	ts.nchan = config.Nchan
+	ts.sampleRate = config.SampleRate
+	ts.samplePeriod = time.Duration(roundint(1e9 / ts.sampleRate))
+	ts.blockLen = roundint(config.SampleRate * tesSimBlockTime.Seconds())
+	if ts.blockLen < 1 {
+		ts.blockLen = 1
+	}
+	ts.timeperbuf = time.Duration(float64(time.Second) * float64(ts.blockLen) / ts.sampleRate)
+	if ts.timeperbuf > 4*time.Second {
+		return fmt.Errorf("timeperbuf is %v, should be less than 4 seconds", ts.timeperbuf)
+	}
+
+	// Simulate each pulse until it falls to 1e-6 of its size, and scale pulses so that a
+	// unit amplitude pulse has a peak of 1.
+	rise := config.RiseTime * config.SampleRate
+	fall := config.FallTime * config.SampleRate
+	ts.tailLen = int(math.Ceil(fall*math.Log(1e6))) + 1
+	tpeak := rise * fall / (fall - rise) * math.Log(fall/rise)
+	ts.peakScale = 1 / (math.Exp(-tpeak/fall) - math.Exp(-tpeak/rise))
+	ts.reset()
+	return nil
+}
+
+// reset starts the simulation over, as at the start of a run.
+func (ts *TESSimSource) reset() {
+	seed := ts.config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ts.rng = rand.New(rand.NewSource(seed))
+	ts.channels = make([]tesSimChannel, ts.nchan)
+	for i := range ts.channels {
+		ch := &ts.channels[i]
+		ch.nextArrival = ts.nextArrivalAfter(0)
+		ch.pink = make([]float64, tesSimPinkPoles)
+	}
+}
+
+// nextArrivalAfter returns the sample index of the next pulse arrival after sample t.
+func (ts *TESSimSource) nextArrivalAfter(t float64) float64 {
+	if ts.config.PulseRate <= 0 {
+		return math.Inf(1)
+	}
+	return t + ts.rng.ExpFloat64()*ts.sampleRate/ts.config.PulseRate
+}
+
+// drawAmplitude returns the amplitude of a random pulse: a line chosen by intensity, its
+// natural (Lorentzian) width, and the detector's (Gaussian) resolution.
+func (ts *TESSimSource) drawAmplitude() float64 {
+	u := ts.rng.Float64()
+	line := ts.lines[len(ts.lines)-1]
+	for i, c := range ts.cumulative {
+		if u < c {
+			line = ts.lines[i]
+			break
+		}
+	}
+	const fwhmPerSigma = 2.3548200450309493 // 2 sqrt(2 ln 2)
+	energy := line.Energy + 0.5*line.Width*math.Tan(math.Pi*(ts.rng.Float64()-0.5))
+	energy += ts.rng.NormFloat64() * ts.config.Resolution / fwhmPerSigma
+	return energy * ts.config.Gain
+}
+
+// generate returns the next n samples of each channel, where the first sample of this
+// block has index firstSample since the run started.
+func (ts *TESSimSource) generate(firstSample int64, n int) [][]RawType {
+	cfg := &ts.config
+	end := float64(firstSample + int64(n))
+
+	// Find the pulses that arrive in this block, and their crosstalk into neighbors.
+	for i := range ts.channels {
+		ch := &ts.channels[i]
+		for ; ch.nextArrival < end; ch.nextArrival = ts.nextArrivalAfter(ch.nextArrival) {
+			p := tesSimPulse{arrival: ch.nextArrival, amplitude: ts.drawAmplitude()}
+			ch.pulses = append(ch.pulses, p)
+			if cfg.Crosstalk > 0 {
+				xp := tesSimPulse{arrival: p.arrival, amplitude: cfg.Crosstalk * p.amplitude}
+				if i > 0 {
+					ts.channels[i-1].pulses = append(ts.channels[i-1].pulses, xp)
+				}
+				if i < len(ts.channels)-1 {
+					ts.channels[i+1].pulses = append(ts.channels[i+1].pulses, xp)
+				}
+			}
+		}
+	}
+
+	rise := cfg.RiseTime * ts.sampleRate
+	fall := cfg.FallTime * ts.sampleRate
+	pinkSigma := cfg.PinkNoise / math.Sqrt(tesSimPinkPoles)
+	data := make([][]RawType, ts.nchan)
+	value := make([]float64, n)
+	for i := range ts.channels {
+		ch := &ts.channels[i]
+		for j := range value {
+			value[j] = cfg.Pedestal
+			if cfg.Drift > 0 {
+				t := float64(firstSample+int64(j)) / ts.sampleRate
+				value[j] += cfg.Drift * math.Sin(2*math.Pi*t/cfg.DriftPeriod)
+			}
+			if cfg.WhiteNoise > 0 {
+				value[j] += ts.rng.NormFloat64() * cfg.WhiteNoise
+			}
+			if cfg.PinkNoise > 0 {
+				// Low-pass filters with time constants spaced by factors of 4 from 1 sample
+				// up; their equally weighted sum has a nearly 1/f power spectrum.
+				for k := range ch.pink {
+					a := math.Exp(-1 / math.Pow(4, float64(k)))
+					ch.pink[k] = a*ch.pink[k] + math.Sqrt(1-a*a)*pinkSigma*ts.rng.NormFloat64()
+					value[j] += ch.pink[k]
+				}
+			}
+		}
+
+		remaining := ch.pulses[:0]
+		for _, p := range ch.pulses {
+			start := int64(math.Ceil(p.arrival))
+			if start < firstSample {
+				start = firstSample
+			}
+			stop := int64(p.arrival) + int64(ts.tailLen)
+			for k := start; k < stop && k < firstSample+int64(n); k++ {
+				dt := float64(k) - p.arrival
+				value[k-firstSample] += p.amplitude * ts.peakScale * (math.Exp(-dt/fall) - math.Exp(-dt/rise))
+			}
+			if stop > firstSample+int64(n) {
+				remaining = append(remaining, p)
+			}
+		}
+		ch.pulses = remaining
+
+		const maxRaw = 1<<rawTypeBits - 1
+		data[i] = make([]RawType, n)
+		for j, v := range value {
+			data[i][j] = RawType(math.Max(0, math.Min(maxRaw, math.Round(v))))
+		}
+	}
+	return data
+}
+
+// Sample determines key data facts by sampling some initial data.
+// It's a no-op for simulated (software) sources
+func (ts *TESSimSource) Sample() error {
+	ts.chanNames = make([]string, ts.nchan)
+	ts.chanNumbers = make([]int, ts.nchan)
+	ts.rowColCodes = make([]RowColCode, ts.nchan)
+	for i := 0; i < ts.nchan; i++ {
+		ts.chanNames[i] = fmt.Sprintf("chan%d", i+1)
+		ts.chanNumbers[i] = i + 1
+		ts.rowColCodes[i] = rcCode(0, i, 1, ts.nchan)
+	}
+	return nil
+}
+
+// StartRun launches the repeated loop that generates simulated TES data.
+func (ts *TESSimSource) StartRun() error {
+	ts.reset()
+	go func() {
+		log.Printf("starting TESSimSource with blockLen %v, nchan %v, timeperbuf %v\n",
+			ts.blockLen, ts.nchan, ts.timeperbuf)
+		defer close(ts.nextBlock)
+		blocksSentSinceLastHeartbeat := 0
+		ticker := time.NewTicker(ts.timeperbuf)
+		defer ticker.Stop()
+		heartbeatTicker := time.NewTicker(1 * time.Second)
+		defer heartbeatTicker.Stop()
+		var firstSample int64
+		for {
+			select {
+			case <-ts.abortSelf:
+				return
+			case <-ticker.C:
+				// Backtrack to find the time associated with the first sample.
+				firstTime := time.Now().Add(-ts.timeperbuf)
+				data := ts.generate(firstSample, ts.blockLen)
+				firstSample += int64(ts.blockLen)
+				block := new(dataBlock)
+				block.segments = make([]DataSegment, ts.nchan)
+				for channelIndex := range block.segments {
+					block.segments[channelIndex] = DataSegment{
+						rawData:         data[channelIndex],
+						framesPerSample: 1,
+						framePeriod:     ts.samplePeriod,
+						firstFramenum:   ts.nextFrameNum,
+						firstTime:       firstTime,
+					}
+				}
+				ts.nextFrameNum += FrameIndex(ts.blockLen)
+				ts.nextBlock <- block
+				ts.lastread = time.Now()
+				blocksSentSinceLastHeartbeat++
+			case <-heartbeatTicker.C:
+				if ts.heartbeats != nil {
+					dataBytes := blocksSentSinceLastHeartbeat * (ts.blockLen * rawTypeBits / 8 * ts.nchan)
+					mb := float64(dataBytes) / 1e6
+					ts.heartbeats <- Heartbeat{Running: true,
+						Time:       ts.timeperbuf.Seconds() * float64(blocksSentSinceLastHeartbeat),
+						HWactualMB: mb, DataMB: mb}
+					blocksSentSinceLastHeartbeat = 0
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,206 @@
+package dastard
+
+import (
+	"math"
+	"testing"
+)
+
+// tesSimStats returns the mean and standard deviation of the values in x.
+func tesSimStats(x []float64) (mean, std float64) {
+	for _, v := range x {
+		mean += v
+	}
+	mean /= float64(len(x))
+	for _, v := range x {
+		std += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(std / float64(len(x)))
+}
+
+func TestTESSimConfigure(t *testing.T) {
+	good := TESSimSourceConfig{Nchan: 4, SampleRate: 10000, Pedestal: 1000, PulseRate: 10, Gain: 1,
+		RiseTime: 1e-4, FallTime: 1e-3}
+	ts := NewTESSimSource()
+	if err := ts.Configure(&good); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.lines) != len(MnKLines) {
+		t.Errorf("TESSimSource has %d lines, want the %d default lines", len(ts.lines), len(MnKLines))
+	}
+	bad := []func(c *TESSimSourceConfig){
+		func(c *TESSimSourceConfig) { c.Nchan = 0 },
+		func(c *TESSimSourceConfig) { c.SampleRate = 0 },
+		func(c *TESSimSourceConfig) { c.RiseTime = 0 },
+		func(c *TESSimSourceConfig) { c.FallTime = c.RiseTime },
+		func(c *TESSimSourceConfig) { c.PulseRate = -1 },
+		func(c *TESSimSourceConfig) { c.WhiteNoise = -1 },
+		func(c *TESSimSourceConfig) { c.Drift = 10 },
+		func(c *TESSimSourceConfig) { c.Lines = []SpectralLine{{Energy: 1000}} },
+		func(c *TESSimSourceConfig) { c.Lines = []SpectralLine{{Energy: 1000, Intensity: 1, Width: -1}} },
+	}
+	for i, modify := range bad {
+		config := good
+		modify(&config)
+		if err := ts.Configure(&config); err == nil {
+			t.Errorf("TESSimSource.Configure(bad config %d: %+v) succeeded, want error", i, config)
+		}
+	}
+}
+
+func TestTESSimPulses(t *testing.T) {
+	// One noiseless pulse, by hand, in the middle channel: check its size, its crosstalk, and
+	// that it continues across blocks.
+	config := TESSimSourceConfig{Nchan: 3, SampleRate: 10000, Pedestal: 1000, Gain: 1,
+		Lines: []SpectralLine{{Energy: 5000, Intensity: 1}}, RiseTime: 1e-4, FallTime: 1e-3,
+		Crosstalk: 0.1, Seed: 1}
+	ts := NewTESSimSource()
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	ts.channels[1].nextArrival = 100.5
+	first := ts.generate(0, 110)
+	second := ts.generate(110, 20)
+	wantPeaks := []float64{1500, 6000, 1500}
+	for i := range first {
+		data := append(first[i], second[i]...)
+		for j := 0; j <= 100; j++ {
+			if data[j] != RawType(config.Pedestal) {
+				t.Fatalf("TESSimSource chan %d sample %d=%d before the pulse, want %v", i, j, data[j], config.Pedestal)
+			}
+		}
+		peak := 0.0
+		for _, d := range data {
+			peak = math.Max(peak, float64(d))
+		}
+		if math.Abs(peak-wantPeaks[i]) > 0.01*(wantPeaks[i]-config.Pedestal) {
+			t.Errorf("TESSimSource chan %d peak %v, want %v", i, peak, wantPeaks[i])
+		}
+		if data[len(data)-1] >= data[len(data)-2] || data[len(data)-1] <= RawType(config.Pedestal) {
+			t.Errorf("TESSimSource chan %d pulse is not decaying toward the pedestal at the end", i)
+		}
+	}
+
+	// Poisson arrivals: count threshold crossings in 20 seconds at 20 pulses per second.
+	// Pileup hides a few percent of them.
+	config = TESSimSourceConfig{Nchan: 1, SampleRate: 10000, Pedestal: 1000, PulseRate: 20, Gain: 1,
+		RiseTime: 1e-4, FallTime: 1e-3, WhiteNoise: 5, Seed: 2}
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	crossings := 0
+	var last RawType
+	for block := int64(0); block < 200; block++ {
+		data := ts.generate(block*1000, 1000)[0]
+		for _, d := range data {
+			if d > 2000 && last <= 2000 {
+				crossings++
+			}
+			last = d
+		}
+	}
+	if crossings < 340 || crossings > 460 {
+		t.Errorf("TESSimSource made %d pulses in 20 s at 20 per second", crossings)
+	}
+
+	// A pulse beyond 16 bits saturates at the largest RawType: 65535, or not at all in raw32 builds.
+	config = TESSimSourceConfig{Nchan: 1, SampleRate: 10000, Pedestal: 1000, Gain: 1,
+		Lines: []SpectralLine{{Energy: 100000, Intensity: 1}}, RiseTime: 1e-4, FallTime: 1e-3, Seed: 3}
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	ts.channels[0].nextArrival = 10.5
+	wantPeak := math.Min(101000, 1<<rawTypeBits-1)
+	peak := 0.0
+	for _, d := range ts.generate(0, 100)[0] {
+		peak = math.Max(peak, float64(d))
+	}
+	if math.Abs(peak-wantPeak) > 0.01*wantPeak {
+		t.Errorf("TESSimSource large pulse peak %v, want %v", peak, wantPeak)
+	}
+}
+
+func TestTESSimNoise(t *testing.T) {
+	const n = 100000
+	config := TESSimSourceConfig{Nchan: 1, SampleRate: 10000, Pedestal: 1000, RiseTime: 1e-4,
+		FallTime: 1e-3, WhiteNoise: 10, Seed: 3}
+	ts := NewTESSimSource()
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	data := ts.generate(0, n)[0]
+	values := make([]float64, n)
+	diffs := make([]float64, n-1)
+	for i, d := range data {
+		values[i] = float64(d)
+		if i > 0 {
+			diffs[i-1] = values[i] - values[i-1]
+		}
+	}
+	mean, std := tesSimStats(values)
+	if math.Abs(mean-1000) > 0.5 || math.Abs(std-10) > 0.5 {
+		t.Errorf("TESSimSource white noise mean=%v, rms=%v, want 1000, 10", mean, std)
+	}
+	// Successive samples of white noise are independent.
+	if _, dstd := tesSimStats(diffs); math.Abs(dstd-std*math.Sqrt2) > 0.5 {
+		t.Errorf("TESSimSource white noise differences have rms %v, want %v", dstd, std*math.Sqrt2)
+	}
+
+	// 1/f noise is dominated by slow fluctuations, so successive samples are correlated.
+	config.WhiteNoise = 0
+	config.PinkNoise = 10
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	data = ts.generate(0, n)[0]
+	for i, d := range data {
+		values[i] = float64(d)
+		if i > 0 {
+			diffs[i-1] = values[i] - values[i-1]
+		}
+	}
+	_, std = tesSimStats(values)
+	_, dstd := tesSimStats(diffs)
+	if std == 0 || dstd > std {
+		t.Errorf("TESSimSource 1/f noise rms=%v and differences rms=%v, want differences smaller", std, dstd)
+	}
+
+	// Drift only.
+	config.PinkNoise = 0
+	config.Drift = 100
+	config.DriftPeriod = 1
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	data = ts.generate(0, 10000)[0]
+	if data[0] != 1000 || data[2500] != 1100 || data[7500] != 900 {
+		t.Errorf("TESSimSource drift gives %d, %d, %d at 0, 1/4, 3/4 period, want 1000, 1100, 900",
+			data[0], data[2500], data[7500])
+	}
+}
+
+func TestTESSimSource(t *testing.T) {
+	ts := NewTESSimSource()
+	config := TESSimSourceConfig{Nchan: 4, SampleRate: 20000, Pedestal: 1000, PulseRate: 50, Gain: 1,
+		RiseTime: 1e-4, FallTime: 1e-3, WhiteNoise: 5, PinkNoise: 5, Crosstalk: 0.01}
+	if err := ts.Configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	ts.noProcess = true // for testing
+	ds := DataSource(ts)
+	if err := Start(ds, nil, 256, 1024); err != nil {
+		t.Fatalf("TESSimSource could not be started: %v", err)
+	}
+	if !ds.Running() {
+		t.Errorf("TESSimSource.Running() says false after started.")
+	}
+	if len(ts.processors) != config.Nchan {
+		t.Errorf("TESSimSource has %d channels, want %d", len(ts.processors), config.Nchan)
+	}
+	if err := ts.Configure(&config); err == nil {
+		t.Errorf("TESSimSource can be configured even though it's running, want error.")
+	}
+	ds.Stop()
+	if ds.Running() {
+		t.Errorf("TESSimSource.Running() says true after stopped.")
+	}
+}
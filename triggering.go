@@ -52,7 +52,22 @@ type TriggerState struct {
 	edgeMultiIPotential              FrameIndex
 	edgeMultiILastInspected          FrameIndex
 
-	// TODO: group source/rx info.
+	// NoiseTrigger makes fixed-length records only from quiet stretches of data, where no
+	// edge (per EdgeLevel) or level crossing (per LevelLevel, if LevelTrigger) occurs within
+	// NoiseGuardSamples of either end of the record. One of these vetoes must be enabled.
+	// NoiseSpacingSec is the minimum time between the starts of noise records; they are
+	// never closer than NSamples, so records don't overlap.
+	NoiseTrigger      bool
+	NoiseSpacingSec   float64
+	NoiseGuardSamples int
+}
+
+// validate checks that the trigger state makes sense.
+func (ts *TriggerState) validate() error {
+	if ts.NoiseTrigger && ts.EdgeLevel <= 0 && !ts.LevelTrigger {
+		return fmt.Errorf("NoiseTrigger requires EdgeLevel > 0 or LevelTrigger, or nothing can veto a noise record")
+	}
+	return nil
 }
 
 // modify dsp to have it start looking for triggers at sample 6
@@ -245,9 +260,9 @@ func (dsp *DataStreamProcessor) edgeMultiTriggerComputeAppend(records []*DataRec
 		case initial:
 			dsp.edgeMultiInternalSearchState = searching
 		case searching:
-			diff := int32(raw[i]) - int32(raw[i-1])
-			if (rising && diff >= dsp.EdgeMultiLevel) ||
-				(falling && diff <= dsp.EdgeMultiLevel) {
+			diff := int64(raw[i]) - int64(raw[i-1])
+			if (rising && diff >= int64(dsp.EdgeMultiLevel)) ||
+				(falling && diff <= int64(dsp.EdgeMultiLevel)) {
 				iPotential = i
 				dsp.edgeMultiInternalSearchState = verifying
 			}
@@ -439,19 +454,19 @@ func (dsp *DataStreamProcessor) edgeTriggerComputeAppend(records []*DataRecord)
 	raw := segment.rawData
 	ndata := len(raw)
 
-	// Solve the problem of signed data by shifting all values up by 2^15
+	// Solve the problem of signed data by shifting all values up by half the RawType range
 	if dsp.stream.signed {
 		raw = make([]RawType, ndata)
 		copy(raw, segment.rawData)
 		for i := 0; i < ndata; i++ {
-			raw[i] += 32768
+			raw[i] += rawSignOffset
 		}
 	}
 
 	for i := dsp.NPresamples; i < ndata+dsp.NPresamples-dsp.NSamples; i++ {
-		diff := int32(raw[i]) + int32(raw[i-1]) - int32(raw[i-2]) - int32(raw[i-3])
-		if (dsp.EdgeRising && diff >= dsp.EdgeLevel) ||
-			(dsp.EdgeFalling && diff <= -dsp.EdgeLevel) {
+		diff := int64(raw[i]) + int64(raw[i-1]) - int64(raw[i-2]) - int64(raw[i-3])
+		if (dsp.EdgeRising && diff >= int64(dsp.EdgeLevel)) ||
+			(dsp.EdgeFalling && diff <= -int64(dsp.EdgeLevel)) {
 			newRecord := dsp.triggerAt(segment, i)
 			records = append(records, newRecord)
 			i += dsp.NSamples
@@ -476,14 +491,14 @@ func (dsp *DataStreamProcessor) levelTriggerComputeAppend(records []*DataRecord)
 		nextFoundTrig = records[idxNextTrig].trigFrame - segment.firstFramenum
 	}
 
-	// Solve the problem of signed data by shifting all values up by 2^15
+	// Solve the problem of signed data by shifting all values up by half the RawType range
 	threshold := dsp.LevelLevel
 	if dsp.stream.signed {
-		threshold += 32768
+		threshold += rawSignOffset
 		raw = make([]RawType, ndata)
 		copy(raw, segment.rawData)
 		for i := 0; i < ndata; i++ {
-			raw[i] += 32768
+			raw[i] += rawSignOffset
 		}
 	}
 
@@ -565,6 +580,105 @@ func (dsp *DataStreamProcessor) autoTriggerComputeAppend(records []*DataRecord)
 	return records
 }
 
+// noiseVetoes returns the indices in raw of every sample that would disqualify a
+// noise record: an edge per dsp.EdgeLevel or a crossing of dsp.LevelLevel (in
+// either direction, only if dsp.LevelTrigger). Samples before index 3 are not checked.
+func (dsp *DataStreamProcessor) noiseVetoes(raw []RawType, threshold RawType) []int {
+	var vetoes []int
+	for i := 3; i < len(raw); i++ {
+		if dsp.EdgeLevel > 0 {
+			diff := int64(raw[i]) + int64(raw[i-1]) - int64(raw[i-2]) - int64(raw[i-3])
+			if diff >= int64(dsp.EdgeLevel) || diff <= -int64(dsp.EdgeLevel) {
+				vetoes = append(vetoes, i)
+				continue
+			}
+		}
+		if dsp.LevelTrigger {
+			if (raw[i] >= threshold && raw[i-1] < threshold) ||
+				(raw[i] <= threshold && raw[i-1] > threshold) {
+				vetoes = append(vetoes, i)
+			}
+		}
+	}
+	return vetoes
+}
+
+func (dsp *DataStreamProcessor) noiseTriggerComputeAppend(records []*DataRecord) []*DataRecord {
+	if !dsp.NoiseTrigger {
+		return records
+	}
+	segment := &dsp.stream.DataSegment
+	raw := segment.rawData
+	ndata := len(raw)
+	nsamp := dsp.NSamples
+	npre := dsp.NPresamples
+	guard := dsp.NoiseGuardSamples
+	if guard < 0 {
+		guard = 0
+	}
+
+	// Solve the problem of signed data by shifting all values up by half the RawType range
+	threshold := dsp.LevelLevel
+	if dsp.stream.signed {
+		threshold += rawSignOffset
+		raw = make([]RawType, ndata)
+		copy(raw, segment.rawData)
+		for i := 0; i < ndata; i++ {
+			raw[i] += rawSignOffset
+		}
+	}
+	vetoes := dsp.noiseVetoes(raw, threshold)
+
+	delaySamples := nsamp
+	if d := roundint(dsp.SampleRate * dsp.NoiseSpacingSec); d > delaySamples {
+		delaySamples = d
+	}
+
+	// dsp.lastNoiseVeto is the last veto from earlier invocations that will not be
+	// seen again in the stream. Vetoes later than that are all in the vetoes slice.
+	lastVeto := int(dsp.lastNoiseVeto - segment.firstFramenum)
+	nextPotentialTrig := int(dsp.LastNoiseTrigger-segment.firstFramenum) + delaySamples
+	if nextPotentialTrig < npre {
+		nextPotentialTrig = npre
+	}
+	idxNextVeto := 0
+
+	// Loop through all potential trigger times whose guarded window lies fully in the stream.
+	for nextPotentialTrig+nsamp-npre+guard <= ndata {
+		lo := nextPotentialTrig - npre - guard
+		hi := nextPotentialTrig + nsamp - npre + guard
+		if lastVeto >= lo && lastVeto < hi {
+			nextPotentialTrig = lastVeto + guard + npre + 1
+			continue
+		}
+		for idxNextVeto < len(vetoes) && vetoes[idxNextVeto] < lo {
+			idxNextVeto++
+		}
+		if idxNextVeto < len(vetoes) && vetoes[idxNextVeto] < hi {
+			// not quiet: try again just after the veto's guard window
+			nextPotentialTrig = vetoes[idxNextVeto] + guard + npre + 1
+			continue
+		}
+		newRecord := dsp.triggerAt(segment, nextPotentialTrig)
+		newRecord.noise = true
+		records = append(records, newRecord)
+		dsp.LastNoiseTrigger = newRecord.trigFrame
+		nextPotentialTrig += delaySamples
+	}
+
+	// TriggerData will keep only the last NSamples in the stream, and vetoes can only be
+	// found starting at index 3. Remember the latest veto that can't be found again.
+	firstRescanned := ndata - nsamp + 3
+	for i := len(vetoes) - 1; i >= 0; i-- {
+		if vetoes[i] < firstRescanned {
+			dsp.lastNoiseVeto = segment.firstFramenum + FrameIndex(vetoes[i])
+			break
+		}
+	}
+	sort.Sort(RecordSlice(records))
+	return records
+}
+
 // TriggerData analyzes a DataSegment to find and generate triggered records.
 // All edge triggers are found, then level triggers, then auto and noise triggers.
 func (dsp *DataStreamProcessor) TriggerData() (records []*DataRecord, secondaries []*DataRecord) {
@@ -604,22 +718,29 @@ func (dsp *DataStreamProcessor) TriggerData() (records []*DataRecord, secondarie
 	// Step 1c: compute all auto triggers, wherever they fit in between edge+level.
 	records = dsp.autoTriggerComputeAppend(records)
 
-	// TODO Step 1d: compute all noise triggers, wherever they fit in between edge+level.
-	//
+	// Step 1d: compute all noise triggers, wherever the data are quiet.
+	records = dsp.noiseTriggerComputeAppend(records)
 
-	// Step 1e: note the last trigger for the next invocation of TriggerData
-	if len(records) > 0 {
-		dsp.LastTrigger = records[len(records)-1].trigFrame
+	// Step 1e: note the last trigger for the next invocation of TriggerData. Noise records
+	// don't count: they have their own spacing (dsp.LastNoiseTrigger).
+	for i := len(records) - 1; i >= 0; i-- {
+		if !records[i].noise {
+			dsp.LastTrigger = records[i].trigFrame
+			break
+		}
 	}
 
 	// Step 2: send the primary trigger list to the group trigger broker and await its
 	// answer about when the secondary triggers are.
 
-	// Step 2a: prepare the primary trigger list from the DataRecord list
+	// Step 2a: prepare the primary trigger list from the DataRecord list, omitting noise
+	// records, which should not cause group triggers.
 	trigList := triggerList{channelIndex: dsp.channelIndex}
-	trigList.frames = make([]FrameIndex, len(records))
-	for i, r := range records {
-		trigList.frames[i] = r.trigFrame
+	trigList.frames = make([]FrameIndex, 0, len(records))
+	for _, r := range records {
+		if !r.noise {
+			trigList.frames = append(trigList.frames, r.trigFrame)
+		}
 	}
 	trigList.keyFrame = dsp.stream.DataSegment.firstFramenum
 	trigList.keyTime = dsp.stream.DataSegment.firstTime
@@ -3,6 +3,7 @@ package dastard
 import (
 	"fmt"
 	"math"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -138,6 +139,81 @@ func TestBrokerConnections(t *testing.T) {
 	}
 }
 
+// TestGroupTriggerRules checks that group trigger rules and connection lists
+// are turned into the right broker connections.
+func TestGroupTriggerRules(t *testing.T) {
+	const N = 8
+	ds := AnySource{nchan: N}
+	ds.PrepareChannels()
+	ds.broker = NewTriggerBroker(N)
+	ds.groupKeysSorted = []GroupIndex{{Firstchan: 0, Nchan: 4}, {Firstchan: 4, Nchan: 4}}
+
+	tests := []struct {
+		rule   GroupTriggerRule
+		expect map[int][]int
+	}{
+		{GroupTriggerRule{Sources: []int{5}, SameGroup: true}, map[int][]int{5: {4, 6, 7}}},
+		{GroupTriggerRule{Sources: []int{2}, NearestNeighbors: 2}, map[int][]int{2: {1, 3}}},
+		{GroupTriggerRule{Sources: []int{4}, NearestNeighbors: 2}, map[int][]int{4: {5, 6}}},
+		{GroupTriggerRule{Sources: []int{0, 7}, NearestNeighbors: 1}, map[int][]int{0: {1}, 7: {6}}},
+	}
+	for _, test := range tests {
+		gts, err := ds.GroupTriggerRuleConnections(&test.rule, nil)
+		if err != nil {
+			t.Errorf("GroupTriggerRuleConnections(%v) error: %v", test.rule, err)
+			continue
+		}
+		if !reflect.DeepEqual(gts.Connections, test.expect) {
+			t.Errorf("GroupTriggerRuleConnections(%v)=%v, want %v", test.rule, gts.Connections, test.expect)
+		}
+	}
+	if _, err := ds.GroupTriggerRuleConnections(&GroupTriggerRule{Sources: []int{N}, SameGroup: true}, nil); err == nil {
+		t.Errorf("GroupTriggerRuleConnections should fail with source out of range")
+	}
+	if _, err := ds.GroupTriggerRuleConnections(&GroupTriggerRule{}, nil); err == nil {
+		t.Errorf("GroupTriggerRuleConnections should fail with an empty rule")
+	}
+
+	// Neighbors come from the TES map, when it's valid.
+	m := &Map{Pixels: make([]Pixel, N)}
+	for i := range m.Pixels {
+		m.Pixels[i] = Pixel{X: 100 * (i % 2), Y: 100 * (i / 2)}
+	}
+	ds.chanNumbers = []int{1, 2, 3, 4, 5, 6, 7, 8} // map pixels are indexed by channel number-1
+	gts, err := ds.GroupTriggerRuleConnections(&GroupTriggerRule{Sources: []int{2}, NearestNeighbors: 3}, m)
+	if err != nil {
+		t.Error(err)
+	} else if expect := map[int][]int{2: {0, 3, 4}}; !reflect.DeepEqual(gts.Connections, expect) {
+		t.Errorf("GroupTriggerRuleConnections with map = %v, want %v", gts.Connections, expect)
+	}
+
+	// Connect, verify, and clear.
+	gts = &GroupTriggerState{Connections: map[int][]int{1: {0, 2}, 3: {2}}}
+	if err := ds.ChangeGroupTrigger(true, gts); err != nil {
+		t.Error(err)
+	}
+	if state := ds.ComputeGroupTriggerState(); !reflect.DeepEqual(state.Connections, gts.Connections) {
+		t.Errorf("ComputeGroupTriggerState()=%v, want %v", state.Connections, gts.Connections)
+	}
+	bad := &GroupTriggerState{Connections: map[int][]int{0: {1, N}}}
+	if err := ds.ChangeGroupTrigger(true, bad); err == nil {
+		t.Errorf("ChangeGroupTrigger should fail with receiver out of range")
+	}
+	if ds.broker.isConnected(0, 1) {
+		t.Errorf("ChangeGroupTrigger made a connection despite an error")
+	}
+	if err := ds.ChangeGroupTrigger(false, &GroupTriggerState{Connections: map[int][]int{3: {2}}}); err != nil {
+		t.Error(err)
+	}
+	if state := ds.ComputeGroupTriggerState(); len(state.Connections) != 1 {
+		t.Errorf("ComputeGroupTriggerState()=%v, want only one source after deleting", state.Connections)
+	}
+	ds.broker.DeleteAllConnections()
+	if state := ds.ComputeGroupTriggerState(); len(state.Connections) != 0 {
+		t.Errorf("ComputeGroupTriggerState()=%v, want none after DeleteAllConnections", state.Connections)
+	}
+}
+
 // TestBrokering checks the group trigger brokering operations.
 func TestBrokering(t *testing.T) {
 	N := 4
@@ -325,8 +401,9 @@ func TestSingles(t *testing.T) {
 	testTriggerSubroutine(t, raw, nRepeat, dsp, "AutoMultipleSegmentsB", expected)
 
 	// Test signed signals
+	minusSix := signedRawType(-6) // 65530 as a 16-bit RawType
 	for i := 0; i < len(raw); i++ {
-		raw[i] = 65530
+		raw[i] = RawType(minusSix)
 	}
 	for i := tframe; i < tframe+10; i++ {
 		raw[i] = bigval
@@ -350,6 +427,133 @@ func TestSingles(t *testing.T) {
 	testTriggerSubroutine(t, raw, nRepeat, dsp, "Level signed", []FrameIndex{1000})
 }
 
+// TestNoiseTrigger tests that noise triggers happen only in quiet stretches of data.
+func TestNoiseTrigger(t *testing.T) {
+	const nchan = 1
+
+	broker := NewTriggerBroker(nchan)
+	go broker.Run()
+	defer broker.Stop()
+	dsp := NewDataStreamProcessor(0, broker, 100, 1000)
+	dsp.SampleRate = 10000.0
+	nRepeat := 1
+
+	const bigval = 8000
+	raw := make([]RawType, 10000)
+	for _, tframe := range []int{1000, 6000} {
+		for i := tframe; i < tframe+10; i++ {
+			raw[i] = bigval
+		}
+	}
+
+	// Noise triggers need something to veto them.
+	if err := (&TriggerState{NoiseTrigger: true}).validate(); err == nil {
+		t.Error("TriggerState with NoiseTrigger but no EdgeLevel or LevelTrigger passes validation")
+	}
+
+	// Edges are seen at samples 1000-1002 and 1010-1012 (and again at 6000+).
+	dsp.EdgeLevel = 100
+	dsp.NoiseTrigger = true
+	if err := dsp.TriggerState.validate(); err != nil {
+		t.Error(err)
+	}
+	dsp.noiseSetInitialState()
+	testTriggerSubroutine(t, raw, nRepeat, dsp, "Noise", []FrameIndex{100, 1113, 2113, 3113, 4113, 6113, 7113, 8113})
+
+	dsp.NoiseGuardSamples = 50
+	dsp.noiseSetInitialState()
+	testTriggerSubroutine(t, raw, nRepeat, dsp, "Noise_Guard50", []FrameIndex{1163, 2163, 3163, 4163, 6163, 7163, 8163})
+
+	// A spacing of 0.2 seconds at 10 kHz means records at least 2000 samples apart.
+	dsp.NoiseGuardSamples = 0
+	dsp.NoiseSpacingSec = 0.2
+	dsp.noiseSetInitialState()
+	testTriggerSubroutine(t, raw, nRepeat, dsp, "Noise_Spacing0.2", []FrameIndex{100, 2100, 4100, 6113, 8113})
+
+	// Check that noise triggers (and their guard windows) are correct across multiple segments.
+	nRepeat = 4
+	dsp.NoiseGuardSamples = 50
+	dsp.NoiseSpacingSec = 0
+	expected := make([]FrameIndex, 0)
+	for i := 0; i < nRepeat; i++ {
+		offset := FrameIndex(i * len(raw))
+		for _, f := range []FrameIndex{1163, 2163, 3163, 4163, 6163, 7163, 8163} {
+			expected = append(expected, f+offset)
+		}
+		if i < nRepeat-1 {
+			expected = append(expected, 9163+offset)
+		}
+	}
+	dsp.noiseSetInitialState()
+	testTriggerSubroutine(t, raw, nRepeat, dsp, "Noise_MultipleSegments", expected)
+
+	// Noise triggers combine with edge triggers.
+	dsp.NoiseGuardSamples = 0
+	dsp.EdgeTrigger = true
+	dsp.EdgeRising = true
+	dsp.noiseSetInitialState()
+	nRepeat = 1
+	testTriggerSubroutine(t, raw, nRepeat, dsp, "Noise+Edge", []FrameIndex{100, 1000, 1113, 2113, 3113, 4113, 6000, 6113, 7113, 8113})
+}
+
+// TestNoiseTriggerIsolated tests that noise records neither cause group triggers nor
+// change the spacing of auto triggers.
+func TestNoiseTriggerIsolated(t *testing.T) {
+	const nchan = 2
+	broker := NewTriggerBroker(nchan)
+	go broker.Run()
+	defer broker.Stop()
+	broker.AddConnection(0, 1)
+
+	dsp0 := NewDataStreamProcessor(0, broker, 100, 1000)
+	dsp1 := NewDataStreamProcessor(1, broker, 100, 1000)
+	dsp0.SampleRate = 10000.0
+	dsp1.SampleRate = 10000.0
+	dsp0.AutoTrigger = true
+	dsp0.AutoDelay = 500 * time.Millisecond
+	dsp0.EdgeLevel = 100
+	dsp0.NoiseTrigger = true
+	dsp0.noiseSetInitialState()
+	dsp0.LastTrigger = math.MinInt64 / 4
+	dsp1.LastTrigger = math.MinInt64 / 4
+
+	raw := make([]RawType, 10000)
+	sampleTime := time.Duration(float64(time.Second) / dsp0.SampleRate)
+	var autoFrames, noiseFrames, secondaryFrames []FrameIndex
+	for i := 0; i < 2; i++ {
+		firstFramenum := FrameIndex(i * len(raw))
+		dsp0.stream.AppendSegment(NewDataSegment(raw, 1, firstFramenum, time.Now(), sampleTime))
+		dsp1.stream.AppendSegment(NewDataSegment(raw, 1, firstFramenum, time.Now(), sampleTime))
+		done := make(chan []*DataRecord)
+		go func() {
+			_, secondaries := dsp1.TriggerData()
+			done <- secondaries
+		}()
+		primaries, _ := dsp0.TriggerData()
+		for _, r := range primaries {
+			if r.noise {
+				noiseFrames = append(noiseFrames, r.trigFrame)
+			} else {
+				autoFrames = append(autoFrames, r.trigFrame)
+			}
+		}
+		for _, r := range <-done {
+			secondaryFrames = append(secondaryFrames, r.trigFrame)
+		}
+	}
+	if len(noiseFrames) == 0 {
+		t.Fatal("no noise records found")
+	}
+	expected := []FrameIndex{100, 5100, 10100, 15100}
+	if !reflect.DeepEqual(autoFrames, expected) {
+		t.Errorf("auto triggers at %v with noise records at %v, want %v", autoFrames, noiseFrames, expected)
+	}
+	if !reflect.DeepEqual(secondaryFrames, autoFrames) {
+		t.Errorf("coupled channel has secondary records at %v, want only those of the auto triggers %v",
+			secondaryFrames, autoFrames)
+	}
+}
+
 func testTriggerSubroutine(t *testing.T, raw []RawType, nRepeat int, dsp *DataStreamProcessor,
 	trigname string, expectedFrames []FrameIndex) ([]*DataRecord, []*DataRecord) {
 	// fmt.Println(trigname, len(dsp.stream.rawData))
@@ -8,11 +8,24 @@ import (
 	"time"
 )
 
+// WritingLimits are optional conditions for writing to stop on its own. Zero means no limit.
+type WritingLimits struct {
+	MaxDurationSec    float64 // stop after writing this many seconds (paused time included)
+	MaxRecords        int     // stop after this many records are written (all channels together)
+	RecordsPerChannel int     // stop once every channel writing a records file has written this many
+}
+
 // WritingState monitors the state of file writing.
 type WritingState struct {
 	Active                            bool
 	Paused                            bool
 	BasePath                          string
+	Limits                            WritingLimits
+	Rotation                          RotationPolicy
+	Segment                           int // index of the current set of files, if Rotation is enabled
+	Started                           time.Time
+	SegmentStarted                    time.Time
+	StopReason                        string // why writing last stopped on its own ("" if stopped on request)
 	FilenamePattern                   string
 	experimentStateFile               *os.File
 	ExperimentStateFilename           string
@@ -48,11 +61,18 @@ func (ws *WritingState) ComputeState() WritingState {
 	copyState.Active = ws.Active
 	copyState.Paused = ws.Paused
 	copyState.BasePath = ws.BasePath
+	copyState.Limits = ws.Limits
+	copyState.Rotation = ws.Rotation
+	copyState.Segment = ws.Segment
+	copyState.Started = ws.Started
+	copyState.SegmentStarted = ws.SegmentStarted
+	copyState.StopReason = ws.StopReason
 	copyState.FilenamePattern = ws.FilenamePattern
 	copyState.ExperimentStateFilename = ws.ExperimentStateFilename
 	copyState.ExperimentStateLabel = ws.ExperimentStateLabel
 	copyState.ExperimentStateLabelUnixNano = ws.ExperimentStateLabelUnixNano
 	copyState.ExternalTriggerFilename = ws.ExternalTriggerFilename
+	copyState.DataDropFilename = ws.DataDropFilename
 	copyState.externalTriggerNumberObserved = ws.externalTriggerNumberObserved
 	return copyState
 }
@@ -64,6 +84,10 @@ func (ws *WritingState) Start(filenamePattern, path string) error {
 	ws.Active = true
 	ws.Paused = false
 	ws.BasePath = path
+	ws.Started = time.Now()
+	ws.Segment = 0
+	ws.SegmentStarted = ws.Started
+	ws.StopReason = ""
 	ws.FilenamePattern = filenamePattern
 	ws.ExperimentStateFilename = fmt.Sprintf(filenamePattern, "experiment_state", "txt")
 	ws.ExternalTriggerFilename = fmt.Sprintf(filenamePattern, "external_trigger", "bin")
@@ -71,12 +95,69 @@ func (ws *WritingState) Start(filenamePattern, path string) error {
 	return ws.setExperimentStateLabel(time.Now(), "START")
 }
 
+// setLimits sets the conditions for writing to stop on its own.
+func (ws *WritingState) setLimits(limits WritingLimits) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.Limits = limits
+}
+
+// setStopReason records why writing stopped on its own.
+func (ws *WritingState) setStopReason(reason string) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.StopReason = reason
+}
+
+// limitReached returns a description of the first writing limit that has been reached, given
+// the number of records written in each channel, or "" if none has been (or writing is not active).
+// RecordsPerChannel applies only to the channels where writesRecords is true.
+func (ws *WritingState) limitReached(numberWritten []int, writesRecords []bool, now time.Time) string {
+	ws.Lock()
+	defer ws.Unlock()
+	if !ws.Active {
+		return ""
+	}
+	limits := ws.Limits
+	if limits.MaxDurationSec > 0 && now.Sub(ws.Started).Seconds() >= limits.MaxDurationSec {
+		return fmt.Sprintf("MaxDurationSec %v reached", limits.MaxDurationSec)
+	}
+	if limits.MaxRecords > 0 {
+		total := 0
+		for _, n := range numberWritten {
+			total += n
+		}
+		if total >= limits.MaxRecords {
+			return fmt.Sprintf("MaxRecords %d reached (%d written)", limits.MaxRecords, total)
+		}
+	}
+	if limits.RecordsPerChannel > 0 {
+		nwriting := 0
+		for i, n := range numberWritten {
+			if !writesRecords[i] {
+				continue
+			}
+			if n < limits.RecordsPerChannel {
+				return ""
+			}
+			nwriting++
+		}
+		if nwriting > 0 {
+			return fmt.Sprintf("RecordsPerChannel %d reached in all %d channels writing records",
+				limits.RecordsPerChannel, nwriting)
+		}
+	}
+	return ""
+}
+
 // Stop will set the WritingState to be completely stopped
 func (ws *WritingState) Stop() error {
 	ws.Lock()
 	defer ws.Unlock()
 	ws.Active = false
 	ws.Paused = false
+	ws.Limits = WritingLimits{}
+	ws.Rotation = RotationPolicy{}
 	ws.FilenamePattern = ""
 	if ws.experimentStateFile != nil {
 		if err := ws.setExperimentStateLabel(time.Now(), "STOP"); err != nil {
@@ -3,7 +3,11 @@ package dastard
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
 )
 
 // See also data_source_test.go, which contains several implicit tests of WritingState.
@@ -21,7 +25,7 @@ func TestWriteControl(t *testing.T) {
 	ds.PrepareChannels()
 	ds.PrepareRun(256, 1024)
 	defer ds.Stop()
-	config := &WriteControlConfig{Request: "Pause", Path: tmp, WriteLJH22: true}
+	config := testWriteConfig("Pause", tmp)
 	for _, request := range []string{"Pause", "Unpause", "Stop"} {
 		config.Request = request
 		if err := ds.WriteControl(config); err != nil {
@@ -33,11 +37,11 @@ func TestWriteControl(t *testing.T) {
 		t.Errorf("WriteControl request %s should fail, but didn't", config.Request)
 	}
 	config.Request = "Start"
-	config.WriteLJH22 = false
+	config.WriteLJH22, config.WriteRaw = false, false
 	if err := ds.WriteControl(config); err == nil {
 		t.Errorf("WriteControl request Start with no valid filetype should fail, but didn't")
 	}
-	config.WriteLJH22 = true
+	config.WriteLJH22, config.WriteRaw = testWritesLJH, !testWritesLJH
 	config.Path = "/notvalid/because/permissions"
 	if err := ds.WriteControl(config); err == nil {
 		t.Errorf("WriteControl request Start with nonvalid path should fail, but didn't")
@@ -63,3 +67,104 @@ func TestWriteControl(t *testing.T) {
 		}
 	}
 }
+
+func TestWritingLimits(t *testing.T) {
+	now := time.Now()
+	ws := WritingState{Active: true, Started: now.Add(-time.Minute)}
+	both := []bool{true, true}
+	tests := []struct {
+		limits  WritingLimits
+		written []int
+		writes  []bool
+		stop    bool
+	}{
+		{WritingLimits{}, []int{1000, 1000}, both, false},
+		{WritingLimits{MaxDurationSec: 3600}, []int{1000, 1000}, both, false},
+		{WritingLimits{MaxDurationSec: 1}, []int{0, 0}, both, true},
+		{WritingLimits{MaxRecords: 100}, []int{49, 50}, both, false},
+		{WritingLimits{MaxRecords: 100}, []int{50, 50}, both, true},
+		{WritingLimits{RecordsPerChannel: 10}, []int{100, 9}, both, false},
+		{WritingLimits{RecordsPerChannel: 10}, []int{10, 11}, both, true},
+		{WritingLimits{RecordsPerChannel: 10}, []int{}, []bool{}, false},
+		// A channel that writes no records file (e.g., OFF without projectors) doesn't count.
+		{WritingLimits{RecordsPerChannel: 10}, []int{10, 0}, []bool{true, false}, true},
+		{WritingLimits{RecordsPerChannel: 10}, []int{9, 0}, []bool{true, false}, false},
+		{WritingLimits{RecordsPerChannel: 10}, []int{0, 0}, []bool{false, false}, false},
+	}
+	for _, test := range tests {
+		ws.Limits = test.limits
+		reason := ws.limitReached(test.written, test.writes, now)
+		if (reason != "") != test.stop {
+			t.Errorf("limitReached with limits %+v, written %v by channels %v = %q, want stop=%t",
+				test.limits, test.written, test.writes, reason, test.stop)
+		}
+	}
+	ws.Active = false
+	if reason := ws.limitReached([]int{0}, []bool{true}, now); reason != "" {
+		t.Errorf("limitReached = %q when not writing, want \"\"", reason)
+	}
+
+	tmp, err := ioutil.TempDir("", "dastardTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds := AnySource{nchan: 2}
+	ds.rowColCodes = make([]RowColCode, ds.nchan)
+	ds.PrepareChannels()
+	ds.PrepareRun(256, 1024)
+	defer ds.Stop()
+	config := testWriteConfig("Start", tmp)
+	config.MaxRecords = -1
+	if err := ds.WriteControl(config); err == nil {
+		t.Errorf("WriteControl Start with negative MaxRecords should fail")
+	}
+	config.MaxRecords = 10
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl Start failed: %v", err)
+	}
+	if state := ds.ComputeWritingState(); state.Limits.MaxRecords != 10 {
+		t.Errorf("WritingState.Limits = %+v, want MaxRecords=10", state.Limits)
+	}
+	if err := ds.stopWritingIfLimitReached([]int{4, 5}); err != nil || !ds.WritingIsActive() {
+		t.Errorf("writing stopped before reaching MaxRecords (err=%v)", err)
+	}
+	if err := ds.stopWritingIfLimitReached([]int{5, 5}); err != nil || ds.WritingIsActive() {
+		t.Errorf("writing did not stop at MaxRecords (err=%v)", err)
+	}
+	state := ds.ComputeWritingState()
+	if !strings.Contains(state.StopReason, "MaxRecords") {
+		t.Errorf("WritingState.StopReason = %q, want it to name MaxRecords", state.StopReason)
+	}
+	config.MaxRecords = 0
+	if err := ds.WriteControl(config); err != nil {
+		t.Fatalf("WriteControl Start failed: %v", err)
+	}
+	if state := ds.ComputeWritingState(); state.StopReason != "" {
+		t.Errorf("WritingState.StopReason = %q after starting again, want \"\"", state.StopReason)
+	}
+	config.Request = "Stop"
+	if err := ds.WriteControl(config); err != nil {
+		t.Errorf("WriteControl Stop failed: %v", err)
+	}
+
+	// With OFF files, a channel without projectors writes no file and doesn't count
+	// toward RecordsPerChannel.
+	dsp0 := ds.processors[0]
+	projectors := mat.NewDense(1, dsp0.NSamples, make([]float64, dsp0.NSamples))
+	basis := mat.NewDense(dsp0.NSamples, 1, make([]float64, dsp0.NSamples))
+	if err := dsp0.SetProjectorsBasis(projectors, basis, "test model"); err != nil {
+		t.Fatal(err)
+	}
+	offConfig := &WriteControlConfig{Request: "Start", Path: tmp, WriteOFF: true,
+		WritingLimits: WritingLimits{RecordsPerChannel: 2}}
+	if err := ds.WriteControl(offConfig); err != nil {
+		t.Fatalf("WriteControl Start failed: %v", err)
+	}
+	if err := ds.stopWritingIfLimitReached([]int{1, 0}); err != nil || !ds.WritingIsActive() {
+		t.Errorf("writing stopped before reaching RecordsPerChannel (err=%v)", err)
+	}
+	if err := ds.stopWritingIfLimitReached([]int{2, 0}); err != nil || ds.WritingIsActive() {
+		t.Errorf("writing did not stop at RecordsPerChannel in the only channel writing OFF (err=%v)", err)
+	}
+}